@@ -0,0 +1,787 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abema/go-mp4/internal/bitio"
+)
+
+// Audio object types defined at ISO/IEC 14496-3 1.5.1.1
+const (
+	AACObjectTypeMain     uint8 = 1
+	AACObjectTypeLC       uint8 = 2
+	AACObjectTypeSSR      uint8 = 3
+	AACObjectTypeLTP      uint8 = 4
+	AACObjectTypeSBR      uint8 = 5
+	AACObjectTypeScalable uint8 = 6
+	AACObjectTypeERLC     uint8 = 17
+	AACObjectTypeERLTP    uint8 = 19
+	AACObjectTypeERScal   uint8 = 20
+	AACObjectTypeERBSAC   uint8 = 22
+	AACObjectTypeERLD     uint8 = 23
+	AACObjectTypePS       uint8 = 29
+	AACObjectTypeERELD    uint8 = 39
+	AACObjectTypeUSAC     uint8 = 42
+)
+
+type AACProfile int
+
+const (
+	AACProfileUnknown AACProfile = iota
+	AACProfileMain
+	AACProfileLC
+	AACProfileSSR
+	AACProfileLTP
+	AACProfileHE   // HE-AAC (v1): AAC-LC + SBR
+	AACProfileHEv2 // HE-AAC v2: AAC-LC + SBR + PS
+	AACProfileLD
+	AACProfileELD
+	AACProfileXHE // xHE-AAC: USAC
+)
+
+func (p AACProfile) String() string {
+	switch p {
+	case AACProfileMain:
+		return "AAC Main"
+	case AACProfileLC:
+		return "AAC-LC"
+	case AACProfileSSR:
+		return "AAC SSR"
+	case AACProfileLTP:
+		return "AAC LTP"
+	case AACProfileHE:
+		return "HE-AAC"
+	case AACProfileHEv2:
+		return "HE-AACv2"
+	case AACProfileLD:
+		return "AAC-LD"
+	case AACProfileELD:
+		return "AAC-ELD"
+	case AACProfileXHE:
+		return "xHE-AAC"
+	default:
+		return "unknown"
+	}
+}
+
+var aacSamplingFrequencies = [...]uint32{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// usacSamplingFrequencies is defined at ISO/IEC 23003-3 Table 71
+var usacSamplingFrequencies = [...]uint32{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350, 0, 0, 57600,
+	51200, 40000, 38400, 34150, 28800, 25600, 20000, 19200, 17075, 14400, 12800, 9600, 0, 0, 0,
+}
+
+// aacChannelCounts is defined at ISO/IEC 14496-3 Table 1.19
+var aacChannelCounts = [...]uint16{0, 1, 2, 3, 4, 5, 6, 8, 0, 0, 0, 7, 8, 24, 8, 0}
+
+// AACSamplingFrequency returns the sampling frequency of the given sampling frequency index.
+// It returns 0 when the index is escape value or reserved.
+func AACSamplingFrequency(index uint8) uint32 {
+	if int(index) < len(aacSamplingFrequencies) {
+		return aacSamplingFrequencies[index]
+	}
+	return 0
+}
+
+// AACSamplingFrequencyIndex returns the sampling frequency index of the given sampling frequency.
+// It returns 0xf (escape value) when the frequency has no index.
+func AACSamplingFrequencyIndex(freq uint32) uint8 {
+	for i, f := range aacSamplingFrequencies {
+		if f == freq {
+			return uint8(i)
+		}
+	}
+	return 0xf
+}
+
+// AudioSpecificConfig is defined at ISO/IEC 14496-3 1.6.2.1
+type AudioSpecificConfig struct {
+	AudioObjectType        uint8
+	SamplingFrequencyIndex uint8
+	SamplingFrequency      uint32
+	ChannelConfiguration   uint8
+
+	// ExtensionAudioObjectType is 5 (SBR) or 22 (ER BSAC) when the extension is signaled
+	ExtensionAudioObjectType        uint8
+	ExtensionSamplingFrequencyIndex uint8
+	ExtensionSamplingFrequency      uint32
+	ExtensionChannelConfiguration   uint8
+
+	// SBRPresent represents whether SBR is explicitly signaled.
+	SBRPresent bool
+	// PSPresent represents whether PS is explicitly signaled.
+	PSPresent bool
+	// BackwardCompatibleSignaling represents whether SBR/PS is signaled by the sync extension
+	// following the core configuration, instead of hierarchical signaling (AOT=5 or 29).
+	BackwardCompatibleSignaling bool
+
+	// GASpecificConfig
+	FrameLengthFlag    bool
+	DependsOnCoreCoder bool
+	CoreCoderDelay     uint16
+	ExtensionFlag      bool
+
+	ProgramConfigElement *ProgramConfigElement
+	ELDSpecificConfig    *ELDSpecificConfig
+	USACConfig           *USACConfig
+}
+
+// ProgramConfigElement is defined at ISO/IEC 14496-3 4.4.1.1
+type ProgramConfigElement struct {
+	ElementInstanceTag      uint8
+	ObjectType              uint8
+	SamplingFrequencyIndex  uint8
+	FrontChannelElements    []PCEChannelElement
+	SideChannelElements     []PCEChannelElement
+	BackChannelElements     []PCEChannelElement
+	NumLFEChannelElements   uint8
+	NumAssocDataElements    uint8
+	NumValidCCElements      uint8
+	MonoMixdownPresent      bool
+	StereoMixdownPresent    bool
+	MatrixMixdownIdxPresent bool
+	MatrixMixdownIdx        uint8
+	PseudoSurroundEnable    bool
+	Comment                 []byte
+}
+
+type PCEChannelElement struct {
+	IsCPE     bool
+	TagSelect uint8
+}
+
+// ChannelCount returns the number of the output channels including LFE channels.
+func (pce *ProgramConfigElement) ChannelCount() uint16 {
+	var n uint16
+	for _, elems := range [][]PCEChannelElement{pce.FrontChannelElements, pce.SideChannelElements, pce.BackChannelElements} {
+		for _, e := range elems {
+			if e.IsCPE {
+				n += 2
+			} else {
+				n++
+			}
+		}
+	}
+	return n + uint16(pce.NumLFEChannelElements)
+}
+
+// ELDSpecificConfig is defined at ISO/IEC 14496-3 4.4.1.2
+type ELDSpecificConfig struct {
+	FrameLengthFlag                  bool
+	AACSectionDataResilienceFlag     bool
+	AACScalefactorDataResilienceFlag bool
+	AACSpectralDataResilienceFlag    bool
+	LDSBRPresentFlag                 bool
+	LDSBRSamplingRate                bool
+	LDSBRCRCFlag                     bool
+}
+
+// USACConfig holds leading fields of UsacConfig defined at ISO/IEC 23003-3 5.2
+type USACConfig struct {
+	SamplingFrequencyIndex    uint8
+	SamplingFrequency         uint32
+	CoreSBRFrameLengthIndex   uint8
+	ChannelConfigurationIndex uint8
+	NumOutChannels            uint32
+}
+
+// SBRRatio returns the ratio of output to core sampling rate, represented as numerator and denominator.
+// It returns (1, 1) when SBR is not used.
+func (c *USACConfig) SBRRatio() (uint32, uint32) {
+	switch c.CoreSBRFrameLengthIndex {
+	case 2:
+		return 8, 3
+	case 3:
+		return 2, 1
+	case 4:
+		return 4, 1
+	default:
+		return 1, 1
+	}
+}
+
+// Profile returns the AAC profile which is derived from the audio object types and SBR/PS signaling.
+func (asc *AudioSpecificConfig) Profile() AACProfile {
+	switch asc.AudioObjectType {
+	case AACObjectTypeMain:
+		return AACProfileMain
+	case AACObjectTypeLC:
+		if asc.SBRPresent && asc.PSPresent {
+			return AACProfileHEv2
+		} else if asc.SBRPresent {
+			return AACProfileHE
+		}
+		return AACProfileLC
+	case AACObjectTypeSSR:
+		return AACProfileSSR
+	case AACObjectTypeLTP:
+		return AACProfileLTP
+	case AACObjectTypeERLD:
+		return AACProfileLD
+	case AACObjectTypeERELD:
+		return AACProfileELD
+	case AACObjectTypeUSAC:
+		return AACProfileXHE
+	default:
+		return AACProfileUnknown
+	}
+}
+
+// AudOTI returns the audio object type which represents the profile in the form used by RFC 6381 codecs parameter.
+// For example, it returns 5 for HE-AAC and 29 for HE-AACv2.
+func (asc *AudioSpecificConfig) AudOTI() uint8 {
+	if asc.AudioObjectType == AACObjectTypeLC && asc.SBRPresent {
+		if asc.PSPresent {
+			return AACObjectTypePS
+		}
+		return AACObjectTypeSBR
+	}
+	return asc.AudioObjectType
+}
+
+// OutputSamplingFrequency returns the sampling frequency of the decoded audio.
+func (asc *AudioSpecificConfig) OutputSamplingFrequency() uint32 {
+	if asc.USACConfig != nil {
+		return asc.USACConfig.SamplingFrequency
+	}
+	if asc.SBRPresent && asc.ExtensionSamplingFrequency != 0 {
+		return asc.ExtensionSamplingFrequency
+	}
+	if asc.ELDSpecificConfig != nil && asc.ELDSpecificConfig.LDSBRPresentFlag && asc.ELDSpecificConfig.LDSBRSamplingRate {
+		// dual-rate SBR
+		return asc.SamplingFrequency * 2
+	}
+	return asc.SamplingFrequency
+}
+
+// ChannelCount returns the number of the output channels.
+// It returns 0 when the number of channels can not be determined.
+func (asc *AudioSpecificConfig) ChannelCount() uint16 {
+	if asc.USACConfig != nil {
+		if asc.USACConfig.ChannelConfigurationIndex == 0 {
+			return uint16(asc.USACConfig.NumOutChannels)
+		}
+		return aacChannelCounts[asc.USACConfig.ChannelConfigurationIndex&0xf]
+	}
+	if asc.PSPresent && asc.ChannelConfiguration == 1 {
+		// parametric stereo produces stereo output from a mono core
+		return 2
+	}
+	if asc.ChannelConfiguration == 0 {
+		if asc.ProgramConfigElement != nil {
+			return asc.ProgramConfigElement.ChannelCount()
+		}
+		return 0
+	}
+	return aacChannelCounts[asc.ChannelConfiguration]
+}
+
+// ParseAudioSpecificConfig parses AudioSpecificConfig which is stored in DecoderSpecificInfo of esds box.
+func ParseAudioSpecificConfig(data []byte) (*AudioSpecificConfig, error) {
+	r := newBitReader(data)
+	asc := new(AudioSpecificConfig)
+
+	aot, err := readAudioObjectType(r)
+	if err != nil {
+		return nil, err
+	}
+	asc.AudioObjectType = aot
+	if asc.SamplingFrequencyIndex, asc.SamplingFrequency, err = readSamplingFrequency(r); err != nil {
+		return nil, err
+	}
+	if asc.ChannelConfiguration, err = r.readUint8(4); err != nil {
+		return nil, err
+	}
+
+	if aot == AACObjectTypeSBR || aot == AACObjectTypePS {
+		// hierarchical signaling
+		asc.ExtensionAudioObjectType = AACObjectTypeSBR
+		asc.SBRPresent = true
+		asc.PSPresent = aot == AACObjectTypePS
+		if asc.ExtensionSamplingFrequencyIndex, asc.ExtensionSamplingFrequency, err = readSamplingFrequency(r); err != nil {
+			return nil, err
+		}
+		if asc.AudioObjectType, err = readAudioObjectType(r); err != nil {
+			return nil, err
+		}
+		if asc.AudioObjectType == AACObjectTypeERBSAC {
+			if asc.ExtensionChannelConfiguration, err = r.readUint8(4); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch asc.AudioObjectType {
+	case 1, 2, 3, 4, 6, 7, 17, 19, 20, 21, 22, 23:
+		if err := asc.readGASpecificConfig(r); err != nil {
+			return nil, err
+		}
+	case AACObjectTypeERELD:
+		if err := asc.readELDSpecificConfig(r); err != nil {
+			return nil, err
+		}
+	case AACObjectTypeUSAC:
+		if err := asc.readUSACConfig(r); err != nil {
+			return nil, err
+		}
+		// the remaining fields of UsacConfig are not parsed
+		return asc, nil
+	default:
+		// the other specific configs are not supported
+		return asc, nil
+	}
+
+	switch asc.AudioObjectType {
+	case 17, 19, 20, 21, 22, 23, 24, 25, 26, 27, 39:
+		epConfig, err := r.readUint8(2)
+		if err != nil {
+			return nil, err
+		}
+		if epConfig == 2 || epConfig == 3 {
+			// ErrorProtectionSpecificConfig is not supported
+			return asc, nil
+		}
+	}
+
+	if asc.ExtensionAudioObjectType != AACObjectTypeSBR && r.remaining() >= 16 {
+		if err := asc.readSyncExtension(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return asc, nil
+}
+
+func (asc *AudioSpecificConfig) readGASpecificConfig(r *bitReader) error {
+	var err error
+	if asc.FrameLengthFlag, err = r.readFlag(); err != nil {
+		return err
+	}
+	if asc.DependsOnCoreCoder, err = r.readFlag(); err != nil {
+		return err
+	}
+	if asc.DependsOnCoreCoder {
+		if asc.CoreCoderDelay, err = r.readUint16(14); err != nil {
+			return err
+		}
+	}
+	if asc.ExtensionFlag, err = r.readFlag(); err != nil {
+		return err
+	}
+	if asc.ChannelConfiguration == 0 {
+		if asc.ProgramConfigElement, err = readProgramConfigElement(r); err != nil {
+			return err
+		}
+	}
+	if asc.AudioObjectType == 6 || asc.AudioObjectType == 20 {
+		// layerNr
+		if err := r.skip(3); err != nil {
+			return err
+		}
+	}
+	if asc.ExtensionFlag {
+		if asc.AudioObjectType == 22 {
+			// numOfSubFrame, layer_length
+			if err := r.skip(5 + 11); err != nil {
+				return err
+			}
+		}
+		switch asc.AudioObjectType {
+		case 17, 19, 20, 23:
+			// aacSectionDataResilienceFlag, aacScalefactorDataResilienceFlag, aacSpectralDataResilienceFlag
+			if err := r.skip(3); err != nil {
+				return err
+			}
+		}
+		// extensionFlag3
+		if err := r.skip(1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readProgramConfigElement(r *bitReader) (*ProgramConfigElement, error) {
+	pce := new(ProgramConfigElement)
+	fields := make([]uint8, 8)
+	for i, width := range []uint{4, 2, 4, 4, 4, 4, 2, 3} {
+		v, err := r.readUint8(width)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = v
+	}
+	pce.ElementInstanceTag = fields[0]
+	pce.ObjectType = fields[1]
+	pce.SamplingFrequencyIndex = fields[2]
+	pce.FrontChannelElements = make([]PCEChannelElement, fields[3])
+	pce.SideChannelElements = make([]PCEChannelElement, fields[4])
+	pce.BackChannelElements = make([]PCEChannelElement, fields[5])
+	pce.NumLFEChannelElements = fields[6]
+	pce.NumAssocDataElements = fields[7]
+	var err error
+	if pce.NumValidCCElements, err = r.readUint8(4); err != nil {
+		return nil, err
+	}
+
+	if pce.MonoMixdownPresent, err = r.readFlag(); err != nil {
+		return nil, err
+	} else if pce.MonoMixdownPresent {
+		// mono_mixdown_element_number
+		if err := r.skip(4); err != nil {
+			return nil, err
+		}
+	}
+	if pce.StereoMixdownPresent, err = r.readFlag(); err != nil {
+		return nil, err
+	} else if pce.StereoMixdownPresent {
+		// stereo_mixdown_element_number
+		if err := r.skip(4); err != nil {
+			return nil, err
+		}
+	}
+	if pce.MatrixMixdownIdxPresent, err = r.readFlag(); err != nil {
+		return nil, err
+	} else if pce.MatrixMixdownIdxPresent {
+		if pce.MatrixMixdownIdx, err = r.readUint8(2); err != nil {
+			return nil, err
+		}
+		if pce.PseudoSurroundEnable, err = r.readFlag(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, elems := range [][]PCEChannelElement{pce.FrontChannelElements, pce.SideChannelElements, pce.BackChannelElements} {
+		for i := range elems {
+			if elems[i].IsCPE, err = r.readFlag(); err != nil {
+				return nil, err
+			}
+			if elems[i].TagSelect, err = r.readUint8(4); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// lfe_element_tag_select, assoc_data_element_tag_select
+	if err := r.skip(4*uint(pce.NumLFEChannelElements) + 4*uint(pce.NumAssocDataElements)); err != nil {
+		return nil, err
+	}
+	// cc_element_is_ind_sw, valid_cc_element_tag_select
+	if err := r.skip(5 * uint(pce.NumValidCCElements)); err != nil {
+		return nil, err
+	}
+
+	// byte_alignment() relative to the start of AudioSpecificConfig
+	if err := r.align(); err != nil {
+		return nil, err
+	}
+	commentFieldBytes, err := r.readUint8(8)
+	if err != nil {
+		return nil, err
+	}
+	pce.Comment = make([]byte, commentFieldBytes)
+	for i := range pce.Comment {
+		if pce.Comment[i], err = r.readUint8(8); err != nil {
+			return nil, err
+		}
+	}
+	return pce, nil
+}
+
+func (asc *AudioSpecificConfig) readELDSpecificConfig(r *bitReader) error {
+	eld := new(ELDSpecificConfig)
+	asc.ELDSpecificConfig = eld
+	var err error
+	for _, f := range []*bool{
+		&eld.FrameLengthFlag,
+		&eld.AACSectionDataResilienceFlag,
+		&eld.AACScalefactorDataResilienceFlag,
+		&eld.AACSpectralDataResilienceFlag,
+		&eld.LDSBRPresentFlag,
+	} {
+		if *f, err = r.readFlag(); err != nil {
+			return err
+		}
+	}
+	asc.FrameLengthFlag = eld.FrameLengthFlag
+	asc.SBRPresent = eld.LDSBRPresentFlag
+	if !eld.LDSBRPresentFlag {
+		return nil
+	}
+	if eld.LDSBRSamplingRate, err = r.readFlag(); err != nil {
+		return err
+	}
+	if eld.LDSBRCRCFlag, err = r.readFlag(); err != nil {
+		return err
+	}
+	// ld_sbr_header()
+	var numSBRHeader int
+	switch asc.ChannelConfiguration {
+	case 1, 2:
+		numSBRHeader = 1
+	case 3:
+		numSBRHeader = 2
+	case 4, 5, 6:
+		numSBRHeader = 3
+	case 7:
+		numSBRHeader = 4
+	}
+	for i := 0; i < numSBRHeader; i++ {
+		// bs_amp_res, bs_start_freq, bs_stop_freq, bs_xover_band, bs_reserved
+		if err := r.skip(1 + 4 + 4 + 3 + 2); err != nil {
+			return err
+		}
+		extra1, err := r.readFlag()
+		if err != nil {
+			return err
+		}
+		extra2, err := r.readFlag()
+		if err != nil {
+			return err
+		}
+		if extra1 {
+			// bs_freq_scale, bs_alter_scale, bs_noise_bands
+			if err := r.skip(2 + 1 + 2); err != nil {
+				return err
+			}
+		}
+		if extra2 {
+			// bs_limiter_bands, bs_limiter_gains, bs_interpol_freq, bs_smoothing_mode
+			if err := r.skip(2 + 2 + 1 + 1); err != nil {
+				return err
+			}
+		}
+	}
+	// the subsequent eldExtType loop is not parsed
+	return nil
+}
+
+func (asc *AudioSpecificConfig) readUSACConfig(r *bitReader) error {
+	usac := new(USACConfig)
+	idx, err := r.readUint8(5)
+	if err != nil {
+		return err
+	}
+	usac.SamplingFrequencyIndex = idx
+	if idx == 0x1f {
+		if usac.SamplingFrequency, err = r.readUint32(24); err != nil {
+			return err
+		}
+	} else {
+		usac.SamplingFrequency = usacSamplingFrequencies[idx]
+	}
+	if usac.CoreSBRFrameLengthIndex, err = r.readUint8(3); err != nil {
+		return err
+	}
+	if usac.ChannelConfigurationIndex, err = r.readUint8(5); err != nil {
+		return err
+	}
+	if usac.ChannelConfigurationIndex == 0 {
+		if usac.NumOutChannels, err = r.readEscapedValue(5, 8, 16); err != nil {
+			return err
+		}
+	}
+	asc.USACConfig = usac
+	n, d := usac.SBRRatio()
+	asc.SBRPresent = n != d
+	return nil
+}
+
+func (asc *AudioSpecificConfig) readSyncExtension(r *bitReader) error {
+	syncExtensionType, err := r.readUint16(11)
+	if err != nil {
+		return err
+	}
+	if syncExtensionType != 0x2b7 {
+		return nil
+	}
+	extAOT, err := readAudioObjectType(r)
+	if err != nil {
+		return err
+	}
+	switch extAOT {
+	case AACObjectTypeSBR:
+		asc.ExtensionAudioObjectType = extAOT
+		if asc.SBRPresent, err = r.readFlag(); err != nil {
+			return err
+		}
+		asc.BackwardCompatibleSignaling = true
+		if !asc.SBRPresent {
+			return nil
+		}
+		if asc.ExtensionSamplingFrequencyIndex, asc.ExtensionSamplingFrequency, err = readSamplingFrequency(r); err != nil {
+			return err
+		}
+		if r.remaining() >= 12 {
+			syncExtensionType, err := r.readUint16(11)
+			if err != nil {
+				return err
+			}
+			if syncExtensionType == 0x548 {
+				if asc.PSPresent, err = r.readFlag(); err != nil {
+					return err
+				}
+			}
+		}
+	case AACObjectTypeERBSAC:
+		asc.ExtensionAudioObjectType = extAOT
+		if asc.SBRPresent, err = r.readFlag(); err != nil {
+			return err
+		}
+		asc.BackwardCompatibleSignaling = true
+		if asc.SBRPresent {
+			if asc.ExtensionSamplingFrequencyIndex, asc.ExtensionSamplingFrequency, err = readSamplingFrequency(r); err != nil {
+				return err
+			}
+		}
+		if asc.ExtensionChannelConfiguration, err = r.readUint8(4); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readAudioObjectType(r *bitReader) (uint8, error) {
+	aot, err := r.readUint8(5)
+	if err != nil {
+		return 0, err
+	}
+	if aot != 0x1f {
+		return aot, nil
+	}
+	ext, err := r.readUint8(6)
+	if err != nil {
+		return 0, err
+	}
+	return 32 + ext, nil
+}
+
+func readSamplingFrequency(r *bitReader) (uint8, uint32, error) {
+	idx, err := r.readUint8(4)
+	if err != nil {
+		return 0, 0, err
+	}
+	if idx == 0xf {
+		freq, err := r.readUint32(24)
+		if err != nil {
+			return 0, 0, err
+		}
+		return idx, freq, nil
+	}
+	return idx, AACSamplingFrequency(idx), nil
+}
+
+// bitReader reads bit fields of the in-memory bitstream, counting the consumed bits.
+type bitReader struct {
+	r    bitio.Reader
+	size int
+	read int
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{
+		r:    bitio.NewReader(bytes.NewReader(data)),
+		size: len(data) * 8,
+	}
+}
+
+func (r *bitReader) remaining() int {
+	return r.size - r.read
+}
+
+func (r *bitReader) readUint64(width uint) (uint64, error) {
+	if width > 64 {
+		return 0, fmt.Errorf("too large bit width: %d", width)
+	}
+	if int(width) > r.remaining() {
+		return 0, io.ErrUnexpectedEOF
+	}
+	data, err := r.r.ReadBits(width)
+	if err != nil {
+		return 0, err
+	}
+	r.read += int(width)
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func (r *bitReader) readUint32(width uint) (uint32, error) {
+	v, err := r.readUint64(width)
+	return uint32(v), err
+}
+
+func (r *bitReader) readUint16(width uint) (uint16, error) {
+	v, err := r.readUint64(width)
+	return uint16(v), err
+}
+
+func (r *bitReader) readUint8(width uint) (uint8, error) {
+	v, err := r.readUint64(width)
+	return uint8(v), err
+}
+
+func (r *bitReader) readFlag() (bool, error) {
+	v, err := r.readUint64(1)
+	return v != 0, err
+}
+
+func (r *bitReader) skip(width uint) error {
+	for width > 0 {
+		w := width
+		if w > 64 {
+			w = 64
+		}
+		if _, err := r.readUint64(w); err != nil {
+			return err
+		}
+		width -= w
+	}
+	return nil
+}
+
+func (r *bitReader) align() error {
+	if r.read%8 == 0 {
+		return nil
+	}
+	return r.skip(uint(8 - r.read%8))
+}
+
+// readEscapedValue reads escapedValue() defined at ISO/IEC 23003-3 5.2
+func (r *bitReader) readEscapedValue(nBits1, nBits2, nBits3 uint) (uint32, error) {
+	v, err := r.readUint32(nBits1)
+	if err != nil {
+		return 0, err
+	}
+	if v != 1<<nBits1-1 {
+		return v, nil
+	}
+	v2, err := r.readUint32(nBits2)
+	if err != nil {
+		return 0, err
+	}
+	v += v2
+	if v2 != 1<<nBits2-1 {
+		return v, nil
+	}
+	v3, err := r.readUint32(nBits3)
+	if err != nil {
+		return 0, err
+	}
+	return v + v3, nil
+}
+
+func getAudioSpecificConfig(esds *Esds) ([]byte, error) {
+	specificDscr := findDescriptorByTag(esds.Descriptors, DecSpecificInfoTag)
+	if specificDscr == nil {
+		return nil, errors.New("DecoderSpecificationInfoDescriptor not found")
+	}
+	return specificDscr.Data, nil
+}
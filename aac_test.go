@@ -0,0 +1,208 @@
+package mp4
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		data       []byte
+		expected   AudioSpecificConfig
+		profile    AACProfile
+		audOTI     uint8
+		sampleRate uint32
+		channels   uint16
+	}{
+		{
+			name: "AAC-LC 44.1kHz stereo",
+			// audio-object-type=2 (5bits), sfi=4 (4bits), channel-config=2 (4bits),
+			// frame-length-flag=0, depends-on-core-coder=0, extension-flag=0
+			data: []byte{0x12, 0x10},
+			expected: AudioSpecificConfig{
+				AudioObjectType:        2,
+				SamplingFrequencyIndex: 4,
+				SamplingFrequency:      44100,
+				ChannelConfiguration:   2,
+			},
+			profile:    AACProfileLC,
+			audOTI:     2,
+			sampleRate: 44100,
+			channels:   2,
+		},
+		{
+			name: "HE-AAC hierarchical signaling",
+			// audio-object-type=5 (5bits), sfi=6 (4bits), channel-config=2 (4bits),
+			// ext-sfi=3 (4bits), audio-object-type=2 (5bits), GASpecificConfig (3bits), padding (7bits)
+			data: []byte{0x2b, 0x11, 0x88, 0x00},
+			expected: AudioSpecificConfig{
+				AudioObjectType:                 2,
+				SamplingFrequencyIndex:          6,
+				SamplingFrequency:               24000,
+				ChannelConfiguration:            2,
+				ExtensionAudioObjectType:        5,
+				ExtensionSamplingFrequencyIndex: 3,
+				ExtensionSamplingFrequency:      48000,
+				SBRPresent:                      true,
+			},
+			profile:    AACProfileHE,
+			audOTI:     5,
+			sampleRate: 48000,
+			channels:   2,
+		},
+		{
+			name: "HE-AACv2 hierarchical signaling",
+			// audio-object-type=29 (5bits), sfi=6 (4bits), channel-config=1 (4bits),
+			// ext-sfi=3 (4bits), audio-object-type=2 (5bits), GASpecificConfig (3bits), padding (7bits)
+			data: []byte{0xeb, 0x09, 0x88, 0x00},
+			expected: AudioSpecificConfig{
+				AudioObjectType:                 2,
+				SamplingFrequencyIndex:          6,
+				SamplingFrequency:               24000,
+				ChannelConfiguration:            1,
+				ExtensionAudioObjectType:        5,
+				ExtensionSamplingFrequencyIndex: 3,
+				ExtensionSamplingFrequency:      48000,
+				SBRPresent:                      true,
+				PSPresent:                       true,
+			},
+			profile:    AACProfileHEv2,
+			audOTI:     29,
+			sampleRate: 48000,
+			channels:   2,
+		},
+		{
+			name: "HE-AACv2 backward compatible signaling",
+			// audio-object-type=2 (5bits), sfi=6 (4bits), channel-config=1 (4bits), GASpecificConfig (3bits),
+			// sync-extension-type=0x2b7 (11bits), audio-object-type=5 (5bits), sbr=1 (1bit), ext-sfi=3 (4bits),
+			// sync-extension-type=0x548 (11bits), ps=1 (1bit), padding (3bits)
+			data: []byte{0x13, 0x08, 0x56, 0xe5, 0x9d, 0x48, 0x80},
+			expected: AudioSpecificConfig{
+				AudioObjectType:                 2,
+				SamplingFrequencyIndex:          6,
+				SamplingFrequency:               24000,
+				ChannelConfiguration:            1,
+				ExtensionAudioObjectType:        5,
+				ExtensionSamplingFrequencyIndex: 3,
+				ExtensionSamplingFrequency:      48000,
+				SBRPresent:                      true,
+				PSPresent:                       true,
+				BackwardCompatibleSignaling:     true,
+			},
+			profile:    AACProfileHEv2,
+			audOTI:     29,
+			sampleRate: 48000,
+			channels:   2,
+		},
+		{
+			name: "AAC-LC explicit frequency",
+			// audio-object-type=2 (5bits), sfi=0xf (4bits), frequency=50000 (24bits),
+			// channel-config=1 (4bits), GASpecificConfig (3bits)
+			data: []byte{0x17, 0x80, 0x61, 0xa8, 0x08},
+			expected: AudioSpecificConfig{
+				AudioObjectType:        2,
+				SamplingFrequencyIndex: 0xf,
+				SamplingFrequency:      50000,
+				ChannelConfiguration:   1,
+			},
+			profile:    AACProfileLC,
+			audOTI:     2,
+			sampleRate: 50000,
+			channels:   1,
+		},
+		{
+			name: "AAC-ELD with LD-SBR",
+			// audio-object-type=0x1f (5bits), 7 (6bits), sfi=3 (4bits), channel-config=1 (4bits),
+			// frame-length-flag=0, resilience-flags=000, ld-sbr-present=1, ld-sbr-sampling-rate=1, ld-sbr-crc=0,
+			// sbr-header (14bits+2bits), ep-config=0 (2bits), padding (4bits)
+			data: []byte{0xf8, 0xe6, 0x21, 0x80, 0x00, 0x00},
+			expected: AudioSpecificConfig{
+				AudioObjectType:        39,
+				SamplingFrequencyIndex: 3,
+				SamplingFrequency:      48000,
+				ChannelConfiguration:   1,
+				SBRPresent:             true,
+				ELDSpecificConfig: &ELDSpecificConfig{
+					LDSBRPresentFlag:  true,
+					LDSBRSamplingRate: true,
+				},
+			},
+			profile:    AACProfileELD,
+			audOTI:     39,
+			sampleRate: 96000,
+			channels:   1,
+		},
+		{
+			name: "xHE-AAC",
+			// audio-object-type=0x1f (5bits), 10 (6bits), sfi=3 (4bits), channel-config=2 (4bits),
+			// usac-sfi=3 (5bits), core-sbr-frame-length-index=3 (3bits), channel-config-index=2 (5bits), padding (3bits)
+			data: []byte{0xf9, 0x46, 0x43, 0x62},
+			expected: AudioSpecificConfig{
+				AudioObjectType:        42,
+				SamplingFrequencyIndex: 3,
+				SamplingFrequency:      48000,
+				ChannelConfiguration:   2,
+				SBRPresent:             true,
+				USACConfig: &USACConfig{
+					SamplingFrequencyIndex:    3,
+					SamplingFrequency:         48000,
+					CoreSBRFrameLengthIndex:   3,
+					ChannelConfigurationIndex: 2,
+				},
+			},
+			profile:    AACProfileXHE,
+			audOTI:     42,
+			sampleRate: 48000,
+			channels:   2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			asc, err := ParseAudioSpecificConfig(tc.data)
+			require.NoError(t, err)
+			assert.Equal(t, &tc.expected, asc)
+			assert.Equal(t, tc.profile, asc.Profile())
+			assert.Equal(t, tc.audOTI, asc.AudOTI())
+			assert.Equal(t, tc.sampleRate, asc.OutputSamplingFrequency())
+			assert.Equal(t, tc.channels, asc.ChannelCount())
+		})
+	}
+}
+
+func TestParseAudioSpecificConfigWithPCE(t *testing.T) {
+	// audio-object-type=2 (5bits), sfi=3 (4bits), channel-config=0 (4bits), GASpecificConfig (3bits),
+	// program_config_element:
+	//   element-instance-tag=0 (4bits), object-type=1 (2bits), sfi=3 (4bits),
+	//   front=2 (4bits), side=0 (4bits), back=1 (4bits), lfe=1 (2bits), assoc=0 (3bits), cc=0 (4bits),
+	//   mono-mixdown=0, stereo-mixdown=0, matrix-mixdown=0,
+	//   front: (sce, tag=0), (cpe, tag=0), back: (cpe, tag=1), lfe: tag=0,
+	//   byte-alignment, comment-field-bytes=0
+	data := []byte{0x11, 0x80, 0x04, 0xc8, 0x05, 0x00, 0x01, 0x08, 0x80, 0x00}
+	asc, err := ParseAudioSpecificConfig(data)
+	require.NoError(t, err)
+	require.NotNil(t, asc.ProgramConfigElement)
+	assert.Len(t, asc.ProgramConfigElement.FrontChannelElements, 2)
+	assert.Len(t, asc.ProgramConfigElement.BackChannelElements, 1)
+	assert.Equal(t, uint8(1), asc.ProgramConfigElement.NumLFEChannelElements)
+	assert.Equal(t, uint16(6), asc.ChannelCount())
+}
+
+func TestProbeAudioSpecificConfig(t *testing.T) {
+	f, err := os.Open("./testdata/sample.mp4")
+	require.NoError(t, err)
+	defer f.Close()
+
+	info, err := Probe(f)
+	require.NoError(t, err)
+	require.Len(t, info.Tracks, 2)
+	require.NotNil(t, info.Tracks[1].MP4A)
+	assert.Equal(t, AACProfileLC, info.Tracks[1].MP4A.Profile)
+	assert.Equal(t, uint32(44100), info.Tracks[1].MP4A.SampleRate)
+	assert.Equal(t, uint16(2), info.Tracks[1].MP4A.ChannelCount)
+	require.NotNil(t, info.Tracks[1].MP4A.AudioSpecificConfig)
+	assert.Equal(t, uint8(2), info.Tracks[1].MP4A.AudioSpecificConfig.ChannelConfiguration)
+}
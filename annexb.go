@@ -0,0 +1,452 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// NAL unit types of AVC defined at ISO/IEC 14496-10 7.4.1
+const (
+	avcNALIDR    = 5
+	avcNALSPS    = 7
+	avcNALPPS    = 8
+	avcNALAUD    = 9
+	avcNALSPSExt = 13
+)
+
+// NAL unit types of HEVC defined at ISO/IEC 23008-2 7.4.2.2
+const (
+	hevcNALBLAWLP    = 16
+	hevcNALIDRWRADL  = 19
+	hevcNALIDRNLP    = 20
+	hevcNALRSVIRAP23 = 23
+	hevcNALVPS       = 32
+	hevcNALSPS       = 33
+	hevcNALPPS       = 34
+	hevcNALAUD       = 35
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+func avcNALType(nalu []byte) uint8 {
+	return nalu[0] & 0x1f
+}
+
+func hevcNALType(nalu []byte) uint8 {
+	return (nalu[0] >> 1) & 0x3f
+}
+
+// SplitAnnexB splits data in Annex B byte stream format into NAL units without start codes.
+// Bytes before the first start code are ignored, and zero bytes before start codes are removed.
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	appendNALU := func(nalu []byte) {
+		if len(nalu) != 0 {
+			nalus = append(nalus, nalu)
+		}
+	}
+	for i := 0; i+2 < len(data); {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				// trailing_zero_8bits and the zero_byte of the next start code are not a part of the NAL unit.
+				// cabac_zero_words are followed by emulation_prevention_three_byte at the end of the NAL unit.
+				end := i
+				for end > start && data[end-1] == 0 {
+					end--
+				}
+				appendNALU(data[start:end])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 {
+		appendNALU(data[start:])
+	}
+	return nalus
+}
+
+// SplitLengthPrefixed splits a sample whose NAL units are prefixed by lengthSize-byte lengths.
+func SplitLengthPrefixed(data []byte, lengthSize int) ([][]byte, error) {
+	if lengthSize < 1 || lengthSize > 4 {
+		return nil, fmt.Errorf("invalid length size: %d", lengthSize)
+	}
+	var nalus [][]byte
+	for len(data) != 0 {
+		if len(data) < lengthSize {
+			return nil, errors.New("truncated NAL unit length")
+		}
+		var length int
+		for _, b := range data[:lengthSize] {
+			length = length<<8 | int(b)
+		}
+		data = data[lengthSize:]
+		if length > len(data) {
+			return nil, errors.New("truncated NAL unit")
+		}
+		nalus = append(nalus, data[:length])
+		data = data[length:]
+	}
+	return nalus, nil
+}
+
+// JoinLengthPrefixed joins NAL units with lengthSize-byte length prefixes.
+func JoinLengthPrefixed(nalus [][]byte, lengthSize int) ([]byte, error) {
+	if lengthSize < 1 || lengthSize > 4 {
+		return nil, fmt.Errorf("invalid length size: %d", lengthSize)
+	}
+	var size int
+	for _, nalu := range nalus {
+		if uint64(len(nalu)) >= 1<<(8*uint(lengthSize)) {
+			return nil, fmt.Errorf("too large NAL unit for %d-byte length: %d", lengthSize, len(nalu))
+		}
+		size += lengthSize + len(nalu)
+	}
+	data := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		for i := lengthSize - 1; i >= 0; i-- {
+			data = append(data, byte(len(nalu)>>(8*uint(i))))
+		}
+		data = append(data, nalu...)
+	}
+	return data, nil
+}
+
+// JoinAnnexB joins NAL units with 4-byte start codes.
+func JoinAnnexB(nalus [][]byte) []byte {
+	var size int
+	for _, nalu := range nalus {
+		size += len(annexBStartCode) + len(nalu)
+	}
+	data := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		data = append(data, annexBStartCode...)
+		data = append(data, nalu...)
+	}
+	return data
+}
+
+// AVCSampleToAnnexB converts a sample of an avc1 or avc3 track to Annex B byte stream format.
+// The parameter sets of avcC are inserted before IDR pictures unless the sample has SPS in-band.
+func AVCSampleToAnnexB(avcC *AVCDecoderConfiguration, sample []byte) ([]byte, error) {
+	nalus, err := SplitLengthPrefixed(sample, int(avcC.LengthSizeMinusOne)+1)
+	if err != nil {
+		return nil, err
+	}
+	var idr, inBand bool
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch avcNALType(nalu) {
+		case avcNALIDR:
+			idr = true
+		case avcNALSPS:
+			inBand = true
+		}
+	}
+	if !idr || inBand {
+		return JoinAnnexB(nalus), nil
+	}
+	var params [][]byte
+	for _, sets := range [][]AVCParameterSet{avcC.SequenceParameterSets, avcC.SequenceParameterSetsExt, avcC.PictureParameterSets} {
+		for _, ps := range sets {
+			params = append(params, ps.NALUnit)
+		}
+	}
+	return JoinAnnexB(insertParameterSets(nalus, params, func(nalu []byte) bool {
+		return avcNALType(nalu) == avcNALAUD
+	})), nil
+}
+
+// HEVCSampleToAnnexB converts a sample of an hvc1 or hev1 track to Annex B byte stream format.
+// The NAL units of hvcC, such as VPS, SPS and PPS, are inserted before IRAP pictures unless the sample has VPS or SPS in-band.
+func HEVCSampleToAnnexB(hvcC *HvcC, sample []byte) ([]byte, error) {
+	nalus, err := SplitLengthPrefixed(sample, int(hvcC.LengthSizeMinusOne)+1)
+	if err != nil {
+		return nil, err
+	}
+	var irap, inBand bool
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch t := hevcNALType(nalu); {
+		case t >= hevcNALBLAWLP && t <= hevcNALRSVIRAP23:
+			irap = true
+		case t == hevcNALVPS || t == hevcNALSPS:
+			inBand = true
+		}
+	}
+	if !irap || inBand {
+		return JoinAnnexB(nalus), nil
+	}
+	var params [][]byte
+	for _, array := range hvcC.NaluArrays {
+		for _, nalu := range array.Nalus {
+			params = append(params, nalu.NALUnit)
+		}
+	}
+	return JoinAnnexB(insertParameterSets(nalus, params, func(nalu []byte) bool {
+		return hevcNALType(nalu) == hevcNALAUD
+	})), nil
+}
+
+// insertParameterSets inserts the parameter sets after the access unit delimiter or at the head.
+func insertParameterSets(nalus, params [][]byte, isAUD func(nalu []byte) bool) [][]byte {
+	var pos int
+	if len(nalus) != 0 && len(nalus[0]) != 0 && isAUD(nalus[0]) {
+		pos = 1
+	}
+	dst := make([][]byte, 0, len(nalus)+len(params))
+	dst = append(dst, nalus[:pos]...)
+	dst = append(dst, params...)
+	return append(dst, nalus[pos:]...)
+}
+
+// AnnexBConverter converts access units in Annex B byte stream format to samples of AVC or HEVC tracks,
+// and builds the decoder configuration record from the parameter sets in the stream.
+type AnnexBConverter struct {
+	codec  Codec
+	inBand bool
+	vps    [][]byte
+	sps    [][]byte
+	spsExt [][]byte
+	pps    [][]byte
+}
+
+// NewAnnexBConverter returns a new AnnexBConverter. codec must be CodecAVC1 or CodecHEVC.
+// When inBand is true, parameter sets are kept in the samples as avc3 and hev1 tracks allow.
+// Otherwise they are removed from the samples and stored only in the decoder configuration record,
+// as avc1 and hvc1 tracks require.
+func NewAnnexBConverter(codec Codec, inBand bool) (*AnnexBConverter, error) {
+	if codec != CodecAVC1 && codec != CodecHEVC {
+		return nil, errors.New("unsupported codec")
+	}
+	return &AnnexBConverter{codec: codec, inBand: inBand}, nil
+}
+
+// Convert converts an access unit to a sample whose NAL units are prefixed by 4-byte lengths.
+// It also returns whether the access unit is an IDR picture of AVC or an IRAP picture of HEVC.
+func (c *AnnexBConverter) Convert(au []byte) ([]byte, bool, error) {
+	nalus := SplitAnnexB(au)
+	if len(nalus) == 0 {
+		return nil, false, errors.New("no NAL unit is found")
+	}
+	var isSync bool
+	dst := make([][]byte, 0, len(nalus))
+	for _, nalu := range nalus {
+		var params *[][]byte
+		if c.codec == CodecAVC1 {
+			switch avcNALType(nalu) {
+			case avcNALIDR:
+				isSync = true
+			case avcNALSPS:
+				params = &c.sps
+			case avcNALSPSExt:
+				params = &c.spsExt
+			case avcNALPPS:
+				params = &c.pps
+			}
+		} else {
+			if len(nalu) < 2 {
+				return nil, false, errors.New("too short NAL unit")
+			}
+			switch t := hevcNALType(nalu); {
+			case t >= hevcNALBLAWLP && t <= hevcNALRSVIRAP23:
+				isSync = true
+			case t == hevcNALVPS:
+				params = &c.vps
+			case t == hevcNALSPS:
+				params = &c.sps
+			case t == hevcNALPPS:
+				params = &c.pps
+			}
+		}
+		if params != nil {
+			var err error
+			if *params, err = c.appendParameterSet(*params, nalu); err != nil {
+				return nil, false, err
+			}
+			if !c.inBand {
+				continue
+			}
+		}
+		dst = append(dst, nalu)
+	}
+	sample, err := JoinLengthPrefixed(dst, 4)
+	return sample, isSync, err
+}
+
+// appendParameterSet appends a copy of the parameter set unless the same one exists.
+// It returns an error when the parameter set has the same ID as another one and different content,
+// because the decoder configuration record can not hold both of them.
+func (c *AnnexBConverter) appendParameterSet(sets [][]byte, nalu []byte) ([][]byte, error) {
+	id, err := c.parameterSetID(nalu)
+	if err != nil {
+		return nil, err
+	}
+	for _, ps := range sets {
+		if bytes.Equal(ps, nalu) {
+			return sets, nil
+		}
+		if psID, err := c.parameterSetID(ps); err == nil && psID == id {
+			return nil, fmt.Errorf("parameter set is redefined with different content: id=%d", id)
+		}
+	}
+	return append(sets, append([]byte{}, nalu...)), nil
+}
+
+// parameterSetID returns the ID of the VPS, SPS, SPS extension or PPS.
+func (c *AnnexBConverter) parameterSetID(nalu []byte) (uint32, error) {
+	if c.codec == CodecAVC1 {
+		switch avcNALType(nalu) {
+		case avcNALSPS:
+			sps, err := parseAVCSPS(nalu)
+			if err != nil {
+				return 0, err
+			}
+			return sps.id, nil
+		case avcNALPPS:
+			pps, err := parseAVCPPS(nalu)
+			if err != nil {
+				return 0, err
+			}
+			return pps.id, nil
+		}
+		// seq_parameter_set_extension_rbsp starts with seq_parameter_set_id
+		return newBitReader(unescapeRBSP(nalu[1:])).readUE()
+	}
+	switch hevcNALType(nalu) {
+	case hevcNALSPS:
+		sps, err := parseHEVCSPS(nalu)
+		if err != nil {
+			return 0, err
+		}
+		return sps.id, nil
+	case hevcNALPPS:
+		pps, err := parseHEVCPPS(nalu)
+		if err != nil {
+			return 0, err
+		}
+		return pps.id, nil
+	}
+	// video_parameter_set_rbsp starts with vps_video_parameter_set_id
+	if len(nalu) < 3 {
+		return 0, errors.New("too short VPS")
+	}
+	return uint32(nalu[2] >> 4), nil
+}
+
+// AVCDecoderConfiguration returns avcC which has the parameter sets found by Convert.
+func (c *AnnexBConverter) AVCDecoderConfiguration() (*AVCDecoderConfiguration, error) {
+	if c.codec != CodecAVC1 {
+		return nil, errors.New("codec is not AVC")
+	}
+	if len(c.sps) == 0 || len(c.pps) == 0 {
+		return nil, errors.New("SPS or PPS is not found")
+	}
+	if len(c.sps) > 31 || len(c.pps) > 255 || len(c.spsExt) > 255 {
+		return nil, errors.New("too many parameter sets")
+	}
+	sps, err := parseAVCSPS(c.sps[0])
+	if err != nil {
+		return nil, err
+	}
+	avcC := &AVCDecoderConfiguration{
+		AnyTypeBox:                 AnyTypeBox{Type: BoxTypeAvcC()},
+		ConfigurationVersion:       1,
+		Profile:                    sps.profile,
+		ProfileCompatibility:       sps.constraints,
+		Level:                      sps.level,
+		Reserved:                   0x3f,
+		LengthSizeMinusOne:         3,
+		Reserved2:                  0x7,
+		NumOfSequenceParameterSets: uint8(len(c.sps)),
+		SequenceParameterSets:      newAVCParameterSets(c.sps),
+		NumOfPictureParameterSets:  uint8(len(c.pps)),
+		PictureParameterSets:       newAVCParameterSets(c.pps),
+	}
+	switch sps.profile {
+	case AVCHighProfile, AVCHigh10Profile, AVCHigh422Profile, 144:
+		avcC.HighProfileFieldsEnabled = true
+		avcC.Reserved3 = 0x3f
+		avcC.ChromaFormat = sps.chromaFormat
+		avcC.Reserved4 = 0x1f
+		avcC.BitDepthLumaMinus8 = sps.bitDepthLumaMinus8
+		avcC.Reserved5 = 0x1f
+		avcC.BitDepthChromaMinus8 = sps.bitDepthChromaMinus8
+		avcC.NumOfSequenceParameterSetExt = uint8(len(c.spsExt))
+		avcC.SequenceParameterSetsExt = newAVCParameterSets(c.spsExt)
+	}
+	return avcC, nil
+}
+
+func newAVCParameterSets(nalus [][]byte) []AVCParameterSet {
+	sets := make([]AVCParameterSet, 0, len(nalus))
+	for _, nalu := range nalus {
+		sets = append(sets, AVCParameterSet{Length: uint16(len(nalu)), NALUnit: nalu})
+	}
+	return sets
+}
+
+// HvcC returns hvcC which has the parameter sets found by Convert.
+func (c *AnnexBConverter) HvcC() (*HvcC, error) {
+	if c.codec != CodecHEVC {
+		return nil, errors.New("codec is not HEVC")
+	}
+	if len(c.vps) == 0 || len(c.sps) == 0 || len(c.pps) == 0 {
+		return nil, errors.New("VPS, SPS or PPS is not found")
+	}
+	sps, err := parseHEVCSPS(c.sps[0])
+	if err != nil {
+		return nil, err
+	}
+	hvcC := &HvcC{
+		ConfigurationVersion:        1,
+		GeneralProfileSpace:         sps.profileSpace,
+		GeneralTierFlag:             sps.tierFlag,
+		GeneralProfileIdc:           sps.profileIdc,
+		GeneralProfileCompatibility: sps.profileCompatibility,
+		GeneralConstraintIndicator:  sps.constraintIndicator,
+		GeneralLevelIdc:             sps.levelIdc,
+		Reserved1:                   0xf,
+		Reserved2:                   0x3f,
+		Reserved3:                   0x3f,
+		ChromaFormatIdc:             sps.chromaFormatIdc,
+		Reserved4:                   0x1f,
+		BitDepthLumaMinus8:          sps.bitDepthLumaMinus8,
+		Reserved5:                   0x1f,
+		BitDepthChromaMinus8:        sps.bitDepthChromaMinus8,
+		NumTemporalLayers:           sps.maxSubLayersMinus1 + 1,
+		LengthSizeMinusOne:          3,
+	}
+	if sps.temporalIDNesting {
+		hvcC.TemporalIdNested = 1
+	}
+	for _, array := range []struct {
+		naluType uint8
+		nalus    [][]byte
+	}{
+		{naluType: hevcNALVPS, nalus: c.vps},
+		{naluType: hevcNALSPS, nalus: c.sps},
+		{naluType: hevcNALPPS, nalus: c.pps},
+	} {
+		a := HEVCNaluArray{
+			// the array is complete unless parameter sets can be updated in-band
+			Completeness: !c.inBand,
+			NaluType:     array.naluType,
+			NumNalus:     uint16(len(array.nalus)),
+		}
+		for _, nalu := range array.nalus {
+			a.Nalus = append(a.Nalus, HEVCNalu{Length: uint16(len(nalu)), NALUnit: nalu})
+		}
+		hvcC.NaluArrays = append(hvcC.NaluArrays, a)
+	}
+	hvcC.NumOfNaluArrays = uint8(len(hvcC.NaluArrays))
+	return hvcC, nil
+}
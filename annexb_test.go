@@ -0,0 +1,164 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	data := []byte{
+		0x00, 0x00, 0x00, 0x01, 0x09, 0xf0,
+		0x00, 0x00, 0x01, 0x67, 0x42, 0x00, 0x00, 0x03, 0x00, 0x00, // trailing zero
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x88,
+	}
+	nalus := SplitAnnexB(data)
+	assert.Equal(t, [][]byte{
+		{0x09, 0xf0},
+		{0x67, 0x42, 0x00, 0x00, 0x03},
+		{0x65, 0x88},
+	}, nalus)
+	assert.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x01, 0x09, 0xf0,
+		0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0x00, 0x00, 0x03,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x88,
+	}, JoinAnnexB(nalus))
+	assert.Empty(t, SplitAnnexB([]byte{0x65, 0x88}))
+
+	// zero bytes which are not followed by a start code are kept
+	assert.Equal(t, [][]byte{{0x65, 0x88, 0x00, 0x00}}, SplitAnnexB([]byte{0x00, 0x00, 0x01, 0x65, 0x88, 0x00, 0x00}))
+}
+
+func TestSplitLengthPrefixed(t *testing.T) {
+	nalus, err := SplitLengthPrefixed([]byte{0x00, 0x02, 0x09, 0xf0, 0x00, 0x01, 0x65}, 2)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{{0x09, 0xf0}, {0x65}}, nalus)
+	data, err := JoinLengthPrefixed(nalus, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x02, 0x09, 0xf0, 0x00, 0x00, 0x00, 0x01, 0x65}, data)
+
+	_, err = SplitLengthPrefixed([]byte{0x00, 0x03, 0x09, 0xf0}, 2)
+	assert.Error(t, err)
+	_, err = SplitLengthPrefixed([]byte{0x00}, 2)
+	assert.Error(t, err)
+	_, err = JoinLengthPrefixed([][]byte{make([]byte, 256)}, 1)
+	assert.Error(t, err)
+}
+
+func TestAVCAnnexB(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+	tree, err := ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	avcC := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAvc1(), BoxTypeAvcC()}).Payload.(*AVCDecoderConfiguration)
+	require.Equal(t, uint8(3), avcC.LengthSizeMinusOne)
+	it, err := NewSampleIterator(bytes.NewReader(input), 1)
+	require.NoError(t, err)
+	samples := readAllSamples(t, it)
+	data := readTrackSampleData(t, bytes.NewReader(input), 1)
+
+	for _, inBand := range []bool{false, true} {
+		c, err := NewAnnexBConverter(CodecAVC1, inBand)
+		require.NoError(t, err)
+		for i, sample := range data {
+			au, err := AVCSampleToAnnexB(avcC, sample)
+			require.NoError(t, err)
+			nalus := SplitAnnexB(au)
+			if samples[i].IsSync {
+				// SPS and PPS are inserted before the IDR picture
+				require.Greater(t, len(nalus), 2)
+				assert.Equal(t, avcC.SequenceParameterSets[0].NALUnit, nalus[0])
+				assert.Equal(t, avcC.PictureParameterSets[0].NALUnit, nalus[1])
+			}
+
+			converted, isSync, err := c.Convert(au)
+			require.NoError(t, err)
+			assert.Equal(t, samples[i].IsSync, isSync, "sample %d", i)
+			if !inBand || !samples[i].IsSync {
+				assert.Equal(t, sample, converted, "sample %d", i)
+				continue
+			}
+			// the parameter sets are kept in-band and not inserted again
+			again, err := AVCSampleToAnnexB(avcC, converted)
+			require.NoError(t, err)
+			assert.Equal(t, au, again)
+		}
+
+		built, err := c.AVCDecoderConfiguration()
+		require.NoError(t, err)
+		assert.Equal(t, avcC.Profile, built.Profile)
+		assert.Equal(t, avcC.ProfileCompatibility, built.ProfileCompatibility)
+		assert.Equal(t, avcC.Level, built.Level)
+		assert.Equal(t, avcC.SequenceParameterSets, built.SequenceParameterSets)
+		assert.Equal(t, avcC.PictureParameterSets, built.PictureParameterSets)
+		// the avcC of the sample file omits the fields for high profiles
+		require.Equal(t, AVCHighProfile, built.Profile)
+		assert.True(t, built.HighProfileFieldsEnabled)
+		assert.Equal(t, uint8(1), built.ChromaFormat)
+		assert.Equal(t, uint8(0), built.BitDepthLumaMinus8)
+		assert.Equal(t, uint8(0), built.BitDepthChromaMinus8)
+		_, err = Marshal(bytes.NewBuffer(nil), built, Context{})
+		require.NoError(t, err)
+	}
+
+	// an SPS whose ID is the same and whose level differs can not be stored together
+	c, err := NewAnnexBConverter(CodecAVC1, false)
+	require.NoError(t, err)
+	sps := avcC.SequenceParameterSets[0].NALUnit
+	redefined := append([]byte{}, sps...)
+	redefined[3]++
+	_, _, err = c.Convert(JoinAnnexB([][]byte{sps}))
+	require.NoError(t, err)
+	_, _, err = c.Convert(JoinAnnexB([][]byte{sps}))
+	require.NoError(t, err)
+	_, _, err = c.Convert(JoinAnnexB([][]byte{redefined}))
+	assert.Error(t, err)
+}
+
+func TestHEVCAnnexB(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09}
+	sps := []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93, 0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x80, 0x80, 0x82}
+	pps := []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+	idr := []byte{0x26, 0x01, 0xaf, 0x06}   // IDR_W_RADL
+	trail := []byte{0x02, 0x01, 0xd0, 0x09} // TRAIL_R
+	aud := []byte{0x46, 0x01, 0x10}
+
+	c, err := NewAnnexBConverter(CodecHEVC, false)
+	require.NoError(t, err)
+	sample, isSync, err := c.Convert(JoinAnnexB([][]byte{aud, vps, sps, pps, idr}))
+	require.NoError(t, err)
+	assert.True(t, isSync)
+	expected, err := JoinLengthPrefixed([][]byte{aud, idr}, 4)
+	require.NoError(t, err)
+	assert.Equal(t, expected, sample)
+	_, isSync, err = c.Convert(JoinAnnexB([][]byte{aud, trail}))
+	require.NoError(t, err)
+	assert.False(t, isSync)
+
+	hvcC, err := c.HvcC()
+	require.NoError(t, err)
+	assert.Equal(t, uint8(1), hvcC.GeneralProfileIdc)
+	assert.True(t, hvcC.GeneralProfileCompatibility[1])
+	assert.True(t, hvcC.GeneralProfileCompatibility[2])
+	assert.Equal(t, [6]uint8{0x90, 0, 0, 0, 0, 0}, hvcC.GeneralConstraintIndicator)
+	assert.Equal(t, uint8(93), hvcC.GeneralLevelIdc)
+	assert.Equal(t, uint8(1), hvcC.ChromaFormatIdc)
+	assert.Equal(t, uint8(0), hvcC.BitDepthLumaMinus8)
+	assert.Equal(t, uint8(1), hvcC.NumTemporalLayers)
+	assert.Equal(t, uint8(1), hvcC.TemporalIdNested)
+	require.Len(t, hvcC.NaluArrays, 3)
+	assert.Equal(t, sps, hvcC.NaluArrays[1].Nalus[0].NALUnit)
+	_, err = Marshal(bytes.NewBuffer(nil), hvcC, Context{})
+	require.NoError(t, err)
+
+	// parameter sets are inserted after the access unit delimiter
+	au, err := HEVCSampleToAnnexB(hvcC, sample)
+	require.NoError(t, err)
+	assert.Equal(t, JoinAnnexB([][]byte{aud, vps, sps, pps, idr}), au)
+
+	_, err = c.AVCDecoderConfiguration()
+	assert.Error(t, err)
+	_, err = NewAnnexBConverter(CodecAV1, false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,1014 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// constants defined at AV1 Bitstream & Decoding Process Specification 3
+const (
+	av1NumRefFrames   = 8
+	av1RefsPerFrame   = 7
+	av1PrimaryRefNone = 7
+	av1MaxSegments    = 8
+	av1SelectTools    = 2 // SELECT_SCREEN_CONTENT_TOOLS and SELECT_INTEGER_MV
+)
+
+// frame types defined at AV1 Bitstream & Decoding Process Specification 6.8.2
+const (
+	av1KeyFrame       = 0
+	av1InterFrame     = 1
+	av1IntraOnlyFrame = 2
+	av1SwitchFrame    = 3
+)
+
+// av1SequenceHeader holds the fields of sequence_header_obu which frame headers depend on.
+type av1SequenceHeader struct {
+	// av1C is the av1C box built from the sequence header.
+	av1C                        *Av1C
+	reducedStillPictureHeader   bool
+	equalPictureInterval        bool
+	decoderModelInfoPresent     bool
+	bufferRemovalTimeLength     uint
+	framePresentationTimeLength uint
+	operatingPointIdc           []uint32
+	decoderModelPresentForOp    []bool
+	frameWidthBits              uint
+	frameHeightBits             uint
+	maxFrameWidth               uint32
+	maxFrameHeight              uint32
+	frameIDNumbersPresent       bool
+	deltaFrameIDLength          uint
+	additionalFrameIDLength     uint
+	use128x128Superblock        bool
+	enableWarpedMotion          bool
+	enableOrderHint             bool
+	enableRefFrameMvs           bool
+	seqForceScreenContentTools  uint32
+	seqForceIntegerMV           uint32
+	orderHintBits               uint
+	enableSuperres              bool
+	enableCdef                  bool
+	enableRestoration           bool
+	separateUVDeltaQ            bool
+	filmGrainParamsPresent      bool
+}
+
+// parseAV1SequenceHeader parses sequence_header_obu defined at
+// AV1 Bitstream & Decoding Process Specification 5.5.
+func parseAV1SequenceHeader(obu []byte) (*av1SequenceHeader, error) {
+	if len(obu) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	headerSize := 1
+	if obu[0]&0x04 != 0 {
+		headerSize++
+	}
+	if len(obu) < headerSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	_, n, err := readLEB128(obu[headerSize:])
+	if err != nil {
+		return nil, err
+	}
+	r := newBitReader(obu[headerSize+n:])
+	read := func(width uint) uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUint32(width)
+		}
+		return v
+	}
+
+	sh := &av1SequenceHeader{
+		av1C: &Av1C{
+			Marker:     1,
+			Version:    1,
+			ConfigOBUs: obu,
+		},
+		seqForceScreenContentTools: av1SelectTools,
+		seqForceIntegerMV:          av1SelectTools,
+	}
+	av1C := sh.av1C
+	av1C.SeqProfile = uint8(read(3))
+	read(1) // still_picture
+	sh.reducedStillPictureHeader = read(1) == 1
+	if sh.reducedStillPictureHeader {
+		av1C.SeqLevelIdx0 = uint8(read(5))
+	} else {
+		var bufferDelayLength uint
+		if read(1) == 1 { // timing_info_present_flag
+			read(32) // num_units_in_display_tick
+			read(32) // time_scale
+			sh.equalPictureInterval = read(1) == 1
+			if sh.equalPictureInterval {
+				// num_ticks_per_picture_minus_1 in uvlc()
+				var leadingZeros uint
+				for err == nil && read(1) == 0 {
+					leadingZeros++
+				}
+				if leadingZeros < 32 {
+					read(leadingZeros)
+				}
+			}
+			sh.decoderModelInfoPresent = read(1) == 1
+			if sh.decoderModelInfoPresent {
+				bufferDelayLength = uint(read(5)) + 1
+				read(32) // num_units_in_decoding_tick
+				sh.bufferRemovalTimeLength = uint(read(5)) + 1
+				sh.framePresentationTimeLength = uint(read(5)) + 1
+			}
+		}
+		initialDisplayDelayPresent := read(1) == 1
+		operatingPoints := read(5) + 1
+		sh.operatingPointIdc = make([]uint32, operatingPoints)
+		sh.decoderModelPresentForOp = make([]bool, operatingPoints)
+		for i := range sh.operatingPointIdc {
+			sh.operatingPointIdc[i] = read(12)
+			level := uint8(read(5))
+			var tier uint8
+			if level > 7 {
+				tier = uint8(read(1))
+			}
+			if sh.decoderModelInfoPresent {
+				sh.decoderModelPresentForOp[i] = read(1) == 1
+				if sh.decoderModelPresentForOp[i] {
+					read(bufferDelayLength) // decoder_buffer_delay
+					read(bufferDelayLength) // encoder_buffer_delay
+					read(1)                 // low_delay_mode_flag
+				}
+			}
+			if initialDisplayDelayPresent && read(1) == 1 { // initial_display_delay_present_for_this_op
+				delay := uint8(read(4))
+				if i == 0 {
+					av1C.InitialPresentationDelayPresent = 1
+					av1C.InitialPresentationDelayMinusOne = delay
+				}
+			}
+			if i == 0 {
+				av1C.SeqLevelIdx0 = level
+				av1C.SeqTier0 = tier
+			}
+		}
+	}
+	sh.frameWidthBits = uint(read(4)) + 1
+	sh.frameHeightBits = uint(read(4)) + 1
+	sh.maxFrameWidth = read(sh.frameWidthBits) + 1
+	sh.maxFrameHeight = read(sh.frameHeightBits) + 1
+	if !sh.reducedStillPictureHeader {
+		sh.frameIDNumbersPresent = read(1) == 1
+	}
+	if sh.frameIDNumbersPresent {
+		sh.deltaFrameIDLength = uint(read(4)) + 2
+		sh.additionalFrameIDLength = uint(read(3)) + 1
+	}
+	sh.use128x128Superblock = read(1) == 1
+	read(2) // enable_filter_intra, enable_intra_edge
+	if !sh.reducedStillPictureHeader {
+		read(2) // enable_interintra_compound, enable_masked_compound
+		sh.enableWarpedMotion = read(1) == 1
+		read(1) // enable_dual_filter
+		sh.enableOrderHint = read(1) == 1
+		if sh.enableOrderHint {
+			read(1) // enable_jnt_comp
+			sh.enableRefFrameMvs = read(1) == 1
+		}
+		if read(1) == 0 { // seq_choose_screen_content_tools
+			sh.seqForceScreenContentTools = read(1)
+		}
+		if sh.seqForceScreenContentTools > 0 && read(1) == 0 { // seq_choose_integer_mv
+			sh.seqForceIntegerMV = read(1)
+		}
+		if sh.enableOrderHint {
+			sh.orderHintBits = uint(read(3)) + 1
+		}
+	}
+	sh.enableSuperres = read(1) == 1
+	sh.enableCdef = read(1) == 1
+	sh.enableRestoration = read(1) == 1
+
+	// color_config
+	av1C.HighBitdepth = uint8(read(1))
+	if av1C.SeqProfile == 2 && av1C.HighBitdepth == 1 {
+		av1C.TwelveBit = uint8(read(1))
+	}
+	if av1C.SeqProfile != 1 {
+		av1C.Monochrome = uint8(read(1))
+	}
+	colorPrimaries, transferCharacteristics, matrixCoefficients := uint32(2), uint32(2), uint32(2)
+	if read(1) == 1 { // color_description_present_flag
+		colorPrimaries = read(8)
+		transferCharacteristics = read(8)
+		matrixCoefficients = read(8)
+	}
+	switch {
+	case av1C.Monochrome == 1:
+		read(1) // color_range
+		av1C.ChromaSubsamplingX, av1C.ChromaSubsamplingY = 1, 1
+	case colorPrimaries == 1 && transferCharacteristics == 13 && matrixCoefficients == 0:
+		// sRGB
+	default:
+		read(1) // color_range
+		switch av1C.SeqProfile {
+		case 0:
+			av1C.ChromaSubsamplingX, av1C.ChromaSubsamplingY = 1, 1
+		case 1:
+		default:
+			if av1C.TwelveBit == 1 {
+				av1C.ChromaSubsamplingX = uint8(read(1))
+				if av1C.ChromaSubsamplingX == 1 {
+					av1C.ChromaSubsamplingY = uint8(read(1))
+				}
+			} else {
+				av1C.ChromaSubsamplingX = 1
+			}
+		}
+		if av1C.ChromaSubsamplingX == 1 && av1C.ChromaSubsamplingY == 1 {
+			av1C.ChromaSamplePosition = uint8(read(2))
+		}
+	}
+	if av1C.Monochrome == 0 {
+		sh.separateUVDeltaQ = read(1) == 1
+	}
+	sh.filmGrainParamsPresent = read(1) == 1
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse AV1 sequence header: %w", err)
+	}
+	return sh, nil
+}
+
+// av1RefFrame is the state of a reference frame slot which the following frame headers depend on.
+type av1RefFrame struct {
+	frameType     uint32
+	orderHint     uint32
+	upscaledWidth uint32
+	frameWidth    uint32
+	frameHeight   uint32
+	// altQEnabled and altQ are FeatureEnabled and FeatureData of SEG_LVL_ALT_Q for each segment.
+	altQEnabled [av1MaxSegments]bool
+	altQ        [av1MaxSegments]int32
+}
+
+// av1FrameHeader holds the fields of uncompressed_header which tile groups depend on.
+type av1FrameHeader struct {
+	showExistingFrame bool
+	tileCols          int
+	tileRows          int
+	tileColsLog2      uint
+	tileRowsLog2      uint
+	tileSizeBytes     int
+}
+
+// av1Tile is a tile in a tile group.
+type av1Tile struct {
+	// sizeBytes is the length of tile_size_minus_1, which is 0 for the last tile of the tile group.
+	sizeBytes int
+	// size is the number of the bytes of the tile including tile_size_minus_1.
+	size int
+}
+
+// av1FrameHeaderParser parses frame headers and tile groups, keeping the reference frame state.
+type av1FrameHeaderParser struct {
+	seq  *av1SequenceHeader
+	refs [av1NumRefFrames]av1RefFrame
+	// frame is the header of the current frame, and seenFrameHeader is SeenFrameHeader.
+	frame           *av1FrameHeader
+	seenFrameHeader bool
+}
+
+// relativeDist returns get_relative_dist defined at AV1 Bitstream & Decoding Process Specification 7.12.3.
+func (p *av1FrameHeaderParser) relativeDist(a, b uint32) int32 {
+	if !p.seq.enableOrderHint {
+		return 0
+	}
+	diff := int32(a) - int32(b)
+	m := int32(1) << (p.seq.orderHintBits - 1)
+	return (diff & (m - 1)) - (diff & m)
+}
+
+// parseFrameHeader parses uncompressed_header defined at AV1 Bitstream & Decoding Process Specification 5.9.2,
+// and updates the reference frames. It returns the number of the bytes of the frame header followed by byte_alignment.
+func (p *av1FrameHeaderParser) parseFrameHeader(data []byte, temporalID, spatialID uint8) (int, error) {
+	seq := p.seq
+	if seq == nil {
+		return 0, errors.New("AV1 sequence header not found")
+	}
+	r := newBitReader(data)
+	var err error
+	read := func(width uint) uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUint32(width)
+		}
+		return v
+	}
+	readSU := func(width uint) int32 {
+		v := int32(read(width))
+		if signMask := int32(1) << (width - 1); v&signMask != 0 {
+			v -= 2 * signMask
+		}
+		return v
+	}
+	readNS := func(n uint32) uint32 {
+		w := uint(bits.Len32(n))
+		m := uint32(1)<<w - n
+		v := read(w - 1)
+		if v < m {
+			return v
+		}
+		return v<<1 - m + read(1)
+	}
+
+	fh := &av1FrameHeader{}
+	var idLen uint
+	if seq.frameIDNumbersPresent {
+		idLen = seq.additionalFrameIDLength + seq.deltaFrameIDLength
+	}
+	const allFrames = 1<<av1NumRefFrames - 1
+	frameType := uint32(av1KeyFrame)
+	showFrame, showableFrame, errorResilientMode := true, false, true
+	if !seq.reducedStillPictureHeader {
+		if read(1) == 1 { // show_existing_frame
+			fh.showExistingFrame = true
+			idx := read(3) // frame_to_show_map_idx
+			if seq.decoderModelInfoPresent && !seq.equalPictureInterval {
+				read(seq.framePresentationTimeLength) // frame_presentation_time
+			}
+			read(idLen) // display_frame_id
+			if err != nil {
+				return 0, fmt.Errorf("failed to parse AV1 frame header: %w", err)
+			}
+			if p.refs[idx].frameType == av1KeyFrame {
+				// the shown key frame refreshes all frames
+				for i := range p.refs {
+					p.refs[i] = p.refs[idx]
+				}
+			}
+			p.frame = fh
+			p.seenFrameHeader = false
+			return (r.read + 7) / 8, nil
+		}
+		frameType = read(2)
+		showFrame = read(1) == 1
+		if showFrame && seq.decoderModelInfoPresent && !seq.equalPictureInterval {
+			read(seq.framePresentationTimeLength) // frame_presentation_time
+		}
+		if showFrame {
+			showableFrame = frameType != av1KeyFrame
+		} else {
+			showableFrame = read(1) == 1
+		}
+		if frameType != av1SwitchFrame && !(frameType == av1KeyFrame && showFrame) {
+			errorResilientMode = read(1) == 1
+		}
+	}
+	frameIsIntra := frameType == av1IntraOnlyFrame || frameType == av1KeyFrame
+	if frameType == av1KeyFrame && showFrame {
+		for i := range p.refs {
+			p.refs[i].orderHint = 0
+		}
+	}
+	disableCdfUpdate := read(1) == 1
+	allowScreenContentTools := seq.seqForceScreenContentTools
+	if allowScreenContentTools == av1SelectTools {
+		allowScreenContentTools = read(1)
+	}
+	forceIntegerMV := uint32(0)
+	if allowScreenContentTools != 0 {
+		forceIntegerMV = seq.seqForceIntegerMV
+		if forceIntegerMV == av1SelectTools {
+			forceIntegerMV = read(1)
+		}
+	}
+	if frameIsIntra {
+		forceIntegerMV = 1
+	}
+	read(idLen) // current_frame_id
+	frameSizeOverride := frameType == av1SwitchFrame
+	if frameType != av1SwitchFrame && !seq.reducedStillPictureHeader {
+		frameSizeOverride = read(1) == 1
+	}
+	orderHint := read(seq.orderHintBits)
+	primaryRefFrame := uint32(av1PrimaryRefNone)
+	if !frameIsIntra && !errorResilientMode {
+		primaryRefFrame = read(3)
+	}
+	if seq.decoderModelInfoPresent && read(1) == 1 { // buffer_removal_time_present_flag
+		for i, idc := range seq.operatingPointIdc {
+			if !seq.decoderModelPresentForOp[i] {
+				continue
+			}
+			inTemporalLayer := idc>>temporalID&1 == 1
+			inSpatialLayer := idc>>(spatialID+8)&1 == 1
+			if idc == 0 || inTemporalLayer && inSpatialLayer {
+				read(seq.bufferRemovalTimeLength) // buffer_removal_time
+			}
+		}
+	}
+	refreshFrameFlags := uint32(allFrames)
+	if frameType != av1SwitchFrame && !(frameType == av1KeyFrame && showFrame) {
+		refreshFrameFlags = read(8)
+	}
+	if (!frameIsIntra || refreshFrameFlags != allFrames) && errorResilientMode && seq.enableOrderHint {
+		for i := range p.refs {
+			p.refs[i].orderHint = read(seq.orderHintBits) // ref_order_hint
+		}
+	}
+
+	var frameWidth, frameHeight, upscaledWidth uint32
+	superresParams := func() {
+		denom := uint32(8)                      // SUPERRES_NUM
+		if seq.enableSuperres && read(1) == 1 { // use_superres
+			denom = read(3) + 9 // coded_denom + SUPERRES_DENOM_MIN
+		}
+		upscaledWidth = frameWidth
+		frameWidth = (upscaledWidth*8 + denom/2) / denom
+	}
+	frameSize := func() {
+		frameWidth, frameHeight = seq.maxFrameWidth, seq.maxFrameHeight
+		if frameSizeOverride {
+			frameWidth = read(seq.frameWidthBits) + 1
+			frameHeight = read(seq.frameHeightBits) + 1
+		}
+		superresParams()
+	}
+	renderSize := func() {
+		if read(1) == 1 { // render_and_frame_size_different
+			read(32) // render_width_minus_1, render_height_minus_1
+		}
+	}
+	var refFrameIdx [av1RefsPerFrame]uint32
+	var allowIntrabc, allowHighPrecisionMV bool
+	if frameIsIntra {
+		frameSize()
+		renderSize()
+		if allowScreenContentTools != 0 && upscaledWidth == frameWidth {
+			allowIntrabc = read(1) == 1
+		}
+	} else {
+		frameRefsShortSignaling := seq.enableOrderHint && read(1) == 1
+		if frameRefsShortSignaling {
+			lastFrameIdx := read(3)
+			goldFrameIdx := read(3)
+			refFrameIdx = p.setFrameRefs(lastFrameIdx, goldFrameIdx, orderHint)
+		}
+		for i := range refFrameIdx {
+			if !frameRefsShortSignaling {
+				refFrameIdx[i] = read(3)
+			}
+			if seq.frameIDNumbersPresent {
+				read(seq.deltaFrameIDLength) // delta_frame_id_minus_1
+			}
+		}
+		if frameSizeOverride && !errorResilientMode {
+			// frame_size_with_refs
+			foundRef := false
+			for i := 0; i < av1RefsPerFrame && !foundRef && err == nil; i++ {
+				if foundRef = read(1) == 1; foundRef {
+					ref := &p.refs[refFrameIdx[i]]
+					frameWidth, frameHeight = ref.upscaledWidth, ref.frameHeight
+				}
+			}
+			if foundRef {
+				superresParams()
+			} else {
+				frameSize()
+				renderSize()
+			}
+		} else {
+			frameSize()
+			renderSize()
+		}
+		if forceIntegerMV == 0 {
+			allowHighPrecisionMV = read(1) == 1
+		}
+		if read(1) == 0 { // is_filter_switchable
+			read(2) // interpolation_filter
+		}
+		read(1) // is_motion_mode_switchable
+		if !errorResilientMode && seq.enableRefFrameMvs {
+			read(1) // use_ref_frame_mvs
+		}
+	}
+	if !seq.reducedStillPictureHeader && !disableCdfUpdate {
+		read(1) // disable_frame_end_update_cdf
+	}
+	var altQEnabled [av1MaxSegments]bool
+	var altQ [av1MaxSegments]int32
+	if primaryRefFrame != av1PrimaryRefNone {
+		// load_previous
+		prev := &p.refs[refFrameIdx[primaryRefFrame]]
+		altQEnabled, altQ = prev.altQEnabled, prev.altQ
+	}
+
+	// tile_info
+	miCols := 2 * ((frameWidth + 7) >> 3)
+	miRows := 2 * ((frameHeight + 7) >> 3)
+	sbCols, sbRows, sbShift := (miCols+15)>>4, (miRows+15)>>4, uint(4)
+	if seq.use128x128Superblock {
+		sbCols, sbRows, sbShift = (miCols+31)>>5, (miRows+31)>>5, 5
+	}
+	sbSize := sbShift + 2
+	maxTileWidthSb := uint32(4096) >> sbSize           // MAX_TILE_WIDTH
+	maxTileAreaSb := uint32(4096*2304) >> (2 * sbSize) // MAX_TILE_AREA
+	minLog2TileCols := av1TileLog2(maxTileWidthSb, sbCols)
+	maxLog2TileCols := av1TileLog2(1, minUint32(sbCols, 64)) // MAX_TILE_COLS
+	maxLog2TileRows := av1TileLog2(1, minUint32(sbRows, 64)) // MAX_TILE_ROWS
+	minLog2Tiles := av1TileLog2(maxTileAreaSb, sbRows*sbCols)
+	if minLog2Tiles < minLog2TileCols {
+		minLog2Tiles = minLog2TileCols
+	}
+	if read(1) == 1 { // uniform_tile_spacing_flag
+		fh.tileColsLog2 = minLog2TileCols
+		for fh.tileColsLog2 < maxLog2TileCols && read(1) == 1 { // increment_tile_cols_log2
+			fh.tileColsLog2++
+		}
+		tileWidthSb := (sbCols + 1<<fh.tileColsLog2 - 1) >> fh.tileColsLog2
+		fh.tileCols = int((sbCols + tileWidthSb - 1) / tileWidthSb)
+		if minLog2Tiles > fh.tileColsLog2 {
+			fh.tileRowsLog2 = minLog2Tiles - fh.tileColsLog2
+		}
+		for fh.tileRowsLog2 < maxLog2TileRows && read(1) == 1 { // increment_tile_rows_log2
+			fh.tileRowsLog2++
+		}
+		tileHeightSb := (sbRows + 1<<fh.tileRowsLog2 - 1) >> fh.tileRowsLog2
+		fh.tileRows = int((sbRows + tileHeightSb - 1) / tileHeightSb)
+	} else {
+		widestTileSb := uint32(1)
+		for startSb := uint32(0); startSb < sbCols; fh.tileCols++ {
+			sizeSb := readNS(minUint32(sbCols-startSb, maxTileWidthSb)) + 1 // width_in_sbs_minus_1
+			if sizeSb > widestTileSb {
+				widestTileSb = sizeSb
+			}
+			startSb += sizeSb
+		}
+		fh.tileColsLog2 = av1TileLog2(1, uint32(fh.tileCols))
+		if minLog2Tiles > 0 {
+			maxTileAreaSb = (sbRows * sbCols) >> (minLog2Tiles + 1)
+		} else {
+			maxTileAreaSb = sbRows * sbCols
+		}
+		maxTileHeightSb := maxTileAreaSb / widestTileSb
+		if maxTileHeightSb < 1 {
+			maxTileHeightSb = 1
+		}
+		for startSb := uint32(0); startSb < sbRows; fh.tileRows++ {
+			startSb += readNS(minUint32(sbRows-startSb, maxTileHeightSb)) + 1 // height_in_sbs_minus_1
+		}
+		fh.tileRowsLog2 = av1TileLog2(1, uint32(fh.tileRows))
+	}
+	if fh.tileColsLog2 > 0 || fh.tileRowsLog2 > 0 {
+		read(fh.tileRowsLog2 + fh.tileColsLog2) // context_update_tile_id
+		fh.tileSizeBytes = int(read(2)) + 1
+	}
+
+	// quantization_params
+	readDeltaQ := func() int32 {
+		if read(1) == 1 { // delta_coded
+			return readSU(7) // delta_q
+		}
+		return 0
+	}
+	monochrome := seq.av1C.Monochrome == 1
+	baseQIdx := read(8)
+	deltaQYDc := readDeltaQ()
+	var deltaQUDc, deltaQUAc, deltaQVDc, deltaQVAc int32
+	if !monochrome {
+		diffUVDelta := seq.separateUVDeltaQ && read(1) == 1
+		deltaQUDc = readDeltaQ()
+		deltaQUAc = readDeltaQ()
+		deltaQVDc, deltaQVAc = deltaQUDc, deltaQUAc
+		if diffUVDelta {
+			deltaQVDc = readDeltaQ()
+			deltaQVAc = readDeltaQ()
+		}
+	}
+	if read(1) == 1 { // using_qmatrix
+		read(8) // qm_y, qm_u
+		if seq.separateUVDeltaQ {
+			read(4) // qm_v
+		}
+	}
+
+	// segmentation_params
+	segmentationEnabled := read(1) == 1
+	if segmentationEnabled {
+		updateData := true
+		if primaryRefFrame != av1PrimaryRefNone {
+			if read(1) == 1 { // segmentation_update_map
+				read(1) // segmentation_temporal_update
+			}
+			updateData = read(1) == 1
+		}
+		if updateData {
+			// Segmentation_Feature_Bits and Segmentation_Feature_Signed
+			featureBits := []uint{8, 6, 6, 6, 6, 3, 0, 0}
+			for i := 0; i < av1MaxSegments; i++ {
+				for j, width := range featureBits {
+					enabled := read(1) == 1 // feature_enabled
+					var value int32
+					if enabled && j < 5 {
+						value = readSU(1 + width)
+					} else if enabled {
+						value = int32(read(width))
+					}
+					if j == 0 {
+						// SEG_LVL_ALT_Q clipped by Segmentation_Feature_Max
+						if value > 255 {
+							value = 255
+						} else if value < -255 {
+							value = -255
+						}
+						altQEnabled[i], altQ[i] = enabled, value
+					}
+				}
+			}
+		}
+	} else {
+		altQEnabled, altQ = [av1MaxSegments]bool{}, [av1MaxSegments]int32{}
+	}
+
+	// delta_q_params and delta_lf_params
+	if baseQIdx > 0 && read(1) == 1 { // delta_q_present
+		read(2)                            // delta_q_res
+		if !allowIntrabc && read(1) == 1 { // delta_lf_present
+			read(3) // delta_lf_res, delta_lf_multi
+		}
+	}
+
+	codedLossless := true
+	for i := 0; i < av1MaxSegments; i++ {
+		qindex := int32(baseQIdx)
+		if segmentationEnabled && altQEnabled[i] {
+			qindex += altQ[i]
+		}
+		if qindex > 0 || deltaQYDc != 0 || deltaQUAc != 0 || deltaQUDc != 0 || deltaQVAc != 0 || deltaQVDc != 0 {
+			codedLossless = false
+		}
+	}
+	allLossless := codedLossless && frameWidth == upscaledWidth
+
+	// loop_filter_params
+	if !codedLossless && !allowIntrabc {
+		level0, level1 := read(6), read(6)
+		if !monochrome && (level0 != 0 || level1 != 0) {
+			read(12) // loop_filter_level[2], loop_filter_level[3]
+		}
+		read(3)                           // loop_filter_sharpness
+		if read(1) == 1 && read(1) == 1 { // loop_filter_delta_enabled, loop_filter_delta_update
+			for i := 0; i < av1NumRefFrames+2; i++ {
+				if read(1) == 1 { // update_ref_delta and update_mode_delta
+					read(7) // loop_filter_ref_deltas and loop_filter_mode_deltas
+				}
+			}
+		}
+	}
+
+	// cdef_params
+	if !codedLossless && !allowIntrabc && seq.enableCdef {
+		read(2) // cdef_damping_minus_3
+		cdefBits := read(2)
+		for i := 0; i < 1<<cdefBits; i++ {
+			read(6) // cdef_y_pri_strength, cdef_y_sec_strength
+			if !monochrome {
+				read(6) // cdef_uv_pri_strength, cdef_uv_sec_strength
+			}
+		}
+	}
+
+	// lr_params
+	if !allLossless && !allowIntrabc && seq.enableRestoration {
+		var usesLr, usesChromaLr bool
+		planes := 3
+		if monochrome {
+			planes = 1
+		}
+		for i := 0; i < planes; i++ {
+			if read(2) != 0 { // lr_type
+				usesLr = true
+				usesChromaLr = usesChromaLr || i > 0
+			}
+		}
+		if usesLr {
+			if read(1) == 1 && !seq.use128x128Superblock { // lr_unit_shift
+				read(1) // lr_unit_extra_shift
+			}
+			if seq.av1C.ChromaSubsamplingX == 1 && seq.av1C.ChromaSubsamplingY == 1 && usesChromaLr {
+				read(1) // lr_uv_shift
+			}
+		}
+	}
+
+	if !codedLossless {
+		read(1) // tx_mode_select
+	}
+	referenceSelect := !frameIsIntra && read(1) == 1
+	if referenceSelect && seq.enableOrderHint && p.skipModeAllowed(refFrameIdx, orderHint) {
+		read(1) // skip_mode_present
+	}
+	if !frameIsIntra && !errorResilientMode && seq.enableWarpedMotion {
+		read(1) // allow_warped_motion
+	}
+	read(1) // reduced_tx_set
+
+	// global_motion_params
+	readSubexp := func(numSyms uint32) {
+		// decode_subexp
+		for i, mk, k := uint(0), uint32(0), uint(3); err == nil; {
+			b2 := k
+			if i != 0 {
+				b2 = k + i - 1
+			}
+			a := uint32(1) << b2
+			if numSyms <= mk+3*a {
+				readNS(numSyms - mk) // subexp_final_bits
+				return
+			}
+			if read(1) == 0 { // subexp_more_bits
+				read(b2) // subexp_bits
+				return
+			}
+			i++
+			mk += a
+		}
+	}
+	if !frameIsIntra {
+		const (
+			translation = 1
+			rotzoom     = 2
+			affine      = 3
+		)
+		for ref := 0; ref < av1RefsPerFrame; ref++ {
+			gmType := 0
+			if read(1) == 1 { // is_global
+				if read(1) == 1 { // is_rot_zoom
+					gmType = rotzoom
+				} else if read(1) == 1 { // is_translation
+					gmType = translation
+				} else {
+					gmType = affine
+				}
+			}
+			params := 0
+			switch gmType {
+			case affine:
+				params = 4
+			case rotzoom:
+				params = 2
+			}
+			for i := 0; i < params; i++ {
+				readSubexp(2<<12 + 1) // GM_ABS_ALPHA_BITS
+			}
+			if gmType >= translation {
+				absBits := uint(12) // GM_ABS_TRANS_BITS
+				if gmType == translation {
+					absBits = 9 // GM_ABS_TRANS_ONLY_BITS
+					if !allowHighPrecisionMV {
+						absBits--
+					}
+				}
+				readSubexp(2<<absBits + 1)
+				readSubexp(2<<absBits + 1)
+			}
+		}
+	}
+
+	// film_grain_params
+	if seq.filmGrainParamsPresent && (showFrame || showableFrame) && read(1) == 1 { // apply_grain
+		read(16)                                        // grain_seed
+		if frameType == av1InterFrame && read(1) == 0 { // update_grain
+			read(3) // film_grain_params_ref_idx
+		} else {
+			numYPoints := read(4)
+			skip := func(width uint) {
+				if err == nil {
+					err = r.skip(width)
+				}
+			}
+			skip(16 * uint(numYPoints)) // point_y_value, point_y_scaling
+			chromaScalingFromLuma := !monochrome && read(1) == 1
+			var numCbPoints, numCrPoints uint32
+			subsampled := seq.av1C.ChromaSubsamplingX == 1 && seq.av1C.ChromaSubsamplingY == 1
+			if !monochrome && !chromaScalingFromLuma && !(subsampled && numYPoints == 0) {
+				numCbPoints = read(4)
+				skip(16 * uint(numCbPoints)) // point_cb_value, point_cb_scaling
+				numCrPoints = read(4)
+				skip(16 * uint(numCrPoints)) // point_cr_value, point_cr_scaling
+			}
+			read(2) // grain_scaling_minus_8
+			arCoeffLag := uint(read(2))
+			numPosLuma := 2 * arCoeffLag * (arCoeffLag + 1)
+			numPosChroma := numPosLuma
+			if numYPoints != 0 {
+				numPosChroma++
+				skip(8 * numPosLuma) // ar_coeffs_y_plus_128
+			}
+			if chromaScalingFromLuma || numCbPoints != 0 {
+				skip(8 * numPosChroma) // ar_coeffs_cb_plus_128
+			}
+			if chromaScalingFromLuma || numCrPoints != 0 {
+				skip(8 * numPosChroma) // ar_coeffs_cr_plus_128
+			}
+			read(4) // ar_coeff_shift_minus_6, grain_scale_shift
+			if numCbPoints != 0 {
+				read(25) // cb_mult, cb_luma_mult, cb_offset
+			}
+			if numCrPoints != 0 {
+				read(25) // cr_mult, cr_luma_mult, cr_offset
+			}
+			read(2) // overlap_flag, clip_to_restricted_range
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse AV1 frame header: %w", err)
+	}
+
+	// reference frame update process
+	for i := range p.refs {
+		if refreshFrameFlags>>uint(i)&1 == 1 {
+			p.refs[i] = av1RefFrame{
+				frameType:     frameType,
+				orderHint:     orderHint,
+				upscaledWidth: upscaledWidth,
+				frameWidth:    frameWidth,
+				frameHeight:   frameHeight,
+				altQEnabled:   altQEnabled,
+				altQ:          altQ,
+			}
+		}
+	}
+	p.frame = fh
+	p.seenFrameHeader = true
+	return (r.read + 7) / 8, nil
+}
+
+// setFrameRefs derives ref_frame_idx from last_frame_idx and gold_frame_idx,
+// defined at AV1 Bitstream & Decoding Process Specification 7.8.
+func (p *av1FrameHeaderParser) setFrameRefs(lastFrameIdx, goldFrameIdx, orderHint uint32) [av1RefsPerFrame]uint32 {
+	var refFrameIdx [av1RefsPerFrame]int
+	for i := range refFrameIdx {
+		refFrameIdx[i] = -1
+	}
+	refFrameIdx[0] = int(lastFrameIdx) // LAST_FRAME
+	refFrameIdx[3] = int(goldFrameIdx) // GOLDEN_FRAME
+	var usedFrame [av1NumRefFrames]bool
+	usedFrame[lastFrameIdx] = true
+	usedFrame[goldFrameIdx] = true
+	curFrameHint := int32(1) << (p.seq.orderHintBits - 1)
+	var shiftedOrderHints [av1NumRefFrames]int32
+	for i := range shiftedOrderHints {
+		shiftedOrderHints[i] = curFrameHint + p.relativeDist(p.refs[i].orderHint, orderHint)
+	}
+
+	// find returns the unused frame whose hint is backward or forward and is the latest or the earliest.
+	find := func(backward, latest bool) int {
+		ref := -1
+		var refHint int32
+		for i, hint := range shiftedOrderHints {
+			if usedFrame[i] || (hint >= curFrameHint) != backward {
+				continue
+			}
+			if ref < 0 || latest && hint >= refHint || !latest && hint < refHint {
+				ref, refHint = i, hint
+			}
+		}
+		return ref
+	}
+	set := func(refFrame, ref int) {
+		if ref >= 0 {
+			refFrameIdx[refFrame] = ref
+			usedFrame[ref] = true
+		}
+	}
+	set(6, find(true, true))                        // ALTREF_FRAME
+	set(4, find(true, false))                       // BWDREF_FRAME
+	set(5, find(true, false))                       // ALTREF2_FRAME
+	for _, refFrame := range []int{1, 2, 4, 5, 6} { // Ref_Frame_List
+		if refFrameIdx[refFrame] < 0 {
+			set(refFrame, find(false, true))
+		}
+	}
+	ref := -1
+	var earliestOrderHint int32
+	for i, hint := range shiftedOrderHints {
+		if ref < 0 || hint < earliestOrderHint {
+			ref, earliestOrderHint = i, hint
+		}
+	}
+	var result [av1RefsPerFrame]uint32
+	for i, idx := range refFrameIdx {
+		if idx < 0 {
+			idx = ref
+		}
+		result[i] = uint32(idx)
+	}
+	return result
+}
+
+// skipModeAllowed returns skipModeAllowed defined at AV1 Bitstream & Decoding Process Specification 5.9.22.
+func (p *av1FrameHeaderParser) skipModeAllowed(refFrameIdx [av1RefsPerFrame]uint32, orderHint uint32) bool {
+	forwardIdx, backwardIdx := -1, -1
+	var forwardHint, backwardHint uint32
+	for i, idx := range refFrameIdx {
+		refHint := p.refs[idx].orderHint
+		if p.relativeDist(refHint, orderHint) < 0 {
+			if forwardIdx < 0 || p.relativeDist(refHint, forwardHint) > 0 {
+				forwardIdx, forwardHint = i, refHint
+			}
+		} else if p.relativeDist(refHint, orderHint) > 0 {
+			if backwardIdx < 0 || p.relativeDist(refHint, backwardHint) < 0 {
+				backwardIdx, backwardHint = i, refHint
+			}
+		}
+	}
+	if forwardIdx < 0 {
+		return false
+	} else if backwardIdx >= 0 {
+		return true
+	}
+	for _, idx := range refFrameIdx {
+		if p.relativeDist(p.refs[idx].orderHint, forwardHint) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTileGroup parses tile_group_obu defined at AV1 Bitstream & Decoding Process Specification 5.11.1,
+// and returns the number of the bytes of its header and the tiles.
+func (p *av1FrameHeaderParser) parseTileGroup(data []byte) (int, []av1Tile, error) {
+	fh := p.frame
+	if !p.seenFrameHeader || fh == nil {
+		return 0, nil, errors.New("AV1 tile group without frame header")
+	}
+	numTiles := fh.tileCols * fh.tileRows
+	r := newBitReader(data)
+	tgStart, tgEnd := 0, numTiles-1
+	if numTiles > 1 {
+		present, err := r.readFlag() // tile_start_and_end_present_flag
+		if err != nil {
+			return 0, nil, err
+		}
+		if present {
+			tileBits := fh.tileColsLog2 + fh.tileRowsLog2
+			start, err := r.readUint32(tileBits)
+			if err != nil {
+				return 0, nil, err
+			}
+			end, err := r.readUint32(tileBits)
+			if err != nil {
+				return 0, nil, err
+			}
+			tgStart, tgEnd = int(start), int(end)
+		}
+	}
+	if err := r.align(); err != nil {
+		return 0, nil, err
+	}
+	if tgEnd < tgStart || tgEnd >= numTiles {
+		return 0, nil, fmt.Errorf("invalid AV1 tile group: start=%d, end=%d", tgStart, tgEnd)
+	}
+	headerSize := r.read / 8
+	var tiles []av1Tile
+	for pos, tileNum := headerSize, tgStart; tileNum <= tgEnd; tileNum++ {
+		if tileNum == tgEnd {
+			tiles = append(tiles, av1Tile{size: len(data) - pos})
+			break
+		}
+		if pos+fh.tileSizeBytes > len(data) {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		var size int
+		for i := 0; i < fh.tileSizeBytes; i++ {
+			size |= int(data[pos+i]) << (8 * uint(i))
+		}
+		size += fh.tileSizeBytes + 1 // tile_size_minus_1
+		if pos+size > len(data) {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		tiles = append(tiles, av1Tile{sizeBytes: fh.tileSizeBytes, size: size})
+		pos += size
+	}
+	if tgEnd == numTiles-1 {
+		p.seenFrameHeader = false
+	}
+	return headerSize, tiles, nil
+}
+
+// av1TileLog2 returns tile_log2 defined at AV1 Bitstream & Decoding Process Specification 5.9.15.
+func av1TileLog2(blkSize, target uint32) uint {
+	var k uint
+	for uint64(blkSize)<<k < uint64(target) {
+		k++
+	}
+	return k
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,145 @@
+package mp4
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sequence header and frame header of AV1 Main profile, 320x180
+var (
+	testAV1SeqHeader = packBits(
+		[2]uint64{3, 0},    // seq_profile
+		[2]uint64{2, 0},    // still_picture, reduced_still_picture_header
+		[2]uint64{2, 0},    // timing_info_present_flag, initial_display_delay_present_flag
+		[2]uint64{5, 0},    // operating_points_cnt_minus_1
+		[2]uint64{12, 0},   // operating_point_idc[0]
+		[2]uint64{5, 8},    // seq_level_idx[0]
+		[2]uint64{1, 0},    // seq_tier[0]
+		[2]uint64{4, 9},    // frame_width_bits_minus_1
+		[2]uint64{4, 8},    // frame_height_bits_minus_1
+		[2]uint64{10, 319}, // max_frame_width_minus_1
+		[2]uint64{9, 179},  // max_frame_height_minus_1
+		[2]uint64{1, 0},    // frame_id_numbers_present_flag
+		[2]uint64{3, 0},    // use_128x128_superblock, enable_filter_intra, enable_intra_edge
+		[2]uint64{4, 0},    // enable_interintra_compound, enable_masked_compound, enable_warped_motion, enable_dual_filter
+		[2]uint64{1, 0},    // enable_order_hint
+		[2]uint64{2, 0},    // seq_choose_screen_content_tools, seq_force_screen_content_tools
+		[2]uint64{3, 0},    // enable_superres, enable_cdef, enable_restoration
+		[2]uint64{3, 0},    // high_bitdepth, mono_chrome, color_description_present_flag
+		[2]uint64{1, 0},    // color_range
+		[2]uint64{2, 0},    // chroma_sample_position
+		[2]uint64{2, 0},    // separate_uv_delta_q, film_grain_params_present
+		[2]uint64{1, 1},    // trailing_one_bit
+	)
+	testAV1FrameHeader = packBits(
+		[2]uint64{4, 1},   // show_existing_frame, frame_type (KEY_FRAME), show_frame
+		[2]uint64{3, 0},   // disable_cdf_update, frame_size_override_flag, render_and_frame_size_different
+		[2]uint64{1, 0},   // disable_frame_end_update_cdf
+		[2]uint64{3, 4},   // uniform_tile_spacing_flag, increment_tile_cols_log2, increment_tile_rows_log2
+		[2]uint64{8, 100}, // base_q_idx
+		[2]uint64{4, 0},   // DeltaQYDc, DeltaQUDc, DeltaQUAc, using_qmatrix
+		[2]uint64{2, 0},   // segmentation_enabled, delta_q_present
+		[2]uint64{12, 0},  // loop_filter_level[0], loop_filter_level[1]
+		[2]uint64{4, 0},   // loop_filter_sharpness, loop_filter_delta_enabled
+		[2]uint64{2, 0},   // tx_mode_select, reduced_tx_set
+	)
+)
+
+func TestParseAV1SequenceHeader(t *testing.T) {
+	obu := append([]byte{0x0a, byte(len(testAV1SeqHeader))}, testAV1SeqHeader...)
+	sh, err := parseAV1SequenceHeader(obu)
+	require.NoError(t, err)
+	assert.Equal(t, uint(10), sh.frameWidthBits)
+	assert.Equal(t, uint(9), sh.frameHeightBits)
+	assert.Equal(t, uint32(320), sh.maxFrameWidth)
+	assert.Equal(t, uint32(180), sh.maxFrameHeight)
+	assert.False(t, sh.enableOrderHint)
+	assert.Equal(t, uint32(0), sh.seqForceScreenContentTools)
+	assert.Equal(t, uint32(av1SelectTools), sh.seqForceIntegerMV)
+	assert.Equal(t, uint8(0), sh.av1C.SeqProfile)
+	assert.Equal(t, uint8(8), sh.av1C.SeqLevelIdx0)
+	assert.Equal(t, uint8(1), sh.av1C.ChromaSubsamplingX)
+	assert.Equal(t, uint8(1), sh.av1C.ChromaSubsamplingY)
+	assert.Equal(t, obu, sh.av1C.ConfigOBUs)
+
+	_, err = parseAV1SequenceHeader(nil)
+	assert.Error(t, err)
+	_, err = parseAV1SequenceHeader(obu[:6])
+	assert.Error(t, err)
+}
+
+func TestAV1FrameHeaderParser(t *testing.T) {
+	seq, err := parseAV1SequenceHeader(append([]byte{0x0a, byte(len(testAV1SeqHeader))}, testAV1SeqHeader...))
+	require.NoError(t, err)
+
+	t.Run("single tile", func(t *testing.T) {
+		p := &av1FrameHeaderParser{seq: seq}
+		n, err := p.parseFrameHeader(testAV1FrameHeader, 0, 0)
+		require.NoError(t, err)
+		assert.Equal(t, len(testAV1FrameHeader), n)
+		assert.Equal(t, 1, p.frame.tileCols)
+		assert.Equal(t, 1, p.frame.tileRows)
+		// a key frame refreshes all of the reference frames
+		for _, ref := range p.refs {
+			assert.Equal(t, uint32(320), ref.frameWidth)
+			assert.Equal(t, uint32(180), ref.frameHeight)
+			assert.Equal(t, uint32(320), ref.upscaledWidth)
+		}
+
+		headerSize, tiles, err := p.parseTileGroup(make([]byte, 10))
+		require.NoError(t, err)
+		assert.Equal(t, 0, headerSize)
+		assert.Equal(t, []av1Tile{{size: 10}}, tiles)
+
+		// the tile group closes the frame
+		_, _, err = p.parseTileGroup(make([]byte, 10))
+		assert.Error(t, err, "AV1 tile group without frame header")
+	})
+
+	t.Run("two tiles", func(t *testing.T) {
+		p := &av1FrameHeaderParser{seq: seq}
+		fh := packBits(
+			[2]uint64{4, 1},   // show_existing_frame, frame_type (KEY_FRAME), show_frame
+			[2]uint64{3, 0},   // disable_cdf_update, frame_size_override_flag, render_and_frame_size_different
+			[2]uint64{1, 0},   // disable_frame_end_update_cdf
+			[2]uint64{4, 12},  // uniform_tile_spacing_flag, increment_tile_cols_log2 (1, 0), increment_tile_rows_log2
+			[2]uint64{1, 0},   // context_update_tile_id
+			[2]uint64{2, 1},   // tile_size_bytes_minus_1
+			[2]uint64{8, 100}, // base_q_idx
+			[2]uint64{4, 0},   // DeltaQYDc, DeltaQUDc, DeltaQUAc, using_qmatrix
+			[2]uint64{2, 0},   // segmentation_enabled, delta_q_present
+			[2]uint64{12, 0},  // loop_filter_level[0], loop_filter_level[1]
+			[2]uint64{4, 0},   // loop_filter_sharpness, loop_filter_delta_enabled
+			[2]uint64{2, 0},   // tx_mode_select, reduced_tx_set
+		)
+		n, err := p.parseFrameHeader(fh, 0, 0)
+		require.NoError(t, err)
+		assert.Equal(t, len(fh), n)
+		assert.Equal(t, 2, p.frame.tileCols)
+		assert.Equal(t, 1, p.frame.tileRows)
+		assert.Equal(t, 2, p.frame.tileSizeBytes)
+
+		tg := []byte{
+			0x00,       // tile_start_and_end_present_flag
+			0x03, 0x00, // tile_size_minus_1
+			0x01, 0x02, 0x03, 0x04,
+			0x05, 0x06, 0x07, 0x08, 0x09,
+		}
+		_, _, err = p.parseTileGroup(tg[:4])
+		assert.Error(t, err)
+		headerSize, tiles, err := p.parseTileGroup(tg)
+		require.NoError(t, err)
+		assert.Equal(t, 1, headerSize)
+		assert.Equal(t, []av1Tile{{sizeBytes: 2, size: 6}, {size: 5}}, tiles)
+	})
+
+	t.Run("no sequence header", func(t *testing.T) {
+		p := &av1FrameHeaderParser{}
+		_, err := p.parseFrameHeader(testAV1FrameHeader, 0, 0)
+		assert.Error(t, err, "AV1 sequence header not found")
+		_, _, err = p.parseTileGroup(make([]byte, 10))
+		assert.Error(t, err, "AV1 tile group without frame header")
+	})
+}
@@ -29,6 +29,9 @@ type Context struct {
 
 	// UnderUdta represents whether current box is under the udta box.
 	UnderUdta bool
+
+	// UnderTref represents whether current box is under the tref box.
+	UnderTref bool
 }
 
 // BoxInfo has common infomations of box
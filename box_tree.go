@@ -0,0 +1,402 @@
+package mp4
+
+import (
+	"errors"
+	"io"
+)
+
+// BoxNode is a box held in memory with its payload and children.
+// Payloads of mdat boxes and unsupported boxes are not loaded; they refer to the source and are copied on writing.
+type BoxNode struct {
+	// Info is the header of the box. Offset, Size and HeaderSize are updated when the node is written.
+	Info BoxInfo
+
+	// Payload is the parsed payload. It is nil for mdat boxes and unsupported boxes.
+	Payload IBox
+
+	Children []*BoxNode
+	Parent   *BoxNode
+
+	// raw payload which is used when Payload is nil
+	data      []byte
+	src       io.ReadSeeker
+	srcOffset uint64
+	srcSize   uint64
+
+	// position where the payload offsets refer to the box
+	origOffset     uint64
+	origSize       uint64
+	origHeaderSize uint64
+	hasOrig        bool
+}
+
+// BoxTree is the whole box structure of a file.
+// The embedded BoxNode is a virtual root node which has only children.
+type BoxTree struct {
+	BoxNode
+}
+
+// NewBoxNode returns a new node holding the box.
+func NewBoxNode(box IBox, children ...*BoxNode) *BoxNode {
+	n := &BoxNode{
+		Info:    BoxInfo{Type: box.GetType()},
+		Payload: box,
+	}
+	for _, c := range children {
+		n.AppendChild(c)
+	}
+	return n
+}
+
+// NewRawBoxNode returns a new node which has the raw payload.
+func NewRawBoxNode(boxType BoxType, data []byte) *BoxNode {
+	return &BoxNode{
+		Info: BoxInfo{Type: boxType},
+		data: data,
+	}
+}
+
+// ReadBoxTree reads the box structure of the whole file into memory.
+func ReadBoxTree(r io.ReadSeeker) (*BoxTree, error) {
+	tree := &BoxTree{}
+	vals, err := ReadBoxStructure(r, newBoxTreeHandler(r))
+	if err != nil {
+		return nil, err
+	}
+	for _, val := range vals {
+		tree.AppendChild(val.(*BoxNode))
+	}
+	return tree, nil
+}
+
+// ReadBoxSubtree reads the box specified by bi and its descendants into memory.
+func ReadBoxSubtree(r io.ReadSeeker, bi *BoxInfo) (*BoxNode, error) {
+	val, err := ReadBoxStructureFromInternal(r, bi, newBoxTreeHandler(r))
+	if err != nil {
+		return nil, err
+	}
+	return val.(*BoxNode), nil
+}
+
+func newBoxTreeHandler(r io.ReadSeeker) ReadHandler {
+	return func(h *ReadHandle) (interface{}, error) {
+		n := &BoxNode{Info: h.BoxInfo}
+		if h.BoxInfo.IsSupportedType() && h.BoxInfo.Type != BoxTypeMdat() {
+			box, _, err := h.ReadPayload()
+			if err == nil {
+				n.Payload = box
+				vals, err := h.Expand()
+				if err != nil {
+					return nil, err
+				}
+				for _, val := range vals {
+					n.AppendChild(val.(*BoxNode))
+				}
+				n.setOrigin()
+				return n, nil
+			} else if err != ErrUnsupportedBoxVersion {
+				return nil, err
+			}
+		}
+		n.src = r
+		n.srcOffset = h.BoxInfo.Offset + h.BoxInfo.HeaderSize
+		n.srcSize = h.BoxInfo.Size - h.BoxInfo.HeaderSize
+		if h.BoxInfo.ExtendToEOF {
+			end, err := r.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, err
+			}
+			n.srcSize = uint64(end) - n.srcOffset
+		}
+		n.setOrigin()
+		return n, nil
+	}
+}
+
+func (n *BoxNode) setOrigin() {
+	n.origOffset = n.Info.Offset
+	n.origSize = n.Info.Size
+	n.origHeaderSize = n.Info.HeaderSize
+	if n.src != nil {
+		n.origSize = n.srcOffset + n.srcSize - n.Info.Offset
+	}
+	n.hasOrig = true
+}
+
+// IsRaw returns true when the payload is not parsed.
+func (n *BoxNode) IsRaw() bool {
+	return n.Payload == nil
+}
+
+// SetData replaces the payload by the raw data. Payload and Children are cleared.
+func (n *BoxNode) SetData(data []byte) {
+	n.Payload = nil
+	n.Children = nil
+	n.data = data
+	n.src = nil
+}
+
+// rawSize returns the size of the raw payload.
+func (n *BoxNode) rawSize() uint64 {
+	if n.src != nil {
+		return n.srcSize
+	}
+	return uint64(len(n.data))
+}
+
+// ReadData writes the raw payload to w.
+func (n *BoxNode) ReadData(w io.Writer) (uint64, error) {
+	if n.src == nil {
+		c, err := w.Write(n.data)
+		return uint64(c), err
+	}
+	if _, err := n.src.Seek(int64(n.srcOffset), io.SeekStart); err != nil {
+		return 0, err
+	}
+	c, err := io.CopyN(w, n.src, int64(n.srcSize))
+	return uint64(c), err
+}
+
+// AppendChild adds the child to the end of the children.
+func (n *BoxNode) AppendChild(child *BoxNode) {
+	n.InsertChild(len(n.Children), child)
+}
+
+// InsertChild inserts the child at the index i of the children.
+func (n *BoxNode) InsertChild(i int, child *BoxNode) {
+	if child.Parent != nil {
+		child.Remove()
+	}
+	n.Children = append(n.Children, nil)
+	copy(n.Children[i+1:], n.Children[i:])
+	n.Children[i] = child
+	child.Parent = n
+	child.setContext(n)
+}
+
+// InsertBefore inserts the node before the sibling ref.
+func (n *BoxNode) InsertBefore(ref, child *BoxNode) error {
+	i := n.indexOf(ref)
+	if i < 0 {
+		return errors.New("reference node is not a child")
+	}
+	n.InsertChild(i, child)
+	return nil
+}
+
+// InsertAfter inserts the node after the sibling ref.
+func (n *BoxNode) InsertAfter(ref, child *BoxNode) error {
+	i := n.indexOf(ref)
+	if i < 0 {
+		return errors.New("reference node is not a child")
+	}
+	n.InsertChild(i+1, child)
+	return nil
+}
+
+// RemoveChild removes the child. It returns false when the node is not a child.
+func (n *BoxNode) RemoveChild(child *BoxNode) bool {
+	i := n.indexOf(child)
+	if i < 0 {
+		return false
+	}
+	n.Children = append(n.Children[:i], n.Children[i+1:]...)
+	child.Parent = nil
+	return true
+}
+
+// Remove removes the node from its parent.
+func (n *BoxNode) Remove() {
+	if n.Parent != nil {
+		n.Parent.RemoveChild(n)
+	}
+}
+
+// Replace replaces the node by another node in its parent.
+func (n *BoxNode) Replace(node *BoxNode) error {
+	parent := n.Parent
+	if parent == nil {
+		return errors.New("node has no parent")
+	}
+	if node.Parent != nil {
+		node.Remove()
+	}
+	i := parent.indexOf(n)
+	parent.Children[i] = node
+	node.Parent = parent
+	node.setContext(parent)
+	n.Parent = nil
+	return nil
+}
+
+// setContext updates the context of the subtree according to the new parent.
+func (n *BoxNode) setContext(parent *BoxNode) {
+	// boxes which are defined only under the specific boxes require the context to be marshaled
+	n.Info.Context.UnderUdta = parent.Info.Context.UnderUdta || parent.Info.Type == BoxTypeUdta()
+	n.Info.Context.UnderTref = parent.Info.Context.UnderTref || parent.Info.Type == BoxTypeTref()
+	for _, c := range n.Children {
+		c.setContext(n)
+	}
+}
+
+func (n *BoxNode) indexOf(child *BoxNode) int {
+	for i := range n.Children {
+		if n.Children[i] == child {
+			return i
+		}
+	}
+	return -1
+}
+
+// Find returns the descendants which match the path relative to the node.
+func (n *BoxNode) Find(path BoxPath) []*BoxNode {
+	if len(path) == 0 {
+		return nil
+	}
+	var nodes []*BoxNode
+	for _, c := range n.Children {
+		if !c.Info.Type.MatchWith(path[0]) {
+			continue
+		}
+		if len(path) == 1 {
+			nodes = append(nodes, c)
+		} else {
+			nodes = append(nodes, c.Find(path[1:])...)
+		}
+	}
+	return nodes
+}
+
+// FindFirst returns the first descendant which matches the path, or nil if not found.
+func (n *BoxNode) FindFirst(path BoxPath) *BoxNode {
+	if nodes := n.Find(path); len(nodes) != 0 {
+		return nodes[0]
+	}
+	return nil
+}
+
+// Walk calls fn for the node's descendants in depth-first order.
+// The children of a node are skipped when fn returns false.
+func (n *BoxNode) Walk(fn func(node *BoxNode) bool) {
+	for _, c := range n.Children {
+		if fn(c) {
+			c.Walk(fn)
+		}
+	}
+}
+
+// Write writes the node and its descendants. Box sizes are recomputed.
+func (n *BoxNode) Write(w *Writer) error {
+	info := n.Info
+	if info.HeaderSize == 0 {
+		info.HeaderSize = SmallHeaderSize
+	}
+	if n.Payload == nil {
+		// the size of the raw payload is known, so that the payload is not buffered by streaming writers
+		info.Size = info.HeaderSize + n.rawSize()
+		if _, err := w.StartFixedSizeBox(&info); err != nil {
+			return err
+		}
+	} else if _, err := w.StartBox(&info); err != nil {
+		return err
+	}
+	if n.Payload != nil {
+		if _, err := Marshal(w, n.Payload, n.Info.Context); err != nil {
+			return err
+		}
+		for _, c := range n.Children {
+			if err := c.Write(w); err != nil {
+				return err
+			}
+		}
+	} else if _, err := n.ReadData(w); err != nil {
+		return err
+	}
+	bi, err := w.EndBox()
+	if err != nil {
+		return err
+	}
+	n.Info.Offset = bi.Offset
+	n.Info.Size = bi.Size
+	n.Info.HeaderSize = bi.HeaderSize
+	return nil
+}
+
+// Write writes all boxes of the tree.
+// The offsets held in the payloads are updated by Relocate before writing.
+func (t *BoxTree) Write(w *Writer) error {
+	offset, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := t.Relocate(uint64(offset)); err != nil {
+		return err
+	}
+	for _, c := range t.Children {
+		if err := c.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTo writes all boxes of the tree to w which is not required to be seekable.
+// Box sizes are computed in advance, and the offsets are relocated assuming that w is at the start of the file.
+func (t *BoxTree) WriteTo(w io.Writer) (int64, error) {
+	if err := t.Relocate(0); err != nil {
+		return 0, err
+	}
+	ow := &offsetWriter{writer: w}
+	for _, c := range t.Children {
+		if err := c.writeTo(ow); err != nil {
+			return ow.offset, err
+		}
+	}
+	return ow.offset, nil
+}
+
+func (n *BoxNode) writeTo(w *offsetWriter) error {
+	if _, err := WriteBoxInfo(w, &n.Info); err != nil {
+		return err
+	}
+	if n.Payload == nil {
+		_, err := n.ReadData(w)
+		return err
+	}
+	if _, err := Marshal(w, n.Payload, n.Info.Context); err != nil {
+		return err
+	}
+	for _, c := range n.Children {
+		if err := c.writeTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNode computes the layout of the node at the current offset and writes it.
+func (w *offsetWriter) writeNode(n *BoxNode) error {
+	if _, err := n.layout(uint64(w.offset)); err != nil {
+		return err
+	}
+	return n.writeTo(w)
+}
+
+// offsetWriter counts written bytes to tell the current offset to WriteBoxInfo.
+type offsetWriter struct {
+	writer io.Writer
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.offset += int64(n)
+	return n, err
+}
+
+func (w *offsetWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekCurrent {
+		return 0, errors.New("offsetWriter does not support seeking")
+	}
+	return w.offset, nil
+}
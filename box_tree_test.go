@@ -0,0 +1,188 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+)
+
+func TestBoxTreeRoundTrip(t *testing.T) {
+	for _, name := range []string{"sample.mp4", "sample_fragmented.mp4", "sample_qt.mp4"} {
+		t.Run(name, func(t *testing.T) {
+			input, err := os.ReadFile("./testdata/" + name)
+			require.NoError(t, err)
+
+			tree, err := ReadBoxTree(bytes.NewReader(input))
+			require.NoError(t, err)
+			for _, mdat := range tree.Find(BoxPath{BoxTypeMdat()}) {
+				assert.True(t, mdat.IsRaw())
+			}
+			assert.False(t, tree.FindFirst(BoxPath{BoxTypeMoov()}).IsRaw())
+
+			output, err := memfs.New().Create("output.mp4")
+			require.NoError(t, err)
+			defer output.Close()
+			require.NoError(t, tree.Write(NewWriter(output)))
+
+			_, err = output.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			actual, err := io.ReadAll(output)
+			require.NoError(t, err)
+			if name == "sample_qt.mp4" {
+				// descriptor sizes of esds box are re-encoded in 4 bytes
+				assert.Equal(t, len(input)+12, len(actual))
+				expected, err := Probe(bytes.NewReader(input))
+				require.NoError(t, err)
+				info, err := Probe(bytes.NewReader(actual))
+				require.NoError(t, err)
+				assert.Equal(t, expected.Tracks[0].Samples, info.Tracks[0].Samples)
+				return
+			}
+			assert.Equal(t, input, actual)
+		})
+	}
+}
+
+func TestBoxTreeEdit(t *testing.T) {
+	f, err := os.Open("./testdata/sample.mp4")
+	require.NoError(t, err)
+	defer f.Close()
+
+	tree, err := ReadBoxTree(f)
+	require.NoError(t, err)
+	moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+	require.NotNil(t, moov)
+	traks := moov.Find(BoxPath{BoxTypeTrak()})
+	require.Len(t, traks, 2)
+	assert.Len(t, tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeAny(), BoxTypeMdhd()}), 2)
+
+	// remove audio track
+	traks[1].Remove()
+	assert.Nil(t, traks[1].Parent)
+	assert.Len(t, moov.Find(BoxPath{BoxTypeTrak()}), 1)
+
+	// insert a box before moov, and replace udta by an unknown box
+	free := NewRawBoxNode(BoxTypeSkip(), []byte{1, 2, 3, 4})
+	require.NoError(t, tree.InsertBefore(moov, free))
+	udta := moov.FindFirst(BoxPath{BoxTypeUdta()})
+	require.NotNil(t, udta)
+	require.NoError(t, udta.Replace(NewRawBoxNode(StrToBoxType("test"), []byte{5, 6})))
+
+	// update mvhd
+	mvhd := moov.FindFirst(BoxPath{BoxTypeMvhd()}).Payload.(*Mvhd)
+	mvhd.NextTrackID = 2
+
+	// replace edts box
+	edts := NewBoxNode(&Edts{}, NewBoxNode(&Elst{
+		EntryCount: 1,
+		Entries:    []ElstEntry{{SegmentDurationV0: 100, MediaTimeV0: 0, MediaRateInteger: 1}},
+	}))
+	require.NoError(t, traks[0].FindFirst(BoxPath{BoxTypeEdts()}).Replace(edts))
+
+	output, err := memfs.New().Create("output.mp4")
+	require.NoError(t, err)
+	defer output.Close()
+	require.NoError(t, tree.Write(NewWriter(output)))
+	assert.Equal(t, uint64(12), free.Info.Size)
+	assert.Equal(t, moov.Info.Offset, free.Info.Offset+free.Info.Size)
+
+	bis, err := ExtractBoxes(output, nil, []BoxPath{
+		{BoxTypeSkip()},
+		{BoxTypeMoov()},
+		{BoxTypeMoov(), BoxTypeTrak()},
+		{BoxTypeMoov(), StrToBoxType("test")},
+		{BoxTypeMoov(), BoxTypeTrak(), BoxTypeEdts(), BoxTypeElst()},
+	})
+	require.NoError(t, err)
+	require.Len(t, bis, 5)
+	for _, bi := range bis {
+		switch bi.Type {
+		case BoxTypeSkip():
+			assert.Equal(t, free.Info.Offset, bi.Offset)
+		case BoxTypeMoov():
+			assert.Equal(t, moov.Info.Size, bi.Size)
+		case BoxTypeTrak():
+			assert.Equal(t, traks[0].Info.Size, bi.Size)
+		case BoxTypeElst():
+			assert.Equal(t, edts.Children[0].Info.Offset, bi.Offset)
+		default:
+			assert.Equal(t, uint64(10), bi.Size)
+		}
+	}
+
+	info, err := Probe(output)
+	require.NoError(t, err)
+	require.Len(t, info.Tracks, 1)
+	require.Len(t, info.Tracks[0].EditList, 1)
+	assert.Equal(t, uint64(100), info.Tracks[0].EditList[0].SegmentDuration)
+
+	// subtree
+	bis, err = ExtractBox(output, nil, BoxPath{BoxTypeMoov()})
+	require.NoError(t, err)
+	require.Len(t, bis, 1)
+	subtree, err := ReadBoxSubtree(output, bis[0])
+	require.NoError(t, err)
+	assert.Equal(t, BoxTypeMoov(), subtree.Info.Type)
+	require.Len(t, subtree.Find(BoxPath{BoxTypeTrak(), BoxTypeEdts(), BoxTypeElst()}), 1)
+	assert.Equal(t, uint32(100), subtree.FindFirst(BoxPath{BoxTypeTrak(), BoxTypeEdts(), BoxTypeElst()}).Payload.(*Elst).Entries[0].SegmentDurationV0)
+}
+
+func TestBoxNodeChildren(t *testing.T) {
+	a := NewRawBoxNode(StrToBoxType("aaaa"), nil)
+	b := NewRawBoxNode(StrToBoxType("bbbb"), nil)
+	c := NewRawBoxNode(StrToBoxType("cccc"), nil)
+	d := NewRawBoxNode(StrToBoxType("dddd"), nil)
+	parent := NewBoxNode(&Moov{}, a, c)
+	require.NoError(t, parent.InsertAfter(a, b))
+	require.NoError(t, parent.InsertBefore(a, d))
+	assert.Equal(t, []*BoxNode{d, a, b, c}, parent.Children)
+
+	other := NewBoxNode(&Moov{})
+	other.AppendChild(b)
+	assert.Equal(t, []*BoxNode{d, a, c}, parent.Children)
+	assert.Equal(t, other, b.Parent)
+	assert.Error(t, parent.InsertBefore(b, NewRawBoxNode(StrToBoxType("eeee"), nil)))
+
+	require.NoError(t, a.Replace(b))
+	assert.Equal(t, []*BoxNode{d, b, c}, parent.Children)
+	assert.Empty(t, other.Children)
+	assert.Nil(t, a.Parent)
+	assert.Error(t, a.Replace(d))
+
+	assert.True(t, parent.RemoveChild(d))
+	assert.False(t, parent.RemoveChild(d))
+	assert.Equal(t, []*BoxNode{b, c}, parent.Children)
+
+	var visited []*BoxNode
+	NewBoxNode(&Moov{}, NewBoxNode(&Trak{}, a), b).Walk(func(n *BoxNode) bool {
+		visited = append(visited, n)
+		return n.Info.Type != BoxTypeTrak()
+	})
+	require.Len(t, visited, 2)
+	assert.Equal(t, BoxTypeTrak(), visited[0].Info.Type)
+	assert.Equal(t, b, visited[1])
+}
+
+func TestBoxNodeContext(t *testing.T) {
+	leaf := NewRawBoxNode(StrToBoxType("leaf"), nil)
+	meta := NewBoxNode(&Meta{}, leaf)
+	udta := NewBoxNode(&Udta{}, meta)
+	moov := NewBoxNode(&Moov{}, udta)
+	assert.False(t, udta.Info.Context.UnderUdta)
+	assert.True(t, meta.Info.Context.UnderUdta)
+	assert.True(t, leaf.Info.Context.UnderUdta)
+
+	// a subtree moved from udta to tref
+	old := NewRawBoxNode(StrToBoxType("hint"), nil)
+	moov.AppendChild(NewBoxNode(&Tref{}, old))
+	require.NoError(t, old.Replace(meta))
+	for _, n := range []*BoxNode{meta, leaf} {
+		assert.False(t, n.Info.Context.UnderUdta)
+		assert.True(t, n.Info.Context.UnderTref)
+	}
+}
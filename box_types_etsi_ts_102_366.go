@@ -34,3 +34,13 @@ type Dac3 struct {
 func (Dac3) GetType() BoxType {
 	return BoxTypeDAC3()
 }
+
+/*************************** ec-3 ****************************/
+
+// https://www.etsi.org/deliver/etsi_ts/102300_102399/102366/01.04.01_60/ts_102366v010401p.pdf
+
+func BoxTypeEC3() BoxType { return StrToBoxType("ec-3") }
+
+func init() {
+	AddAnyTypeBoxDef(&AudioSampleEntry{}, BoxTypeEC3())
+}
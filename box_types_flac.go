@@ -0,0 +1,61 @@
+package mp4
+
+import "fmt"
+
+/*************************** fLaC ****************************/
+
+// https://github.com/xiph/flac/blob/master/doc/isoflac.txt
+
+func BoxTypeFLaC() BoxType { return StrToBoxType("fLaC") }
+
+func init() {
+	AddAnyTypeBoxDef(&AudioSampleEntry{}, BoxTypeFLaC())
+}
+
+/*************************** dfLa ****************************/
+
+// https://github.com/xiph/flac/blob/master/doc/isoflac.txt
+
+func BoxTypeDfLa() BoxType { return StrToBoxType("dfLa") }
+
+func init() {
+	AddBoxDef(&DfLa{}, 0)
+}
+
+const (
+	FLACMetadataBlockTypeStreamInfo    = 0
+	FLACMetadataBlockTypePadding       = 1
+	FLACMetadataBlockTypeApplication   = 2
+	FLACMetadataBlockTypeSeekTable     = 3
+	FLACMetadataBlockTypeVorbisComment = 4
+	FLACMetadataBlockTypeCueSheet      = 5
+	FLACMetadataBlockTypePicture       = 6
+)
+
+// DfLa is FLAC specific box, which contains the metadata blocks of FLAC stream header.
+// The first block must be STREAMINFO.
+type DfLa struct {
+	FullBox        `mp4:"0,extend"`
+	MetadataBlocks []FLACMetadataBlock `mp4:"1,array"`
+}
+
+func (DfLa) GetType() BoxType {
+	return BoxTypeDfLa()
+}
+
+type FLACMetadataBlock struct {
+	BaseCustomFieldObject
+	LastMetadataBlockFlag bool   `mp4:"0,size=1"`
+	BlockType             uint8  `mp4:"1,size=7"`
+	Length                uint32 `mp4:"2,size=24"`
+	BlockData             []byte `mp4:"3,size=8,len=dynamic"`
+}
+
+// GetFieldLength returns length of dynamic field
+func (b *FLACMetadataBlock) GetFieldLength(name string, ctx Context) uint {
+	switch name {
+	case "BlockData":
+		return uint(b.Length)
+	}
+	panic(fmt.Errorf("invalid name of dynamic-length field: boxType=dfLa fieldName=%s", name))
+}
@@ -0,0 +1,72 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoxTypesFLAC(t *testing.T) {
+	testCases := []struct {
+		name string
+		src  IImmutableBox
+		dst  IBox
+		bin  []byte
+		str  string
+		ctx  Context
+	}{
+		{
+			name: "dfLa",
+			src: &DfLa{
+				MetadataBlocks: []FLACMetadataBlock{
+					{BlockType: FLACMetadataBlockTypeStreamInfo, Length: 4, BlockData: []byte{0x10, 0x00, 0x10, 0x00}},
+					{LastMetadataBlockFlag: true, BlockType: FLACMetadataBlockTypePadding, Length: 2, BlockData: []byte{0x00, 0x00}},
+				},
+			},
+			dst: &DfLa{},
+			bin: []byte{
+				0x00, 0x00, 0x00, 0x00, // version & flags
+				0x00, 0x00, 0x00, 0x04, 0x10, 0x00, 0x10, 0x00,
+				0x81, 0x00, 0x00, 0x02, 0x00, 0x00,
+			},
+			str: `Version=0 Flags=0x000000 MetadataBlocks=[{LastMetadataBlockFlag=false BlockType=0x0 Length=4 BlockData=[0x10, 0x0, 0x10, 0x0]}, {LastMetadataBlockFlag=true BlockType=0x1 Length=2 BlockData=[0x0, 0x0]}]`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Marshal
+			buf := bytes.NewBuffer(nil)
+			n, err := Marshal(buf, tc.src, tc.ctx)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(len(tc.bin)), n)
+			assert.Equal(t, tc.bin, buf.Bytes())
+
+			// Unmarshal
+			r := bytes.NewReader(tc.bin)
+			n, err = Unmarshal(r, uint64(len(tc.bin)), tc.dst, tc.ctx)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(buf.Len()), n)
+			assert.Equal(t, tc.src, tc.dst)
+			s, err := r.Seek(0, io.SeekCurrent)
+			require.NoError(t, err)
+			assert.Equal(t, int64(buf.Len()), s)
+
+			// UnmarshalAny
+			dst, n, err := UnmarshalAny(bytes.NewReader(tc.bin), tc.src.GetType(), uint64(len(tc.bin)), tc.ctx)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(buf.Len()), n)
+			assert.Equal(t, tc.src, dst)
+			s, err = r.Seek(0, io.SeekCurrent)
+			require.NoError(t, err)
+			assert.Equal(t, int64(buf.Len()), s)
+
+			// Stringify
+			str, err := Stringify(tc.src, tc.ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tc.str, str)
+		})
+	}
+}
@@ -1123,6 +1123,24 @@ func (mvhd *Mvhd) GetRateInt() int16 {
 	return int16(mvhd.Rate >> 16)
 }
 
+/*************************** nmhd ****************************/
+
+func BoxTypeNmhd() BoxType { return StrToBoxType("nmhd") }
+
+func init() {
+	AddBoxDef(&Nmhd{}, 0)
+}
+
+// Nmhd is ISOBMFF nmhd box type
+type Nmhd struct {
+	FullBox `mp4:"0,extend"`
+}
+
+// GetType returns the BoxType
+func (*Nmhd) GetType() BoxType {
+	return BoxTypeNmhd()
+}
+
 /*************************** saio ****************************/
 
 func BoxTypeSaio() BoxType { return StrToBoxType("saio") }
@@ -1845,6 +1863,24 @@ func (stco *Stco) GetFieldLength(name string, ctx Context) uint {
 	panic(fmt.Errorf("invalid name of dynamic-length field: boxType=stco fieldName=%s", name))
 }
 
+/*************************** sthd ****************************/
+
+func BoxTypeSthd() BoxType { return StrToBoxType("sthd") }
+
+func init() {
+	AddBoxDef(&Sthd{}, 0)
+}
+
+// Sthd is ISOBMFF sthd box type
+type Sthd struct {
+	FullBox `mp4:"0,extend"`
+}
+
+// GetType returns the BoxType
+func (*Sthd) GetType() BoxType {
+	return BoxTypeSthd()
+}
+
 /*************************** stsc ****************************/
 
 func BoxTypeStsc() BoxType { return StrToBoxType("stsc") }
@@ -2013,6 +2049,71 @@ func (*Styp) GetType() BoxType {
 	return BoxTypeStyp()
 }
 
+/*************************** subs ****************************/
+
+func BoxTypeSubs() BoxType { return StrToBoxType("subs") }
+
+func init() {
+	AddBoxDef(&Subs{}, 0, 1)
+}
+
+// Subs is ISOBMFF subs box type
+type Subs struct {
+	FullBox    `mp4:"0,extend"`
+	EntryCount uint32      `mp4:"1,size=32"`
+	Entries    []SubsEntry `mp4:"2,len=dynamic"`
+}
+
+type SubsEntry struct {
+	BaseCustomFieldObject
+	SampleDelta    uint32          `mp4:"0,size=32"`
+	SubsampleCount uint16          `mp4:"1,size=16"`
+	Subsamples     []SubsSubsample `mp4:"2,len=dynamic"`
+}
+
+type SubsSubsample struct {
+	SubsampleSizeV0         uint16 `mp4:"0,size=16,ver=0"`
+	SubsampleSizeV1         uint32 `mp4:"1,size=32,ver=1"`
+	SubsamplePriority       uint8  `mp4:"2,size=8"`
+	Discardable             uint8  `mp4:"3,size=8"`
+	CodecSpecificParameters uint32 `mp4:"4,size=32"`
+}
+
+// GetType returns the BoxType
+func (*Subs) GetType() BoxType {
+	return BoxTypeSubs()
+}
+
+// GetFieldLength returns length of dynamic field
+func (subs *Subs) GetFieldLength(name string, ctx Context) uint {
+	switch name {
+	case "Entries":
+		return uint(subs.EntryCount)
+	}
+	panic(fmt.Errorf("invalid name of dynamic-length field: boxType=subs fieldName=%s", name))
+}
+
+// GetFieldLength returns length of dynamic field
+func (entry *SubsEntry) GetFieldLength(name string, ctx Context) uint {
+	switch name {
+	case "Subsamples":
+		return uint(entry.SubsampleCount)
+	}
+	panic(fmt.Errorf("invalid name of dynamic-length field: boxType=subs fieldName=%s", name))
+}
+
+// GetSubsampleSize returns the size of the subsample
+func (subs *Subs) GetSubsampleSize(entry, subsample int) uint32 {
+	switch subs.GetVersion() {
+	case 0:
+		return uint32(subs.Entries[entry].Subsamples[subsample].SubsampleSizeV0)
+	case 1:
+		return subs.Entries[entry].Subsamples[subsample].SubsampleSizeV1
+	default:
+		return 0
+	}
+}
+
 /*************************** tfdt ****************************/
 
 func BoxTypeTfdt() BoxType { return StrToBoxType("tfdt") }
@@ -2312,6 +2413,56 @@ func (*Trak) GetType() BoxType {
 	return BoxTypeTrak()
 }
 
+/*************************** tref ****************************/
+
+func BoxTypeTref() BoxType { return StrToBoxType("tref") }
+
+func init() {
+	AddBoxDef(&Tref{})
+}
+
+// Tref is ISOBMFF tref box type
+type Tref struct {
+	Box
+}
+
+// GetType returns the BoxType
+func (*Tref) GetType() BoxType {
+	return BoxTypeTref()
+}
+
+var trackReferenceTypes = []BoxType{
+	StrToBoxType("hint"),
+	StrToBoxType("cdsc"),
+	StrToBoxType("font"),
+	StrToBoxType("hind"),
+	StrToBoxType("vdep"),
+	StrToBoxType("vplx"),
+	StrToBoxType("subt"),
+	StrToBoxType("thmb"),
+	StrToBoxType("auxl"),
+	StrToBoxType("chap"),
+	StrToBoxType("sync"),
+	StrToBoxType("tmcd"),
+	StrToBoxType("forc"),
+}
+
+func init() {
+	for _, bt := range trackReferenceTypes {
+		AddAnyTypeBoxDefEx(&TrackReferenceType{}, bt, isUnderTref)
+	}
+}
+
+// TrackReferenceType is a box in tref box which refers to tracks, such as hint and cdsc.
+type TrackReferenceType struct {
+	AnyTypeBox
+	TrackIDs []uint32 `mp4:"0,size=32"` // reach to end of the box
+}
+
+func isUnderTref(ctx Context) bool {
+	return ctx.UnderTref
+}
+
 /*************************** trep ****************************/
 
 func BoxTypeTrep() BoxType { return StrToBoxType("trep") }
@@ -2381,6 +2532,15 @@ type TrunEntry struct {
 	SampleCompositionTimeOffsetV1 int32  `mp4:"4,size=32,opt=0x000800,nver=0"`
 }
 
+const (
+	TrunDataOffsetPresent                  = 0x000001
+	TrunFirstSampleFlagsPresent            = 0x000004
+	TrunSampleDurationPresent              = 0x000100
+	TrunSampleSizePresent                  = 0x000200
+	TrunSampleFlagsPresent                 = 0x000400
+	TrunSampleCompositionTimeOffsetPresent = 0x000800
+)
+
 // GetType returns the BoxType
 func (*Trun) GetType() BoxType {
 	return BoxTypeTrun()
@@ -862,6 +862,21 @@ func TestBoxTypesISO14496_12(t *testing.T) {
 				`PreDefined=[0, 0, 0, 0, 0, 0] ` +
 				`NextTrackID=2882400001`,
 		},
+		{
+			name: "nmhd",
+			src: &Nmhd{
+				FullBox: FullBox{
+					Version: 0,
+					Flags:   [3]byte{0x00, 0x00, 0x00},
+				},
+			},
+			dst: &Nmhd{},
+			bin: []byte{
+				0,                // version
+				0x00, 0x00, 0x00, // flags
+			},
+			str: `Version=0 Flags=0x000000`,
+		},
 		{
 			name: "saio: version 0: no aux info type",
 			src: &Saio{
@@ -2173,6 +2188,21 @@ func TestBoxTypesISO14496_12(t *testing.T) {
 			},
 			str: `Version=0 Flags=0x000000 EntryCount=2 SampleNumber=[19088743, 2309737967]`,
 		},
+		{
+			name: "sthd",
+			src: &Sthd{
+				FullBox: FullBox{
+					Version: 0,
+					Flags:   [3]byte{0x00, 0x00, 0x00},
+				},
+			},
+			dst: &Sthd{},
+			bin: []byte{
+				0,                // version
+				0x00, 0x00, 0x00, // flags
+			},
+			str: `Version=0 Flags=0x000000`,
+		},
 		{
 			name: "stsz: common sample size",
 			src: &Stsz{
@@ -2260,6 +2290,84 @@ func TestBoxTypesISO14496_12(t *testing.T) {
 			},
 			str: `MajorBrand="abem" MinorVersion=305419896 CompatibleBrands=[{CompatibleBrand="abcd"}, {CompatibleBrand="efgh"}]`,
 		},
+		{
+			name: "subs: version 0",
+			src: &Subs{
+				FullBox: FullBox{
+					Version: 0,
+					Flags:   [3]byte{0x00, 0x00, 0x00},
+				},
+				EntryCount: 2,
+				Entries: []SubsEntry{
+					{
+						SampleDelta:    1,
+						SubsampleCount: 2,
+						Subsamples: []SubsSubsample{
+							{SubsampleSizeV0: 0x1234, SubsamplePriority: 0x56, Discardable: 1, CodecSpecificParameters: 0x789abcde},
+							{SubsampleSizeV0: 0x2345},
+						},
+					},
+					{SampleDelta: 3, Subsamples: []SubsSubsample{}},
+				},
+			},
+			dst: &Subs{},
+			bin: []byte{
+				0,                // version
+				0x00, 0x00, 0x00, // flags
+				0x00, 0x00, 0x00, 0x02, // entry count
+				0x00, 0x00, 0x00, 0x01, // sample delta
+				0x00, 0x02, // subsample count
+				0x12, 0x34, // subsample size
+				0x56,                   // subsample priority
+				0x01,                   // discardable
+				0x78, 0x9a, 0xbc, 0xde, // codec specific parameters
+				0x23, 0x45, // subsample size
+				0x00,                   // subsample priority
+				0x00,                   // discardable
+				0x00, 0x00, 0x00, 0x00, // codec specific parameters
+				0x00, 0x00, 0x00, 0x03, // sample delta
+				0x00, 0x00, // subsample count
+			},
+			str: `Version=0 Flags=0x000000 EntryCount=2 Entries=[` +
+				`{SampleDelta=1 SubsampleCount=2 Subsamples=[` +
+				`{SubsampleSizeV0=4660 SubsamplePriority=0x56 Discardable=0x1 CodecSpecificParameters=2023406814}, ` +
+				`{SubsampleSizeV0=9029 SubsamplePriority=0x0 Discardable=0x0 CodecSpecificParameters=0}]}, ` +
+				`{SampleDelta=3 SubsampleCount=0 Subsamples=[]}]`,
+		},
+		{
+			name: "subs: version 1",
+			src: &Subs{
+				FullBox: FullBox{
+					Version: 1,
+					Flags:   [3]byte{0x00, 0x00, 0x00},
+				},
+				EntryCount: 1,
+				Entries: []SubsEntry{
+					{
+						SampleDelta:    1,
+						SubsampleCount: 1,
+						Subsamples: []SubsSubsample{
+							{SubsampleSizeV1: 0x12345678},
+						},
+					},
+				},
+			},
+			dst: &Subs{},
+			bin: []byte{
+				1,                // version
+				0x00, 0x00, 0x00, // flags
+				0x00, 0x00, 0x00, 0x01, // entry count
+				0x00, 0x00, 0x00, 0x01, // sample delta
+				0x00, 0x01, // subsample count
+				0x12, 0x34, 0x56, 0x78, // subsample size
+				0x00,                   // subsample priority
+				0x00,                   // discardable
+				0x00, 0x00, 0x00, 0x00, // codec specific parameters
+			},
+			str: `Version=1 Flags=0x000000 EntryCount=1 Entries=[` +
+				`{SampleDelta=1 SubsampleCount=1 Subsamples=[` +
+				`{SubsampleSizeV1=305419896 SubsamplePriority=0x0 Discardable=0x0 CodecSpecificParameters=0}]}]`,
+		},
 		{
 			name: "tfdt: version 0",
 			src: &Tfdt{
@@ -2572,6 +2680,29 @@ func TestBoxTypesISO14496_12(t *testing.T) {
 			bin:  nil,
 			str:  ``,
 		},
+		{
+			name: "tref",
+			src:  &Tref{},
+			dst:  &Tref{},
+			bin:  nil,
+			str:  ``,
+		},
+		{
+			name: "tref hint",
+			src: &TrackReferenceType{
+				AnyTypeBox: AnyTypeBox{Type: StrToBoxType("hint")},
+				TrackIDs:   []uint32{0x01234567, 0x89abcdef},
+			},
+			dst: &TrackReferenceType{
+				AnyTypeBox: AnyTypeBox{Type: StrToBoxType("hint")},
+			},
+			bin: []byte{
+				0x01, 0x23, 0x45, 0x67, // track ID
+				0x89, 0xab, 0xcd, 0xef, // track ID
+			},
+			str: `TrackIDs=[19088743, 2309737967]`,
+			ctx: Context{UnderTref: true},
+		},
 		{
 			name: "trep",
 			src: &Trep{
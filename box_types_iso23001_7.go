@@ -2,6 +2,8 @@ package mp4
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/google/uuid"
@@ -65,6 +67,88 @@ func (*Pssh) GetType() BoxType {
 	return BoxTypePssh()
 }
 
+/*************************** senc ****************************/
+
+func BoxTypeSenc() BoxType { return StrToBoxType("senc") }
+
+func init() {
+	AddBoxDef(&Senc{}, 0)
+}
+
+const (
+	SencUseSubsampleEncryption = 0x000002
+)
+
+// Senc is ISOBMFF senc box type
+// SampleData holds the sample auxiliary information of the samples, whose layout depends on
+// the per-sample IV size given by the tenc box or the seig sample group.
+type Senc struct {
+	FullBox     `mp4:"0,extend"`
+	SampleCount uint32 `mp4:"1,size=32"`
+	SampleData  []byte `mp4:"2,size=8"`
+}
+
+// SampleEncryption is the sample auxiliary information of a protected sample.
+// IV is empty when the constant IV is used.
+type SampleEncryption struct {
+	IV         []byte
+	Subsamples []SubsampleEncryption
+}
+
+type SubsampleEncryption struct {
+	BytesOfClearData     uint16
+	BytesOfProtectedData uint32
+}
+
+// GetType returns the BoxType
+func (*Senc) GetType() BoxType {
+	return BoxTypeSenc()
+}
+
+// GetSamples parses SampleData assuming that all samples have the same per-sample IV size.
+func (senc *Senc) GetSamples(ivSize uint8) ([]SampleEncryption, error) {
+	samples := make([]SampleEncryption, 0, senc.SampleCount)
+	data := senc.SampleData
+	for i := uint32(0); i < senc.SampleCount; i++ {
+		sample, n, err := parseSampleEncryption(data, ivSize, senc.CheckFlag(SencUseSubsampleEncryption))
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, *sample)
+		data = data[n:]
+	}
+	return samples, nil
+}
+
+// parseSampleEncryption parses the sample auxiliary information of a sample and returns its size.
+func parseSampleEncryption(data []byte, ivSize uint8, subsample bool) (*SampleEncryption, int, error) {
+	if len(data) < int(ivSize) {
+		return nil, 0, errors.New("too short sample auxiliary information")
+	}
+	sample := &SampleEncryption{IV: data[:ivSize]}
+	n := int(ivSize)
+	if !subsample {
+		return sample, n, nil
+	}
+	if len(data) < n+2 {
+		return nil, 0, errors.New("too short sample auxiliary information")
+	}
+	count := int(binary.BigEndian.Uint16(data[n:]))
+	n += 2
+	if len(data) < n+count*6 {
+		return nil, 0, errors.New("too short sample auxiliary information")
+	}
+	sample.Subsamples = make([]SubsampleEncryption, count)
+	for i := range sample.Subsamples {
+		sample.Subsamples[i] = SubsampleEncryption{
+			BytesOfClearData:     binary.BigEndian.Uint16(data[n:]),
+			BytesOfProtectedData: binary.BigEndian.Uint32(data[n+2:]),
+		}
+		n += 6
+	}
+	return sample, n, nil
+}
+
 /*************************** tenc ****************************/
 
 func BoxTypeTenc() BoxType { return StrToBoxType("tenc") }
@@ -106,3 +190,59 @@ func (tenc *Tenc) GetFieldLength(name string, ctx Context) uint {
 func (*Tenc) GetType() BoxType {
 	return BoxTypeTenc()
 }
+
+/*************************** seig ****************************/
+
+// SeigEntry is CencSampleEncryptionInformationGroupEntry, which is the entry of sgpd box of seig grouping type.
+// It overrides the defaults of the tenc box for the samples which belong to the group.
+type SeigEntry struct {
+	CryptByteBlock  uint8
+	SkipByteBlock   uint8
+	IsProtected     uint8
+	PerSampleIVSize uint8
+	KID             [16]byte
+	ConstantIV      []byte
+}
+
+// GetSeigEntries parses the entries of sgpd box of seig grouping type, which are held in Unsupported field.
+func GetSeigEntries(sgpd *Sgpd) ([]SeigEntry, error) {
+	if sgpd.GroupingType != [4]byte{'s', 'e', 'i', 'g'} {
+		return nil, fmt.Errorf("unexpected grouping type: %s", string(sgpd.GroupingType[:]))
+	}
+	entries := make([]SeigEntry, 0, sgpd.EntryCount)
+	data := sgpd.Unsupported
+	for i := uint32(0); i < sgpd.EntryCount; i++ {
+		length := int(sgpd.DefaultLength)
+		if sgpd.Version == 1 && sgpd.DefaultLength == 0 {
+			if len(data) < 4 {
+				return nil, errors.New("too short seig entry")
+			}
+			length = int(binary.BigEndian.Uint32(data))
+			data = data[4:]
+		}
+		if len(data) < 20 || length != 0 && len(data) < length {
+			return nil, errors.New("too short seig entry")
+		}
+		entry := SeigEntry{
+			CryptByteBlock:  data[1] >> 4,
+			SkipByteBlock:   data[1] & 0x0f,
+			IsProtected:     data[2],
+			PerSampleIVSize: data[3],
+		}
+		copy(entry.KID[:], data[4:20])
+		n := 20
+		if entry.IsProtected == 1 && entry.PerSampleIVSize == 0 {
+			if len(data) < n+1 || len(data) < n+1+int(data[n]) {
+				return nil, errors.New("too short seig entry")
+			}
+			entry.ConstantIV = data[n+1 : n+1+int(data[n])]
+			n += 1 + int(data[n])
+		}
+		if length != 0 {
+			n = length
+		}
+		entries = append(entries, entry)
+		data = data[n:]
+	}
+	return entries, nil
+}
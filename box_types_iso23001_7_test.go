@@ -79,6 +79,29 @@ func TestBoxTypesISO23001_7(t *testing.T) {
 				`DataSize=5 ` +
 				`Data=[0x21, 0x22, 0x23, 0x24, 0x25]`,
 		},
+		{
+			name: "senc",
+			src: &Senc{
+				FullBox: FullBox{
+					Version: 0,
+					Flags:   [3]byte{0x00, 0x00, 0x02},
+				},
+				SampleCount: 1,
+				SampleData:  []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x00, 0x01, 0x00, 0x10, 0x00, 0x00, 0x01, 0x00},
+			},
+			dst: &Senc{},
+			bin: []byte{
+				0,                // version
+				0x00, 0x00, 0x02, // flags
+				0x00, 0x00, 0x00, 0x01, // sample count
+				0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // IV
+				0x00, 0x01, // subsample count
+				0x00, 0x10, 0x00, 0x00, 0x01, 0x00, // clear and protected bytes
+			},
+			str: `Version=0 Flags=0x000002 ` +
+				`SampleCount=1 ` +
+				`SampleData=[0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x0, 0x1, 0x0, 0x10, 0x0, 0x0, 0x1, 0x0]`,
+		},
 		{
 			name: "tenc: DefaultIsProtected=1 DefaultPerSampleIVSize=0",
 			src: &Tenc{
@@ -226,3 +249,73 @@ func TestBoxTypesISO23001_7(t *testing.T) {
 		})
 	}
 }
+
+func TestSencGetSamples(t *testing.T) {
+	senc := &Senc{
+		FullBox:     FullBox{Flags: [3]byte{0x00, 0x00, 0x02}},
+		SampleCount: 2,
+		SampleData: []byte{
+			0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // IV
+			0x00, 0x02, // subsample count
+			0x00, 0x10, 0x00, 0x00, 0x01, 0x00,
+			0x00, 0x05, 0x00, 0x00, 0x00, 0x20,
+			0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, // IV
+			0x00, 0x00, // subsample count
+		},
+	}
+	samples, err := senc.GetSamples(8)
+	require.NoError(t, err)
+	assert.Equal(t, []SampleEncryption{
+		{
+			IV: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			Subsamples: []SubsampleEncryption{
+				{BytesOfClearData: 0x10, BytesOfProtectedData: 0x100},
+				{BytesOfClearData: 0x05, BytesOfProtectedData: 0x20},
+			},
+		},
+		{
+			IV:         []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18},
+			Subsamples: []SubsampleEncryption{},
+		},
+	}, samples)
+
+	_, err = senc.GetSamples(16)
+	assert.Error(t, err)
+}
+
+func TestGetSeigEntries(t *testing.T) {
+	sgpd := &Sgpd{
+		FullBox:      FullBox{Version: 1},
+		GroupingType: [4]byte{'s', 'e', 'i', 'g'},
+		EntryCount:   2,
+		Unsupported: []byte{
+			0x00, 0x00, 0x00, 0x14, // description length
+			0x00, 0x00, 0x01, 0x08, // reserved, pattern, protected, per-sample IV size
+			0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, // KID
+			0x00, 0x00, 0x00, 0x19, // description length
+			0x00, 0x19, 0x01, 0x00, // reserved, pattern, protected, per-sample IV size
+			0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10, 0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10, // KID
+			0x04, 0x01, 0x02, 0x03, 0x04, // constant IV
+		},
+	}
+	entries, err := GetSeigEntries(sgpd)
+	require.NoError(t, err)
+	assert.Equal(t, []SeigEntry{
+		{
+			IsProtected:     1,
+			PerSampleIVSize: 8,
+			KID:             [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+		},
+		{
+			CryptByteBlock: 1,
+			SkipByteBlock:  9,
+			IsProtected:    1,
+			KID:            [16]byte{0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10, 0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10},
+			ConstantIV:     []byte{0x01, 0x02, 0x03, 0x04},
+		},
+	}, entries)
+
+	sgpd.Unsupported = sgpd.Unsupported[:40]
+	_, err = GetSeigEntries(sgpd)
+	assert.Error(t, err)
+}
@@ -0,0 +1,190 @@
+package mp4
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// schemeTypes of the Common Encryption defined at ISO/IEC 23001-7
+var (
+	cencSchemeCENC = [4]byte{'c', 'e', 'n', 'c'}
+	cencSchemeCENS = [4]byte{'c', 'e', 'n', 's'}
+	cencSchemeCBC1 = [4]byte{'c', 'b', 'c', '1'}
+	cencSchemeCBCS = [4]byte{'c', 'b', 'c', 's'}
+)
+
+func isCENCScheme(schemeType [4]byte) bool {
+	switch schemeType {
+	case cencSchemeCENC, cencSchemeCENS, cencSchemeCBC1, cencSchemeCBCS:
+		return true
+	}
+	return false
+}
+
+// cencScheme is the protection scheme of a sample entry.
+type cencScheme struct {
+	schemeType [4]byte
+	tenc       *Tenc
+}
+
+// cencSample is a protected sample and the parameters to encrypt or decrypt it.
+type cencSample struct {
+	offset     uint64
+	size       uint32
+	schemeType [4]byte
+	key        []byte
+	iv         []byte
+	subsamples []SubsampleEncryption
+	crypt      uint8
+	skip       uint8
+}
+
+// apply encrypts or decrypts the sample data in place.
+func (s *cencSample) apply(data []byte, encrypt bool) error {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return err
+	}
+
+	// protected ranges of the sample
+	var ranges [][]byte
+	if len(s.subsamples) == 0 {
+		ranges = [][]byte{data}
+	} else {
+		rest := data
+		for _, sub := range s.subsamples {
+			clearSize, protectedSize := uint64(sub.BytesOfClearData), uint64(sub.BytesOfProtectedData)
+			if clearSize+protectedSize > uint64(len(rest)) {
+				return fmt.Errorf("subsamples exceed the sample: offset=%d", s.offset)
+			}
+			ranges = append(ranges, rest[clearSize:clearSize+protectedSize])
+			rest = rest[clearSize+protectedSize:]
+		}
+	}
+	pattern := s.crypt != 0 || s.skip != 0
+
+	switch s.schemeType {
+	case cencSchemeCENC, cencSchemeCENS:
+		// 8-byte IVs are followed by the 64-bit block counter
+		if len(s.iv) != 8 && len(s.iv) != 16 {
+			return fmt.Errorf("invalid IV size: %d", len(s.iv))
+		}
+		iv := make([]byte, aes.BlockSize)
+		copy(iv, s.iv)
+		stream := cipher.NewCTR(block, iv)
+		for _, r := range ranges {
+			if s.schemeType == cencSchemeCENS && pattern {
+				applyCENCPattern(r, s.crypt, s.skip, func(b []byte) { stream.XORKeyStream(b, b) })
+			} else {
+				stream.XORKeyStream(r, r)
+			}
+		}
+	case cencSchemeCBC1, cencSchemeCBCS:
+		if len(s.iv) != aes.BlockSize {
+			return fmt.Errorf("invalid IV size: %d", len(s.iv))
+		}
+		// the chain continues over the subsamples on cbc1, and restarts at each subsample on cbcs
+		newMode := cipher.NewCBCDecrypter
+		if encrypt {
+			newMode = cipher.NewCBCEncrypter
+		}
+		mode := newMode(block, s.iv)
+		for _, r := range ranges {
+			if s.schemeType == cencSchemeCBCS {
+				mode = newMode(block, s.iv)
+			}
+			if s.schemeType == cencSchemeCBCS && pattern {
+				applyCENCPattern(r, s.crypt, s.skip, func(b []byte) { mode.CryptBlocks(b, b) })
+			} else {
+				// the trailing partial block is not encrypted
+				n := len(r) / aes.BlockSize * aes.BlockSize
+				mode.CryptBlocks(r[:n], r[:n])
+			}
+		}
+	}
+	return nil
+}
+
+// applyCENCPattern calls fn for each run of the encrypted blocks of the pattern encryption,
+// which repeats crypt encrypted blocks and skip clear blocks. The trailing partial block is not encrypted.
+func applyCENCPattern(data []byte, crypt, skip uint8, fn func([]byte)) {
+	for len(data) >= aes.BlockSize {
+		n := int(crypt) * aes.BlockSize
+		if full := len(data) / aes.BlockSize * aes.BlockSize; n > full {
+			n = full
+		}
+		fn(data[:n])
+		data = data[n:]
+		n = int(skip) * aes.BlockSize
+		if n > len(data) {
+			n = len(data)
+		}
+		data = data[n:]
+	}
+}
+
+// cencReader reads the source replacing the samples by the encrypted or decrypted data.
+type cencReader struct {
+	r       io.ReadSeeker
+	samples []*cencSample // sorted by offset
+	encrypt bool
+	pos     uint64
+
+	// processed data of the last sample
+	sample *cencSample
+	data   []byte
+}
+
+func (cr *cencReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(cr.pos)
+	default:
+		return 0, errors.New("unsupported whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	cr.pos = uint64(offset)
+	return offset, nil
+}
+
+func (cr *cencReader) Read(p []byte) (int, error) {
+	i := sort.Search(len(cr.samples), func(i int) bool {
+		return cr.samples[i].offset+uint64(cr.samples[i].size) > cr.pos
+	})
+	if i < len(cr.samples) && cr.samples[i].offset <= cr.pos {
+		s := cr.samples[i]
+		if cr.sample != s {
+			data := make([]byte, s.size)
+			if _, err := cr.r.Seek(int64(s.offset), io.SeekStart); err != nil {
+				return 0, err
+			}
+			if _, err := io.ReadFull(cr.r, data); err != nil {
+				return 0, err
+			}
+			if err := s.apply(data, cr.encrypt); err != nil {
+				return 0, err
+			}
+			cr.sample, cr.data = s, data
+		}
+		n := copy(p, cr.data[cr.pos-s.offset:])
+		cr.pos += uint64(n)
+		return n, nil
+	}
+
+	if i < len(cr.samples) && uint64(len(p)) > cr.samples[i].offset-cr.pos {
+		p = p[:cr.samples[i].offset-cr.pos]
+	}
+	if _, err := cr.r.Seek(int64(cr.pos), io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := cr.r.Read(p)
+	cr.pos += uint64(n)
+	return n, err
+}
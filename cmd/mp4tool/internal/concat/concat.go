@@ -0,0 +1,48 @@
+package concat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/abema/go-mp4"
+	"github.com/sunfish-shogi/bufseekio"
+)
+
+func Main(args []string) int {
+	if len(args) < 3 {
+		println("USAGE: mp4tool concat INPUT1.mp4 INPUT2.mp4 [INPUT3.mp4 ...] OUTPUT.mp4")
+		return 1
+	}
+
+	if err := concat(args[:len(args)-1], args[len(args)-1]); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func concat(inputPaths []string, outputPath string) error {
+	var rs []io.ReadSeeker
+	for _, inputPath := range inputPaths {
+		inputFile, err := os.Open(inputPath)
+		if err != nil {
+			return err
+		}
+		defer inputFile.Close()
+		rs = append(rs, bufseekio.NewReadSeeker(inputFile, 128*1024, 4))
+	}
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	w := bufio.NewWriterSize(outputFile, 128*1024)
+	if err := mp4.Concat(rs, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,56 @@
+package cut
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/abema/go-mp4"
+	"github.com/sunfish-shogi/bufseekio"
+)
+
+func Main(args []string) int {
+	flagSet := flag.NewFlagSet("cut", flag.ExitOnError)
+	start := flagSet.Float64("start", 0, "start time in seconds")
+	end := flagSet.Float64("end", 0, "end time in seconds (0 means the end of the file)")
+	exact := flagSet.Bool("exact", false, "keep the exact start time by edit list instead of snapping to the preceding sync sample")
+	flagSet.Usage = func() {
+		println("USAGE: mp4tool cut [OPTIONS] INPUT.mp4 OUTPUT.mp4")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+
+	if len(flagSet.Args()) < 2 {
+		flagSet.Usage()
+		return 1
+	}
+
+	opts := &mp4.TrimOptions{Start: *start, End: *end, ExactStart: *exact}
+	if err := cut(flagSet.Args()[0], flagSet.Args()[1], opts); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func cut(inputPath, outputPath string, opts *mp4.TrimOptions) error {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	r := bufseekio.NewReadSeeker(inputFile, 128*1024, 4)
+	w := bufio.NewWriterSize(outputFile, 128*1024)
+	if err := mp4.Trim(r, w, opts); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,87 @@
+package decrypt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/abema/go-mp4"
+	"github.com/sunfish-shogi/bufseekio"
+)
+
+// keyFlag is a repeatable flag which holds KID:KEY pairs.
+type keyFlag map[[16]byte][]byte
+
+func (f keyFlag) String() string {
+	var pairs []string
+	for kid, key := range f {
+		pairs = append(pairs, hex.EncodeToString(kid[:])+":"+hex.EncodeToString(key))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f keyFlag) Set(value string) error {
+	pair := strings.Split(value, ":")
+	if len(pair) != 2 {
+		return errors.New("key must be in the form of KID:KEY")
+	}
+	kid, err := hex.DecodeString(strings.ReplaceAll(pair[0], "-", ""))
+	if err != nil || len(kid) != 16 {
+		return fmt.Errorf("invalid KID: %s", pair[0])
+	}
+	key, err := hex.DecodeString(pair[1])
+	if err != nil || len(key) != 16 {
+		return fmt.Errorf("invalid key: %s", pair[1])
+	}
+	var k [16]byte
+	copy(k[:], kid)
+	f[k] = key
+	return nil
+}
+
+func Main(args []string) int {
+	flagSet := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keys := make(keyFlag)
+	flagSet.Var(keys, "key", "KID and key in hex, in the form of KID:KEY (can be repeated)")
+	flagSet.Usage = func() {
+		println("USAGE: mp4tool decrypt -key KID:KEY [-key KID:KEY ...] INPUT.mp4 OUTPUT.mp4")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+
+	if len(flagSet.Args()) < 2 || len(keys) == 0 {
+		flagSet.Usage()
+		return 1
+	}
+
+	if err := decrypt(flagSet.Args()[0], flagSet.Args()[1], keys); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func decrypt(inputPath, outputPath string, keys map[[16]byte][]byte) error {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	r := bufseekio.NewReadSeeker(inputFile, 128*1024, 4)
+	w := bufio.NewWriterSize(outputFile, 128*1024)
+	if err := mp4.Decrypt(r, w, keys); err != nil {
+		return err
+	}
+	return w.Flush()
+}
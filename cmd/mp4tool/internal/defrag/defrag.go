@@ -0,0 +1,51 @@
+package defrag
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/abema/go-mp4"
+	"github.com/sunfish-shogi/bufseekio"
+)
+
+func Main(args []string) int {
+	flagSet := flag.NewFlagSet("defrag", flag.ExitOnError)
+	flagSet.Usage = func() {
+		println("USAGE: mp4tool defrag INPUT.mp4 OUTPUT.mp4")
+	}
+	flagSet.Parse(args)
+
+	if len(flagSet.Args()) < 2 {
+		flagSet.Usage()
+		return 1
+	}
+
+	if err := defrag(flagSet.Args()[0], flagSet.Args()[1]); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func defrag(inputPath, outputPath string) error {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	r := bufseekio.NewReadSeeker(inputFile, 128*1024, 4)
+	w := bufio.NewWriterSize(outputFile, 128*1024)
+	if err := mp4.Defragment(r, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
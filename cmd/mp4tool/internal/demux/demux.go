@@ -0,0 +1,95 @@
+package demux
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/abema/go-mp4"
+	"github.com/sunfish-shogi/bufseekio"
+)
+
+func Main(args []string) int {
+	flagSet := flag.NewFlagSet("demux", flag.ExitOnError)
+	trackID := flagSet.Uint("track", 0, "track ID to demux (all supported tracks are demuxed when 0)")
+	flagSet.Usage = func() {
+		println("USAGE: mp4tool demux [OPTIONS] INPUT.mp4 [OUTPUT]")
+		println()
+		println("  With -track, OUTPUT is the output file. Otherwise, or when OUTPUT is omitted,")
+		println("  each track is written to OUTPUT_<TRACK_ID>.<EXT>, where OUTPUT defaults to the input path without extension.")
+		println()
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+
+	if len(flagSet.Args()) < 1 {
+		flagSet.Usage()
+		return 1
+	}
+	inputPath := flagSet.Args()[0]
+	output := strings.TrimSuffix(inputPath, filepath.Ext(inputPath))
+	if len(flagSet.Args()) >= 2 {
+		output = flagSet.Args()[1]
+	}
+
+	if err := demux(inputPath, output, uint32(*trackID), len(flagSet.Args()) >= 2); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func demux(inputPath, output string, trackID uint32, outputIsFile bool) error {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+	r := bufseekio.NewReadSeeker(inputFile, 128*1024, 4)
+
+	if trackID != 0 {
+		d, err := mp4.NewDemuxer(r, trackID)
+		if err != nil {
+			return err
+		}
+		if !outputIsFile {
+			output = fmt.Sprintf("%s_%d.%s", output, trackID, d.Extension())
+		}
+		return writeFile(d, output)
+	}
+
+	info, err := mp4.Probe(r)
+	if err != nil {
+		return err
+	}
+	for _, track := range info.Tracks {
+		d, err := mp4.NewDemuxer(r, track.TrackID)
+		if err != nil {
+			fmt.Printf("track %d is skipped: %s\n", track.TrackID, err)
+			continue
+		}
+		path := fmt.Sprintf("%s_%d.%s", output, track.TrackID, d.Extension())
+		if err := writeFile(d, path); err != nil {
+			return err
+		}
+		fmt.Printf("track %d: %s\n", track.TrackID, path)
+	}
+	return nil
+}
+
+func writeFile(d *mp4.Demuxer, path string) error {
+	outputFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	w := bufio.NewWriterSize(outputFile, 128*1024)
+	if _, err := d.WriteTo(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
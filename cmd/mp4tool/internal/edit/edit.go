@@ -77,51 +77,32 @@ func editFile(inputPath, outputPath string) error {
 	defer outputFile.Close()
 
 	r := bufseekio.NewReadSeeker(inputFile, 128*1024, 4)
-	w := mp4.NewWriter(outputFile)
-	_, err = mp4.ReadBoxStructure(r, func(h *mp4.ReadHandle) (interface{}, error) {
-		if config.dropBoxes.Exists(h.BoxInfo.Type.String()) {
-			// drop
-			return uint64(0), nil
-		}
-
-		if !h.BoxInfo.IsSupportedType() || h.BoxInfo.Type == mp4.BoxTypeMdat() {
-			// copy all data
-			return nil, w.CopyBox(r, &h.BoxInfo)
-		}
-
-		// write header
-		_, err := w.StartBox(&h.BoxInfo)
-		if err != nil {
-			return nil, err
-		}
-		// read payload
-		box, _, err := h.ReadPayload()
-		if err != nil {
-			return nil, err
+	tree, err := mp4.ReadBoxTree(r)
+	if err != nil {
+		return err
+	}
+	var drops []*mp4.BoxNode
+	tree.Walk(func(n *mp4.BoxNode) bool {
+		if config.dropBoxes.Exists(n.Info.Type.String()) {
+			drops = append(drops, n)
+			return false
 		}
 		// edit some fields
-		switch h.BoxInfo.Type {
-		case mp4.BoxTypeTfdt():
-			tfdt := box.(*mp4.Tfdt)
+		switch box := n.Payload.(type) {
+		case *mp4.Tfdt:
 			if config.values.BaseMediaDecodeTime != UNoValue {
-				if tfdt.GetVersion() == 0 {
-					tfdt.BaseMediaDecodeTimeV0 = uint32(config.values.BaseMediaDecodeTime)
+				if box.GetVersion() == 0 {
+					box.BaseMediaDecodeTimeV0 = uint32(config.values.BaseMediaDecodeTime)
 				} else {
-					tfdt.BaseMediaDecodeTimeV1 = config.values.BaseMediaDecodeTime
+					box.BaseMediaDecodeTimeV1 = config.values.BaseMediaDecodeTime
 				}
 			}
 		}
-		// write payload
-		if _, err := mp4.Marshal(w, box, h.BoxInfo.Context); err != nil {
-			return nil, err
-		}
-		// expand all of offsprings
-		if _, err := h.Expand(); err != nil {
-			return nil, err
-		}
-		// rewrite box size
-		_, err = w.EndBox()
-		return nil, err
+		return true
 	})
-	return err
+	for _, n := range drops {
+		n.Remove()
+	}
+	// offsets of chunks and fragments are updated by the tree
+	return tree.Write(mp4.NewWriter(outputFile))
 }
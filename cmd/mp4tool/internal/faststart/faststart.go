@@ -0,0 +1,53 @@
+package faststart
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/abema/go-mp4"
+	"github.com/sunfish-shogi/bufseekio"
+)
+
+func Main(args []string) int {
+	flagSet := flag.NewFlagSet("faststart", flag.ExitOnError)
+	padding := flagSet.Uint64("padding", 0, "size of free box placed after moov box")
+	flagSet.Usage = func() {
+		println("USAGE: mp4tool faststart [OPTIONS] INPUT.mp4 OUTPUT.mp4")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+
+	if len(flagSet.Args()) < 2 {
+		flagSet.Usage()
+		return 1
+	}
+
+	if err := fastStart(flagSet.Args()[0], flagSet.Args()[1], *padding); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func fastStart(inputPath, outputPath string, padding uint64) error {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	r := bufseekio.NewReadSeeker(inputFile, 128*1024, 4)
+	w := bufio.NewWriterSize(outputFile, 128*1024)
+	if err := mp4.FastStart(r, w, &mp4.FastStartOptions{Padding: padding}); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,84 @@
+package importer
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/abema/go-mp4"
+)
+
+func Main(args []string) int {
+	flagSet := flag.NewFlagSet("import", flag.ExitOnError)
+	frameRate := flagSet.Float64("fps", 25, "frame rate of H.264 and H.265 streams")
+	language := flagSet.String("lang", "", "ISO-639-2/T language code")
+	fragment := flagSet.Bool("fragment", false, "write a fragmented mp4 file")
+	flagSet.Usage = func() {
+		println("USAGE: mp4tool import [OPTIONS] INPUT OUTPUT.mp4")
+		println()
+		println("  The format of INPUT is detected by its extension:")
+		println("  .264/.h264/.avc, .265/.h265/.hevc, .aac/.adts, .ivf, .wav and .vtt")
+		println()
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+
+	if len(flagSet.Args()) < 2 {
+		flagSet.Usage()
+		return 1
+	}
+
+	opts := &mp4.ImportOptions{
+		FrameRate: *frameRate,
+		Language:  *language,
+		Muxer:     &mp4.MuxerOptions{Fragmented: *fragment},
+	}
+	if err := importFile(flagSet.Args()[0], flagSet.Args()[1], opts); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func detectFormat(path string) mp4.ImportFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".264", ".h264", ".avc":
+		return mp4.ImportFormatH264
+	case ".265", ".h265", ".hevc":
+		return mp4.ImportFormatH265
+	case ".aac", ".adts":
+		return mp4.ImportFormatADTS
+	case ".ivf":
+		return mp4.ImportFormatIVF
+	case ".wav":
+		return mp4.ImportFormatWAV
+	case ".vtt":
+		return mp4.ImportFormatWebVTT
+	}
+	return mp4.ImportFormatUnknown
+}
+
+func importFile(inputPath, outputPath string, opts *mp4.ImportOptions) error {
+	format := detectFormat(inputPath)
+	if format == mp4.ImportFormatUnknown {
+		return errors.New("unknown input format")
+	}
+
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	// the muxer seeks back to complete a progressive file, so the output file is passed without buffering
+	return mp4.Import(inputFile, format, outputFile, opts)
+}
@@ -0,0 +1,302 @@
+package psshdump
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+var (
+	systemIDWidevine  = uuid.MustParse("edef8ba9-79d6-4ace-a3c8-27dcd51d21ed")
+	systemIDPlayReady = uuid.MustParse("9a04f079-9840-4286-ab92-e65be0885f95")
+	systemIDFairPlay  = uuid.MustParse("94ce86fb-07ff-4f43-adb8-93d2fa968ca2")
+	systemIDCommon    = uuid.MustParse("1077efec-c0b2-4d02-ace3-3c1e52e2fb4b")
+	systemIDClearKey  = uuid.MustParse("e2719d58-a985-b3c9-781a-b030af78d30e")
+	systemIDMarlin    = uuid.MustParse("5e629af5-38da-4063-8977-97ffbd9902d4")
+	systemIDPrimeTime = uuid.MustParse("f239e769-efa3-4850-9c16-a903c6932efb")
+)
+
+var systemNames = map[uuid.UUID]string{
+	systemIDWidevine:  "Widevine",
+	systemIDPlayReady: "PlayReady",
+	systemIDFairPlay:  "FairPlay",
+	systemIDCommon:    "W3C Common (ClearKey)",
+	systemIDClearKey:  "ClearKey (DASH-IF)",
+	systemIDMarlin:    "Marlin",
+	systemIDPrimeTime: "Adobe Primetime",
+}
+
+// widevineData is the decoded WidevinePsshData protobuf message.
+type widevineData struct {
+	Algorithm         string   `json:"algorithm,omitempty"`
+	KeyIDs            []string `json:"keyIds,omitempty"`
+	Provider          string   `json:"provider,omitempty"`
+	ContentID         string   `json:"contentId,omitempty"`
+	Policy            string   `json:"policy,omitempty"`
+	CryptoPeriodIndex *uint32  `json:"cryptoPeriodIndex,omitempty"`
+	ProtectionScheme  string   `json:"protectionScheme,omitempty"`
+	Type              string   `json:"type,omitempty"`
+}
+
+var widevineAlgorithms = map[uint64]string{0: "UNENCRYPTED", 1: "AESCTR"}
+
+var widevineTypes = map[uint64]string{0: "SINGLE", 1: "ENTITLEMENT", 2: "ENTITLED_KEY"}
+
+func decodeWidevine(data []byte) (*widevineData, error) {
+	wv := &widevineData{}
+	for len(data) != 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf field key")
+		}
+		data = data[n:]
+		var value uint64
+		var bytesValue []byte
+		switch key & 0x7 {
+		case 0:
+			value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return nil, errors.New("invalid protobuf length")
+			}
+			bytesValue = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			data = data[4:]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type: %d", key&0x7)
+		}
+
+		switch key {
+		case 1<<3 | 0:
+			wv.Algorithm = enumName(widevineAlgorithms, value)
+		case 2<<3 | 2:
+			wv.KeyIDs = append(wv.KeyIDs, formatKID(bytesValue))
+		case 3<<3 | 2:
+			wv.Provider = string(bytesValue)
+		case 4<<3 | 2:
+			wv.ContentID = hex.EncodeToString(bytesValue)
+		case 6<<3 | 2:
+			wv.Policy = string(bytesValue)
+		case 7<<3 | 0:
+			index := uint32(value)
+			wv.CryptoPeriodIndex = &index
+		case 9<<3 | 0:
+			var fourcc [4]byte
+			binary.BigEndian.PutUint32(fourcc[:], uint32(value))
+			wv.ProtectionScheme = formatFourCC(fourcc)
+		case 11<<3 | 0:
+			wv.Type = enumName(widevineTypes, value)
+		}
+	}
+	return wv, nil
+}
+
+func enumName(names map[uint64]string, value uint64) string {
+	if name, ok := names[value]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", value)
+}
+
+// playReadyData is the decoded PlayReady Object.
+type playReadyData struct {
+	Records []*playReadyRecord `json:"records"`
+}
+
+type playReadyRecord struct {
+	Type   uint16           `json:"type"`
+	Size   int              `json:"size"`
+	Header *playReadyHeader `json:"header,omitempty"`
+}
+
+// playReadyHeader is the decoded WRMHEADER of a rights management header record.
+type playReadyHeader struct {
+	Version  string   `json:"version,omitempty"`
+	KIDs     []string `json:"kids,omitempty"`
+	AlgID    string   `json:"algId,omitempty"`
+	LAURL    string   `json:"laUrl,omitempty"`
+	LUIURL   string   `json:"luiUrl,omitempty"`
+	DSID     string   `json:"dsId,omitempty"`
+	Checksum string   `json:"checksum,omitempty"`
+}
+
+const playReadyRecordTypeRightsManagementHeader = 1
+
+func decodePlayReady(data []byte) (*playReadyData, error) {
+	if len(data) < 6 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if length := binary.LittleEndian.Uint32(data); int(length) != len(data) {
+		return nil, fmt.Errorf("PlayReady object length mismatch: length=%d, actual=%d", length, len(data))
+	}
+	count := binary.LittleEndian.Uint16(data[4:])
+	data = data[6:]
+	pr := &playReadyData{}
+	for i := 0; i < int(count); i++ {
+		if len(data) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		record := &playReadyRecord{
+			Type: binary.LittleEndian.Uint16(data),
+			Size: int(binary.LittleEndian.Uint16(data[2:])),
+		}
+		if len(data)-4 < record.Size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		value := data[4 : 4+record.Size]
+		data = data[4+record.Size:]
+		if record.Type == playReadyRecordTypeRightsManagementHeader {
+			header, err := decodeWRMHeader(value)
+			if err != nil {
+				return nil, err
+			}
+			record.Header = header
+		}
+		pr.Records = append(pr.Records, record)
+	}
+	return pr, nil
+}
+
+func decodeWRMHeader(data []byte) (*playReadyHeader, error) {
+	if len(data)%2 != 0 {
+		return nil, errors.New("invalid UTF-16 WRMHEADER")
+	}
+	u16 := make([]uint16, len(data)/2)
+	for i := range u16 {
+		u16[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	text := strings.TrimPrefix(string(utf16.Decode(u16)), "\ufeff")
+
+	header := &playReadyHeader{}
+	dec := xml.NewDecoder(strings.NewReader(text))
+	dec.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		// the text has already been decoded from UTF-16
+		return input, nil
+	}
+	var path []string
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			switch t.Name.Local {
+			case "WRMHEADER":
+				header.Version = attr(t, "version")
+			case "KID":
+				// version 4.1 and later put KIDs into attributes
+				if value := attr(t, "VALUE"); value != "" {
+					kid, err := decodePlayReadyKID(value)
+					if err != nil {
+						return nil, err
+					}
+					header.KIDs = append(header.KIDs, kid)
+					if algID := attr(t, "ALGID"); algID != "" {
+						header.AlgID = algID
+					}
+					if checksum := attr(t, "CHECKSUM"); checksum != "" {
+						header.Checksum = checksum
+					}
+				}
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+		case xml.CharData:
+			if len(path) == 0 {
+				continue
+			}
+			value := strings.TrimSpace(string(t))
+			if value == "" {
+				continue
+			}
+			switch path[len(path)-1] {
+			case "KID":
+				kid, err := decodePlayReadyKID(value)
+				if err != nil {
+					return nil, err
+				}
+				header.KIDs = append(header.KIDs, kid)
+			case "ALGID":
+				header.AlgID = value
+			case "CHECKSUM":
+				header.Checksum = value
+			case "LA_URL":
+				header.LAURL = value
+			case "LUI_URL":
+				header.LUIURL = value
+			case "DS_ID":
+				header.DSID = value
+			}
+		}
+	}
+	return header, nil
+}
+
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// decodePlayReadyKID converts a base64 encoded GUID, whose first three fields
+// are little-endian, into the big-endian UUID form used by pssh boxes.
+func decodePlayReadyKID(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	if len(b) != 16 {
+		return "", fmt.Errorf("invalid PlayReady KID size: %d", len(b))
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return formatKID(b), nil
+}
+
+func formatKID(b []byte) string {
+	if len(b) != 16 {
+		return hex.EncodeToString(b)
+	}
+	var id uuid.UUID
+	copy(id[:], b)
+	return id.String()
+}
+
+func formatFourCC(fourcc [4]byte) string {
+	for _, c := range fourcc {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(fourcc[:]))
+		}
+	}
+	return string(fourcc[:])
+}
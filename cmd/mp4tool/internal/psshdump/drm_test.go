@@ -0,0 +1,175 @@
+package psshdump
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	mp4 "github.com/abema/go-mp4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testKID1 = [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	testKID2 = [16]byte{0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10, 0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10}
+)
+
+func appendProtobufVarint(b []byte, field int, value uint64) []byte {
+	b = appendVarint(b, uint64(field<<3|0))
+	return appendVarint(b, value)
+}
+
+func appendProtobufBytes(b []byte, field int, value []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|2))
+	b = appendVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func TestDecodeWidevine(t *testing.T) {
+	var data []byte
+	data = appendProtobufVarint(data, 1, 1)
+	data = appendProtobufBytes(data, 2, testKID1[:])
+	data = appendProtobufBytes(data, 2, testKID2[:])
+	data = appendProtobufBytes(data, 3, []byte("widevine_test"))
+	data = appendProtobufBytes(data, 4, []byte("content"))
+	data = appendProtobufVarint(data, 7, 0)
+	data = append(data, 0x55, 0x01, 0x02, 0x03, 0x04) // unknown fixed32 field
+	data = appendProtobufVarint(data, 9, 0x63626373)
+	data = appendProtobufVarint(data, 11, 1)
+
+	wv, err := decodeWidevine(data)
+	require.NoError(t, err)
+	index := uint32(0)
+	assert.Equal(t, &widevineData{
+		Algorithm:         "AESCTR",
+		KeyIDs:            []string{"01234567-89ab-cdef-0123-456789abcdef", "fedcba98-7654-3210-fedc-ba9876543210"},
+		Provider:          "widevine_test",
+		ContentID:         "636f6e74656e74",
+		CryptoPeriodIndex: &index,
+		ProtectionScheme:  "cbcs",
+		Type:              "ENTITLEMENT",
+	}, wv)
+
+	_, err = decodeWidevine([]byte{0x12, 0x10, 0x00})
+	assert.Error(t, err)
+	_, err = decodeWidevine([]byte{0x0b})
+	assert.Error(t, err)
+}
+
+func newPlayReadyObject(headers ...string) []byte {
+	data := make([]byte, 6)
+	binary.LittleEndian.PutUint16(data[4:], uint16(len(headers)))
+	for _, header := range headers {
+		u16 := utf16.Encode([]rune(header))
+		record := make([]byte, 4+len(u16)*2)
+		binary.LittleEndian.PutUint16(record, playReadyRecordTypeRightsManagementHeader)
+		binary.LittleEndian.PutUint16(record[2:], uint16(len(u16)*2))
+		for i, c := range u16 {
+			binary.LittleEndian.PutUint16(record[4+i*2:], c)
+		}
+		data = append(data, record...)
+	}
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+// playReadyKID returns the base64 encoded GUID form of the KID.
+func playReadyKID(kid [16]byte) string {
+	kid[0], kid[1], kid[2], kid[3] = kid[3], kid[2], kid[1], kid[0]
+	kid[4], kid[5] = kid[5], kid[4]
+	kid[6], kid[7] = kid[7], kid[6]
+	return base64.StdEncoding.EncodeToString(kid[:])
+}
+
+func TestDecodePlayReady(t *testing.T) {
+	v40 := `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.0.0.0">` +
+		`<DATA><PROTECTINFO><KEYLEN>16</KEYLEN><ALGID>AESCTR</ALGID></PROTECTINFO>` +
+		`<KID>` + playReadyKID(testKID1) + `</KID><CHECKSUM>AAAAAAAAAAA=</CHECKSUM>` +
+		`<LA_URL>https://example.com/rightsmanager.asmx</LA_URL></DATA></WRMHEADER>`
+	v43 := `<?xml version="1.0" encoding="utf-16"?>` +
+		`<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.3.0.0">` +
+		`<DATA><PROTECTINFO><KIDS>` +
+		`<KID ALGID="AESCBC" VALUE="` + playReadyKID(testKID1) + `"></KID>` +
+		`<KID ALGID="AESCBC" VALUE="` + playReadyKID(testKID2) + `"></KID>` +
+		`</KIDS></PROTECTINFO><LUI_URL>https://example.com/lui</LUI_URL><DS_ID>ds</DS_ID></DATA></WRMHEADER>`
+
+	pr, err := decodePlayReady(newPlayReadyObject("\ufeff"+v40, v43))
+	require.NoError(t, err)
+	require.Len(t, pr.Records, 2)
+	assert.Equal(t, uint16(1), pr.Records[0].Type)
+	assert.Equal(t, len(utf16.Encode([]rune(v40)))*2+2, pr.Records[0].Size)
+	assert.Equal(t, &playReadyHeader{
+		Version:  "4.0.0.0",
+		KIDs:     []string{"01234567-89ab-cdef-0123-456789abcdef"},
+		AlgID:    "AESCTR",
+		LAURL:    "https://example.com/rightsmanager.asmx",
+		Checksum: "AAAAAAAAAAA=",
+	}, pr.Records[0].Header)
+	assert.Equal(t, &playReadyHeader{
+		Version: "4.3.0.0",
+		KIDs:    []string{"01234567-89ab-cdef-0123-456789abcdef", "fedcba98-7654-3210-fedc-ba9876543210"},
+		AlgID:   "AESCBC",
+		LUIURL:  "https://example.com/lui",
+		DSID:    "ds",
+	}, pr.Records[1].Header)
+
+	data := newPlayReadyObject(v40)
+	_, err = decodePlayReady(data[:len(data)-2])
+	assert.Error(t, err)
+}
+
+func TestBuildReport(t *testing.T) {
+	var wvData []byte
+	wvData = appendProtobufBytes(wvData, 2, testKID1[:])
+	wvData = appendProtobufBytes(wvData, 3, []byte("provider"))
+
+	testCases := []struct {
+		name  string
+		pssh  *mp4.Pssh
+		check func(t *testing.T, rep *psshReport)
+	}{
+		{
+			name: "widevine",
+			pssh: &mp4.Pssh{SystemID: systemIDWidevine, DataSize: int32(len(wvData)), Data: wvData},
+			check: func(t *testing.T, rep *psshReport) {
+				assert.Equal(t, "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed", rep.SystemID)
+				assert.Equal(t, "Widevine", rep.System)
+				require.NotNil(t, rep.Widevine)
+				assert.Equal(t, []string{"01234567-89ab-cdef-0123-456789abcdef"}, rep.Widevine.KeyIDs)
+				assert.Equal(t, "provider", rep.Widevine.Provider)
+				assert.Empty(t, rep.DecodeError)
+			},
+		},
+		{
+			name: "playready",
+			pssh: &mp4.Pssh{SystemID: systemIDPlayReady, DataSize: 3, Data: []byte{0x01, 0x02, 0x03}},
+			check: func(t *testing.T, rep *psshReport) {
+				assert.Equal(t, "PlayReady", rep.System)
+				assert.Nil(t, rep.PlayReady)
+				assert.NotEmpty(t, rep.DecodeError)
+			},
+		},
+		{
+			name: "unknown",
+			pssh: &mp4.Pssh{SystemID: [16]byte{0x01}, DataSize: 1, Data: []byte{0x01}},
+			check: func(t *testing.T, rep *psshReport) {
+				assert.Empty(t, rep.System)
+				assert.Nil(t, rep.Widevine)
+				assert.Nil(t, rep.PlayReady)
+				assert.Empty(t, rep.DecodeError)
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.check(t, buildReport(&mp4.BoxInfo{}, tc.pssh, nil))
+		})
+	}
+}
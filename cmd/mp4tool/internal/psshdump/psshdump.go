@@ -2,28 +2,60 @@ package psshdump
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 
 	mp4 "github.com/abema/go-mp4"
+	"github.com/google/uuid"
 	"github.com/sunfish-shogi/bufseekio"
 )
 
 func Main(args []string) int {
-	if len(args) < 1 {
-		println("USAGE: mp4tool psshdump INPUT.mp4")
+	flagSet := flag.NewFlagSet("psshdump", flag.ExitOnError)
+	format := flagSet.String("format", "text", "output format (text|json)")
+	flagSet.Usage = func() {
+		println("USAGE: mp4tool psshdump [OPTIONS] INPUT.mp4")
+		println("  The data of Widevine and PlayReady are decoded. The data of the other systems,")
+		println("  including FairPlay, are not decoded and are only printed as base64.")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+
+	if len(flagSet.Args()) < 1 {
+		flagSet.Usage()
 		return 1
 	}
 
-	if err := dump(args[0]); err != nil {
+	if err := dump(flagSet.Args()[0], *format); err != nil {
 		fmt.Println("Error:", err)
 		return 1
 	}
 	return 0
 }
 
-func dump(inputFilePath string) error {
+type psshReport struct {
+	Offset      uint64         `json:"offset"`
+	Size        uint64         `json:"size"`
+	Version     uint8          `json:"version"`
+	Flags       uint32         `json:"flags"`
+	SystemID    string         `json:"systemId"`
+	System      string         `json:"system,omitempty"`
+	KIDs        []string       `json:"kids,omitempty"`
+	DataSize    int32          `json:"dataSize"`
+	Widevine    *widevineData  `json:"widevine,omitempty"`
+	PlayReady   *playReadyData `json:"playready,omitempty"`
+	DecodeError string         `json:"decodeError,omitempty"`
+	Base64      string         `json:"base64"`
+}
+
+func dump(inputFilePath string, format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown format: %s", format)
+	}
+
 	inputFile, err := os.Open(inputFilePath)
 	if err != nil {
 		return err
@@ -40,17 +72,10 @@ func dump(inputFilePath string) error {
 		return err
 	}
 
+	reports := make([]*psshReport, 0, len(bs))
 	for i := range bs {
 		pssh := bs[i].Payload.(*mp4.Pssh)
 
-		var sysid string
-		for i, v := range pssh.SystemID {
-			sysid += fmt.Sprintf("%02x", v)
-			if i == 3 || i == 5 || i == 7 || i == 9 {
-				sysid += "-"
-			}
-		}
-
 		if _, err := bs[i].Info.SeekToStart(r); err != nil {
 			return err
 		}
@@ -59,16 +84,107 @@ func dump(inputFilePath string) error {
 			return err
 		}
 
-		fmt.Printf("%d:\n", i)
-		fmt.Printf("  offset: %d\n", bs[i].Info.Offset)
-		fmt.Printf("  size: %d\n", bs[i].Info.Size)
-		fmt.Printf("  version: %d\n", pssh.Version)
-		fmt.Printf("  flags: 0x%x\n", pssh.Flags)
-		fmt.Printf("  systemId: %s\n", sysid)
-		fmt.Printf("  dataSize: %d\n", pssh.DataSize)
-		fmt.Printf("  base64: \"%s\"\n", base64.StdEncoding.EncodeToString(rawData))
-		fmt.Println()
+		reports = append(reports, buildReport(&bs[i].Info, pssh, rawData))
 	}
 
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	}
+	for i, rep := range reports {
+		printReport(i, rep)
+	}
 	return nil
 }
+
+func buildReport(bi *mp4.BoxInfo, pssh *mp4.Pssh, rawData []byte) *psshReport {
+	systemID := uuid.UUID(pssh.SystemID)
+	rep := &psshReport{
+		Offset:   bi.Offset,
+		Size:     bi.Size,
+		Version:  pssh.Version,
+		Flags:    pssh.GetFlags(),
+		SystemID: systemID.String(),
+		System:   systemNames[systemID],
+		DataSize: pssh.DataSize,
+		Base64:   base64.StdEncoding.EncodeToString(rawData),
+	}
+	for _, kid := range pssh.KIDs {
+		rep.KIDs = append(rep.KIDs, formatKID(kid.KID[:]))
+	}
+
+	var err error
+	switch systemID {
+	case systemIDWidevine:
+		rep.Widevine, err = decodeWidevine(pssh.Data)
+	case systemIDPlayReady:
+		rep.PlayReady, err = decodePlayReady(pssh.Data)
+	}
+	if err != nil {
+		rep.DecodeError = err.Error()
+	}
+	return rep
+}
+
+func printReport(i int, rep *psshReport) {
+	fmt.Printf("%d:\n", i)
+	fmt.Printf("  offset: %d\n", rep.Offset)
+	fmt.Printf("  size: %d\n", rep.Size)
+	fmt.Printf("  version: %d\n", rep.Version)
+	fmt.Printf("  flags: 0x%x\n", rep.Flags)
+	fmt.Printf("  systemId: %s\n", rep.SystemID)
+	if rep.System != "" {
+		fmt.Printf("  system: %s\n", rep.System)
+	}
+	printList("  ", "kids", rep.KIDs)
+	fmt.Printf("  dataSize: %d\n", rep.DataSize)
+	if wv := rep.Widevine; wv != nil {
+		fmt.Printf("  widevine:\n")
+		printString("    ", "algorithm", wv.Algorithm)
+		printList("    ", "keyIds", wv.KeyIDs)
+		printString("    ", "provider", wv.Provider)
+		printString("    ", "contentId", wv.ContentID)
+		printString("    ", "policy", wv.Policy)
+		if wv.CryptoPeriodIndex != nil {
+			fmt.Printf("    cryptoPeriodIndex: %d\n", *wv.CryptoPeriodIndex)
+		}
+		printString("    ", "protectionScheme", wv.ProtectionScheme)
+		printString("    ", "type", wv.Type)
+	}
+	if pr := rep.PlayReady; pr != nil {
+		fmt.Printf("  playready:\n")
+		for _, record := range pr.Records {
+			fmt.Printf("    - type: %d\n", record.Type)
+			fmt.Printf("      size: %d\n", record.Size)
+			if h := record.Header; h != nil {
+				printString("      ", "version", h.Version)
+				printList("      ", "kids", h.KIDs)
+				printString("      ", "algId", h.AlgID)
+				printString("      ", "laUrl", h.LAURL)
+				printString("      ", "luiUrl", h.LUIURL)
+				printString("      ", "dsId", h.DSID)
+				printString("      ", "checksum", h.Checksum)
+			}
+		}
+	}
+	printString("  ", "decodeError", rep.DecodeError)
+	fmt.Printf("  base64: \"%s\"\n", rep.Base64)
+	fmt.Println()
+}
+
+func printString(indent, name, value string) {
+	if value != "" {
+		fmt.Printf("%s%s: %s\n", indent, name, value)
+	}
+}
+
+func printList(indent, name string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Printf("%s%s:\n", indent, name)
+	for _, v := range values {
+		fmt.Printf("%s  - %s\n", indent, v)
+	}
+}
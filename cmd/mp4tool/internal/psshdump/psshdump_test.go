@@ -23,8 +23,11 @@ func TestPsshdump(t *testing.T) {
 				"  offset: 1307\n" +
 				"  size: 52\n" +
 				"  version: 1\n" +
-				"  flags: 0x000000\n" +
+				"  flags: 0x0\n" +
 				"  systemId: 1077efec-c0b2-4d02-ace3-3c1e52e2fb4b\n" +
+				"  system: W3C Common (ClearKey)\n" +
+				"  kids:\n" +
+				"    - 01234567-89ab-cdef-0123-456789abcdef\n" +
 				"  dataSize: 0\n" +
 				"  base64: \"AAAANHBzc2gBAAAAEHfv7MCyTQKs4zweUuL7SwAAAAEBI0VniavN7wEjRWeJq83vAAAAAA==\"\n" +
 				"\n",
@@ -36,12 +39,35 @@ func TestPsshdump(t *testing.T) {
 				"  offset: 1307\n" +
 				"  size: 52\n" +
 				"  version: 1\n" +
-				"  flags: 0x000000\n" +
+				"  flags: 0x0\n" +
 				"  systemId: 1077efec-c0b2-4d02-ace3-3c1e52e2fb4b\n" +
+				"  system: W3C Common (ClearKey)\n" +
+				"  kids:\n" +
+				"    - 01234567-89ab-cdef-0123-456789abcdef\n" +
 				"  dataSize: 0\n" +
 				"  base64: \"AAAANHBzc2gBAAAAEHfv7MCyTQKs4zweUuL7SwAAAAEBI0VniavN7wEjRWeJq83vAAAAAA==\"\n" +
 				"\n",
 		},
+		{
+			name:    "json",
+			file:    "../../../../testdata/sample_init.encv.mp4",
+			options: []string{"-format", "json"},
+			wants: "[\n" +
+				"  {\n" +
+				"    \"offset\": 1307,\n" +
+				"    \"size\": 52,\n" +
+				"    \"version\": 1,\n" +
+				"    \"flags\": 0,\n" +
+				"    \"systemId\": \"1077efec-c0b2-4d02-ace3-3c1e52e2fb4b\",\n" +
+				"    \"system\": \"W3C Common (ClearKey)\",\n" +
+				"    \"kids\": [\n" +
+				"      \"01234567-89ab-cdef-0123-456789abcdef\"\n" +
+				"    ],\n" +
+				"    \"dataSize\": 0,\n" +
+				"    \"base64\": \"AAAANHBzc2gBAAAAEHfv7MCyTQKs4zweUuL7SwAAAAEBI0VniavN7wEjRWeJq83vAAAAAA==\"\n" +
+				"  }\n" +
+				"]\n",
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
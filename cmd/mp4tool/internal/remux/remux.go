@@ -0,0 +1,105 @@
+package remux
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/abema/go-mp4"
+	"github.com/sunfish-shogi/bufseekio"
+)
+
+func Main(args []string) int {
+	flagSet := flag.NewFlagSet("remux", flag.ExitOnError)
+	tracks := flagSet.String("tracks", "", "tracks to keep (comma separated track IDs, handler types or languages, e.g. \"1,soun\")")
+	drop := flagSet.String("drop", "", "tracks to drop (same format as -tracks)")
+	add := flagSet.String("add", "", "mp4 file whose tracks are added")
+	addTracks := flagSet.String("add-tracks", "", "tracks of the -add file to add (same format as -tracks)")
+	flagSet.Usage = func() {
+		println("USAGE: mp4tool remux [OPTIONS] INPUT.mp4 OUTPUT.mp4")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+
+	if len(flagSet.Args()) < 2 {
+		flagSet.Usage()
+		return 1
+	}
+
+	input := &mp4.RemuxInput{}
+	var err error
+	if input.Tracks, err = parseSelectors(*tracks); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	if input.Drop, err = parseSelectors(*drop); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	inputs := []*mp4.RemuxInput{input}
+	paths := []string{flagSet.Args()[0]}
+	if *add != "" {
+		addInput := &mp4.RemuxInput{}
+		if addInput.Tracks, err = parseSelectors(*addTracks); err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+		inputs = append(inputs, addInput)
+		paths = append(paths, *add)
+	}
+
+	if err := remux(inputs, paths, flagSet.Args()[1]); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// parseSelectors parses comma separated track IDs, handler types (4 characters) and languages (3 characters).
+func parseSelectors(s string) ([]mp4.TrackSelector, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var selectors []mp4.TrackSelector
+	for _, e := range strings.Split(s, ",") {
+		if id, err := strconv.ParseUint(e, 10, 32); err == nil {
+			selectors = append(selectors, mp4.TrackSelector{TrackID: uint32(id)})
+			continue
+		}
+		switch len(e) {
+		case 4:
+			selectors = append(selectors, mp4.TrackSelector{HandlerType: e})
+		case 3:
+			selectors = append(selectors, mp4.TrackSelector{Language: e})
+		default:
+			return nil, fmt.Errorf("invalid track selector: %s", e)
+		}
+	}
+	return selectors, nil
+}
+
+func remux(inputs []*mp4.RemuxInput, inputPaths []string, outputPath string) error {
+	for i, inputPath := range inputPaths {
+		inputFile, err := os.Open(inputPath)
+		if err != nil {
+			return err
+		}
+		defer inputFile.Close()
+		inputs[i].Reader = bufseekio.NewReadSeeker(inputFile, 128*1024, 4)
+	}
+
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	w := bufio.NewWriterSize(outputFile, 128*1024)
+	if err := mp4.Remux(inputs, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
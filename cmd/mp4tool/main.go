@@ -4,12 +4,20 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/abema/go-mp4/cmd/mp4tool/internal/concat"
+	"github.com/abema/go-mp4/cmd/mp4tool/internal/cut"
+	"github.com/abema/go-mp4/cmd/mp4tool/internal/decrypt"
+	"github.com/abema/go-mp4/cmd/mp4tool/internal/defrag"
+	"github.com/abema/go-mp4/cmd/mp4tool/internal/demux"
 	"github.com/abema/go-mp4/cmd/mp4tool/internal/divide"
 	"github.com/abema/go-mp4/cmd/mp4tool/internal/dump"
 	"github.com/abema/go-mp4/cmd/mp4tool/internal/edit"
 	"github.com/abema/go-mp4/cmd/mp4tool/internal/extract"
+	"github.com/abema/go-mp4/cmd/mp4tool/internal/faststart"
+	"github.com/abema/go-mp4/cmd/mp4tool/internal/importer"
 	"github.com/abema/go-mp4/cmd/mp4tool/internal/probe"
 	"github.com/abema/go-mp4/cmd/mp4tool/internal/psshdump"
+	"github.com/abema/go-mp4/cmd/mp4tool/internal/remux"
 )
 
 func main() {
@@ -31,6 +39,22 @@ func main() {
 		os.Exit(probe.Main(args[1:]))
 	case "extract":
 		os.Exit(extract.Main(args[1:]))
+	case "faststart":
+		os.Exit(faststart.Main(args[1:]))
+	case "defrag":
+		os.Exit(defrag.Main(args[1:]))
+	case "cut":
+		os.Exit(cut.Main(args[1:]))
+	case "concat":
+		os.Exit(concat.Main(args[1:]))
+	case "remux":
+		os.Exit(remux.Main(args[1:]))
+	case "demux":
+		os.Exit(demux.Main(args[1:]))
+	case "import":
+		os.Exit(importer.Main(args[1:]))
+	case "decrypt":
+		os.Exit(decrypt.Main(args[1:]))
 	case "alpha":
 		os.Exit(alpha(args[1:]))
 	default:
@@ -61,9 +85,17 @@ func printUsage() {
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "COMMAND_NAME:")
 	fmt.Fprintln(os.Stderr, "  dump         : display box tree as human readable format")
-	fmt.Fprintln(os.Stderr, "  psshdump     : display pssh box attributes")
+	fmt.Fprintln(os.Stderr, "  psshdump     : display pssh box attributes and DRM system specific data")
 	fmt.Fprintln(os.Stderr, "  probe        : probe and summarize mp4 file status")
 	fmt.Fprintln(os.Stderr, "  extract      : extract specific box")
+	fmt.Fprintln(os.Stderr, "  faststart    : move moov box before mdat box")
+	fmt.Fprintln(os.Stderr, "  defrag       : convert fragmented mp4 file to non-fragmented one")
+	fmt.Fprintln(os.Stderr, "  cut          : cut mp4 file to time range without re-encoding")
+	fmt.Fprintln(os.Stderr, "  concat       : concatenate mp4 files which have the same track structure")
+	fmt.Fprintln(os.Stderr, "  remux        : extract, drop or add tracks")
+	fmt.Fprintln(os.Stderr, "  demux        : export tracks as elementary streams")
+	fmt.Fprintln(os.Stderr, "  import       : wrap an elementary stream into mp4 file")
+	fmt.Fprintln(os.Stderr, "  decrypt      : decrypt samples protected by common encryption")
 	fmt.Fprintln(os.Stderr, "  alpha edit")
 	fmt.Fprintln(os.Stderr, "  alpha divide")
 }
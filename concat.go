@@ -0,0 +1,750 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Concat concatenates MP4 files which have the same track structure.
+// The inputs must be all progressive files or all fragmented files.
+// Tracks are matched in the order of the trak boxes, and matched tracks must have the same handler type.
+// Sample entries which differ from the ones of the preceding inputs are added to the stsd boxes.
+// Each input starts at the end of the longest track of the preceding input.
+//
+// Progressive inputs are merged into the boxes of the first input which have one mdat box.
+// Timestamps are rebased to the timescales of the first input, and the edit lists have edits for each input.
+// Fragmented inputs are written after the ftyp and moov boxes of the first input,
+// and their tfdt boxes and the sequence numbers of the mfhd boxes are rewritten.
+// Matched tracks of fragmented inputs must have the same timescale.
+func Concat(rs []io.ReadSeeker, w io.Writer) error {
+	if len(rs) == 0 {
+		return errors.New("no input")
+	}
+	c := &concatenator{}
+	for i, r := range rs {
+		in, err := readConcatInput(r)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		if i != 0 {
+			if err := c.inputs[0].checkCompatible(in); err != nil {
+				return fmt.Errorf("input %d: %w", i, err)
+			}
+		}
+		c.inputs = append(c.inputs, in)
+	}
+	if err := c.mergeSampleEntries(); err != nil {
+		return err
+	}
+	if c.inputs[0].fragmented {
+		return c.concatFragments(w)
+	}
+	return c.concatSamples(w)
+}
+
+type concatenator struct {
+	inputs []*concatInput
+}
+
+type concatInput struct {
+	r              io.ReadSeeker
+	tree           *BoxTree
+	moov           *BoxNode
+	traks          []*BoxNode
+	movieTimescale uint32
+	fragmented     bool
+	descIdx        [][]uint32 // track index -> original sample description index - 1 -> new index
+}
+
+func readConcatInput(r io.ReadSeeker) (*concatInput, error) {
+	tree, err := ReadBoxTree(r)
+	if err != nil {
+		return nil, err
+	}
+	moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+	if moov == nil {
+		return nil, errors.New("moov box not found")
+	}
+	in := &concatInput{
+		r:          r,
+		tree:       tree,
+		moov:       moov,
+		traks:      moov.Find(BoxPath{BoxTypeTrak()}),
+		fragmented: moov.FindFirst(BoxPath{BoxTypeMvex()}) != nil,
+	}
+	if mvhd, ok := findPayload(moov, BoxTypeMvhd()).(*Mvhd); ok {
+		in.movieTimescale = mvhd.Timescale
+	}
+	if in.movieTimescale == 0 {
+		return nil, errors.New("movie timescale is zero")
+	}
+	return in, nil
+}
+
+func (in *concatInput) checkCompatible(other *concatInput) error {
+	if in.fragmented != other.fragmented {
+		return errors.New("progressive and fragmented inputs cannot be concatenated")
+	}
+	if len(in.traks) != len(other.traks) {
+		return fmt.Errorf("number of tracks mismatch: %d != %d", len(other.traks), len(in.traks))
+	}
+	for j := range in.traks {
+		h1, _ := findPayload(in.traks[j], BoxTypeMdia(), BoxTypeHdlr()).(*Hdlr)
+		h2, _ := findPayload(other.traks[j], BoxTypeMdia(), BoxTypeHdlr()).(*Hdlr)
+		if h1 == nil || h2 == nil || h1.HandlerType != h2.HandlerType {
+			return fmt.Errorf("handler type mismatch: track=%d", j+1)
+		}
+	}
+	return nil
+}
+
+// mergeSampleEntries adds the sample entries of the inputs to the stsd boxes of the first input
+// unless the same entries exist, and makes the maps of the sample description indices.
+func (c *concatenator) mergeSampleEntries() error {
+	base := c.inputs[0]
+	for _, in := range c.inputs {
+		in.descIdx = make([][]uint32, len(base.traks))
+	}
+	for j, trak := range base.traks {
+		stsdPath := BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd()}
+		dst := trak.FindFirst(stsdPath)
+		if dst == nil {
+			return fmt.Errorf("stsd box not found: track=%d", j+1)
+		}
+		stsd, ok := dst.Payload.(*Stsd)
+		if !ok {
+			return fmt.Errorf("unsupported stsd box: track=%d", j+1)
+		}
+		var entries [][]byte
+		for _, e := range dst.Children {
+			data, err := marshalBoxNode(e)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, data)
+		}
+		for i, in := range c.inputs {
+			if i == 0 {
+				for k := range dst.Children {
+					in.descIdx[j] = append(in.descIdx[j], uint32(k+1))
+				}
+				continue
+			}
+			src := in.traks[j].FindFirst(stsdPath)
+			if src == nil {
+				return fmt.Errorf("input %d: stsd box not found: track=%d", i, j+1)
+			}
+			for _, e := range append([]*BoxNode(nil), src.Children...) {
+				data, err := marshalBoxNode(e)
+				if err != nil {
+					return err
+				}
+				idx := -1
+				for k := range entries {
+					if bytes.Equal(entries[k], data) {
+						idx = k
+						break
+					}
+				}
+				if idx == -1 {
+					dst.AppendChild(e)
+					stsd.EntryCount++
+					entries = append(entries, data)
+					idx = len(entries) - 1
+				}
+				in.descIdx[j] = append(in.descIdx[j], uint32(idx+1))
+			}
+		}
+	}
+	return nil
+}
+
+// marshalBoxNode returns the bytes of the box including its header and children.
+func marshalBoxNode(n *BoxNode) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := (&offsetWriter{writer: buf}).writeNode(n); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (in *concatInput) mapDescIdx(track int, idx uint32) (uint32, error) {
+	if idx == 0 || int(idx) > len(in.descIdx[track]) {
+		return 0, fmt.Errorf("invalid sample description index: track=%d index=%d", track+1, idx)
+	}
+	return in.descIdx[track][idx-1], nil
+}
+
+// concatTrack is a track of the output of progressive inputs.
+type concatTrack struct {
+	trak      *BoxNode
+	stbl      *BoxNode
+	timescale uint32
+	builder   *SampleTableBuilder
+	chunks    []*mediaChunk
+	duration  uint64
+	edits     []ElstEntry // version 1 fields are used
+	sgpds     []*BoxNode
+	sbgps     []*Sbgp
+	sdtp      *Sdtp
+}
+
+// concatSamples concatenates progressive inputs.
+func (c *concatenator) concatSamples(w io.Writer) error {
+	base := c.inputs[0]
+	tracks := make([]*concatTrack, len(base.traks))
+	for j, trak := range base.traks {
+		st, err := readStblTrack(trak)
+		if err != nil {
+			return err
+		}
+		tracks[j] = &concatTrack{trak: trak, stbl: st.stbl, timescale: st.timescale, builder: NewSampleTableBuilder()}
+	}
+
+	chunks := make([][]*mediaChunk, len(c.inputs)) // input index -> chunks
+	for i, in := range c.inputs {
+		sts := make([]*stblTrack, len(in.traks))
+		presentations := make([]uint64, len(in.traks))
+		var movieDuration uint64
+		for j, trak := range in.traks {
+			st, err := readStblTrack(trak)
+			if err != nil {
+				return fmt.Errorf("input %d: %w", i, err)
+			}
+			sts[j] = st
+			t := tracks[j]
+			var mediaDuration uint64
+			for _, s := range st.samples {
+				mediaDuration += uint64(s.Duration)
+			}
+			empty, segment := inputEdit(trak, st, mediaDuration, in.movieTimescale)
+			empty = rescaleTime(empty, base.movieTimescale, in.movieTimescale)
+			segment = rescaleTime(segment, base.movieTimescale, in.movieTimescale)
+			if empty != 0 {
+				t.edits = append(t.edits, ElstEntry{SegmentDurationV1: empty, MediaTimeV1: -1, MediaRateInteger: 1})
+			}
+			if segment != 0 {
+				t.edits = append(t.edits, ElstEntry{
+					SegmentDurationV1: segment,
+					MediaTimeV1:       int64(t.duration + rescaleTime(uint64(st.mediaOffset), t.timescale, st.timescale)),
+					MediaRateInteger:  1,
+				})
+			}
+			presentations[j] = empty + segment
+			if presentations[j] > movieDuration {
+				movieDuration = presentations[j]
+			}
+
+			var chunk *mediaChunk
+			for k, s := range st.samples {
+				if chunk == nil || s.Chunk != st.samples[k-1].Chunk {
+					chunk = &mediaChunk{srcOffset: st.offsets[k]}
+					t.chunks = append(t.chunks, chunk)
+					chunks[i] = append(chunks[i], chunk)
+				}
+				chunk.size += uint64(s.Size)
+				chunk.sampleCount++
+				descIdx, err := in.mapDescIdx(j, s.SampleDescriptionIndex)
+				if err != nil {
+					return fmt.Errorf("input %d: %w", i, err)
+				}
+				chunk.descIdx = descIdx
+				if st.timescale != t.timescale {
+					dts := rescaleTime(st.dts[k], t.timescale, st.timescale)
+					s.Duration = uint32(rescaleTime(st.dts[k]+uint64(s.Duration), t.timescale, st.timescale) - dts)
+					s.CompositionTimeOffset = int64(math.Round(float64(s.CompositionTimeOffset) * float64(t.timescale) / float64(st.timescale)))
+				}
+				s.Chunk = uint32(len(t.chunks) - 1)
+				s.SampleDescriptionIndex = descIdx
+				if err := t.builder.AddSample(s); err != nil {
+					return err
+				}
+			}
+			t.duration += rescaleTime(mediaDuration, t.timescale, st.timescale)
+		}
+
+		// align the start of the next input
+		if i != len(c.inputs)-1 {
+			for j, t := range tracks {
+				if presentations[j] < movieDuration {
+					t.edits = append(t.edits, ElstEntry{SegmentDurationV1: movieDuration - presentations[j], MediaTimeV1: -1, MediaRateInteger: 1})
+				}
+			}
+		}
+		if err := mergeSampleGroups(tracks, sts, i); err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+	}
+
+	durations := make(map[*BoxNode]uint64, len(tracks))
+	for _, t := range tracks {
+		if err := setEditList(t.trak, newElst(t.edits)); err != nil {
+			return err
+		}
+		durations[t.trak] = t.duration
+	}
+	updateDurations(base.moov, durations)
+
+	var dataSize uint64
+	for i := range chunks {
+		sort.SliceStable(chunks[i], func(a, b int) bool {
+			return chunks[i][a].srcOffset < chunks[i][b].srcOffset
+		})
+		for _, chunk := range chunks[i] {
+			chunk.dstOffset = dataSize
+			dataSize += chunk.size
+		}
+	}
+	build := func(base uint64) error {
+		for _, t := range tracks {
+			if err := t.buildSampleTable(base); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	writeData := func(w io.Writer) error {
+		for i, in := range c.inputs {
+			if err := copyChunks(w, in.r, chunks[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return writeWithMdat(w, replaceMdats(base.tree), dataSize, build, writeData)
+}
+
+// inputEdit returns the durations of the leading empty edit and the presented media in the movie timescale.
+func inputEdit(trak *BoxNode, st *stblTrack, mediaDuration uint64, movieTimescale uint32) (empty, segment uint64) {
+	if elst, ok := findPayload(trak, BoxTypeEdts(), BoxTypeElst()).(*Elst); ok {
+		for i := range elst.Entries {
+			if elst.GetMediaTime(i) == -1 {
+				if segment == 0 {
+					empty += elst.GetSegmentDuration(i)
+				}
+				continue
+			}
+			segment = elst.GetSegmentDuration(i)
+		}
+	}
+	if segment == 0 && mediaDuration > uint64(st.mediaOffset) {
+		segment = rescaleTime(mediaDuration-uint64(st.mediaOffset), movieTimescale, st.timescale)
+	}
+	return empty, segment
+}
+
+func newElst(entries []ElstEntry) *Elst {
+	elst := &Elst{EntryCount: uint32(len(entries)), Entries: entries}
+	for _, e := range entries {
+		if e.SegmentDurationV1 > math.MaxUint32 || e.MediaTimeV1 > math.MaxInt32 {
+			elst.SetVersion(1)
+			return elst
+		}
+	}
+	for i := range entries {
+		entries[i].SegmentDurationV0 = uint32(entries[i].SegmentDurationV1)
+		entries[i].MediaTimeV0 = int32(entries[i].MediaTimeV1)
+		entries[i].SegmentDurationV1 = 0
+		entries[i].MediaTimeV1 = 0
+	}
+	return elst
+}
+
+// mergeSampleGroups appends the sample groups and the sample dependencies of the input to the tracks.
+// Group description indices are renumbered by the entries of the preceding inputs.
+func mergeSampleGroups(tracks []*concatTrack, sts []*stblTrack, input int) error {
+	for j, t := range tracks {
+		st := sts[j]
+		count := uint32(len(st.samples))
+		prevCount := t.builder.SampleCount() - count // number of samples of the preceding inputs
+
+		bases := make(map[uint32]uint32)
+		var sbgps []*Sbgp
+		var sdtp *Sdtp
+		for _, n := range st.stbl.Children {
+			switch box := n.Payload.(type) {
+			case *Sgpd:
+				groupingType := sgpdGroupingType(box)
+				var dst *Sgpd
+				for _, n := range t.sgpds {
+					if sgpd, ok := n.Payload.(*Sgpd); ok && sgpdGroupingType(sgpd) == groupingType {
+						dst = sgpd
+						break
+					}
+				}
+				if dst == nil {
+					dst = &Sgpd{GroupingType: box.GroupingType, DefaultLength: box.DefaultLength, DefaultSampleDescriptionIndex: box.DefaultSampleDescriptionIndex}
+					dst.SetVersion(box.GetVersion())
+					t.sgpds = append(t.sgpds, NewBoxNode(dst))
+				}
+				bases[groupingType] = dst.EntryCount
+				if err := appendSgpdEntries(dst, box); err != nil {
+					return err
+				}
+			case *Sbgp:
+				sbgps = append(sbgps, box)
+			case *Sdtp:
+				sdtp = box
+			}
+		}
+
+		for _, src := range sbgps {
+			var dst *Sbgp
+			for _, sbgp := range t.sbgps {
+				if sbgp.GroupingType == src.GroupingType {
+					dst = sbgp
+					break
+				}
+			}
+			if dst == nil {
+				dst = &Sbgp{GroupingType: src.GroupingType, GroupingTypeParameter: src.GroupingTypeParameter}
+				dst.SetVersion(src.GetVersion())
+				appendSbgpEntry(dst, prevCount, 0)
+				t.sbgps = append(t.sbgps, dst)
+			}
+			remain := count
+			for _, e := range src.Entries {
+				n := e.SampleCount
+				if n > remain {
+					n = remain
+				}
+				index := e.GroupDescriptionIndex
+				if index != 0 {
+					index += bases[src.GroupingType]
+				}
+				appendSbgpEntry(dst, n, index)
+				remain -= n
+			}
+			appendSbgpEntry(dst, remain, 0)
+		}
+		for _, dst := range t.sbgps {
+			var total uint32
+			for _, e := range dst.Entries {
+				total += e.SampleCount
+			}
+			appendSbgpEntry(dst, prevCount+count-total, 0)
+		}
+
+		// sample dependencies are kept only when all inputs have them
+		if input == 0 {
+			t.sdtp = sdtp
+		}
+		if t.sdtp != nil && (sdtp == nil || len(sdtp.Samples) != int(count)) {
+			t.sdtp = nil
+		} else if t.sdtp != nil && input != 0 {
+			t.sdtp.Samples = append(t.sdtp.Samples, sdtp.Samples...)
+		}
+	}
+	return nil
+}
+
+func appendSbgpEntry(sbgp *Sbgp, count, index uint32) {
+	if count == 0 {
+		return
+	}
+	if n := len(sbgp.Entries); n != 0 && sbgp.Entries[n-1].GroupDescriptionIndex == index {
+		sbgp.Entries[n-1].SampleCount += count
+		return
+	}
+	sbgp.Entries = append(sbgp.Entries, SbgpEntry{SampleCount: count, GroupDescriptionIndex: index})
+	sbgp.EntryCount = uint32(len(sbgp.Entries))
+}
+
+// buildSampleTable replaces the sample table of the stbl box by the merged one.
+// base is the offset of the payload of the new mdat box.
+func (t *concatTrack) buildSampleTable(base uint64) error {
+	offsets := make([]uint64, len(t.chunks))
+	for i, c := range t.chunks {
+		offsets[i] = base + c.dstOffset
+	}
+	st, err := t.builder.Build(offsets)
+	if err != nil {
+		return err
+	}
+
+	var children []*BoxNode
+	for _, c := range t.stbl.Children {
+		c.Parent = nil
+		switch c.Info.Type {
+		case BoxTypeStts(), BoxTypeCtts(), BoxTypeStss(), BoxTypeStsc(), BoxTypeStsz(), StrToBoxType("stz2"),
+			BoxTypeStco(), BoxTypeCo64(), BoxTypeSdtp(), BoxTypeCslg(), StrToBoxType("stps"),
+			BoxTypeSgpd(), BoxTypeSbgp(), StrToBoxType("subs"):
+		default:
+			children = append(children, c)
+		}
+	}
+	for _, box := range st.Boxes() {
+		children = append(children, NewBoxNode(box))
+	}
+	children = append(children, t.sgpds...)
+	for _, sbgp := range t.sbgps {
+		children = append(children, NewBoxNode(sbgp))
+	}
+	if t.sdtp != nil {
+		children = append(children, NewBoxNode(t.sdtp))
+	}
+	t.stbl.Children = nil
+	for _, c := range children {
+		t.stbl.AppendChild(c)
+	}
+	return nil
+}
+
+// fragmentRange is the decode times of the samples of a track in a fragmented input.
+type fragmentRange struct {
+	first, end uint64
+	trafs      map[uint64]uint64 // moof offset -> decode time of the first sample
+}
+
+// concatFragments concatenates fragmented inputs.
+func (c *concatenator) concatFragments(w io.Writer) error {
+	base := c.inputs[0]
+	trackIDs := make([]uint32, len(base.traks))
+	timescales := make([]uint32, len(base.traks))
+	for j, trak := range base.traks {
+		if tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd); ok {
+			trackIDs[j] = tkhd.TrackID
+		}
+		if mdhd, ok := findPayload(trak, BoxTypeMdia(), BoxTypeMdhd()).(*Mdhd); ok {
+			timescales[j] = mdhd.Timescale
+		}
+		if timescales[j] == 0 {
+			return fmt.Errorf("timescale is zero: trackID=%d", trackIDs[j])
+		}
+	}
+	baseTrexs := base.trexs(trackIDs)
+
+	ranges := make([][]*fragmentRange, len(c.inputs))
+	durations := make([]float64, len(c.inputs)) // durations of the inputs in seconds
+	var total float64
+	for i, in := range c.inputs {
+		for j, trak := range in.traks {
+			if mdhd, ok := findPayload(trak, BoxTypeMdia(), BoxTypeMdhd()).(*Mdhd); !ok || mdhd.Timescale != timescales[j] {
+				return fmt.Errorf("input %d: timescale mismatch: track=%d", i, j+1)
+			}
+		}
+		var err error
+		if ranges[i], err = in.readFragmentRanges(); err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		for j, r := range ranges[i] {
+			if d := float64(r.end-r.first) / float64(timescales[j]); d > durations[i] {
+				durations[i] = d
+			}
+		}
+		total += durations[i]
+	}
+	if mehd, ok := findPayload(base.moov, BoxTypeMvex(), BoxTypeMehd()).(*Mehd); ok {
+		duration := uint64(math.Round(total * float64(base.movieTimescale)))
+		if duration > math.MaxUint32 {
+			mehd.SetVersion(1)
+		}
+		mehd.FragmentDurationV0, mehd.FragmentDurationV1 = uint32(duration), duration
+	}
+
+	// the initialization segment of the first input
+	ow := &offsetWriter{writer: w}
+	if ftyp := base.tree.FindFirst(BoxPath{BoxTypeFtyp()}); ftyp != nil {
+		if err := ow.writeNode(ftyp); err != nil {
+			return err
+		}
+	}
+	if err := ow.writeNode(base.moov); err != nil {
+		return err
+	}
+
+	var seq uint32
+	var start float64 // start of the input in seconds
+	for i, in := range c.inputs {
+		idx := make(map[uint32]int, len(in.traks)) // track ID -> track index
+		for j, trak := range in.traks {
+			if tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd); ok {
+				idx[tkhd.TrackID] = j
+			}
+		}
+		srcIDs := make([]uint32, len(in.traks))
+		for id, j := range idx {
+			srcIDs[j] = id
+		}
+		trexs := in.trexs(srcIDs)
+		relocTrexs := make(map[uint32]*Trex, len(trexs)) // output track ID -> trex box of the input
+		for j, trex := range trexs {
+			relocTrexs[trackIDs[j]] = trex
+		}
+
+		var children []*BoxNode
+		for _, n := range in.tree.Children {
+			switch n.Info.Type {
+			case BoxTypeMoof(), BoxTypeMdat(), BoxTypeEmsg(), StrToBoxType("prft"):
+				children = append(children, n)
+			}
+		}
+		for _, moof := range children {
+			if moof.Info.Type != BoxTypeMoof() {
+				continue
+			}
+			seq++
+			if mfhd, ok := findPayload(moof, BoxTypeMfhd()).(*Mfhd); ok {
+				mfhd.SequenceNumber = seq
+			}
+			for _, traf := range moof.Find(BoxPath{BoxTypeTraf()}) {
+				tfhdNode := traf.FindFirst(BoxPath{BoxTypeTfhd()})
+				if tfhdNode == nil {
+					return fmt.Errorf("input %d: tfhd box not found", i)
+				}
+				tfhd, ok := tfhdNode.Payload.(*Tfhd)
+				if !ok {
+					return fmt.Errorf("input %d: unsupported tfhd box", i)
+				}
+				j, ok := idx[tfhd.TrackID]
+				if !ok {
+					return fmt.Errorf("input %d: trak box not found: trackID=%d", i, tfhd.TrackID)
+				}
+				tfhd.TrackID = trackIDs[j]
+				if err := rewriteTfhd(tfhd, in, j, trexs[j], baseTrexs[j]); err != nil {
+					return fmt.Errorf("input %d: %w", i, err)
+				}
+
+				r := ranges[i][j]
+				offset := uint64(math.Round(start * float64(timescales[j])))
+				if tfdt, ok := findPayload(traf, BoxTypeTfdt()).(*Tfdt); ok {
+					setBaseMediaDecodeTime(tfdt, tfdt.GetBaseMediaDecodeTime()-r.first+offset)
+				} else if dts, ok := r.trafs[moof.Info.Offset]; ok {
+					tfdt := &Tfdt{}
+					setBaseMediaDecodeTime(tfdt, dts-r.first+offset)
+					if err := traf.InsertAfter(tfhdNode, NewBoxNode(tfdt)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		start += durations[i]
+
+		// the fragments refer to their data by the offsets in the input,
+		// and the sizes of implicit samples come from the trex boxes of the input
+		in.tree.Children = nil
+		for _, n := range children {
+			n.Parent = nil
+			in.tree.AppendChild(n)
+		}
+		if err := in.tree.relocate(uint64(ow.offset), relocTrexs); err != nil {
+			return err
+		}
+		for _, n := range in.tree.Children {
+			if err := n.writeTo(ow); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trexs returns the trex boxes of the tracks. Missing boxes are replaced by empty ones.
+func (in *concatInput) trexs(trackIDs []uint32) []*Trex {
+	trexs := make([]*Trex, len(trackIDs))
+	for _, n := range in.moov.Find(BoxPath{BoxTypeMvex(), BoxTypeTrex()}) {
+		trex, ok := n.Payload.(*Trex)
+		if !ok {
+			continue
+		}
+		for j, id := range trackIDs {
+			if trex.TrackID == id {
+				trexs[j] = trex
+			}
+		}
+	}
+	for j := range trexs {
+		if trexs[j] == nil {
+			trexs[j] = &Trex{TrackID: trackIDs[j], DefaultSampleDescriptionIndex: 1}
+		}
+	}
+	return trexs
+}
+
+// readFragmentRanges reads the decode times of the samples of each track.
+func (in *concatInput) readFragmentRanges() ([]*fragmentRange, error) {
+	its, err := NewSampleIterators(in.r)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]*fragmentRange, len(in.traks))
+	for j, trak := range in.traks {
+		ranges[j] = &fragmentRange{trafs: make(map[uint64]uint64)}
+		tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd)
+		if !ok {
+			continue
+		}
+		for _, it := range its {
+			if it.TrackID() != tkhd.TrackID {
+				continue
+			}
+			r := ranges[j]
+			var count int
+			for {
+				s, err := it.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return nil, err
+				}
+				if s.MoofOffset == 0 {
+					return nil, fmt.Errorf("samples in moov box are not supported: trackID=%d", tkhd.TrackID)
+				}
+				if count == 0 {
+					r.first = s.DecodeTime
+				}
+				if _, ok := r.trafs[s.MoofOffset]; !ok {
+					r.trafs[s.MoofOffset] = s.DecodeTime
+				}
+				if end := s.DecodeTime + uint64(s.Duration); end > r.end {
+					r.end = end
+				}
+				count++
+			}
+			if count == 0 {
+				r.end = r.first
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// rewriteTfhd makes the tfhd box keep its defaults and sample description index under the trex box of the output.
+func rewriteTfhd(tfhd *Tfhd, in *concatInput, track int, src, dst *Trex) error {
+	descIdx := src.DefaultSampleDescriptionIndex
+	if tfhd.CheckFlag(TfhdSampleDescriptionIndexPresent) {
+		descIdx = tfhd.SampleDescriptionIndex
+	}
+	mapped, err := in.mapDescIdx(track, descIdx)
+	if err != nil {
+		return err
+	}
+	if tfhd.CheckFlag(TfhdSampleDescriptionIndexPresent) || mapped != dst.DefaultSampleDescriptionIndex {
+		tfhd.AddFlag(TfhdSampleDescriptionIndexPresent)
+		tfhd.SampleDescriptionIndex = mapped
+	}
+	if !tfhd.CheckFlag(TfhdDefaultSampleDurationPresent) && src.DefaultSampleDuration != dst.DefaultSampleDuration {
+		tfhd.AddFlag(TfhdDefaultSampleDurationPresent)
+		tfhd.DefaultSampleDuration = src.DefaultSampleDuration
+	}
+	if !tfhd.CheckFlag(TfhdDefaultSampleSizePresent) && src.DefaultSampleSize != dst.DefaultSampleSize {
+		tfhd.AddFlag(TfhdDefaultSampleSizePresent)
+		tfhd.DefaultSampleSize = src.DefaultSampleSize
+	}
+	if !tfhd.CheckFlag(TfhdDefaultSampleFlagsPresent) && src.DefaultSampleFlags != dst.DefaultSampleFlags {
+		tfhd.AddFlag(TfhdDefaultSampleFlagsPresent)
+		tfhd.DefaultSampleFlags = src.DefaultSampleFlags
+	}
+	return nil
+}
+
+func setBaseMediaDecodeTime(tfdt *Tfdt, t uint64) {
+	if t > math.MaxUint32 {
+		tfdt.SetVersion(1)
+	}
+	tfdt.BaseMediaDecodeTimeV0, tfdt.BaseMediaDecodeTimeV1 = uint32(t), t
+}
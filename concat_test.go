@@ -0,0 +1,227 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcat(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Concat([]io.ReadSeeker{bytes.NewReader(input), bytes.NewReader(input)}, output))
+	r := bytes.NewReader(output.Bytes())
+
+	data := readAllSampleData(t, bytes.NewReader(input))
+	for _, trackID := range []uint32{1, 2} {
+		expected := readTrackSampleData(t, bytes.NewReader(input), trackID)
+		assert.Equal(t, append(expected, expected...), readTrackSampleData(t, r, trackID))
+	}
+	assert.Len(t, readAllSampleData(t, r), len(data)*2)
+
+	info, err := Probe(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2000, info.Duration)
+	require.Len(t, info.Tracks, 2)
+	assert.EqualValues(t, 20480, info.Tracks[0].Duration)
+	assert.Equal(t, EditList{
+		{MediaTime: 2048, SegmentDuration: 1000, MediaRate: 1},
+		{MediaTime: 10240 + 2048, SegmentDuration: 1000, MediaRate: 1},
+	}, info.Tracks[0].EditList)
+	assert.EqualValues(t, 45124*2, info.Tracks[1].Duration)
+	assert.Equal(t, EditList{
+		{MediaTime: 1024, SegmentDuration: 1000, MediaRate: 1},
+		{MediaTime: 45124 + 1024, SegmentDuration: 1000, MediaRate: 1},
+	}, info.Tracks[1].EditList)
+
+	tree, err := ReadBoxTree(r)
+	require.NoError(t, err)
+	assert.Len(t, tree.Find(BoxPath{BoxTypeMdat()}), 1)
+	for _, stsd := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd()}) {
+		assert.Equal(t, uint32(1), stsd.Payload.(*Stsd).EntryCount)
+		assert.Len(t, stsd.Children, 1)
+	}
+	stbl := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})[1]
+	assert.Equal(t, uint32(2), stbl.FindFirst(BoxPath{BoxTypeSgpd()}).Payload.(*Sgpd).EntryCount)
+	assert.Equal(t, []SbgpEntry{
+		{SampleCount: 44, GroupDescriptionIndex: 1},
+		{SampleCount: 44, GroupDescriptionIndex: 2},
+	}, stbl.FindFirst(BoxPath{BoxTypeSbgp()}).Payload.(*Sbgp).Entries)
+}
+
+func TestConcatDifferentSampleEntryAndTimescale(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+
+	// the second input has another video resolution and the doubled video timescale
+	tree, err := ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	trak := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak()})
+	trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMdhd()}).Payload.(*Mdhd).Timescale = 20480
+	avc1 := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAvc1()})
+	avc1.Payload.(*VisualSampleEntry).Width *= 2
+	second := writeBoxTree(t, tree)
+
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Concat([]io.ReadSeeker{bytes.NewReader(input), bytes.NewReader(second)}, output))
+	r := bytes.NewReader(output.Bytes())
+
+	expected := readTrackSampleData(t, bytes.NewReader(input), 1)
+	assert.Equal(t, append(expected, expected...), readTrackSampleData(t, r, 1))
+
+	it, err := NewSampleIterator(r, 1)
+	require.NoError(t, err)
+	samples := readAllSamples(t, it)
+	require.Len(t, samples, 20)
+	for i, s := range samples[:10] {
+		assert.Equal(t, uint32(1024), s.Duration, "sample %d", i)
+		assert.Equal(t, uint32(1), s.SampleDescriptionIndex, "sample %d", i)
+	}
+	for i, s := range samples[10:] {
+		assert.Equal(t, uint64(10240+512*i), s.DecodeTime, "sample %d", i+10)
+		assert.Equal(t, uint32(512), s.Duration, "sample %d", i+10)
+		assert.Equal(t, samples[i].CompositionTimeOffset/2, s.CompositionTimeOffset, "sample %d", i+10)
+		assert.Equal(t, uint32(2), s.SampleDescriptionIndex, "sample %d", i+10)
+	}
+
+	info, err := Probe(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, 10240+5120, info.Tracks[0].Duration)
+	assert.Equal(t, EditList{
+		{MediaTime: 2048, SegmentDuration: 1000, MediaRate: 1},
+		{MediaTime: 10240 + 1024, SegmentDuration: 1000, MediaRate: 1},
+	}, info.Tracks[0].EditList)
+
+	tree, err = ReadBoxTree(r)
+	require.NoError(t, err)
+	stsd := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd()})
+	assert.Equal(t, uint32(2), stsd.Payload.(*Stsd).EntryCount)
+	require.Len(t, stsd.Children, 2)
+	assert.Equal(t, 2*stsd.Children[0].Payload.(*VisualSampleEntry).Width, stsd.Children[1].Payload.(*VisualSampleEntry).Width)
+}
+
+func TestConcatFragmented(t *testing.T) {
+	input := readFile(t, "./testdata/sample_fragmented.mp4")
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Concat([]io.ReadSeeker{bytes.NewReader(input), bytes.NewReader(input)}, output))
+	r := bytes.NewReader(output.Bytes())
+
+	its, err := NewSampleIterators(bytes.NewReader(input))
+	require.NoError(t, err)
+	samples := make([][]*MediaSample, len(its))
+	timescales := make([]uint32, len(its))
+	var duration float64
+	for i, it := range its {
+		samples[i] = readAllSamples(t, it)
+		timescales[i] = it.Timescale()
+		first, last := samples[i][0], samples[i][len(samples[i])-1]
+		if d := float64(last.DecodeTime+uint64(last.Duration)-first.DecodeTime) / float64(it.Timescale()); d > duration {
+			duration = d
+		}
+	}
+
+	its, err = NewSampleIterators(r)
+	require.NoError(t, err)
+	require.Len(t, its, len(samples))
+	for i, it := range its {
+		actual := readAllSamples(t, it)
+		require.Len(t, actual, len(samples[i])*2)
+		offset := uint64(math.Round(duration*float64(timescales[i]))) - samples[i][0].DecodeTime
+		for j, s := range samples[i] {
+			assert.Equal(t, s.DecodeTime, actual[j].DecodeTime)
+			assert.Equal(t, s.DecodeTime+offset, actual[len(samples[i])+j].DecodeTime)
+			assert.Equal(t, s.Duration, actual[len(samples[i])+j].Duration)
+			assert.Equal(t, s.CompositionTimeOffset, actual[len(samples[i])+j].CompositionTimeOffset)
+		}
+	}
+	for _, it := range its {
+		expected := readTrackSampleData(t, bytes.NewReader(input), it.TrackID())
+		assert.Equal(t, append(expected, expected...), readTrackSampleData(t, r, it.TrackID()))
+	}
+
+	tree, err := ReadBoxTree(r)
+	require.NoError(t, err)
+	assert.Len(t, tree.Find(BoxPath{BoxTypeMoov()}), 1)
+	moofs := tree.Find(BoxPath{BoxTypeMoof()})
+	require.NotEmpty(t, moofs)
+	for i, moof := range moofs {
+		assert.Equal(t, uint32(i+1), moof.FindFirst(BoxPath{BoxTypeMfhd()}).Payload.(*Mfhd).SequenceNumber)
+	}
+}
+
+func TestConcatFragmentedWithTrexDefaults(t *testing.T) {
+	tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample_fragmented.mp4")))
+	require.NoError(t, err)
+	for _, n := range append([]*BoxNode(nil), tree.Children...) {
+		if n.Info.Type != BoxTypeFtyp() && n.Info.Type != BoxTypeMoov() {
+			n.Remove()
+		}
+	}
+	for _, n := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypeMvex(), BoxTypeTrex()}) {
+		trex := n.Payload.(*Trex)
+		trex.DefaultSampleDuration = 1024
+		if trex.TrackID == 2 {
+			trex.DefaultSampleSize = 10
+		}
+	}
+
+	// both inputs share the trex boxes, and the data offset of the video trun is
+	// relative to the end of the audio samples whose sizes come from the trex box
+	audioTrun := &Trun{SampleCount: 3, Entries: make([]TrunEntry, 3)}
+	audioTrun.SetFlags(TrunDataOffsetPresent)
+	videoTrun := &Trun{SampleCount: 2, Entries: []TrunEntry{{SampleSize: 5}, {SampleSize: 7}}}
+	videoTrun.SetFlags(TrunDataOffsetPresent | TrunSampleSizePresent)
+	moof := NewBoxNode(&Moof{},
+		NewBoxNode(&Mfhd{SequenceNumber: 1}),
+		NewBoxNode(&Traf{}, NewBoxNode(&Tfhd{TrackID: 2}), NewBoxNode(audioTrun)),
+		NewBoxNode(&Traf{}, NewBoxNode(&Tfhd{TrackID: 1}), NewBoxNode(videoTrun)),
+	)
+	data := make([]byte, 42)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// the free box between the mdat boxes is dropped by Concat
+	tree.AppendChild(moof)
+	tree.AppendChild(NewRawBoxNode(BoxTypeMdat(), data[:30]))
+	tree.AppendChild(NewRawBoxNode(BoxTypeFree(), nil))
+	tree.AppendChild(NewRawBoxNode(BoxTypeMdat(), data[30:]))
+	require.NoError(t, tree.Relocate(0))
+	audioTrun.DataOffset = int32(moof.Info.Size + 8)
+	videoTrun.DataOffset = 8 + 8
+	input := writeBoxTree(t, tree)
+
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Concat([]io.ReadSeeker{bytes.NewReader(input), bytes.NewReader(input)}, output))
+	r := bytes.NewReader(output.Bytes())
+	expected := map[uint32][][]byte{
+		1: {data[30:35], data[35:42]},
+		2: {data[0:10], data[10:20], data[20:30]},
+	}
+	for trackID, samples := range expected {
+		assert.Equal(t, append(samples, samples...), readTrackSampleData(t, r, trackID), "track %d", trackID)
+	}
+
+	// the defaults are left to the trex boxes
+	outTree, err := ReadBoxTree(r)
+	require.NoError(t, err)
+	for _, n := range outTree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf(), BoxTypeTfhd()}) {
+		assert.False(t, n.Payload.(*Tfhd).CheckFlag(TfhdDefaultSampleSizePresent))
+	}
+}
+
+func TestConcatErrors(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+	fragmented := readFile(t, "./testdata/sample_fragmented.mp4")
+	assert.Error(t, Concat(nil, io.Discard))
+	assert.Error(t, Concat([]io.ReadSeeker{bytes.NewReader(input), bytes.NewReader(fragmented)}, io.Discard))
+
+	// the second input has only the video track
+	tree, err := ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak()})[1].Remove()
+	videoOnly := writeBoxTree(t, tree)
+	assert.Error(t, Concat([]io.ReadSeeker{bytes.NewReader(input), bytes.NewReader(videoOnly)}, io.Discard))
+}
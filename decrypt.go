@@ -0,0 +1,432 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Decrypt writes the file whose samples protected by the Common Encryption are decrypted.
+// All of cenc, cens, cbc1 and cbcs schemes are supported, and keys maps KIDs to 16-byte keys.
+// IVs and subsample maps are read from senc boxes or saiz and saio boxes,
+// and the keys and the IVs are switched by the seig sample groups.
+// The sample entries are restored from the frma boxes, and the sinf, senc, saiz, saio and pssh boxes
+// and the seig sample groups are removed.
+func Decrypt(r io.ReadSeeker, w io.Writer, keys map[[16]byte][]byte) error {
+	tree, err := ReadBoxTree(r)
+	if err != nil {
+		return err
+	}
+	if tree.FindFirst(BoxPath{BoxTypeMoov()}) == nil {
+		return errors.New("moov box not found")
+	}
+
+	var samples []*cencSample
+	for _, trak := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak()}) {
+		s, err := readCENCSamples(r, tree, trak, keys)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, s...)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].offset < samples[j].offset })
+	for i := 1; i < len(samples); i++ {
+		if samples[i-1].offset+uint64(samples[i-1].size) > samples[i].offset {
+			return fmt.Errorf("samples overlap: offset=%d", samples[i].offset)
+		}
+	}
+	for _, n := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypePssh()}) {
+		n.Remove()
+	}
+	for _, n := range tree.Find(BoxPath{BoxTypeMoof(), BoxTypePssh()}) {
+		n.Remove()
+	}
+
+	cr := &cencReader{r: r, samples: samples}
+	for _, n := range tree.Children {
+		if n.Info.Type == BoxTypeMdat() && n.src != nil {
+			n.src = cr
+		}
+	}
+	_, err = tree.WriteTo(w)
+	return err
+}
+
+// readCENCSamples returns the protected samples of the track.
+// The sample entries of the track are restored, and the boxes describing the encryption are removed.
+func readCENCSamples(r io.ReadSeeker, tree *BoxTree, trak *BoxNode, keys map[[16]byte][]byte) ([]*cencSample, error) {
+	tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd)
+	if !ok {
+		return nil, errors.New("tkhd box not found")
+	}
+	stbl := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+	if stbl == nil {
+		return nil, errors.New("stbl box not found")
+	}
+	stsd := stbl.FindFirst(BoxPath{BoxTypeStsd()})
+	if stsd == nil {
+		return nil, errors.New("stsd box not found")
+	}
+
+	schemes := make(map[uint32]*cencScheme) // indexed by sample description index
+	for i, entry := range stsd.Children {
+		sinf := entry.FindFirst(BoxPath{BoxTypeSinf()})
+		if sinf == nil {
+			continue
+		}
+		frma, ok := findPayload(sinf, BoxTypeFrma()).(*Frma)
+		if !ok {
+			return nil, errors.New("frma box not found")
+		}
+		schm, ok := findPayload(sinf, BoxTypeSchm()).(*Schm)
+		if !ok {
+			return nil, errors.New("schm box not found")
+		}
+		if !isCENCScheme(schm.SchemeType) {
+			return nil, fmt.Errorf("unsupported scheme type: %s", string(schm.SchemeType[:]))
+		}
+		tenc, ok := findPayload(sinf, BoxTypeSchi(), BoxTypeTenc()).(*Tenc)
+		if !ok {
+			return nil, errors.New("tenc box not found")
+		}
+		schemes[uint32(i+1)] = &cencScheme{schemeType: schm.SchemeType, tenc: tenc}
+
+		entry.Info.Type = BoxType(frma.DataFormat)
+		if payload, ok := entry.Payload.(IAnyType); ok {
+			payload.SetType(entry.Info.Type)
+		}
+		sinf.Remove()
+	}
+	if len(schemes) == 0 {
+		return nil, nil
+	}
+
+	it, err := NewSampleIterator(r, tkhd.TrackID)
+	if err != nil {
+		return nil, err
+	}
+	var media []*MediaSample
+	for {
+		s, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		media = append(media, s)
+	}
+
+	d := &cencSampleReader{
+		r:       r,
+		keys:    keys,
+		schemes: schemes,
+		media:   media,
+	}
+	if sgpd := findSeigSgpd(stbl); sgpd != nil {
+		if d.globalSeig, err = GetSeigEntries(sgpd); err != nil {
+			return nil, err
+		}
+	}
+
+	var count uint64
+	if stsz, ok := findPayload(stbl, BoxTypeStsz()).(*Stsz); ok {
+		count = uint64(stsz.SampleCount)
+	}
+	if count != 0 {
+		// saio boxes in stbl box have an offset per chunk
+		var chunks []uint64
+		stsc, _ := findPayload(stbl, BoxTypeStsc()).(*Stsc)
+		var chunkCount int
+		if stco, ok := findPayload(stbl, BoxTypeStco()).(*Stco); ok {
+			chunkCount = len(stco.ChunkOffset)
+		} else if co64, ok := findPayload(stbl, BoxTypeCo64()).(*Co64); ok {
+			chunkCount = len(co64.ChunkOffset)
+		}
+		if stsc != nil {
+			for i, e := range stsc.Entries {
+				last := chunkCount
+				if i+1 < len(stsc.Entries) {
+					last = int(stsc.Entries[i+1].FirstChunk) - 1
+				}
+				for c := int(e.FirstChunk); c <= last; c++ {
+					chunks = append(chunks, uint64(e.SamplesPerChunk))
+				}
+			}
+		}
+		if err := d.read(stbl, 0, count, chunks, 0); err != nil {
+			return nil, err
+		}
+	}
+	removeCENCBoxes(stbl)
+
+	trexs := findTrexs(&tree.BoxNode)
+	for _, moof := range tree.Find(BoxPath{BoxTypeMoof()}) {
+		for _, traf := range moof.Find(BoxPath{BoxTypeTraf()}) {
+			tfhd, ok := findPayload(traf, BoxTypeTfhd()).(*Tfhd)
+			if !ok {
+				return nil, errors.New("tfhd box not found")
+			}
+			if tfhd.TrackID != tkhd.TrackID {
+				continue
+			}
+			var runs []uint64
+			var total uint64
+			for _, trun := range traf.Find(BoxPath{BoxTypeTrun()}) {
+				runs = append(runs, uint64(trun.Payload.(*Trun).SampleCount))
+				total += uint64(trun.Payload.(*Trun).SampleCount)
+			}
+			base, err := trafBaseOffset(traf, trexs)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.read(traf, count, total, runs, base); err != nil {
+				return nil, err
+			}
+			removeCENCBoxes(traf)
+			count += total
+		}
+	}
+	return d.samples, nil
+}
+
+// cencSampleReader builds the decryption parameters of the samples of a track.
+type cencSampleReader struct {
+	r          io.ReadSeeker
+	keys       map[[16]byte][]byte
+	schemes    map[uint32]*cencScheme
+	media      []*MediaSample
+	globalSeig []SeigEntry
+	samples    []*cencSample
+}
+
+// read reads the parameters of the count samples starting from index, which are described by
+// the boxes in the stbl or traf box. groups are the numbers of samples which each saio offset points to.
+func (d *cencSampleReader) read(parent *BoxNode, index, count uint64, groups []uint64, base uint64) error {
+	if index+count > uint64(len(d.media)) {
+		return errors.New("inconsistent sample count")
+	}
+
+	var localSeig []SeigEntry
+	if sgpd := findSeigSgpd(parent); sgpd != nil {
+		var err error
+		if localSeig, err = GetSeigEntries(sgpd); err != nil {
+			return err
+		}
+	}
+	groupIndices := make([]uint32, count)
+	for _, n := range parent.Find(BoxPath{BoxTypeSbgp()}) {
+		sbgp := n.Payload.(*Sbgp)
+		if sbgp.GroupingType != 0x73656967 { // seig
+			continue
+		}
+		var i uint64
+		for _, e := range sbgp.Entries {
+			for j := uint32(0); j < e.SampleCount && i < count; j++ {
+				groupIndices[i] = e.GroupDescriptionIndex
+				i++
+			}
+		}
+	}
+
+	senc, _ := findPayload(parent, BoxTypeSenc()).(*Senc)
+	var senData []byte
+	if senc != nil {
+		if uint64(senc.SampleCount) != count {
+			return errors.New("sample count of senc box does not match")
+		}
+		senData = senc.SampleData
+	}
+	var auxInfo [][]byte
+	if senc == nil {
+		var err error
+		if auxInfo, err = d.readAuxInfo(parent, count, groups, base); err != nil {
+			return err
+		}
+	}
+
+	for i := uint64(0); i < count; i++ {
+		ms := d.media[index+i]
+		scheme := d.schemes[ms.SampleDescriptionIndex]
+		if scheme == nil {
+			// clear sample entry
+			scheme = &cencScheme{tenc: &Tenc{}}
+		}
+		tenc := scheme.tenc
+		s := &cencSample{
+			offset:     ms.Offset,
+			size:       ms.Size,
+			schemeType: scheme.schemeType,
+			crypt:      tenc.DefaultCryptByteBlock,
+			skip:       tenc.DefaultSkipByteBlock,
+		}
+		protected := tenc.DefaultIsProtected == 1
+		ivSize := tenc.DefaultPerSampleIVSize
+		kid := tenc.DefaultKID
+		constantIV := tenc.DefaultConstantIV
+		if g := groupIndices[i]; g != 0 {
+			// group description indices above 0x10000 refer to the sgpd box in the traf box
+			entries := d.globalSeig
+			if g > 0x10000 {
+				entries = localSeig
+				g -= 0x10000
+			}
+			if int(g) > len(entries) {
+				return fmt.Errorf("seig entry not found: index=%d", groupIndices[i])
+			}
+			e := entries[g-1]
+			protected = e.IsProtected == 1
+			ivSize = e.PerSampleIVSize
+			kid = e.KID
+			constantIV = e.ConstantIV
+			s.crypt, s.skip = e.CryptByteBlock, e.SkipByteBlock
+		}
+		if !protected {
+			ivSize = 0
+		}
+
+		var enc *SampleEncryption
+		if senc != nil {
+			var n int
+			var err error
+			enc, n, err = parseSampleEncryption(senData, ivSize, senc.CheckFlag(SencUseSubsampleEncryption))
+			if err != nil {
+				return err
+			}
+			senData = senData[n:]
+		} else if auxInfo != nil {
+			var err error
+			data := auxInfo[i]
+			if enc, _, err = parseSampleEncryption(data, ivSize, len(data) > int(ivSize)); err != nil {
+				return err
+			}
+		}
+		if !protected || ms.Size == 0 {
+			continue
+		}
+
+		key, ok := d.keys[kid]
+		if !ok {
+			return fmt.Errorf("key not found: KID=%s", uuid.UUID(kid).String())
+		}
+		if len(key) != 16 {
+			return fmt.Errorf("invalid key size: KID=%s", uuid.UUID(kid).String())
+		}
+		s.key = key
+		if enc != nil {
+			s.iv = enc.IV
+			s.subsamples = enc.Subsamples
+		} else if ivSize != 0 {
+			return fmt.Errorf("sample auxiliary information not found: index=%d", ms.Index)
+		}
+		if ivSize == 0 {
+			s.iv = constantIV
+		}
+		d.samples = append(d.samples, s)
+	}
+	return nil
+}
+
+// readAuxInfo reads the sample auxiliary information pointed by saiz and saio boxes.
+// It returns nil when the boxes are not found.
+func (d *cencSampleReader) readAuxInfo(parent *BoxNode, count uint64, groups []uint64, base uint64) ([][]byte, error) {
+	var saiz *Saiz
+	for _, n := range parent.Find(BoxPath{BoxTypeSaiz()}) {
+		if s := n.Payload.(*Saiz); !s.CheckFlag(0x000001) || isCENCScheme(s.AuxInfoType) {
+			saiz = s
+			break
+		}
+	}
+	var saio *Saio
+	for _, n := range parent.Find(BoxPath{BoxTypeSaio()}) {
+		if s := n.Payload.(*Saio); !s.CheckFlag(0x000001) || isCENCScheme(s.AuxInfoType) {
+			saio = s
+			break
+		}
+	}
+	if saiz == nil || saio == nil {
+		return nil, nil
+	}
+	if uint64(saiz.SampleCount) != count {
+		return nil, errors.New("sample count of saiz box does not match")
+	}
+	if saiz.DefaultSampleInfoSize == 0 && uint64(len(saiz.SampleInfoSize)) < count {
+		return nil, errors.New("saiz box does not have sizes of all samples")
+	}
+	sizes := make([]uint64, count)
+	for i := range sizes {
+		sizes[i] = uint64(saiz.DefaultSampleInfoSize)
+		if saiz.DefaultSampleInfoSize == 0 {
+			sizes[i] = uint64(saiz.SampleInfoSize[i])
+		}
+	}
+	if saio.EntryCount == 1 {
+		groups = []uint64{count}
+	} else if int(saio.EntryCount) != len(groups) {
+		return nil, errors.New("entry count of saio box does not match")
+	}
+
+	auxInfo := make([][]byte, 0, count)
+	for i, n := range groups {
+		if uint64(len(auxInfo))+n > count {
+			n = count - uint64(len(auxInfo))
+		}
+		var size uint64
+		for _, s := range sizes[len(auxInfo) : uint64(len(auxInfo))+n] {
+			size += s
+		}
+		data := make([]byte, size)
+		if _, err := d.r.Seek(int64(base+saio.GetOffset(i)), io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < n; j++ {
+			s := sizes[len(auxInfo)]
+			auxInfo = append(auxInfo, data[:s])
+			data = data[s:]
+		}
+	}
+	if uint64(len(auxInfo)) != count {
+		return nil, errors.New("saio box does not cover all samples")
+	}
+	return auxInfo, nil
+}
+
+func findSeigSgpd(parent *BoxNode) *Sgpd {
+	for _, n := range parent.Find(BoxPath{BoxTypeSgpd()}) {
+		if sgpd := n.Payload.(*Sgpd); sgpd.GroupingType == [4]byte{'s', 'e', 'i', 'g'} {
+			return sgpd
+		}
+	}
+	return nil
+}
+
+// removeCENCBoxes removes the boxes describing the encryption from the stbl or traf box.
+func removeCENCBoxes(parent *BoxNode) {
+	for _, n := range append([]*BoxNode{}, parent.Children...) {
+		switch box := n.Payload.(type) {
+		case *Senc:
+			n.Remove()
+		case *Saiz:
+			if !box.CheckFlag(0x000001) || isCENCScheme(box.AuxInfoType) {
+				n.Remove()
+			}
+		case *Saio:
+			if !box.CheckFlag(0x000001) || isCENCScheme(box.AuxInfoType) {
+				n.Remove()
+			}
+		case *Sbgp:
+			if box.GroupingType == 0x73656967 { // seig
+				n.Remove()
+			}
+		case *Sgpd:
+			if box.GroupingType == [4]byte{'s', 'e', 'i', 'g'} {
+				n.Remove()
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package mp4
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testKID1 = [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	testKID2 = [16]byte{0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10, 0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10}
+	testKeys = map[[16]byte][]byte{
+		testKID1: []byte("0123456789abcdef"),
+		testKID2: []byte("fedcba9876543210"),
+	}
+)
+
+type cencTestParams struct {
+	scheme     [4]byte
+	ivSize     uint8 // the constant IV is used when it is 0
+	subsample  bool
+	crypt      uint8
+	skip       uint8
+	saio       bool // the auxiliary information is referred only by saiz and saio boxes
+	rotate     bool // the latter fragments are encrypted by testKID2 through seig sample groups
+	constantIV []byte
+}
+
+// encryptTestSample is a straightforward implementation of the encryption of ISO/IEC 23001-7.
+func encryptTestSample(t *testing.T, p *cencTestParams, key, iv []byte, subsamples []SubsampleEncryption, data []byte) {
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	var ranges [][]byte
+	if len(subsamples) == 0 {
+		ranges = [][]byte{data}
+	}
+	for _, sub := range subsamples {
+		ranges = append(ranges, data[sub.BytesOfClearData:uint32(sub.BytesOfClearData)+sub.BytesOfProtectedData])
+		data = data[uint32(sub.BytesOfClearData)+sub.BytesOfProtectedData:]
+	}
+	// blocks returns the encrypted blocks of the protected range
+	blocks := func(r []byte) [][]byte {
+		var bs [][]byte
+		for i := 0; i+16 <= len(r); i += 16 {
+			if p.crypt == 0 && p.skip == 0 || (i/16)%int(p.crypt+p.skip) < int(p.crypt) {
+				bs = append(bs, r[i:i+16])
+			}
+		}
+		return bs
+	}
+	switch p.scheme {
+	case cencSchemeCENC, cencSchemeCENS:
+		counter := make([]byte, 16)
+		copy(counter, iv)
+		stream := cipher.NewCTR(block, counter)
+		for _, r := range ranges {
+			if p.scheme == cencSchemeCENC {
+				stream.XORKeyStream(r, r)
+				continue
+			}
+			for _, b := range blocks(r) {
+				stream.XORKeyStream(b, b)
+			}
+		}
+	case cencSchemeCBC1, cencSchemeCBCS:
+		prev := iv
+		for _, r := range ranges {
+			if p.scheme == cencSchemeCBCS {
+				prev = iv
+			}
+			for _, b := range blocks(r) {
+				for i := range b {
+					b[i] ^= prev[i]
+				}
+				block.Encrypt(b, b)
+				prev = append([]byte{}, b...)
+			}
+		}
+	}
+}
+
+// encryptTestFile encrypts all tracks of the fragmented file.
+func encryptTestFile(t *testing.T, input []byte, p *cencTestParams) []byte {
+	data := append([]byte{}, input...)
+	tree, err := ReadBoxTree(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	samples := make(map[uint32][]*MediaSample)
+	for _, trak := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak()}) {
+		trackID := findPayload(trak, BoxTypeTkhd()).(*Tkhd).TrackID
+		it, err := NewSampleIterator(bytes.NewReader(input), trackID)
+		require.NoError(t, err)
+		samples[trackID] = readAllSamples(t, it)
+
+		entry := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd()}).Children[0]
+		frma := &Frma{DataFormat: entry.Info.Type}
+		entry.Info.Type = BoxTypeEncv()
+		if entry.FindFirst(BoxPath{BoxTypeEsds()}) != nil {
+			entry.Info.Type = BoxTypeEnca()
+		}
+		entry.Payload.(IAnyType).SetType(entry.Info.Type)
+		tenc := &Tenc{
+			DefaultCryptByteBlock:  p.crypt,
+			DefaultSkipByteBlock:   p.skip,
+			DefaultIsProtected:     1,
+			DefaultPerSampleIVSize: p.ivSize,
+			DefaultKID:             testKID1,
+		}
+		if p.crypt != 0 || p.skip != 0 {
+			tenc.SetVersion(1)
+		}
+		if p.ivSize == 0 {
+			tenc.DefaultConstantIVSize = uint8(len(p.constantIV))
+			tenc.DefaultConstantIV = p.constantIV
+		}
+		entry.AppendChild(NewBoxNode(&Sinf{},
+			NewBoxNode(frma),
+			NewBoxNode(&Schm{SchemeType: p.scheme, SchemeVersion: 0x10000}),
+			NewBoxNode(&Schi{}, NewBoxNode(tenc)),
+		))
+	}
+	tree.FindFirst(BoxPath{BoxTypeMoov()}).AppendChild(NewBoxNode(&Pssh{
+		FullBox:  FullBox{Version: 1},
+		SystemID: [16]byte{0x10, 0x77, 0xef, 0xec, 0xc0, 0xb2, 0x4d, 0x02, 0xac, 0xe3, 0x3c, 0x1e, 0x52, 0xe2, 0xfb, 0x4b},
+		KIDCount: 1,
+		KIDs:     []PsshKID{{KID: testKID1}},
+	}))
+
+	moofs := tree.Find(BoxPath{BoxTypeMoof()})
+	var saios []*Saio
+	var auxInfo []*BoxNode
+	for i, moof := range moofs {
+		for _, traf := range moof.Find(BoxPath{BoxTypeTraf()}) {
+			trackID := findPayload(traf, BoxTypeTfhd()).(*Tfhd).TrackID
+			count := findPayload(traf, BoxTypeTrun()).(*Trun).SampleCount
+			key := testKeys[testKID1]
+			if p.rotate && i >= len(moofs)/2 {
+				key = testKeys[testKID2]
+				entry := make([]byte, 20)
+				entry[1] = p.crypt<<4 | p.skip
+				entry[2] = 1
+				entry[3] = p.ivSize
+				copy(entry[4:], testKID2[:])
+				if p.ivSize == 0 {
+					entry = append(append(entry, byte(len(p.constantIV))), p.constantIV...)
+				}
+				traf.AppendChild(NewBoxNode(&Sbgp{
+					GroupingType: 0x73656967, // seig
+					EntryCount:   1,
+					Entries:      []SbgpEntry{{SampleCount: count, GroupDescriptionIndex: 0x10001}},
+				}))
+				traf.AppendChild(NewBoxNode(&Sgpd{
+					FullBox:       FullBox{Version: 1},
+					GroupingType:  [4]byte{'s', 'e', 'i', 'g'},
+					DefaultLength: uint32(len(entry)),
+					EntryCount:    1,
+					Unsupported:   entry,
+				}))
+			}
+
+			senc := &Senc{SampleCount: count}
+			if p.subsample {
+				senc.AddFlag(SencUseSubsampleEncryption)
+			}
+			saiz := &Saiz{SampleCount: count}
+			for _, s := range samples[trackID][:count] {
+				iv := p.constantIV
+				if p.ivSize != 0 {
+					iv = bytes.Repeat([]byte{byte(s.Index)}, int(p.ivSize))
+				}
+				var subsamples []SubsampleEncryption
+				if p.subsample {
+					subsamples = []SubsampleEncryption{{BytesOfClearData: 3, BytesOfProtectedData: s.Size - 3}}
+					if s.Size >= 48 {
+						subsamples = []SubsampleEncryption{
+							{BytesOfClearData: 3, BytesOfProtectedData: 37},
+							{BytesOfClearData: 2, BytesOfProtectedData: s.Size - 42},
+						}
+					}
+				}
+				encryptTestSample(t, p, key, iv, subsamples, data[s.Offset:s.Offset+uint64(s.Size)])
+
+				info := append([]byte{}, iv[:p.ivSize]...)
+				if p.subsample {
+					info = append(info, byte(len(subsamples)>>8), byte(len(subsamples)))
+					for _, sub := range subsamples {
+						info = append(info, 0, 0, 0, 0, 0, 0)
+						binary.BigEndian.PutUint16(info[len(info)-6:], sub.BytesOfClearData)
+						binary.BigEndian.PutUint32(info[len(info)-4:], sub.BytesOfProtectedData)
+					}
+				}
+				senc.SampleData = append(senc.SampleData, info...)
+				saiz.SampleInfoSize = append(saiz.SampleInfoSize, uint8(len(info)))
+			}
+			samples[trackID] = samples[trackID][count:]
+			if len(senc.SampleData) == 0 {
+				continue
+			}
+
+			var node *BoxNode
+			if p.saio {
+				// hide the senc box, so that the auxiliary information is found only through saio box
+				payload := bytes.NewBuffer(nil)
+				_, err := Marshal(payload, senc, Context{})
+				require.NoError(t, err)
+				node = NewRawBoxNode(BoxTypeFree(), payload.Bytes())
+			} else {
+				node = NewBoxNode(senc)
+			}
+			saios = append(saios, &Saio{EntryCount: 1, OffsetV0: []uint32{0}})
+			auxInfo = append(auxInfo, node)
+			traf.AppendChild(NewBoxNode(saiz))
+			traf.AppendChild(NewBoxNode(saios[len(saios)-1]))
+			traf.AppendChild(node)
+		}
+	}
+	require.NoError(t, tree.Relocate(0))
+	for i, node := range auxInfo {
+		moof := node.Parent.Parent
+		// the auxiliary information follows the version, flags and sample_count of the senc box
+		saios[i].OffsetV0[0] = uint32(node.Info.Offset + node.Info.HeaderSize + 8 - moof.Info.Offset)
+	}
+	return writeBoxTree(t, tree)
+}
+
+func TestDecrypt(t *testing.T) {
+	input := readFile(t, "./testdata/sample_fragmented.mp4")
+
+	testCases := []struct {
+		name   string
+		params cencTestParams
+	}{
+		{name: "cenc full sample", params: cencTestParams{scheme: cencSchemeCENC, ivSize: 8}},
+		{name: "cenc subsample", params: cencTestParams{scheme: cencSchemeCENC, ivSize: 16, subsample: true}},
+		{name: "cenc saio", params: cencTestParams{scheme: cencSchemeCENC, ivSize: 8, subsample: true, saio: true}},
+		{name: "cens", params: cencTestParams{scheme: cencSchemeCENS, ivSize: 8, subsample: true, crypt: 1, skip: 1}},
+		{name: "cbc1", params: cencTestParams{scheme: cencSchemeCBC1, ivSize: 16, subsample: true}},
+		{name: "cbcs constant IV", params: cencTestParams{scheme: cencSchemeCBCS, subsample: true, crypt: 1, skip: 9,
+			constantIV: []byte("constant-iv-0123")}},
+		{name: "cbcs full sample", params: cencTestParams{scheme: cencSchemeCBCS, crypt: 1, constantIV: []byte("constant-iv-0123")}},
+		{name: "key rotation", params: cencTestParams{scheme: cencSchemeCENC, ivSize: 8, subsample: true, rotate: true}},
+		{name: "key rotation saio", params: cencTestParams{scheme: cencSchemeCBCS, subsample: true, crypt: 1, skip: 9,
+			constantIV: []byte("constant-iv-0123"), rotate: true, saio: true}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encrypted := encryptTestFile(t, input, &tc.params)
+			for _, trackID := range []uint32{1, 2} {
+				assert.NotEqual(t, readTrackSampleData(t, bytes.NewReader(input), trackID),
+					readTrackSampleData(t, bytes.NewReader(encrypted), trackID))
+			}
+
+			output := bytes.NewBuffer(nil)
+			require.NoError(t, Decrypt(bytes.NewReader(encrypted), output, testKeys))
+			for _, trackID := range []uint32{1, 2} {
+				assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), trackID),
+					readTrackSampleData(t, bytes.NewReader(output.Bytes()), trackID))
+			}
+			assert.Equal(t, readSampleSummaries(t, bytes.NewReader(input)), readSampleSummaries(t, bytes.NewReader(output.Bytes())))
+
+			tree, err := ReadBoxTree(bytes.NewReader(output.Bytes()))
+			require.NoError(t, err)
+			var types []BoxType
+			for _, n := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAny()}) {
+				types = append(types, n.Info.Type)
+				assert.Nil(t, n.FindFirst(BoxPath{BoxTypeSinf()}))
+			}
+			assert.Equal(t, []BoxType{BoxTypeAvc1(), BoxTypeMp4a()}, types)
+			assert.Empty(t, tree.Find(BoxPath{BoxTypeMoov(), BoxTypePssh()}))
+			for _, traf := range tree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf()}) {
+				for _, c := range traf.Children {
+					assert.NotContains(t, []BoxType{BoxTypeSenc(), BoxTypeSaiz(), BoxTypeSaio(), BoxTypeSbgp(), BoxTypeSgpd()}, c.Info.Type)
+				}
+			}
+		})
+	}
+
+	t.Run("progressive", func(t *testing.T) {
+		// Defragment moves the auxiliary information and the seig sample groups into the sample table.
+		encrypted := encryptTestFile(t, input, &cencTestParams{scheme: cencSchemeCENC, ivSize: 8, subsample: true, saio: true, rotate: true})
+		progressive := bytes.NewBuffer(nil)
+		require.NoError(t, Defragment(bytes.NewReader(encrypted), progressive))
+		tree, err := ReadBoxTree(bytes.NewReader(progressive.Bytes()))
+		require.NoError(t, err)
+		require.NotNil(t, tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeSaio()}))
+
+		output := bytes.NewBuffer(nil)
+		require.NoError(t, Decrypt(bytes.NewReader(progressive.Bytes()), output, testKeys))
+		for _, trackID := range []uint32{1, 2} {
+			assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), trackID),
+				readTrackSampleData(t, bytes.NewReader(output.Bytes()), trackID))
+		}
+		tree, err = ReadBoxTree(bytes.NewReader(output.Bytes()))
+		require.NoError(t, err)
+		stbl := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+		assert.Nil(t, stbl.FindFirst(BoxPath{BoxTypeSaio()}))
+		assert.Nil(t, stbl.FindFirst(BoxPath{BoxTypeSgpd()}))
+	})
+
+	t.Run("progressive senc only", func(t *testing.T) {
+		// some packagers write senc boxes without saiz and saio boxes
+		encrypted := encryptTestFile(t, input, &cencTestParams{scheme: cencSchemeCENC, ivSize: 8, subsample: true})
+		tree, err := ReadBoxTree(bytes.NewReader(encrypted))
+		require.NoError(t, err)
+		for _, traf := range tree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf()}) {
+			for _, n := range traf.Find(BoxPath{BoxTypeSaiz()}) {
+				n.Remove()
+			}
+			for _, n := range traf.Find(BoxPath{BoxTypeSaio()}) {
+				n.Remove()
+			}
+		}
+		progressive := bytes.NewBuffer(nil)
+		require.NoError(t, Defragment(bytes.NewReader(writeBoxTree(t, tree)), progressive))
+
+		output := bytes.NewBuffer(nil)
+		require.NoError(t, Decrypt(bytes.NewReader(progressive.Bytes()), output, testKeys))
+		for _, trackID := range []uint32{1, 2} {
+			assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), trackID),
+				readTrackSampleData(t, bytes.NewReader(output.Bytes()), trackID))
+		}
+	})
+
+	t.Run("short saiz", func(t *testing.T) {
+		encrypted := encryptTestFile(t, input, &cencTestParams{scheme: cencSchemeCENC, ivSize: 8, subsample: true, saio: true})
+		tree, err := ReadBoxTree(bytes.NewReader(encrypted))
+		require.NoError(t, err)
+		saiz := tree.FindFirst(BoxPath{BoxTypeMoof(), BoxTypeTraf(), BoxTypeSaiz()}).Payload.(*Saiz)
+		require.Zero(t, saiz.DefaultSampleInfoSize)
+		saiz.SampleInfoSize = saiz.SampleInfoSize[:len(saiz.SampleInfoSize)-1]
+		trak := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak()})
+		_, err = readCENCSamples(bytes.NewReader(encrypted), tree, trak, testKeys)
+		assert.Error(t, err)
+	})
+
+	t.Run("key not found", func(t *testing.T) {
+		encrypted := encryptTestFile(t, input, &cencTestParams{scheme: cencSchemeCENC, ivSize: 8, rotate: true})
+		err := Decrypt(bytes.NewReader(encrypted), bytes.NewBuffer(nil), map[[16]byte][]byte{testKID1: testKeys[testKID1]})
+		assert.EqualError(t, err, "key not found: KID=fedcba98-7654-3210-fedc-ba9876543210")
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		output := bytes.NewBuffer(nil)
+		require.NoError(t, Decrypt(bytes.NewReader(input), output, nil))
+		assert.Equal(t, input, output.Bytes())
+	})
+}
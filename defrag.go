@@ -0,0 +1,689 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Defragment converts a fragmented MP4 file to a progressive MP4 file,
+// which consists of ftyp box, moov box and one mdat box.
+// Samples of all tracks are interleaved in the original order.
+// Edit lists, sample groups and sample auxiliary information, such as common encryption parameters, are kept,
+// and pssh boxes in moof boxes are moved to the moov box.
+// The auxiliary information of senc boxes which lack saiz and saio boxes is referred by new saiz and saio boxes.
+func Defragment(r io.ReadSeeker, w io.Writer) error {
+	tree, err := ReadBoxTree(r)
+	if err != nil {
+		return err
+	}
+	moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+	if moov == nil {
+		return errors.New("moov box not found")
+	}
+	ftyp := tree.FindFirst(BoxPath{BoxTypeFtyp()})
+	if ftyp == nil {
+		ftyp = NewBoxNode(&Ftyp{MajorBrand: BrandISOM(), CompatibleBrands: []CompatibleBrandElem{{CompatibleBrand: BrandISOM()}}})
+	}
+
+	d := &defragmenter{r: r, moov: moov, trexs: findTrexs(&tree.BoxNode), trafs: make(map[uint64]map[uint32]*BoxNode)}
+	for _, moof := range tree.Find(BoxPath{BoxTypeMoof()}) {
+		trafs := make(map[uint32]*BoxNode)
+		for _, traf := range moof.Find(BoxPath{BoxTypeTraf()}) {
+			if tfhd, ok := findPayload(traf, BoxTypeTfhd()).(*Tfhd); ok {
+				if _, exists := trafs[tfhd.TrackID]; !exists {
+					trafs[tfhd.TrackID] = traf
+				}
+			}
+		}
+		d.trafs[moof.Info.Offset] = trafs
+		for _, pssh := range moof.Find(BoxPath{BoxTypePssh()}) {
+			if err := d.addPssh(pssh); err != nil {
+				return err
+			}
+		}
+	}
+	if mvex := moov.FindFirst(BoxPath{BoxTypeMvex()}); mvex != nil {
+		mvex.Remove()
+	}
+
+	if err := d.readSamples(); err != nil {
+		return err
+	}
+	for _, t := range d.tracks {
+		if err := d.buildSampleGroups(t); err != nil {
+			return err
+		}
+		if err := d.buildAuxInfo(t); err != nil {
+			return err
+		}
+	}
+	durations := make(map[*BoxNode]uint64, len(d.tracks))
+	for _, t := range d.tracks {
+		durations[t.trak] = t.duration
+	}
+	updateDurations(moov, durations)
+
+	// layout: ftyp, moov, mdat
+	if _, err := ftyp.layout(0); err != nil {
+		return err
+	}
+	dataSize := d.assignOffsets()
+	mdat := &BoxInfo{Type: BoxTypeMdat(), HeaderSize: SmallHeaderSize}
+	if dataSize+SmallHeaderSize > math.MaxUint32 {
+		mdat.HeaderSize = LargeHeaderSize
+	}
+	mdat.Size = mdat.HeaderSize + dataSize
+	var moovSize uint64
+	for {
+		base := ftyp.Info.Size + moovSize + mdat.HeaderSize
+		if err := d.buildSampleTables(base); err != nil {
+			return err
+		}
+		end, err := moov.layout(ftyp.Info.Size)
+		if err != nil {
+			return err
+		}
+		if end-ftyp.Info.Size == moovSize {
+			break
+		}
+		moovSize = end - ftyp.Info.Size
+	}
+
+	ow := &offsetWriter{writer: w}
+	for _, n := range []*BoxNode{ftyp, moov} {
+		if err := ow.writeNode(n); err != nil {
+			return err
+		}
+	}
+	if _, err := WriteBoxInfo(ow, mdat); err != nil {
+		return err
+	}
+	for _, c := range d.chunks {
+		if err := d.copyData(ow, c.srcOffset, c.size); err != nil {
+			return err
+		}
+	}
+	for _, t := range d.tracks {
+		for _, br := range t.auxRanges {
+			if err := d.copyData(ow, br.Offset, br.Size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type defragmenter struct {
+	r      io.ReadSeeker
+	moov   *BoxNode
+	trexs  map[uint32]*Trex
+	trafs  map[uint64]map[uint32]*BoxNode // moof offset -> track ID -> traf
+	tracks []*defragTrack
+	chunks []*mediaChunk // all chunks in the order of the original offsets
+}
+
+type defragTrack struct {
+	trackID   uint32
+	trak      *BoxNode
+	stbl      *BoxNode
+	builder   *SampleTableBuilder
+	chunks    []*mediaChunk
+	segments  []*defragSegment
+	duration  uint64
+	sgpds     []*BoxNode
+	sbgps     []*BoxNode
+	saiz      *Saiz
+	saio      *Saio
+	auxRanges []ByteRange
+	auxOffset uint64
+}
+
+// mediaChunk is a run of contiguous samples which is copied to the new mdat box as a chunk.
+type mediaChunk struct {
+	srcOffset   uint64
+	size        uint64
+	dstOffset   uint64 // relative to the payload of the mdat box
+	sampleCount uint32
+	descIdx     uint32
+}
+
+// defragSegment is a run of samples which are described by a traf box or the original sample table.
+type defragSegment struct {
+	moofOffset  uint64
+	sampleCount uint32
+	traf        *BoxNode
+}
+
+// addPssh adds the pssh box to the moov box unless the same box already exists.
+func (d *defragmenter) addPssh(pssh *BoxNode) error {
+	data := bytes.NewBuffer(nil)
+	if _, err := Marshal(data, pssh.Payload, pssh.Info.Context); err != nil {
+		return err
+	}
+	for _, n := range d.moov.Find(BoxPath{BoxTypePssh()}) {
+		buf := bytes.NewBuffer(nil)
+		if _, err := Marshal(buf, n.Payload, n.Info.Context); err != nil {
+			return err
+		}
+		if bytes.Equal(data.Bytes(), buf.Bytes()) {
+			return nil
+		}
+	}
+	d.moov.AppendChild(pssh)
+	return nil
+}
+
+// readSamples reads all samples and groups them into chunks.
+func (d *defragmenter) readSamples() error {
+	its, err := NewSampleIterators(d.r)
+	if err != nil {
+		return err
+	}
+	traks := make(map[uint32]*BoxNode)
+	for _, trak := range d.moov.Find(BoxPath{BoxTypeTrak()}) {
+		if tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd); ok {
+			traks[tkhd.TrackID] = trak
+		}
+	}
+	for _, it := range its {
+		trak := traks[it.TrackID()]
+		if trak == nil {
+			return fmt.Errorf("trak box not found: trackID=%d", it.TrackID())
+		}
+		stbl := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+		if stbl == nil {
+			return fmt.Errorf("stbl box not found: trackID=%d", it.TrackID())
+		}
+		t := &defragTrack{trackID: it.TrackID(), trak: trak, stbl: stbl, builder: NewSampleTableBuilder()}
+		var chunk *mediaChunk
+		var seg *defragSegment
+		for {
+			s, err := it.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if seg == nil || s.MoofOffset != seg.moofOffset {
+				seg = &defragSegment{moofOffset: s.MoofOffset}
+				if s.MoofOffset != 0 {
+					seg.traf = d.trafs[s.MoofOffset][t.trackID]
+				}
+				t.segments = append(t.segments, seg)
+				chunk = nil
+			}
+			if chunk == nil || s.Offset != chunk.srcOffset+chunk.size || s.SampleDescriptionIndex != chunk.descIdx {
+				chunk = &mediaChunk{srcOffset: s.Offset, descIdx: s.SampleDescriptionIndex}
+				t.chunks = append(t.chunks, chunk)
+			}
+			chunk.size += uint64(s.Size)
+			chunk.sampleCount++
+			seg.sampleCount++
+			t.duration += uint64(s.Duration)
+			if err := t.builder.AddSample(SampleTableEntry{
+				Duration:               s.Duration,
+				CompositionTimeOffset:  s.CompositionTimeOffset,
+				Size:                   s.Size,
+				IsSync:                 s.IsSync,
+				Chunk:                  uint32(len(t.chunks) - 1),
+				SampleDescriptionIndex: s.SampleDescriptionIndex,
+			}); err != nil {
+				return err
+			}
+		}
+		d.tracks = append(d.tracks, t)
+		d.chunks = append(d.chunks, t.chunks...)
+	}
+	sort.SliceStable(d.chunks, func(i, j int) bool {
+		return d.chunks[i].srcOffset < d.chunks[j].srcOffset
+	})
+	return nil
+}
+
+// buildSampleGroups merges sbgp and sgpd boxes of the traf boxes into the sample table.
+// Group description indices which refer to sgpd boxes in the traf boxes are renumbered.
+func (d *defragmenter) buildSampleGroups(t *defragTrack) error {
+	t.sgpds = t.stbl.Find(BoxPath{BoxTypeSgpd()})
+	findSgpd := func(groupingType uint32) *Sgpd {
+		for _, n := range t.sgpds {
+			if sgpd, ok := n.Payload.(*Sgpd); ok && sgpdGroupingType(sgpd) == groupingType {
+				return sgpd
+			}
+		}
+		return nil
+	}
+
+	type mergedSbgp struct {
+		sbgp    *Sbgp
+		entries []SbgpEntry
+	}
+	var groupingTypes []uint32
+	sbgps := make(map[uint32]*mergedSbgp)
+	addGroupingType := func(src *Sbgp) {
+		if _, ok := sbgps[src.GroupingType]; ok {
+			return
+		}
+		sbgp := &Sbgp{GroupingType: src.GroupingType, GroupingTypeParameter: src.GroupingTypeParameter}
+		sbgp.SetVersion(src.GetVersion())
+		sbgps[src.GroupingType] = &mergedSbgp{sbgp: sbgp}
+		groupingTypes = append(groupingTypes, src.GroupingType)
+	}
+	segmentSbgps := func(seg *defragSegment) []*Sbgp {
+		parent := seg.traf
+		if seg.moofOffset == 0 {
+			parent = t.stbl
+		}
+		if parent == nil {
+			return nil
+		}
+		var list []*Sbgp
+		for _, n := range parent.Find(BoxPath{BoxTypeSbgp()}) {
+			if sbgp, ok := n.Payload.(*Sbgp); ok {
+				list = append(list, sbgp)
+			}
+		}
+		return list
+	}
+	for _, seg := range t.segments {
+		for _, sbgp := range segmentSbgps(seg) {
+			addGroupingType(sbgp)
+		}
+	}
+	if len(groupingTypes) == 0 {
+		return nil
+	}
+
+	for _, seg := range t.segments {
+		// group description indices above 0x10000 refer to the sgpd box in the traf box
+		bases := make(map[uint32]uint32)
+		if seg.traf != nil {
+			for _, n := range seg.traf.Find(BoxPath{BoxTypeSgpd()}) {
+				src, ok := n.Payload.(*Sgpd)
+				if !ok {
+					continue
+				}
+				groupingType := sgpdGroupingType(src)
+				dst := findSgpd(groupingType)
+				if dst == nil {
+					dst = &Sgpd{GroupingType: src.GroupingType, DefaultLength: src.DefaultLength, DefaultSampleDescriptionIndex: src.DefaultSampleDescriptionIndex}
+					dst.SetVersion(src.GetVersion())
+					t.sgpds = append(t.sgpds, NewBoxNode(dst))
+				}
+				bases[groupingType] = dst.EntryCount
+				if err := appendSgpdEntries(dst, src); err != nil {
+					return err
+				}
+			}
+		}
+
+		srcs := make(map[uint32]*Sbgp)
+		for _, sbgp := range segmentSbgps(seg) {
+			if _, ok := srcs[sbgp.GroupingType]; !ok {
+				srcs[sbgp.GroupingType] = sbgp
+			}
+		}
+		for _, groupingType := range groupingTypes {
+			merged := sbgps[groupingType]
+			add := func(count, index uint32) {
+				if count == 0 {
+					return
+				}
+				if n := len(merged.entries); n != 0 && merged.entries[n-1].GroupDescriptionIndex == index {
+					merged.entries[n-1].SampleCount += count
+					return
+				}
+				merged.entries = append(merged.entries, SbgpEntry{SampleCount: count, GroupDescriptionIndex: index})
+			}
+			remain := seg.sampleCount
+			if src := srcs[groupingType]; src != nil {
+				for _, e := range src.Entries {
+					count := e.SampleCount
+					if count > remain {
+						count = remain
+					}
+					index := e.GroupDescriptionIndex
+					if index > 0x10000 {
+						index = index - 0x10000 + bases[groupingType]
+					}
+					add(count, index)
+					remain -= count
+				}
+			}
+			add(remain, 0)
+		}
+	}
+
+	for _, groupingType := range groupingTypes {
+		merged := sbgps[groupingType]
+		merged.sbgp.EntryCount = uint32(len(merged.entries))
+		merged.sbgp.Entries = merged.entries
+		t.sbgps = append(t.sbgps, NewBoxNode(merged.sbgp))
+	}
+	return nil
+}
+
+func sgpdGroupingType(sgpd *Sgpd) uint32 {
+	return uint32(sgpd.GroupingType[0])<<24 | uint32(sgpd.GroupingType[1])<<16 |
+		uint32(sgpd.GroupingType[2])<<8 | uint32(sgpd.GroupingType[3])
+}
+
+// appendSgpdEntries appends the sample group description entries of src to dst.
+func appendSgpdEntries(dst, src *Sgpd) error {
+	if dst.GetVersion() != src.GetVersion() || dst.DefaultLength != src.DefaultLength {
+		return fmt.Errorf("incompatible sgpd boxes: groupingType=%s", string(src.GroupingType[:]))
+	}
+	dst.EntryCount += src.EntryCount
+	dst.RollDistances = append(dst.RollDistances, src.RollDistances...)
+	dst.RollDistancesL = append(dst.RollDistancesL, src.RollDistancesL...)
+	dst.AlternativeStartupEntries = append(dst.AlternativeStartupEntries, src.AlternativeStartupEntries...)
+	dst.AlternativeStartupEntriesL = append(dst.AlternativeStartupEntriesL, src.AlternativeStartupEntriesL...)
+	dst.VisualRandomAccessEntries = append(dst.VisualRandomAccessEntries, src.VisualRandomAccessEntries...)
+	dst.VisualRandomAccessEntriesL = append(dst.VisualRandomAccessEntriesL, src.VisualRandomAccessEntriesL...)
+	dst.TemporalLevelEntries = append(dst.TemporalLevelEntries, src.TemporalLevelEntries...)
+	dst.TemporalLevelEntriesL = append(dst.TemporalLevelEntriesL, src.TemporalLevelEntriesL...)
+	dst.Unsupported = append(dst.Unsupported, src.Unsupported...)
+	return nil
+}
+
+// buildAuxInfo collects the sample auxiliary information referred by saiz and saio boxes.
+// The information of the track is placed at the end of the mdat box contiguously.
+func (d *defragmenter) buildAuxInfo(t *defragTrack) error {
+	var sizes []uint8
+	for _, seg := range t.segments {
+		parent := seg.traf
+		if seg.moofOffset == 0 {
+			parent = t.stbl
+		}
+		var saiz *Saiz
+		var saio *Saio
+		if parent != nil {
+			saiz, _ = findPayload(parent, BoxTypeSaiz()).(*Saiz)
+			saio, _ = findPayload(parent, BoxTypeSaio()).(*Saio)
+		}
+		if saiz == nil && saio == nil && seg.traf != nil {
+			// the auxiliary information may be carried only by senc box
+			segSizes, br, err := t.sencAuxInfo(seg.traf, seg.sampleCount)
+			if err != nil {
+				return err
+			}
+			if br != nil {
+				if t.saiz == nil {
+					t.saiz = &Saiz{}
+					t.saio = &Saio{EntryCount: 1}
+				}
+				sizes = append(sizes, segSizes...)
+				t.auxRanges = append(t.auxRanges, *br)
+				continue
+			}
+		}
+		if saiz == nil || saio == nil {
+			sizes = append(sizes, make([]uint8, seg.sampleCount)...)
+			continue
+		}
+		if saiz.SampleCount != seg.sampleCount {
+			return fmt.Errorf("saiz box has unexpected sample count: trackID=%d", t.trackID)
+		}
+		if t.saiz == nil {
+			t.saiz = &Saiz{AuxInfoType: saiz.AuxInfoType, AuxInfoTypeParameter: saiz.AuxInfoTypeParameter}
+			t.saiz.SetFlags(saiz.GetFlags())
+			t.saio = &Saio{AuxInfoType: saio.AuxInfoType, AuxInfoTypeParameter: saio.AuxInfoTypeParameter, EntryCount: 1}
+			t.saio.SetFlags(saio.GetFlags())
+		}
+		segSizes := make([]uint8, seg.sampleCount)
+		for i := range segSizes {
+			if saiz.DefaultSampleInfoSize != 0 {
+				segSizes[i] = saiz.DefaultSampleInfoSize
+			} else {
+				segSizes[i] = saiz.SampleInfoSize[i]
+			}
+		}
+		sizes = append(sizes, segSizes...)
+
+		var base uint64
+		var counts []uint32 // sample counts of the ranges
+		if seg.moofOffset == 0 {
+			counts = []uint32{seg.sampleCount}
+		} else {
+			var err error
+			if base, err = trafBaseOffset(seg.traf, d.trexs); err != nil {
+				return err
+			}
+			if saio.EntryCount == 1 {
+				counts = []uint32{seg.sampleCount}
+			} else {
+				for _, n := range seg.traf.Find(BoxPath{BoxTypeTrun()}) {
+					if trun, ok := n.Payload.(*Trun); ok {
+						counts = append(counts, trun.SampleCount)
+					}
+				}
+			}
+		}
+		if uint32(len(counts)) != saio.EntryCount {
+			return fmt.Errorf("unsupported saio box: trackID=%d entryCount=%d", t.trackID, saio.EntryCount)
+		}
+		var i uint32
+		for j, count := range counts {
+			br := ByteRange{Offset: base + saio.GetOffset(j)}
+			for end := i + count; i < end && i < seg.sampleCount; i++ {
+				br.Size += uint64(segSizes[i])
+			}
+			t.auxRanges = append(t.auxRanges, br)
+		}
+	}
+	if t.saiz == nil {
+		return nil
+	}
+
+	t.saiz.SampleCount = uint32(len(sizes))
+	constant := len(sizes) != 0
+	for _, size := range sizes {
+		constant = constant && size == sizes[0]
+	}
+	if constant {
+		t.saiz.DefaultSampleInfoSize = sizes[0]
+	} else {
+		t.saiz.SampleInfoSize = sizes
+	}
+	return nil
+}
+
+// sencAuxInfo derives the sizes and the position of the sample auxiliary information from the senc box
+// of the traf box which has neither saiz box nor saio box.
+// It returns nil ByteRange when the traf box has no senc box.
+func (t *defragTrack) sencAuxInfo(traf *BoxNode, sampleCount uint32) ([]uint8, *ByteRange, error) {
+	sencNode := traf.FindFirst(BoxPath{BoxTypeSenc()})
+	if sencNode == nil {
+		return nil, nil, nil
+	}
+	senc, ok := sencNode.Payload.(*Senc)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported senc box: trackID=%d", t.trackID)
+	}
+	if senc.SampleCount != sampleCount {
+		return nil, nil, fmt.Errorf("senc box has unexpected sample count: trackID=%d", t.trackID)
+	}
+	tenc, ok := findPayload(t.stbl, BoxTypeStsd(), BoxTypeAny(), BoxTypeSinf(), BoxTypeSchi(), BoxTypeTenc()).(*Tenc)
+	if !ok {
+		return nil, nil, fmt.Errorf("tenc box not found: trackID=%d", t.trackID)
+	}
+	ivSize := tenc.DefaultPerSampleIVSize
+	for _, parent := range []*BoxNode{t.stbl, traf} {
+		sgpd := findSeigSgpd(parent)
+		if sgpd == nil {
+			continue
+		}
+		entries, err := GetSeigEntries(sgpd)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			if e.PerSampleIVSize != ivSize {
+				return nil, nil, fmt.Errorf("senc box without saiz box is not supported for varying IV sizes: trackID=%d", t.trackID)
+			}
+		}
+	}
+
+	sizes := make([]uint8, sampleCount)
+	data := senc.SampleData
+	for i := range sizes {
+		_, n, err := parseSampleEncryption(data, ivSize, senc.CheckFlag(SencUseSubsampleEncryption))
+		if err != nil {
+			return nil, nil, err
+		}
+		if n > math.MaxUint8 {
+			return nil, nil, fmt.Errorf("too large sample auxiliary information: trackID=%d size=%d", t.trackID, n)
+		}
+		sizes[i] = uint8(n)
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		return nil, nil, fmt.Errorf("senc box has unexpected size: trackID=%d", t.trackID)
+	}
+	// the auxiliary information follows the version, flags and sample_count of the senc box
+	return sizes, &ByteRange{
+		Offset: sencNode.Info.Offset + sencNode.Info.HeaderSize + 8,
+		Size:   uint64(len(senc.SampleData)),
+	}, nil
+}
+
+// updateDurations sets durations of mdhd, tkhd and mvhd boxes.
+// durations maps trak boxes to the sums of their sample durations in the media timescale.
+// Track durations are the sums of the edit lists when they exist.
+func updateDurations(moov *BoxNode, durations map[*BoxNode]uint64) {
+	var movieTimescale uint32
+	mvhd, _ := findPayload(moov, BoxTypeMvhd()).(*Mvhd)
+	if mvhd != nil {
+		movieTimescale = mvhd.Timescale
+	}
+	var movieDuration uint64
+	for _, trak := range moov.Find(BoxPath{BoxTypeTrak()}) {
+		duration, ok := durations[trak]
+		if !ok {
+			continue
+		}
+		var trackDuration uint64
+		if mdhd, ok := findPayload(trak, BoxTypeMdia(), BoxTypeMdhd()).(*Mdhd); ok {
+			if mdhd.GetVersion() == 0 && duration > math.MaxUint32 {
+				mdhd.SetVersion(1)
+				mdhd.CreationTimeV1 = uint64(mdhd.CreationTimeV0)
+				mdhd.ModificationTimeV1 = uint64(mdhd.ModificationTimeV0)
+			}
+			mdhd.DurationV0, mdhd.DurationV1 = uint32(duration), duration
+			trackDuration = rescaleTime(duration, movieTimescale, mdhd.Timescale)
+		}
+		if elst, ok := findPayload(trak, BoxTypeEdts(), BoxTypeElst()).(*Elst); ok {
+			var sum uint64
+			for i := range elst.Entries {
+				sum += elst.GetSegmentDuration(i)
+			}
+			if sum != 0 {
+				trackDuration = sum
+			}
+		}
+		if tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd); ok {
+			if tkhd.GetVersion() == 0 && trackDuration > math.MaxUint32 {
+				tkhd.SetVersion(1)
+				tkhd.CreationTimeV1 = uint64(tkhd.CreationTimeV0)
+				tkhd.ModificationTimeV1 = uint64(tkhd.ModificationTimeV0)
+			}
+			tkhd.DurationV0, tkhd.DurationV1 = uint32(trackDuration), trackDuration
+		}
+		if trackDuration > movieDuration {
+			movieDuration = trackDuration
+		}
+	}
+	if mvhd != nil {
+		if mvhd.GetVersion() == 0 && movieDuration > math.MaxUint32 {
+			mvhd.SetVersion(1)
+			mvhd.CreationTimeV1 = uint64(mvhd.CreationTimeV0)
+			mvhd.ModificationTimeV1 = uint64(mvhd.ModificationTimeV0)
+		}
+		mvhd.DurationV0, mvhd.DurationV1 = uint32(movieDuration), movieDuration
+	}
+}
+
+// assignOffsets places the chunks and the auxiliary information in the mdat box, and returns the size of the data.
+func (d *defragmenter) assignOffsets() uint64 {
+	var offset uint64
+	for _, c := range d.chunks {
+		c.dstOffset = offset
+		offset += c.size
+	}
+	for _, t := range d.tracks {
+		t.auxOffset = offset
+		for _, br := range t.auxRanges {
+			offset += br.Size
+		}
+	}
+	return offset
+}
+
+// buildSampleTables replaces the sample tables by new ones whose chunk offsets are based on base.
+func (d *defragmenter) buildSampleTables(base uint64) error {
+	for _, t := range d.tracks {
+		offsets := make([]uint64, len(t.chunks))
+		for i, c := range t.chunks {
+			offsets[i] = base + c.dstOffset
+		}
+		st, err := t.builder.Build(offsets)
+		if err != nil {
+			return err
+		}
+
+		var children []*BoxNode
+		for _, c := range t.stbl.Children {
+			c.Parent = nil
+			switch c.Info.Type {
+			case BoxTypeStts(), BoxTypeCtts(), BoxTypeStss(), BoxTypeStsc(), BoxTypeStsz(), StrToBoxType("stz2"),
+				BoxTypeStco(), BoxTypeCo64(), BoxTypeSdtp(), BoxTypeCslg(), StrToBoxType("stps"),
+				BoxTypeSgpd(), BoxTypeSbgp(), BoxTypeSaiz(), BoxTypeSaio(), StrToBoxType("subs"):
+			default:
+				children = append(children, c)
+			}
+		}
+		for _, box := range st.Boxes() {
+			children = append(children, NewBoxNode(box))
+		}
+		children = append(children, t.sgpds...)
+		children = append(children, t.sbgps...)
+		if t.saiz != nil {
+			offset := base + t.auxOffset
+			if offset > math.MaxUint32 {
+				t.saio.SetVersion(1)
+				t.saio.OffsetV0, t.saio.OffsetV1 = nil, []uint64{offset}
+			} else {
+				t.saio.SetVersion(0)
+				t.saio.OffsetV0, t.saio.OffsetV1 = []uint32{uint32(offset)}, nil
+			}
+			children = append(children, NewBoxNode(t.saiz), NewBoxNode(t.saio))
+		}
+		t.stbl.Children = nil
+		for _, c := range children {
+			t.stbl.AppendChild(c)
+		}
+	}
+	return nil
+}
+
+func (d *defragmenter) copyData(w io.Writer, offset, size uint64) error {
+	if size == 0 {
+		return nil
+	}
+	if _, err := d.r.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, d.r, int64(size))
+	return err
+}
+
+// findPayload returns the payload of the first box at the path, or nil.
+func findPayload(n *BoxNode, path ...BoxType) IBox {
+	if c := n.FindFirst(path); c != nil {
+		return c.Payload
+	}
+	return nil
+}
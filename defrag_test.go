@@ -0,0 +1,137 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefragment(t *testing.T) {
+	input, err := os.ReadFile("./testdata/sample_fragmented.mp4")
+	require.NoError(t, err)
+	expectedSamples := readSampleSummaries(t, bytes.NewReader(input))
+	expectedData := readAllSampleData(t, bytes.NewReader(input))
+
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Defragment(bytes.NewReader(input), output))
+	r := bytes.NewReader(output.Bytes())
+	assert.Equal(t, expectedSamples, readSampleSummaries(t, r))
+	assert.Equal(t, expectedData, readAllSampleData(t, r))
+
+	tree, err := ReadBoxTree(r)
+	require.NoError(t, err)
+	require.Len(t, tree.Children, 3)
+	assert.Equal(t, BoxTypeFtyp(), tree.Children[0].Info.Type)
+	assert.Equal(t, BoxTypeMoov(), tree.Children[1].Info.Type)
+	assert.Equal(t, BoxTypeMdat(), tree.Children[2].Info.Type)
+	assert.Nil(t, tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeMvex()}))
+
+	info, err := Probe(r)
+	require.NoError(t, err)
+	assert.Empty(t, info.Segments)
+	for _, track := range info.Tracks {
+		assert.NotZero(t, track.Duration)
+	}
+}
+
+func TestDefragmentRoundTrip(t *testing.T) {
+	input, err := os.ReadFile("./testdata/sample.mp4")
+	require.NoError(t, err)
+	expected, err := Probe(bytes.NewReader(input))
+	require.NoError(t, err)
+	expectedSamples := readSampleSummaries(t, bytes.NewReader(input))
+	expectedData := readAllSampleData(t, bytes.NewReader(input))
+
+	fragmented := bytes.NewBuffer(nil)
+	require.NoError(t, Fragment(bytes.NewReader(input), fragmented, &FragmentOptions{FragmentDuration: 0.2}))
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Defragment(bytes.NewReader(fragmented.Bytes()), output))
+	r := bytes.NewReader(output.Bytes())
+	assert.Equal(t, expectedSamples, readSampleSummaries(t, r))
+	assert.Equal(t, expectedData, readAllSampleData(t, r))
+
+	info, err := Probe(r)
+	require.NoError(t, err)
+	// the movie duration is the sum of the edit list
+	assert.EqualValues(t, 1000, info.Duration)
+	require.Len(t, info.Tracks, len(expected.Tracks))
+	for i := range info.Tracks {
+		assert.Equal(t, expected.Tracks[i].Duration, info.Tracks[i].Duration)
+		assert.Equal(t, expected.Tracks[i].EditList, info.Tracks[i].EditList)
+		assert.Equal(t, expected.Tracks[i].Samples, info.Tracks[i].Samples)
+	}
+}
+
+func TestDefragmentSampleGroupsAndAuxInfo(t *testing.T) {
+	input, err := os.ReadFile("./testdata/sample.mp4")
+	require.NoError(t, err)
+	fragmented := bytes.NewBuffer(nil)
+	require.NoError(t, Fragment(bytes.NewReader(input), fragmented, &FragmentOptions{FragmentDuration: 0.2}))
+
+	// add a fragment-local seig sample group and 8 bytes of auxiliary information per video sample,
+	// which refers to the head of the mdat box.
+	tree, err := ReadBoxTree(bytes.NewReader(fragmented.Bytes()))
+	require.NoError(t, err)
+	moofs := tree.Find(BoxPath{BoxTypeMoof()})
+	require.NotEmpty(t, moofs)
+	saios := make([]*Saio, len(moofs))
+	mdats := make([]*BoxNode, len(moofs))
+	var counts []uint32
+	var expectedAuxInfo []byte
+	for i, moof := range moofs {
+		mdats[i] = tree.Children[tree.indexOf(moof)+1]
+		require.Equal(t, BoxTypeMdat(), mdats[i].Info.Type)
+		start := mdats[i].Info.Offset + mdats[i].Info.HeaderSize
+		traf := moof.FindFirst(BoxPath{BoxTypeTraf()})
+		require.Equal(t, uint32(1), traf.FindFirst(BoxPath{BoxTypeTfhd()}).Payload.(*Tfhd).TrackID)
+		count := traf.FindFirst(BoxPath{BoxTypeTrun()}).Payload.(*Trun).SampleCount
+		counts = append(counts, count)
+		expectedAuxInfo = append(expectedAuxInfo, fragmented.Bytes()[start:start+uint64(count)*8]...)
+		traf.AppendChild(NewBoxNode(&Sbgp{
+			GroupingType: 0x73656967, // seig
+			EntryCount:   1,
+			Entries:      []SbgpEntry{{SampleCount: count, GroupDescriptionIndex: 0x10001}},
+		}))
+		traf.AppendChild(NewBoxNode(&Sgpd{
+			FullBox:       FullBox{Version: 1},
+			GroupingType:  [4]byte{'s', 'e', 'i', 'g'},
+			DefaultLength: 4,
+			EntryCount:    1,
+			Unsupported:   []byte{0, 0, 0, byte(i)},
+		}))
+		traf.AppendChild(NewBoxNode(&Saiz{DefaultSampleInfoSize: 8, SampleCount: count}))
+		saios[i] = &Saio{EntryCount: 1, OffsetV0: []uint32{0}}
+		traf.AppendChild(NewBoxNode(saios[i]))
+	}
+	require.NoError(t, tree.Relocate(0))
+	for i, moof := range moofs {
+		saios[i].OffsetV0[0] = uint32(mdats[i].Info.Offset + mdats[i].Info.HeaderSize - moof.Info.Offset)
+	}
+	edited := writeBoxTree(t, tree)
+
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Defragment(bytes.NewReader(edited), output))
+	r := bytes.NewReader(output.Bytes())
+	assert.Equal(t, readSampleSummaries(t, bytes.NewReader(input)), readSampleSummaries(t, r))
+
+	tree, err = ReadBoxTree(r)
+	require.NoError(t, err)
+	stbl := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+	sgpd := stbl.FindFirst(BoxPath{BoxTypeSgpd()}).Payload.(*Sgpd)
+	assert.Equal(t, uint32(len(moofs)), sgpd.EntryCount)
+	sbgp := stbl.FindFirst(BoxPath{BoxTypeSbgp()}).Payload.(*Sbgp)
+	require.Len(t, sbgp.Entries, len(moofs))
+	for i, e := range sbgp.Entries {
+		assert.Equal(t, SbgpEntry{SampleCount: counts[i], GroupDescriptionIndex: uint32(i + 1)}, e)
+	}
+	saiz := stbl.FindFirst(BoxPath{BoxTypeSaiz()}).Payload.(*Saiz)
+	assert.Equal(t, uint8(8), saiz.DefaultSampleInfoSize)
+	assert.Equal(t, uint32(len(expectedAuxInfo)/8), saiz.SampleCount)
+	saio := stbl.FindFirst(BoxPath{BoxTypeSaio()}).Payload.(*Saio)
+	require.Equal(t, uint32(1), saio.EntryCount)
+	offset := saio.GetOffset(0)
+	assert.Equal(t, expectedAuxInfo, output.Bytes()[offset:offset+uint64(len(expectedAuxInfo))])
+}
@@ -0,0 +1,701 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Demuxer writes the samples of a track as an elementary stream which can be used without MP4 container.
+// The output format is decided by the sample entry of the track:
+//
+//   - avc1: H.264 Annex B byte stream, with SPS and PPS inserted before IDR pictures
+//   - hvc1, hev1: H.265 Annex B byte stream, with VPS, SPS and PPS inserted before IRAP pictures
+//   - mp4a (AAC): ADTS stream, whose headers are built from AudioSpecificConfig
+//   - ac-3, ec-3: raw syncframes
+//   - Opus: Ogg Opus, whose OpusHead is built from dOps box
+//   - vp08, vp09, av01: IVF
+//   - ipcm, fpcm: WAV, whose header is built from pcmC box
+//   - fLaC: native FLAC stream, whose metadata blocks are copied from dfLa box
+//   - wvtt: WebVTT, whose header is copied from vttC box and whose cues repeated in consecutive samples are merged
+//
+// Edit lists are ignored, and all samples of the track are written.
+// Multiple sample entries are supported only by H.264, H.265, ADTS and raw syncframes.
+type Demuxer struct {
+	r         io.ReadSeeker
+	trackID   uint32
+	timescale uint32
+	entries   []*BoxNode // sample entries of stsd box
+	format    demuxFormat
+}
+
+type demuxFormat int
+
+const (
+	demuxFormatH264 demuxFormat = iota
+	demuxFormatH265
+	demuxFormatADTS
+	demuxFormatAC3
+	demuxFormatEC3
+	demuxFormatOgg
+	demuxFormatIVF
+	demuxFormatWAV
+	demuxFormatFLAC
+	demuxFormatWebVTT
+)
+
+// NewDemuxer returns a Demuxer of the track which has the given track ID.
+// It returns an error when the codec of the track is not supported.
+func NewDemuxer(r io.ReadSeeker, trackID uint32) (*Demuxer, error) {
+	tree, err := ReadBoxTree(r)
+	if err != nil {
+		return nil, err
+	}
+	var trak *BoxNode
+	for _, t := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak()}) {
+		if tkhd, ok := findPayload(t, BoxTypeTkhd()).(*Tkhd); ok && tkhd.TrackID == trackID {
+			trak = t
+			break
+		}
+	}
+	if trak == nil {
+		return nil, fmt.Errorf("track not found: trackID=%d", trackID)
+	}
+	mdhd, ok := findPayload(trak, BoxTypeMdia(), BoxTypeMdhd()).(*Mdhd)
+	if !ok {
+		return nil, errors.New("mdhd box not found")
+	}
+	stsd := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd()})
+	if stsd == nil || len(stsd.Children) == 0 {
+		return nil, errors.New("sample entry not found")
+	}
+	d := &Demuxer{
+		r:         r,
+		trackID:   trackID,
+		timescale: mdhd.Timescale,
+		entries:   stsd.Children,
+	}
+	entry := d.entries[0]
+	switch entry.Info.Type {
+	case BoxTypeAvc1():
+		d.format = demuxFormatH264
+	case BoxTypeHvc1(), BoxTypeHev1():
+		d.format = demuxFormatH265
+	case BoxTypeMp4a():
+		for _, e := range d.entries {
+			esds, ok := findPayload(e, BoxTypeEsds()).(*Esds)
+			if !ok {
+				return nil, errors.New("esds box not found")
+			}
+			dcd := findDescriptorByTag(esds.Descriptors, DecoderConfigDescrTag)
+			if dcd == nil || dcd.DecoderConfigDescriptor == nil || dcd.DecoderConfigDescriptor.ObjectTypeIndication != 0x40 {
+				return nil, errors.New("unsupported codec: mp4a is not AAC")
+			}
+		}
+		d.format = demuxFormatADTS
+	case BoxTypeAC3():
+		d.format = demuxFormatAC3
+	case BoxTypeEC3():
+		d.format = demuxFormatEC3
+	case BoxTypeOpus():
+		d.format = demuxFormatOgg
+	case BoxTypeVp08(), BoxTypeVp09(), BoxTypeAv01():
+		d.format = demuxFormatIVF
+	case BoxTypeIpcm(), BoxTypeFpcm():
+		d.format = demuxFormatWAV
+	case BoxTypeFLaC():
+		d.format = demuxFormatFLAC
+	case BoxTypeWvtt():
+		d.format = demuxFormatWebVTT
+	default:
+		return nil, fmt.Errorf("unsupported codec: %s", entry.Info.Type)
+	}
+	for _, e := range d.entries[1:] {
+		if e.Info.Type != entry.Info.Type && d.format != demuxFormatH264 && d.format != demuxFormatH265 {
+			return nil, errors.New("sample entries of different codecs are not supported")
+		}
+	}
+	switch d.format {
+	case demuxFormatOgg, demuxFormatIVF, demuxFormatWAV, demuxFormatFLAC, demuxFormatWebVTT:
+		// the configuration is written only once in the stream header
+		if len(d.entries) > 1 {
+			return nil, fmt.Errorf("multiple sample entries are not supported: %s", entry.Info.Type)
+		}
+	}
+	return d, nil
+}
+
+// Extension returns the file extension of the output format without the leading dot, such as "h264".
+func (d *Demuxer) Extension() string {
+	switch d.format {
+	case demuxFormatH264:
+		return "h264"
+	case demuxFormatH265:
+		return "h265"
+	case demuxFormatADTS:
+		return "aac"
+	case demuxFormatAC3:
+		return "ac3"
+	case demuxFormatEC3:
+		return "ec3"
+	case demuxFormatOgg:
+		return "opus"
+	case demuxFormatIVF:
+		return "ivf"
+	case demuxFormatWAV:
+		return "wav"
+	case demuxFormatWebVTT:
+		return "vtt"
+	default:
+		return "flac"
+	}
+}
+
+// WriteTo writes the elementary stream to w.
+func (d *Demuxer) WriteTo(w io.Writer) (int64, error) {
+	it, err := NewSampleIterator(d.r, d.trackID)
+	if err != nil {
+		return 0, err
+	}
+	var samples []*MediaSample
+	for {
+		s, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		samples = append(samples, s)
+	}
+
+	ow := &offsetWriter{writer: w}
+	switch d.format {
+	case demuxFormatH264, demuxFormatH265:
+		err = d.writeAnnexB(ow, samples)
+	case demuxFormatADTS:
+		err = d.writeADTS(ow, samples)
+	case demuxFormatOgg:
+		err = d.writeOgg(ow, samples)
+	case demuxFormatIVF:
+		err = d.writeIVF(ow, samples)
+	case demuxFormatWAV:
+		err = d.writeWAV(ow, samples)
+	case demuxFormatFLAC:
+		err = d.writeFLAC(ow, samples)
+	case demuxFormatWebVTT:
+		err = d.writeWebVTT(ow, samples)
+	default:
+		err = d.writeRaw(ow, samples)
+	}
+	return ow.offset, err
+}
+
+func (d *Demuxer) readSample(s *MediaSample) ([]byte, error) {
+	if _, err := d.r.Seek(int64(s.Offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, s.Size)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// sampleEntry returns the sample entry which is referred by the sample.
+func (d *Demuxer) sampleEntry(s *MediaSample) (*BoxNode, error) {
+	if s.SampleDescriptionIndex == 0 || int(s.SampleDescriptionIndex) > len(d.entries) {
+		return nil, fmt.Errorf("invalid sample description index: %d", s.SampleDescriptionIndex)
+	}
+	return d.entries[s.SampleDescriptionIndex-1], nil
+}
+
+func (d *Demuxer) writeRaw(w io.Writer, samples []*MediaSample) error {
+	for _, s := range samples {
+		data, err := d.readSample(s)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Demuxer) writeAnnexB(w io.Writer, samples []*MediaSample) error {
+	for _, s := range samples {
+		entry, err := d.sampleEntry(s)
+		if err != nil {
+			return err
+		}
+		data, err := d.readSample(s)
+		if err != nil {
+			return err
+		}
+		var au []byte
+		if d.format == demuxFormatH264 {
+			avcC, ok := findPayload(entry, BoxTypeAvcC()).(*AVCDecoderConfiguration)
+			if !ok {
+				return errors.New("avcC box not found")
+			}
+			au, err = AVCSampleToAnnexB(avcC, data)
+		} else {
+			hvcC, ok := findPayload(entry, BoxTypeHvcC()).(*HvcC)
+			if !ok {
+				return errors.New("hvcC box not found")
+			}
+			au, err = HEVCSampleToAnnexB(hvcC, data)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(au); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Demuxer) writeADTS(w io.Writer, samples []*MediaSample) error {
+	ascs := make(map[*BoxNode]*AudioSpecificConfig, len(d.entries))
+	for _, s := range samples {
+		entry, err := d.sampleEntry(s)
+		if err != nil {
+			return err
+		}
+		asc, ok := ascs[entry]
+		if !ok {
+			if asc, err = adtsConfig(entry); err != nil {
+				return err
+			}
+			ascs[entry] = asc
+		}
+		data, err := d.readSample(s)
+		if err != nil {
+			return err
+		}
+		frameLength := len(data) + 7
+		if frameLength >= 1<<13 {
+			return fmt.Errorf("too large AAC frame: size=%d", len(data))
+		}
+		// ISO/IEC 14496-3 1.A.2.2 adts_fixed_header and adts_variable_header, without CRC
+		header := []byte{
+			0xff,
+			0xf1, // ID=0 (MPEG-4), layer=0, protection_absent=1
+			(asc.AudioObjectType-1)<<6 | asc.SamplingFrequencyIndex<<2 | asc.ChannelConfiguration>>2,
+			asc.ChannelConfiguration<<6 | byte(frameLength>>11),
+			byte(frameLength >> 3),
+			byte(frameLength<<5) | 0x1f, // adts_buffer_fullness=0x7ff (VBR)
+			0xfc,
+		}
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adtsConfig returns the AudioSpecificConfig of the sample entry, which must be represented by ADTS headers.
+func adtsConfig(entry *BoxNode) (*AudioSpecificConfig, error) {
+	data, err := getAudioSpecificConfig(findPayload(entry, BoxTypeEsds()).(*Esds))
+	if err != nil {
+		return nil, err
+	}
+	asc, err := ParseAudioSpecificConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	if asc.AudioObjectType < AACObjectTypeMain || asc.AudioObjectType > AACObjectTypeLTP {
+		return nil, fmt.Errorf("audio object type %d can not be represented by ADTS", asc.AudioObjectType)
+	}
+	if asc.SamplingFrequencyIndex > 0xc {
+		return nil, fmt.Errorf("sampling frequency %d can not be represented by ADTS", asc.SamplingFrequency)
+	}
+	if asc.ChannelConfiguration == 0 {
+		// ADTS requires the program_config_element in the raw data blocks
+		return nil, errors.New("channel configuration 0 can not be represented by ADTS")
+	}
+	return asc, nil
+}
+
+func (d *Demuxer) writeIVF(w io.Writer, samples []*MediaSample) error {
+	entry := d.entries[0]
+	var fourcc string
+	var configOBUs []byte
+	switch entry.Info.Type {
+	case BoxTypeVp08():
+		fourcc = "VP80"
+	case BoxTypeVp09():
+		fourcc = "VP90"
+	default:
+		fourcc = "AV01"
+		av1C, ok := findPayload(entry, BoxTypeAv1C()).(*Av1C)
+		if !ok {
+			return errors.New("av1C box not found")
+		}
+		configOBUs = av1C.ConfigOBUs
+	}
+	var width, height uint16
+	if vse, ok := entry.Payload.(*VisualSampleEntry); ok {
+		width, height = vse.Width, vse.Height
+	}
+
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)  // version
+	binary.LittleEndian.PutUint16(header[6:], 32) // header size
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint16(header[12:], width)
+	binary.LittleEndian.PutUint16(header[14:], height)
+	binary.LittleEndian.PutUint32(header[16:], d.timescale) // time base denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)           // time base numerator
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(samples)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for i, s := range samples {
+		data, err := d.readSample(s)
+		if err != nil {
+			return err
+		}
+		if entry.Info.Type == BoxTypeAv01() {
+			// temporal units in IVF start with a temporal delimiter, which is removed in MP4
+			prefix := []byte{av1OBUTemporalDelimiter<<3 | 0x02, 0x00}
+			if i == 0 {
+				found, err := hasAV1OBU(data, av1OBUSequenceHeader)
+				if err != nil {
+					return err
+				}
+				if !found {
+					prefix = append(prefix, configOBUs...)
+				}
+			}
+			data = append(prefix, data...)
+		}
+		frameHeader := make([]byte, 12)
+		binary.LittleEndian.PutUint32(frameHeader[0:], uint32(len(data)))
+		binary.LittleEndian.PutUint64(frameHeader[4:], uint64(s.CompositionTime()))
+		if _, err := w.Write(frameHeader); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasAV1OBU reports whether the data contains an OBU of the given type.
+func hasAV1OBU(data []byte, obuType uint8) (bool, error) {
+	obus, err := splitAV1OBUs(data)
+	if err != nil {
+		return false, err
+	}
+	for _, obu := range obus {
+		if av1OBUType(obu) == obuType {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (d *Demuxer) writeWAV(w io.Writer, samples []*MediaSample) error {
+	entry := d.entries[0]
+	ase, ok := entry.Payload.(*AudioSampleEntry)
+	if !ok {
+		return errors.New("invalid sample entry")
+	}
+	pcmC, ok := findPayload(entry, BoxTypePcmC()).(*PcmC)
+	if !ok {
+		return errors.New("pcmC box not found")
+	}
+	if pcmC.PCMSampleSize == 0 || pcmC.PCMSampleSize%8 != 0 {
+		return fmt.Errorf("unsupported PCM sample size: %d", pcmC.PCMSampleSize)
+	}
+	formatTag := uint16(1) // WAVE_FORMAT_PCM
+	if entry.Info.Type == BoxTypeFpcm() {
+		formatTag = 3 // WAVE_FORMAT_IEEE_FLOAT
+	}
+	sampleRate := ase.SampleRate >> 16
+	if sampleRate == 0 {
+		sampleRate = d.timescale
+	}
+	bytesPerSample := uint32(pcmC.PCMSampleSize / 8)
+	blockAlign := uint32(ase.ChannelCount) * bytesPerSample
+	var dataSize uint64
+	for _, s := range samples {
+		dataSize += uint64(s.Size)
+	}
+	if dataSize > 0xffffffff-36 {
+		return errors.New("too large PCM data for WAV")
+	}
+
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+dataSize+dataSize%2))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], formatTag)
+	binary.LittleEndian.PutUint16(header[22:], ase.ChannelCount)
+	binary.LittleEndian.PutUint32(header[24:], sampleRate)
+	binary.LittleEndian.PutUint32(header[28:], sampleRate*blockAlign)
+	binary.LittleEndian.PutUint16(header[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:], uint16(pcmC.PCMSampleSize))
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(dataSize))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	littleEndian := pcmC.FormatFlags&0x01 != 0
+	for _, s := range samples {
+		data, err := d.readSample(s)
+		if err != nil {
+			return err
+		}
+		if !littleEndian {
+			for i := 0; i+int(bytesPerSample) <= len(data); i += int(bytesPerSample) {
+				for j, k := i, i+int(bytesPerSample)-1; j < k; j, k = j+1, k-1 {
+					data[j], data[k] = data[k], data[j]
+				}
+			}
+		}
+		if bytesPerSample == 1 && formatTag == 1 {
+			// 8-bit samples are signed in ISO/IEC 23003-5 and unsigned in WAV
+			for i := range data {
+				data[i] ^= 0x80
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	if dataSize%2 != 0 {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Demuxer) writeFLAC(w io.Writer, samples []*MediaSample) error {
+	dfLa, ok := findPayload(d.entries[0], BoxTypeDfLa()).(*DfLa)
+	if !ok {
+		return errors.New("dfLa box not found")
+	}
+	if len(dfLa.MetadataBlocks) == 0 || dfLa.MetadataBlocks[0].BlockType != FLACMetadataBlockTypeStreamInfo {
+		return errors.New("STREAMINFO metadata block not found")
+	}
+	if _, err := w.Write([]byte("fLaC")); err != nil {
+		return err
+	}
+	for i, block := range dfLa.MetadataBlocks {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(block.BlockData))&0xffffff)
+		header[0] = block.BlockType & 0x7f
+		if i == len(dfLa.MetadataBlocks)-1 {
+			header[0] |= 0x80
+		}
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(block.BlockData); err != nil {
+			return err
+		}
+	}
+	return d.writeRaw(w, samples)
+}
+
+func (d *Demuxer) writeWebVTT(w io.Writer, samples []*MediaSample) error {
+	vttC, ok := findPayload(d.entries[0], BoxTypeVttC()).(*WebVTTConfigurationBox)
+	if !ok {
+		return errors.New("vttC box not found")
+	}
+	var cues []*vttCue
+	var open []*vttCue // cues of the previous sample, which can be continued by the current sample
+	for _, s := range samples {
+		data, err := d.readSample(s)
+		if err != nil {
+			return err
+		}
+		tree, err := ReadBoxTree(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		pts := uint64(int64(s.DecodeTime) + s.CompositionTimeOffset)
+		start := rescaleTime(pts, 1000, d.timescale)
+		end := rescaleTime(pts+uint64(s.Duration), 1000, d.timescale)
+		var next []*vttCue
+		for _, vttc := range tree.Find(BoxPath{BoxTypeVttc()}) {
+			cue := &vttCue{start: start, end: end}
+			if iden, ok := findPayload(vttc, BoxTypeIden()).(*CueIDBox); ok {
+				cue.id = iden.CueId
+			}
+			if sttg, ok := findPayload(vttc, BoxTypeSttg()).(*CueSettingsBox); ok {
+				cue.settings = sttg.Settings
+			}
+			if payl, ok := findPayload(vttc, BoxTypePayl()).(*CuePayloadBox); ok {
+				cue.payload = strings.TrimRight(payl.CueText, "\n")
+			}
+			continued := false
+			for i, c := range open {
+				if c != nil && c.end == start && c.id == cue.id && c.settings == cue.settings && c.payload == cue.payload {
+					c.end = end
+					next = append(next, c)
+					open[i] = nil
+					continued = true
+					break
+				}
+			}
+			if !continued {
+				cues = append(cues, cue)
+				next = append(next, cue)
+			}
+		}
+		open = next
+	}
+
+	header := strings.TrimRight(vttC.Config, "\n")
+	if header == "" {
+		header = "WEBVTT"
+	}
+	buf := bytes.NewBufferString(header + "\n")
+	for _, cue := range cues {
+		buf.WriteString("\n")
+		if cue.id != "" {
+			buf.WriteString(cue.id + "\n")
+		}
+		buf.WriteString(formatVTTTimestamp(cue.start) + " --> " + formatVTTTimestamp(cue.end))
+		if cue.settings != "" {
+			buf.WriteString(" " + cue.settings)
+		}
+		buf.WriteString("\n")
+		if cue.payload != "" {
+			buf.WriteString(cue.payload + "\n")
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (d *Demuxer) writeOgg(w io.Writer, samples []*MediaSample) error {
+	dOps, ok := findPayload(d.entries[0], BoxTypeDOps()).(*DOps)
+	if !ok {
+		return errors.New("dOps box not found")
+	}
+
+	// RFC 7845 5.1 Identification Header, whose fields are little endian unlike dOps box
+	head := make([]byte, 19, 21+len(dOps.ChannelMapping))
+	copy(head[0:], "OpusHead")
+	head[8] = 1 // version
+	head[9] = dOps.OutputChannelCount
+	binary.LittleEndian.PutUint16(head[10:], dOps.PreSkip)
+	binary.LittleEndian.PutUint32(head[12:], dOps.InputSampleRate)
+	binary.LittleEndian.PutUint16(head[16:], uint16(dOps.OutputGain))
+	head[18] = dOps.ChannelMappingFamily
+	if dOps.ChannelMappingFamily != 0 {
+		head = append(head, dOps.StreamCount, dOps.CoupledCount)
+		head = append(head, dOps.ChannelMapping...)
+	}
+
+	// RFC 7845 5.2 Comment Header
+	const vendor = "go-mp4"
+	tags := make([]byte, 16+len(vendor))
+	copy(tags[0:], "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	binary.LittleEndian.PutUint32(tags[12+len(vendor):], 0) // user comment list length
+
+	ogg := &oggWriter{w: w, serial: d.trackID}
+	if err := ogg.writePage(head, 0, oggHeaderTypeBOS); err != nil {
+		return err
+	}
+	if err := ogg.writePage(tags, 0, 0); err != nil {
+		return err
+	}
+	for i, s := range samples {
+		data, err := d.readSample(s)
+		if err != nil {
+			return err
+		}
+		// granule position is the end time of the packet in 48 kHz including pre-skip
+		granule := rescaleTime(s.DecodeTime+uint64(s.Duration), 48000, d.timescale)
+		var headerType uint8
+		if i == len(samples)-1 {
+			headerType = oggHeaderTypeEOS
+		}
+		if err := ogg.writePage(data, granule, headerType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	oggHeaderTypeBOS = 0x02
+	oggHeaderTypeEOS = 0x04
+)
+
+// oggWriter writes Ogg pages which contain one packet each, defined at RFC 3533.
+type oggWriter struct {
+	w        io.Writer
+	serial   uint32
+	sequence uint32
+}
+
+func (o *oggWriter) writePage(packet []byte, granule uint64, headerType uint8) error {
+	segments := len(packet)/255 + 1
+	if segments > 255 {
+		return fmt.Errorf("too large Ogg packet: size=%d", len(packet))
+	}
+	page := make([]byte, 27+segments, 27+segments+len(packet))
+	copy(page[0:], "OggS")
+	page[4] = 0 // version
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.sequence)
+	page[26] = uint8(segments)
+	for i := 0; i < segments-1; i++ {
+		page[27+i] = 255
+	}
+	page[27+segments-1] = uint8(len(packet) % 255)
+	page = append(page, packet...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	o.sequence++
+	_, err := o.w.Write(page)
+	return err
+}
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+// oggCRC calculates the CRC-32 of Ogg page, whose generator polynomial is 0x04c11db7
+// without reflection and final XOR.
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
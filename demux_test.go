@@ -0,0 +1,336 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replaceSampleEntry replaces the sample entry of the track of sample.mp4.
+func replaceSampleEntry(t *testing.T, trackID int, entry *BoxNode) []byte {
+	tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample.mp4")))
+	require.NoError(t, err)
+	stsd := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd()})[trackID-1]
+	require.NoError(t, stsd.Children[0].Replace(entry))
+	return writeBoxTree(t, tree)
+}
+
+func demuxTrack(t *testing.T, input []byte, trackID uint32) (string, []byte) {
+	d, err := NewDemuxer(bytes.NewReader(input), trackID)
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	n, err := d.WriteTo(buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	return d.Extension(), buf.Bytes()
+}
+
+func TestDemuxer(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+
+	ext, output := demuxTrack(t, input, 1)
+	assert.Equal(t, "h264", ext)
+	tree, err := ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	avcC := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAvc1(), BoxTypeAvcC()}).Payload.(*AVCDecoderConfiguration)
+	var expected []byte
+	for _, data := range readTrackSampleData(t, bytes.NewReader(input), 1) {
+		au, err := AVCSampleToAnnexB(avcC, data)
+		require.NoError(t, err)
+		expected = append(expected, au...)
+	}
+	assert.Equal(t, expected, output)
+	nalus := SplitAnnexB(output)
+	require.NotEmpty(t, nalus)
+	assert.Equal(t, avcC.SequenceParameterSets[0].NALUnit, nalus[0])
+
+	ext, output = demuxTrack(t, input, 2)
+	assert.Equal(t, "aac", ext)
+	for i, data := range readTrackSampleData(t, bytes.NewReader(input), 2) {
+		require.Greater(t, len(output), 7)
+		assert.Equal(t, []byte{0xff, 0xf1}, output[:2], "frame %d", i)
+		assert.Equal(t, uint8(1), output[2]>>6, "profile must be AAC LC")
+		assert.Equal(t, uint8(4), (output[2]>>2)&0xf, "sampling frequency index must be 44100 Hz")
+		assert.Equal(t, uint8(2), (output[2]&0x1)<<2|output[3]>>6, "channel configuration must be stereo")
+		frameLength := int(output[3]&0x3)<<11 | int(output[4])<<3 | int(output[5])>>5
+		require.Equal(t, len(data)+7, frameLength, "frame %d", i)
+		assert.Equal(t, data, output[7:frameLength], "frame %d", i)
+		output = output[frameLength:]
+	}
+	assert.Empty(t, output)
+
+	_, err = NewDemuxer(bytes.NewReader(input), 3)
+	assert.Error(t, err)
+}
+
+func TestDemuxerAudio(t *testing.T) {
+	data := readTrackSampleData(t, bytes.NewReader(readFile(t, "./testdata/sample.mp4")), 2)
+	var raw []byte
+	for _, d := range data {
+		raw = append(raw, d...)
+	}
+	newEntry := func(boxType BoxType, children ...*BoxNode) *BoxNode {
+		return NewBoxNode(&AudioSampleEntry{
+			SampleEntry:  SampleEntry{AnyTypeBox: AnyTypeBox{Type: boxType}, DataReferenceIndex: 1},
+			ChannelCount: 2,
+			SampleSize:   16,
+			SampleRate:   44100 << 16,
+		}, children...)
+	}
+
+	t.Run("ac-3", func(t *testing.T) {
+		ext, output := demuxTrack(t, replaceSampleEntry(t, 2, newEntry(BoxTypeAC3(), NewBoxNode(&Dac3{}))), 2)
+		assert.Equal(t, "ac3", ext)
+		assert.Equal(t, raw, output)
+	})
+
+	t.Run("ec-3", func(t *testing.T) {
+		ext, output := demuxTrack(t, replaceSampleEntry(t, 2, newEntry(BoxTypeEC3())), 2)
+		assert.Equal(t, "ec3", ext)
+		assert.Equal(t, raw, output)
+	})
+
+	t.Run("ipcm", func(t *testing.T) {
+		// 16-bit big endian samples are swapped into little endian
+		entry := newEntry(BoxTypeIpcm(), NewBoxNode(&PcmC{FormatFlags: 0, PCMSampleSize: 16}))
+		ext, output := demuxTrack(t, replaceSampleEntry(t, 2, entry), 2)
+		assert.Equal(t, "wav", ext)
+		require.Len(t, output, 44+len(raw))
+		assert.Equal(t, []byte("RIFF"), output[0:4])
+		assert.Equal(t, uint32(36+len(raw)), binary.LittleEndian.Uint32(output[4:]))
+		assert.Equal(t, []byte("WAVEfmt "), output[8:16])
+		assert.Equal(t, uint16(1), binary.LittleEndian.Uint16(output[20:]), "format tag")
+		assert.Equal(t, uint16(2), binary.LittleEndian.Uint16(output[22:]), "channels")
+		assert.Equal(t, uint32(44100), binary.LittleEndian.Uint32(output[24:]), "sample rate")
+		assert.Equal(t, uint32(44100*4), binary.LittleEndian.Uint32(output[28:]), "byte rate")
+		assert.Equal(t, uint16(4), binary.LittleEndian.Uint16(output[32:]), "block align")
+		assert.Equal(t, uint16(16), binary.LittleEndian.Uint16(output[34:]), "bits per sample")
+		assert.Equal(t, []byte("data"), output[36:40])
+		assert.Equal(t, uint32(len(raw)), binary.LittleEndian.Uint32(output[40:]))
+		assert.Equal(t, []byte{raw[1], raw[0], raw[3], raw[2]}, output[44:48])
+	})
+
+	t.Run("fpcm", func(t *testing.T) {
+		entry := newEntry(BoxTypeFpcm(), NewBoxNode(&PcmC{FormatFlags: 0x01, PCMSampleSize: 32}))
+		_, output := demuxTrack(t, replaceSampleEntry(t, 2, entry), 2)
+		assert.Equal(t, uint16(3), binary.LittleEndian.Uint16(output[20:]), "format tag")
+		assert.Equal(t, uint16(8), binary.LittleEndian.Uint16(output[32:]), "block align")
+		assert.Equal(t, uint16(32), binary.LittleEndian.Uint16(output[34:]), "bits per sample")
+		assert.Equal(t, raw, output[44:])
+	})
+
+	t.Run("fLaC", func(t *testing.T) {
+		streamInfo := make([]byte, 34)
+		entry := newEntry(BoxTypeFLaC(), NewBoxNode(&DfLa{
+			MetadataBlocks: []FLACMetadataBlock{
+				{LastMetadataBlockFlag: true, BlockType: FLACMetadataBlockTypeStreamInfo, Length: 34, BlockData: streamInfo},
+			},
+		}))
+		ext, output := demuxTrack(t, replaceSampleEntry(t, 2, entry), 2)
+		assert.Equal(t, "flac", ext)
+		expected := append([]byte{'f', 'L', 'a', 'C', 0x80, 0x00, 0x00, 34}, streamInfo...)
+		assert.Equal(t, append(expected, raw...), output)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := NewDemuxer(bytes.NewReader(replaceSampleEntry(t, 2, newEntry(BoxTypeEnca()))), 2)
+		assert.Error(t, err)
+	})
+}
+
+func TestDemuxerSampleEntries(t *testing.T) {
+	// replaceSampleEntries replaces the sample entries of the audio track of sample.mp4,
+	// and makes all samples refer to the last entry
+	replaceSampleEntries := func(t *testing.T, entries ...*BoxNode) []byte {
+		tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample.mp4")))
+		require.NoError(t, err)
+		stbl := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})[1]
+		stsd := stbl.FindFirst(BoxPath{BoxTypeStsd()})
+		stsd.Children = nil
+		for _, entry := range entries {
+			stsd.AppendChild(entry)
+		}
+		stsd.Payload.(*Stsd).EntryCount = uint32(len(entries))
+		stsc := stbl.FindFirst(BoxPath{BoxTypeStsc()}).Payload.(*Stsc)
+		for i := range stsc.Entries {
+			stsc.Entries[i].SampleDescriptionIndex = uint32(len(entries))
+		}
+		return writeBoxTree(t, tree)
+	}
+	newEntry := func(boxType BoxType, children ...*BoxNode) *BoxNode {
+		return NewBoxNode(&AudioSampleEntry{
+			SampleEntry:  SampleEntry{AnyTypeBox: AnyTypeBox{Type: boxType}, DataReferenceIndex: 1},
+			ChannelCount: 2,
+			SampleSize:   16,
+			SampleRate:   44100 << 16,
+		}, children...)
+	}
+
+	t.Run("mp4a", func(t *testing.T) {
+		input := replaceSampleEntries(t,
+			newEntry(BoxTypeMp4a(), NewBoxNode(newAACEsds(2, []byte{0x12, 0x10}))), // 44.1 kHz
+			newEntry(BoxTypeMp4a(), NewBoxNode(newAACEsds(2, []byte{0x11, 0x90}))), // 48 kHz
+		)
+		_, output := demuxTrack(t, input, 2)
+		require.Greater(t, len(output), 7)
+		assert.Equal(t, uint8(3), (output[2]>>2)&0xf, "sampling frequency index must be 48000 Hz")
+	})
+
+	t.Run("mp4a with PCE", func(t *testing.T) {
+		pce := []byte{0x11, 0x80, 0x04, 0xc8, 0x05, 0x00, 0x01, 0x08, 0x80, 0x00}
+		input := replaceSampleEntries(t, newEntry(BoxTypeMp4a(), NewBoxNode(newAACEsds(2, pce))))
+		d, err := NewDemuxer(bytes.NewReader(input), 2)
+		require.NoError(t, err)
+		_, err = d.WriteTo(io.Discard)
+		assert.Error(t, err)
+	})
+
+	t.Run("ipcm", func(t *testing.T) {
+		input := replaceSampleEntries(t,
+			newEntry(BoxTypeIpcm(), NewBoxNode(&PcmC{PCMSampleSize: 16})),
+			newEntry(BoxTypeIpcm(), NewBoxNode(&PcmC{PCMSampleSize: 24})),
+		)
+		_, err := NewDemuxer(bytes.NewReader(input), 2)
+		assert.Error(t, err)
+	})
+}
+
+func TestDemuxerOgg(t *testing.T) {
+	dOps := &DOps{
+		OutputChannelCount: 2,
+		PreSkip:            312,
+		InputSampleRate:    44100,
+		OutputGain:         -256,
+	}
+	packets := [][]byte{{0xfc, 0x01}, bytes.Repeat([]byte{0xfc}, 300), {0xfc, 0x03}}
+	output := bytes.NewBuffer(nil)
+	m, err := NewMuxer(output, &MuxerOptions{Fragmented: true})
+	require.NoError(t, err)
+	trackID, err := m.AddTrack(MuxerTrack{Opus: dOps})
+	require.NoError(t, err)
+	for i, p := range packets {
+		require.NoError(t, m.WriteSample(trackID, &MuxerSample{
+			DecodeTime:       uint64(i * 960),
+			PresentationTime: uint64(i * 960),
+			Duration:         960,
+			IsSync:           true,
+			Data:             p,
+		}))
+	}
+	require.NoError(t, m.Close())
+
+	ext, ogg := demuxTrack(t, output.Bytes(), trackID)
+	assert.Equal(t, "opus", ext)
+	var pages [][]byte
+	var granules []uint64
+	var headerTypes []uint8
+	for len(ogg) != 0 {
+		require.Greater(t, len(ogg), 27)
+		require.Equal(t, []byte("OggS"), ogg[:4])
+		assert.Equal(t, uint32(len(pages)), binary.LittleEndian.Uint32(ogg[18:]), "page sequence number")
+		segments := int(ogg[26])
+		size := 27 + segments
+		var packet int
+		for _, lacing := range ogg[27 : 27+segments] {
+			packet += int(lacing)
+		}
+		size += packet
+		page := append([]byte{}, ogg[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		assert.Equal(t, oggCRC(page), crc, "page %d", len(pages))
+		pages = append(pages, ogg[27+segments:size])
+		granules = append(granules, binary.LittleEndian.Uint64(ogg[6:]))
+		headerTypes = append(headerTypes, ogg[5])
+		ogg = ogg[size:]
+	}
+	require.Len(t, pages, 5)
+	assert.Equal(t, []byte{
+		'O', 'p', 'u', 's', 'H', 'e', 'a', 'd',
+		0x01, 0x02, 0x38, 0x01, 0x44, 0xac, 0x00, 0x00, 0x00, 0xff, 0x00,
+	}, pages[0])
+	assert.Equal(t, []byte("OpusTags"), pages[1][:8])
+	assert.Equal(t, packets, pages[2:])
+	assert.Equal(t, []uint64{0, 0, 960, 1920, 2880}, granules)
+	assert.Equal(t, []uint8{oggHeaderTypeBOS, 0, 0, 0, oggHeaderTypeEOS}, headerTypes)
+
+	// check value of CRC-32 with the parameters of Ogg
+	assert.Equal(t, uint32(0x89a1897f), oggCRC([]byte("123456789")))
+}
+
+func TestDemuxerIVF(t *testing.T) {
+	t.Run("vp09", func(t *testing.T) {
+		entry := NewBoxNode(&VisualSampleEntry{
+			SampleEntry: SampleEntry{AnyTypeBox: AnyTypeBox{Type: BoxTypeVp09()}, DataReferenceIndex: 1},
+			Width:       320,
+			Height:      180,
+		}, NewBoxNode(&VpcC{FullBox: FullBox{Version: 1}, BitDepth: 8}))
+		input := replaceSampleEntry(t, 1, entry)
+		ext, output := demuxTrack(t, input, 1)
+		assert.Equal(t, "ivf", ext)
+		it, err := NewSampleIterator(bytes.NewReader(input), 1)
+		require.NoError(t, err)
+		samples := readAllSamples(t, it)
+		data := readTrackSampleData(t, bytes.NewReader(input), 1)
+
+		require.Greater(t, len(output), 32)
+		assert.Equal(t, []byte("DKIF"), output[0:4])
+		assert.Equal(t, uint16(32), binary.LittleEndian.Uint16(output[6:]))
+		assert.Equal(t, []byte("VP90"), output[8:12])
+		assert.Equal(t, uint16(320), binary.LittleEndian.Uint16(output[12:]))
+		assert.Equal(t, uint16(180), binary.LittleEndian.Uint16(output[14:]))
+		assert.Equal(t, uint32(10240), binary.LittleEndian.Uint32(output[16:]))
+		assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(output[20:]))
+		assert.Equal(t, uint32(len(samples)), binary.LittleEndian.Uint32(output[24:]))
+		output = output[32:]
+		for i, s := range samples {
+			require.Greater(t, len(output), 12)
+			size := int(binary.LittleEndian.Uint32(output))
+			assert.Equal(t, uint64(s.CompositionTime()), binary.LittleEndian.Uint64(output[4:]), "frame %d", i)
+			assert.Equal(t, data[i], output[12:12+size], "frame %d", i)
+			output = output[12+size:]
+		}
+		assert.Empty(t, output)
+	})
+
+	t.Run("av01", func(t *testing.T) {
+		seqHeader := []byte{0x0a, 0x01, 0x00}
+		frame := []byte{0x32, 0x01, 0x10}
+		output := bytes.NewBuffer(nil)
+		m, err := NewMuxer(output, &MuxerOptions{Fragmented: true})
+		require.NoError(t, err)
+		trackID, err := m.AddTrack(MuxerTrack{
+			Timescale: 30,
+			Width:     64,
+			Height:    64,
+			AV1:       &Av1C{Marker: 1, Version: 1, ConfigOBUs: seqHeader},
+		})
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, m.WriteSample(trackID, &MuxerSample{
+				DecodeTime:       uint64(i),
+				PresentationTime: uint64(i),
+				Duration:         1,
+				IsSync:           i == 0,
+				Data:             frame,
+			}))
+		}
+		require.NoError(t, m.Close())
+
+		_, ivf := demuxTrack(t, output.Bytes(), trackID)
+		require.Greater(t, len(ivf), 32)
+		assert.Equal(t, []byte("AV01"), ivf[8:12])
+		ivf = ivf[32:]
+		// the sequence header is inserted into the first temporal unit
+		assert.Equal(t, []byte{
+			0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x12, 0x00, 0x0a, 0x01, 0x00, 0x32, 0x01, 0x10,
+			0x05, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x12, 0x00, 0x32, 0x01, 0x10,
+		}, ivf)
+	})
+}
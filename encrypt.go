@@ -0,0 +1,614 @@
+package mp4
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// EncryptionKey is a content key of the Common Encryption.
+type EncryptionKey struct {
+	KID [16]byte
+	Key []byte // 16 bytes
+
+	// IV is the 8-byte IV of the first sample, which is incremented for each sample on cenc scheme,
+	// or the 16-byte constant IV on cbcs scheme. A random IV is used when it is empty.
+	IV []byte
+}
+
+// EncryptOptions is options for Encrypt.
+type EncryptOptions struct {
+	// Scheme is the protection scheme, "cenc" or "cbcs". It defaults to "cenc".
+	Scheme string
+
+	// Key is used for the tracks which are not in TrackKeys. Tracks without keys are left clear.
+	Key       *EncryptionKey
+	TrackKeys map[uint32]*EncryptionKey
+
+	// PSSH boxes are inserted into the moov box, or into every moof box when PSSHInFragments is true.
+	PSSH            []*Pssh
+	PSSHInFragments bool
+}
+
+// NewPssh returns a pssh box for the DRM system. A version 1 box is returned when kids are given.
+func NewPssh(systemID [16]byte, kids [][16]byte, data []byte) *Pssh {
+	pssh := &Pssh{
+		SystemID: systemID,
+		DataSize: int32(len(data)),
+		Data:     data,
+	}
+	if len(kids) != 0 {
+		pssh.SetVersion(1)
+		pssh.KIDCount = uint32(len(kids))
+		for _, kid := range kids {
+			pssh.KIDs = append(pssh.KIDs, PsshKID{KID: kid})
+		}
+	}
+	return pssh
+}
+
+// Encrypt writes the fragmented MP4 file whose samples are encrypted by the Common Encryption.
+// The sample entries are replaced by encv or enca boxes with sinf boxes, and senc, saiz and saio boxes
+// are added to each traf box. AVC, HEVC and AV1 samples are encrypted as subsamples,
+// where only slice data and tile data are protected. The protected ranges are multiples of 16 bytes
+// on cenc scheme, and start right after the headers on cbcs scheme.
+// VP8 and VP9 are not supported, and samples of other codecs are encrypted entirely.
+// Video tracks are encrypted by 1:9 pattern on cbcs scheme.
+// The samples must be held by movie fragments.
+func Encrypt(r io.ReadSeeker, w io.Writer, opts *EncryptOptions) error {
+	if opts == nil {
+		opts = &EncryptOptions{}
+	}
+	schemeType := cencSchemeCENC
+	switch opts.Scheme {
+	case "", "cenc":
+	case "cbcs":
+		schemeType = cencSchemeCBCS
+	default:
+		return fmt.Errorf("unsupported scheme: %s", opts.Scheme)
+	}
+
+	tree, err := ReadBoxTree(r)
+	if err != nil {
+		return err
+	}
+	moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+	if moov == nil {
+		return errors.New("moov box not found")
+	}
+
+	var samples []*cencSample
+	var auxInfo []*BoxNode
+	for _, trak := range moov.Find(BoxPath{BoxTypeTrak()}) {
+		tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd)
+		if !ok {
+			return errors.New("tkhd box not found")
+		}
+		key := opts.Key
+		if k, ok := opts.TrackKeys[tkhd.TrackID]; ok {
+			key = k
+		}
+		if key == nil {
+			continue
+		}
+		e, err := newTrackEncrypter(r, trak, schemeType, key)
+		if err != nil {
+			return err
+		}
+		for _, moof := range tree.Find(BoxPath{BoxTypeMoof()}) {
+			for _, traf := range moof.Find(BoxPath{BoxTypeTraf()}) {
+				tfhd, ok := findPayload(traf, BoxTypeTfhd()).(*Tfhd)
+				if !ok {
+					return errors.New("tfhd box not found")
+				}
+				if tfhd.TrackID != tkhd.TrackID {
+					continue
+				}
+				s, senc, err := e.encryptTraf(traf)
+				if err != nil {
+					return err
+				}
+				samples = append(samples, s...)
+				if senc != nil {
+					auxInfo = append(auxInfo, senc)
+				}
+			}
+		}
+		if e.index != len(e.media) {
+			return errors.New("inconsistent sample count")
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].offset < samples[j].offset })
+
+	for _, pssh := range opts.PSSH {
+		if opts.PSSHInFragments {
+			for _, moof := range tree.Find(BoxPath{BoxTypeMoof()}) {
+				p := *pssh
+				moof.AppendChild(NewBoxNode(&p))
+			}
+		} else {
+			moov.AppendChild(NewBoxNode(pssh))
+		}
+	}
+
+	// saio boxes point to the data of senc boxes, which are placed by the layout
+	if err := tree.Relocate(0); err != nil {
+		return err
+	}
+	trexs := findTrexs(&tree.BoxNode)
+	for _, senc := range auxInfo {
+		traf := senc.Parent
+		base, err := trafBaseOffset(traf, trexs)
+		if err != nil {
+			return err
+		}
+		// the data follows the version, flags and sample_count of the senc box
+		if senc.Info.Offset+senc.Info.HeaderSize+8 < base {
+			return errors.New("senc box precedes the base offset of traf box")
+		}
+		offset := senc.Info.Offset + senc.Info.HeaderSize + 8 - base
+		saio := findPayload(traf, BoxTypeSaio()).(*Saio)
+		if offset > 0xffffffff {
+			saio.SetVersion(1)
+			saio.OffsetV1 = []uint64{offset}
+		} else {
+			saio.OffsetV0 = []uint32{uint32(offset)}
+		}
+	}
+
+	cr := &cencReader{r: r, samples: samples, encrypt: true}
+	for _, n := range tree.Children {
+		if n.Info.Type == BoxTypeMdat() && n.src != nil {
+			n.src = cr
+		}
+	}
+	_, err = tree.WriteTo(w)
+	return err
+}
+
+// trackEncrypter encrypts the samples of a track.
+type trackEncrypter struct {
+	r          io.ReadSeeker
+	schemeType [4]byte
+	key        []byte
+	iv         []byte
+	crypt      uint8
+	skip       uint8
+	codec      Codec
+	media      []*MediaSample
+	index      int
+
+	// entries are the sample entries, whose parameter sets are loaded when the sample description index changes.
+	entries    []*BoxNode
+	entryIndex uint32
+	lengthSize int
+	avcSPS     map[uint32]*avcSPS
+	avcPPS     map[uint32]*avcPPS
+	hevcSPS    map[uint32]*hevcSPS
+	hevcPPS    map[uint32]*hevcPPS
+	av1        *av1FrameHeaderParser
+}
+
+func newTrackEncrypter(r io.ReadSeeker, trak *BoxNode, schemeType [4]byte, key *EncryptionKey) (*trackEncrypter, error) {
+	if len(key.Key) != 16 {
+		return nil, errors.New("key must be 16 bytes")
+	}
+	e := &trackEncrypter{
+		r:          r,
+		schemeType: schemeType,
+		key:        key.Key,
+		codec:      CodecUnknown,
+	}
+	ivSize := 8
+	if schemeType == cencSchemeCBCS {
+		ivSize = 16
+	}
+	if len(key.IV) == 0 {
+		e.iv = make([]byte, ivSize)
+		if _, err := rand.Read(e.iv); err != nil {
+			return nil, err
+		}
+	} else if len(key.IV) != ivSize {
+		return nil, fmt.Errorf("IV must be %d bytes on %s scheme", ivSize, string(schemeType[:]))
+	} else {
+		e.iv = append([]byte{}, key.IV...)
+	}
+
+	hdlr, ok := findPayload(trak, BoxTypeMdia(), BoxTypeHdlr()).(*Hdlr)
+	if !ok {
+		return nil, errors.New("hdlr box not found")
+	}
+	video := hdlr.HandlerType == [4]byte{'v', 'i', 'd', 'e'}
+	if video && schemeType == cencSchemeCBCS {
+		e.crypt, e.skip = 1, 9
+	}
+
+	tenc := &Tenc{
+		DefaultCryptByteBlock: e.crypt,
+		DefaultSkipByteBlock:  e.skip,
+		DefaultIsProtected:    1,
+		DefaultKID:            key.KID,
+	}
+	if schemeType == cencSchemeCBCS {
+		tenc.SetVersion(1)
+		tenc.DefaultConstantIVSize = uint8(len(e.iv))
+		tenc.DefaultConstantIV = e.iv
+	} else {
+		tenc.DefaultPerSampleIVSize = uint8(len(e.iv))
+	}
+
+	stsd := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd()})
+	if stsd == nil {
+		return nil, errors.New("stsd box not found")
+	}
+	for i, entry := range stsd.Children {
+		if entry.FindFirst(BoxPath{BoxTypeSinf()}) != nil {
+			return nil, errors.New("track is already protected")
+		}
+		var encType BoxType
+		switch entry.Payload.(type) {
+		case *VisualSampleEntry:
+			encType = BoxTypeEncv()
+		case *AudioSampleEntry:
+			encType = BoxTypeEnca()
+		default:
+			return nil, fmt.Errorf("unsupported sample entry: %s", entry.Info.Type)
+		}
+		codec := CodecUnknown
+		switch {
+		case findPayload(entry, BoxTypeAvcC()) != nil:
+			codec = CodecAVC1
+		case findPayload(entry, BoxTypeHvcC()) != nil:
+			codec = CodecHEVC
+		case entry.Info.Type == BoxTypeAv01():
+			codec = CodecAV1
+		case entry.Info.Type == BoxTypeVp08(), entry.Info.Type == BoxTypeVp09():
+			return nil, fmt.Errorf("unsupported codec: %s", entry.Info.Type)
+		}
+		if i == 0 {
+			e.codec = codec
+		} else if codec != e.codec {
+			return nil, errors.New("sample entries of different codecs are not supported")
+		}
+		e.entries = append(e.entries, entry)
+		frma := &Frma{DataFormat: entry.Info.Type}
+		entry.Info.Type = encType
+		entry.Payload.(IAnyType).SetType(encType)
+		entry.AppendChild(NewBoxNode(&Sinf{},
+			NewBoxNode(frma),
+			NewBoxNode(&Schm{SchemeType: schemeType, SchemeVersion: 0x00010000}),
+			NewBoxNode(&Schi{}, NewBoxNode(tenc)),
+		))
+	}
+
+	if stsz, ok := findPayload(trak, BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsz()).(*Stsz); ok && stsz.SampleCount != 0 {
+		return nil, errors.New("samples in sample table are not supported")
+	}
+	tkhd := findPayload(trak, BoxTypeTkhd()).(*Tkhd)
+	it, err := NewSampleIterator(r, tkhd.TrackID)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		s, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		e.media = append(e.media, s)
+	}
+	return e, nil
+}
+
+// encryptTraf builds the parameters to encrypt the samples of the traf box,
+// and adds saiz, saio and senc boxes to the traf box. It returns the senc box node.
+func (e *trackEncrypter) encryptTraf(traf *BoxNode) ([]*cencSample, *BoxNode, error) {
+	var count int
+	for _, trun := range traf.Find(BoxPath{BoxTypeTrun()}) {
+		count += int(trun.Payload.(*Trun).SampleCount)
+	}
+	if e.index+count > len(e.media) {
+		return nil, nil, errors.New("inconsistent sample count")
+	}
+
+	senc := &Senc{SampleCount: uint32(count)}
+	if e.codec != CodecUnknown {
+		senc.AddFlag(SencUseSubsampleEncryption)
+	}
+	saiz := &Saiz{SampleCount: uint32(count)}
+	var samples []*cencSample
+	for _, ms := range e.media[e.index : e.index+count] {
+		s := &cencSample{
+			offset:     ms.Offset,
+			size:       ms.Size,
+			schemeType: e.schemeType,
+			key:        e.key,
+			iv:         e.iv,
+			crypt:      e.crypt,
+			skip:       e.skip,
+		}
+		var info []byte
+		if e.schemeType == cencSchemeCENC {
+			s.iv = append([]byte{}, e.iv...)
+			info = append(info, s.iv...)
+			binary.BigEndian.PutUint64(e.iv, binary.BigEndian.Uint64(e.iv)+1)
+		}
+		if e.codec != CodecUnknown {
+			if err := e.loadSampleEntry(ms.SampleDescriptionIndex); err != nil {
+				return nil, nil, err
+			}
+			data := make([]byte, ms.Size)
+			if _, err := e.r.Seek(int64(ms.Offset), io.SeekStart); err != nil {
+				return nil, nil, err
+			}
+			if _, err := io.ReadFull(e.r, data); err != nil {
+				return nil, nil, err
+			}
+			var err error
+			if s.subsamples, err = e.subsamples(data); err != nil {
+				return nil, nil, fmt.Errorf("sample %d: %w", ms.Index, err)
+			}
+			info = append(info, byte(len(s.subsamples)>>8), byte(len(s.subsamples)))
+			for _, sub := range s.subsamples {
+				info = append(info, byte(sub.BytesOfClearData>>8), byte(sub.BytesOfClearData))
+				info = append(info, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(info[len(info)-4:], sub.BytesOfProtectedData)
+			}
+		}
+		senc.SampleData = append(senc.SampleData, info...)
+		saiz.SampleInfoSize = append(saiz.SampleInfoSize, uint8(len(info)))
+		if ms.Size != 0 {
+			samples = append(samples, s)
+		}
+	}
+	e.index += count
+	if len(senc.SampleData) == 0 {
+		// the constant IV is used for all samples
+		return samples, nil, nil
+	}
+
+	// the default size is used when all samples have the same size
+	saiz.DefaultSampleInfoSize = saiz.SampleInfoSize[0]
+	for _, size := range saiz.SampleInfoSize {
+		if size != saiz.DefaultSampleInfoSize {
+			saiz.DefaultSampleInfoSize = 0
+			break
+		}
+	}
+	if saiz.DefaultSampleInfoSize != 0 {
+		saiz.SampleInfoSize = nil
+	}
+	node := NewBoxNode(senc)
+	traf.AppendChild(NewBoxNode(saiz))
+	traf.AppendChild(NewBoxNode(&Saio{EntryCount: 1, OffsetV0: []uint32{0}}))
+	traf.AppendChild(node)
+	return samples, node, nil
+}
+
+// loadSampleEntry loads the length size and the parameter sets of the sample entry
+// when the sample description index differs from the one of the previous sample.
+func (e *trackEncrypter) loadSampleEntry(index uint32) error {
+	if index == e.entryIndex {
+		return nil
+	}
+	if index == 0 || int(index) > len(e.entries) {
+		return fmt.Errorf("invalid sample description index: %d", index)
+	}
+	e.entryIndex = index
+	entry := e.entries[index-1]
+	switch e.codec {
+	case CodecAVC1:
+		avcC := findPayload(entry, BoxTypeAvcC()).(*AVCDecoderConfiguration)
+		e.lengthSize = int(avcC.LengthSizeMinusOne) + 1
+		e.avcSPS, e.avcPPS = make(map[uint32]*avcSPS), make(map[uint32]*avcPPS)
+		for _, ps := range append(append([]AVCParameterSet{}, avcC.SequenceParameterSets...), avcC.PictureParameterSets...) {
+			if err := e.addParameterSet(ps.NALUnit); err != nil {
+				return err
+			}
+		}
+	case CodecHEVC:
+		hvcC := findPayload(entry, BoxTypeHvcC()).(*HvcC)
+		e.lengthSize = int(hvcC.LengthSizeMinusOne) + 1
+		e.hevcSPS, e.hevcPPS = make(map[uint32]*hevcSPS), make(map[uint32]*hevcPPS)
+		for _, array := range hvcC.NaluArrays {
+			for _, nalu := range array.Nalus {
+				if err := e.addParameterSet(nalu.NALUnit); err != nil {
+					return err
+				}
+			}
+		}
+	case CodecAV1:
+		if e.av1 == nil {
+			e.av1 = &av1FrameHeaderParser{}
+		}
+		av1C, ok := findPayload(entry, BoxTypeAv1C()).(*Av1C)
+		if !ok {
+			return nil
+		}
+		obus, err := splitAV1OBUs(av1C.ConfigOBUs)
+		if err != nil {
+			return err
+		}
+		for _, obu := range obus {
+			if av1OBUType(obu) != av1OBUSequenceHeader {
+				continue
+			}
+			if e.av1.seq, err = parseAV1SequenceHeader(obu); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addParameterSet stores the SPS or the PPS to parse the following slice headers.
+// NAL units of other types are ignored.
+func (e *trackEncrypter) addParameterSet(nalu []byte) error {
+	if len(nalu) == 0 {
+		return nil
+	}
+	if e.codec == CodecAVC1 {
+		switch avcNALType(nalu) {
+		case avcNALSPS:
+			sps, err := parseAVCSPS(nalu)
+			if err != nil {
+				return err
+			}
+			e.avcSPS[sps.id] = sps
+		case avcNALPPS:
+			pps, err := parseAVCPPS(nalu)
+			if err != nil {
+				return err
+			}
+			e.avcPPS[pps.id] = pps
+		}
+		return nil
+	}
+	switch hevcNALType(nalu) {
+	case hevcNALSPS:
+		sps, err := parseHEVCSPS(nalu)
+		if err != nil {
+			return err
+		}
+		e.hevcSPS[sps.id] = sps
+	case hevcNALPPS:
+		pps, err := parseHEVCPPS(nalu)
+		if err != nil {
+			return err
+		}
+		e.hevcPPS[pps.id] = pps
+	}
+	return nil
+}
+
+// subsamples returns the subsample map of the sample, whose protected ranges are the slice data of
+// VCL NAL units or the tiles of AV1 tile groups. On cenc scheme, the protected ranges are multiples of
+// 16 bytes placed at the end of them. On cbcs scheme, the pattern leaves the trailing partial blocks clear.
+// Slice headers, frame headers and tile group headers are left clear.
+func (e *trackEncrypter) subsamples(data []byte) ([]SubsampleEncryption, error) {
+	var subsamples []SubsampleEncryption
+	var clearSize int
+	add := func(unitSize, headerSize int, protect bool) {
+		protectedSize := 0
+		if protect {
+			protectedSize = unitSize - headerSize
+			if e.schemeType == cencSchemeCENC {
+				protectedSize = protectedSize / 16 * 16
+			} else if protectedSize < 16 {
+				// no block is encrypted
+				protectedSize = 0
+			}
+		}
+		clearSize += unitSize - protectedSize
+		if protectedSize == 0 {
+			return
+		}
+		for clearSize > 0xffff {
+			subsamples = append(subsamples, SubsampleEncryption{BytesOfClearData: 0xffff})
+			clearSize -= 0xffff
+		}
+		subsamples = append(subsamples, SubsampleEncryption{
+			BytesOfClearData:     uint16(clearSize),
+			BytesOfProtectedData: uint32(protectedSize),
+		})
+		clearSize = 0
+	}
+
+	switch e.codec {
+	case CodecAVC1, CodecHEVC:
+		nalus, err := SplitLengthPrefixed(data, e.lengthSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				add(e.lengthSize, e.lengthSize, false)
+				continue
+			}
+			if err := e.addParameterSet(nalu); err != nil {
+				return nil, err
+			}
+			var headerSize int
+			if e.codec == CodecAVC1 {
+				if nalType := avcNALType(nalu); nalType >= 1 && nalType <= avcNALIDR {
+					sh, err := parseAVCSliceHeader(nalu, e.avcPPS, e.avcSPS)
+					if err != nil {
+						return nil, err
+					}
+					headerSize = sh.size
+				}
+			} else if hevcNALType(nalu) < 32 {
+				sh, err := parseHEVCSliceHeader(nalu, e.hevcPPS, e.hevcSPS)
+				if err != nil {
+					return nil, err
+				}
+				headerSize = sh.size
+			}
+			add(e.lengthSize+len(nalu), e.lengthSize+headerSize, headerSize != 0)
+		}
+	case CodecAV1:
+		obus, err := splitAV1OBUs(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, obu := range obus {
+			headerSize := 1
+			var temporalID, spatialID uint8
+			if obu[0]&0x04 != 0 {
+				headerSize++
+				temporalID, spatialID = obu[1]>>5, (obu[1]>>3)&0x03
+			}
+			_, n, err := readLEB128(obu[headerSize:])
+			if err != nil {
+				return nil, err
+			}
+			headerSize += n
+			switch obuType := av1OBUType(obu); obuType {
+			case av1OBUSequenceHeader:
+				if e.av1.seq, err = parseAV1SequenceHeader(obu); err != nil {
+					return nil, err
+				}
+			case av1OBUTemporalDelimiter:
+				e.av1.seenFrameHeader = false
+			case av1OBUFrameHeader, av1OBURedundantFrameHeader:
+				// copies of the frame header are not parsed
+				if !e.av1.seenFrameHeader {
+					if _, err := e.av1.parseFrameHeader(obu[headerSize:], temporalID, spatialID); err != nil {
+						return nil, err
+					}
+				}
+			case av1OBUFrame, av1OBUTileGroup:
+				if obuType == av1OBUFrame {
+					size, err := e.av1.parseFrameHeader(obu[headerSize:], temporalID, spatialID)
+					if err != nil {
+						return nil, err
+					}
+					headerSize += size
+				}
+				size, tiles, err := e.av1.parseTileGroup(obu[headerSize:])
+				if err != nil {
+					return nil, err
+				}
+				add(headerSize+size, headerSize+size, false)
+				for _, tile := range tiles {
+					add(tile.size, tile.sizeBytes, true)
+				}
+				continue
+			}
+			add(len(obu), len(obu), false)
+		}
+	}
+	for clearSize > 0 {
+		size := clearSize
+		if size > 0xffff {
+			size = 0xffff
+		}
+		subsamples = append(subsamples, SubsampleEncryption{BytesOfClearData: uint16(size)})
+		clearSize -= size
+	}
+	return subsamples, nil
+}
@@ -0,0 +1,273 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncrypt(t *testing.T) {
+	input := readFile(t, "./testdata/sample_fragmented.mp4")
+	widevine := [16]byte{0xed, 0xef, 0x8b, 0xa9, 0x79, 0xd6, 0x4a, 0xce, 0xa3, 0xc8, 0x27, 0xdc, 0xd5, 0x1d, 0x21, 0xed}
+
+	for _, scheme := range []string{"cenc", "cbcs"} {
+		t.Run(scheme, func(t *testing.T) {
+			output := bytes.NewBuffer(nil)
+			require.NoError(t, Encrypt(bytes.NewReader(input), output, &EncryptOptions{
+				Scheme: scheme,
+				Key:    &EncryptionKey{KID: testKID1, Key: testKeys[testKID1]},
+				TrackKeys: map[uint32]*EncryptionKey{
+					2: {KID: testKID2, Key: testKeys[testKID2]},
+				},
+				PSSH: []*Pssh{NewPssh(widevine, [][16]byte{testKID1, testKID2}, []byte{0x12, 0x10})},
+			}))
+			encrypted := output.Bytes()
+			for _, trackID := range []uint32{1, 2} {
+				assert.NotEqual(t, readTrackSampleData(t, bytes.NewReader(input), trackID),
+					readTrackSampleData(t, bytes.NewReader(encrypted), trackID))
+			}
+
+			tree, err := ReadBoxTree(bytes.NewReader(encrypted))
+			require.NoError(t, err)
+			pssh := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypePssh()}).Payload.(*Pssh)
+			assert.Equal(t, uint8(1), pssh.GetVersion())
+			assert.Equal(t, uint32(2), pssh.KIDCount)
+			assert.Equal(t, widevine, pssh.SystemID)
+			entries := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAny()})
+			require.Len(t, entries, 2)
+			assert.Equal(t, BoxTypeEncv(), entries[0].Info.Type)
+			assert.Equal(t, BoxTypeEnca(), entries[1].Info.Type)
+			assert.Equal(t, [4]byte{'a', 'v', 'c', '1'}, findPayload(entries[0], BoxTypeSinf(), BoxTypeFrma()).(*Frma).DataFormat)
+			assert.Equal(t, [4]byte{'m', 'p', '4', 'a'}, findPayload(entries[1], BoxTypeSinf(), BoxTypeFrma()).(*Frma).DataFormat)
+			videoTenc := findPayload(entries[0], BoxTypeSinf(), BoxTypeSchi(), BoxTypeTenc()).(*Tenc)
+			audioTenc := findPayload(entries[1], BoxTypeSinf(), BoxTypeSchi(), BoxTypeTenc()).(*Tenc)
+			assert.Equal(t, testKID1, videoTenc.DefaultKID)
+			assert.Equal(t, testKID2, audioTenc.DefaultKID)
+			if scheme == "cbcs" {
+				assert.Equal(t, [2]uint8{1, 9}, [2]uint8{videoTenc.DefaultCryptByteBlock, videoTenc.DefaultSkipByteBlock})
+				assert.Equal(t, [2]uint8{0, 0}, [2]uint8{audioTenc.DefaultCryptByteBlock, audioTenc.DefaultSkipByteBlock})
+				assert.Equal(t, uint8(0), videoTenc.DefaultPerSampleIVSize)
+				assert.Len(t, videoTenc.DefaultConstantIV, 16)
+			} else {
+				assert.Equal(t, uint8(8), videoTenc.DefaultPerSampleIVSize)
+			}
+
+			for _, traf := range tree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf()}) {
+				tfhd := findPayload(traf, BoxTypeTfhd()).(*Tfhd)
+				senc, ok := findPayload(traf, BoxTypeSenc()).(*Senc)
+				if scheme == "cbcs" && tfhd.TrackID == 2 {
+					// full sample encryption with the constant IV needs no auxiliary information
+					assert.False(t, ok)
+					continue
+				}
+				require.True(t, ok)
+				saio := findPayload(traf, BoxTypeSaio()).(*Saio)
+				offset := traf.Parent.Info.Offset + saio.GetOffset(0)
+				assert.Equal(t, senc.SampleData, encrypted[offset:offset+uint64(len(senc.SampleData))])
+				if tfhd.TrackID == 1 {
+					assert.True(t, senc.CheckFlag(SencUseSubsampleEncryption))
+					ivSize := uint8(8)
+					if scheme == "cbcs" {
+						ivSize = 0
+					}
+					samples, err := senc.GetSamples(ivSize)
+					require.NoError(t, err)
+					for _, s := range samples {
+						for _, sub := range s.Subsamples {
+							if scheme == "cbcs" {
+								// the pattern leaves the trailing partial block clear
+								assert.True(t, sub.BytesOfProtectedData == 0 || sub.BytesOfProtectedData >= 16)
+							} else {
+								assert.Zero(t, sub.BytesOfProtectedData%16)
+							}
+						}
+					}
+				}
+			}
+
+			decrypted := bytes.NewBuffer(nil)
+			require.NoError(t, Decrypt(bytes.NewReader(encrypted), decrypted, testKeys))
+			for _, trackID := range []uint32{1, 2} {
+				assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), trackID),
+					readTrackSampleData(t, bytes.NewReader(decrypted.Bytes()), trackID))
+			}
+			assert.Equal(t, readSampleSummaries(t, bytes.NewReader(input)), readSampleSummaries(t, bytes.NewReader(decrypted.Bytes())))
+		})
+	}
+
+	t.Run("pssh in fragments", func(t *testing.T) {
+		output := bytes.NewBuffer(nil)
+		require.NoError(t, Encrypt(bytes.NewReader(input), output, &EncryptOptions{
+			TrackKeys:       map[uint32]*EncryptionKey{1: {KID: testKID1, Key: testKeys[testKID1], IV: []byte("iv-01234")}},
+			PSSH:            []*Pssh{NewPssh(widevine, nil, []byte{0x12, 0x10})},
+			PSSHInFragments: true,
+		}))
+		tree, err := ReadBoxTree(bytes.NewReader(output.Bytes()))
+		require.NoError(t, err)
+		assert.Nil(t, tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypePssh()}))
+		assert.Len(t, tree.Find(BoxPath{BoxTypeMoof(), BoxTypePssh()}), len(tree.Find(BoxPath{BoxTypeMoof()})))
+		assert.Equal(t, uint8(0), tree.FindFirst(BoxPath{BoxTypeMoof(), BoxTypePssh()}).Payload.(*Pssh).GetVersion())
+
+		// the audio track is left clear
+		assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), 2), readTrackSampleData(t, bytes.NewReader(output.Bytes()), 2))
+		assert.NotNil(t, tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeMp4a()}))
+		senc := tree.FindFirst(BoxPath{BoxTypeMoof(), BoxTypeTraf(), BoxTypeSenc()}).Payload.(*Senc)
+		samples, err := senc.GetSamples(8)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("iv-01234"), samples[0].IV)
+		assert.Equal(t, []byte("iv-01235"), samples[1].IV)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		key := &EncryptionKey{KID: testKID1, Key: testKeys[testKID1]}
+		assert.Error(t, Encrypt(bytes.NewReader(input), bytes.NewBuffer(nil), &EncryptOptions{Scheme: "cens", Key: key}))
+		assert.Error(t, Encrypt(bytes.NewReader(input), bytes.NewBuffer(nil), &EncryptOptions{
+			Key: &EncryptionKey{KID: testKID1, Key: testKeys[testKID1], IV: make([]byte, 16)},
+		}))
+		assert.Error(t, Encrypt(bytes.NewReader(readFile(t, "./testdata/sample.mp4")), bytes.NewBuffer(nil), &EncryptOptions{Key: key}))
+		assert.Error(t, Encrypt(bytes.NewReader(readFile(t, "./testdata/sample_init.encv.mp4")), bytes.NewBuffer(nil), &EncryptOptions{Key: key}))
+
+		// VP9 needs its own subsample rules which are not implemented
+		keyFrame := append([]byte{0x82, 0x49, 0x83, 0x42}, packBits(
+			[2]uint64{3, 2},    // color_space (BT.709)
+			[2]uint64{1, 0},    // color_range
+			[2]uint64{16, 319}, // frame_width_minus_1
+			[2]uint64{16, 179}, // frame_height_minus_1
+		)...)
+		vp09, _ := importStream(t, newIVF("VP90", 30, [][]byte{keyFrame}), ImportFormatIVF, nil)
+		assert.Error(t, Encrypt(bytes.NewReader(vp09), bytes.NewBuffer(nil), &EncryptOptions{Key: key}))
+	})
+}
+
+func TestEncryptSubsamples(t *testing.T) {
+	payload := func(size int) []byte {
+		return bytes.Repeat([]byte{0xa5}, size)
+	}
+	lengthPrefixed := func(lengthSize int, nalus ...[]byte) []byte {
+		data, err := JoinLengthPrefixed(nalus, lengthSize)
+		require.NoError(t, err)
+		return data
+	}
+
+	testCases := []struct {
+		name       string
+		codec      Codec
+		lengthSize int
+		data       []byte
+		expected   []SubsampleEncryption
+		cbcs       []SubsampleEncryption
+	}{
+		{
+			name:       "AVC",
+			codec:      CodecAVC1,
+			lengthSize: 4,
+			data: lengthPrefixed(4,
+				[]byte{0x09, 0xf0}, // AUD
+				testAVCSPS,
+				testAVCPPS,
+				append(append([]byte{}, testAVCIDR...), payload(36)...),
+				append(append([]byte{}, testAVCNonIDR...), payload(4)...),
+				append(append([]byte{}, testAVCNonIDR...), payload(16)...),
+			),
+			expected: []SubsampleEncryption{
+				{BytesOfClearData: 6 + uint16(4+len(testAVCSPS)+4+len(testAVCPPS)) + 4 + 4 + 4, BytesOfProtectedData: 32},
+				{BytesOfClearData: 4 + 4 + 4 + 4 + 4, BytesOfProtectedData: 16},
+			},
+			cbcs: []SubsampleEncryption{
+				{BytesOfClearData: 6 + uint16(4+len(testAVCSPS)+4+len(testAVCPPS)) + 4 + uint16(len(testAVCIDR)), BytesOfProtectedData: 36},
+				{BytesOfClearData: 4 + 4 + 4 + 4 + 4, BytesOfProtectedData: 16},
+			},
+		},
+		{
+			name:       "HEVC",
+			codec:      CodecHEVC,
+			lengthSize: 2,
+			data: lengthPrefixed(2,
+				testHEVCSPS,
+				testHEVCPPS,
+				append(append([]byte{}, testHEVCIDR...), payload(40)...),
+				append(append([]byte{}, testHEVCTrail...), payload(20)...),
+				[]byte{0x4e, 0x01, 0x05}, // SEI
+			),
+			expected: []SubsampleEncryption{
+				{BytesOfClearData: uint16(2+len(testHEVCSPS)+2+len(testHEVCPPS)) + 2 + 5 + 8, BytesOfProtectedData: 32},
+				{BytesOfClearData: 2 + 7 + 4, BytesOfProtectedData: 16},
+				{BytesOfClearData: 2 + 3},
+			},
+			cbcs: []SubsampleEncryption{
+				{BytesOfClearData: uint16(2+len(testHEVCSPS)+2+len(testHEVCPPS)) + 2 + 5, BytesOfProtectedData: 40},
+				{BytesOfClearData: 2 + 7, BytesOfProtectedData: 20},
+				{BytesOfClearData: 2 + 3},
+			},
+		},
+		{
+			name:  "AV1",
+			codec: CodecAV1,
+			data: bytes.Join([][]byte{
+				{0x12, 0x00}, // temporal delimiter
+				{0x0a, byte(len(testAV1SeqHeader))}, testAV1SeqHeader,
+				{0x32, byte(len(testAV1FrameHeader) + 40)}, testAV1FrameHeader, payload(40), // frame
+			}, nil),
+			expected: []SubsampleEncryption{
+				{BytesOfClearData: 2 + 2 + uint16(len(testAV1SeqHeader)) + 2 + uint16(len(testAV1FrameHeader)) + 8, BytesOfProtectedData: 32},
+			},
+			cbcs: []SubsampleEncryption{
+				{BytesOfClearData: 2 + 2 + uint16(len(testAV1SeqHeader)) + 2 + uint16(len(testAV1FrameHeader)), BytesOfProtectedData: 40},
+			},
+		},
+		{
+			name:       "large clear data",
+			codec:      CodecAVC1,
+			lengthSize: 4,
+			data: lengthPrefixed(4,
+				testAVCSPS,
+				testAVCPPS,
+				append([]byte{0x06}, payload(0xffff)...), // SEI
+				append(append([]byte{}, testAVCNonIDR...), payload(16)...),
+			),
+			expected: []SubsampleEncryption{
+				{BytesOfClearData: 0xffff},
+				{BytesOfClearData: uint16(4+len(testAVCSPS)+4+len(testAVCPPS)) + 4 + 1 + 4 + 4, BytesOfProtectedData: 16},
+			},
+			cbcs: []SubsampleEncryption{
+				{BytesOfClearData: 0xffff},
+				{BytesOfClearData: uint16(4+len(testAVCSPS)+4+len(testAVCPPS)) + 4 + 1 + 4 + 4, BytesOfProtectedData: 16},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for schemeType, expected := range map[[4]byte][]SubsampleEncryption{
+				cencSchemeCENC: tc.expected,
+				cencSchemeCBCS: tc.cbcs,
+			} {
+				e := &trackEncrypter{
+					schemeType: schemeType,
+					codec:      tc.codec,
+					lengthSize: tc.lengthSize,
+					avcSPS:     make(map[uint32]*avcSPS),
+					avcPPS:     make(map[uint32]*avcPPS),
+					hevcSPS:    make(map[uint32]*hevcSPS),
+					hevcPPS:    make(map[uint32]*hevcPPS),
+					av1:        &av1FrameHeaderParser{},
+				}
+				subsamples, err := e.subsamples(tc.data)
+				require.NoError(t, err)
+				assert.Equal(t, expected, subsamples, string(schemeType[:]))
+			}
+		})
+	}
+
+	t.Run("missing parameter sets", func(t *testing.T) {
+		e := &trackEncrypter{
+			codec:      CodecAVC1,
+			lengthSize: 4,
+			avcSPS:     make(map[uint32]*avcSPS),
+			avcPPS:     make(map[uint32]*avcPPS),
+		}
+		_, err := e.subsamples(lengthPrefixed(4, append(append([]byte{}, testAVCIDR...), payload(32)...)))
+		assert.Error(t, err)
+	})
+}
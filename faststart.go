@@ -0,0 +1,59 @@
+package mp4
+
+import (
+	"errors"
+	"io"
+)
+
+// FastStartOptions is options for FastStart.
+type FastStartOptions struct {
+	// Padding is the payload size of the free box which is placed after the moov box.
+	// The free box leaves room for editing the moov box in place later. No free box is added when it is 0.
+	Padding uint64
+}
+
+// FastStart writes the file to w with the moov box placed before the media data,
+// so that players can start playback before downloading the whole file.
+// The boxes preceding the first mdat box, such as ftyp and free boxes, are kept at the head,
+// and chunk offsets are adjusted to the new positions of the media data.
+// opts can be nil.
+func FastStart(r io.ReadSeeker, w io.Writer, opts *FastStartOptions) error {
+	if opts == nil {
+		opts = &FastStartOptions{}
+	}
+
+	tree, err := ReadBoxTree(r)
+	if err != nil {
+		return err
+	}
+	moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+	if moov == nil {
+		return errors.New("moov box not found")
+	}
+
+	var head, tail []*BoxNode
+	var mdatAppeared bool
+	for _, n := range tree.Children {
+		if n == moov {
+			continue
+		}
+		if n.Info.Type == BoxTypeMdat() {
+			mdatAppeared = true
+		}
+		if mdatAppeared {
+			tail = append(tail, n)
+		} else {
+			head = append(head, n)
+		}
+	}
+	children := append(head, moov)
+	if opts.Padding != 0 {
+		free := NewRawBoxNode(BoxTypeFree(), make([]byte, opts.Padding))
+		free.Parent = &tree.BoxNode
+		children = append(children, free)
+	}
+	tree.Children = append(children, tail...)
+
+	_, err = tree.WriteTo(w)
+	return err
+}
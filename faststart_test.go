@@ -0,0 +1,54 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFastStart(t *testing.T) {
+	input, err := os.ReadFile("./testdata/sample.mp4")
+	require.NoError(t, err)
+	info, err := Probe(bytes.NewReader(input))
+	require.NoError(t, err)
+	require.False(t, info.FastStart)
+	expected := readAllSampleData(t, bytes.NewReader(input))
+
+	for _, padding := range []uint64{0, 1024} {
+		output := bytes.NewBuffer(nil)
+		require.NoError(t, FastStart(bytes.NewReader(input), output, &FastStartOptions{Padding: padding}))
+		if padding == 0 {
+			assert.Equal(t, len(input), output.Len())
+		} else {
+			assert.Equal(t, len(input)+int(padding)+8, output.Len())
+		}
+
+		r := bytes.NewReader(output.Bytes())
+		info, err := Probe(r)
+		require.NoError(t, err)
+		assert.True(t, info.FastStart)
+		assert.Equal(t, expected, readAllSampleData(t, r))
+
+		bis, err := ExtractBoxes(r, nil, []BoxPath{{BoxTypeAny()}})
+		require.NoError(t, err)
+		var types []BoxType
+		for _, bi := range bis {
+			types = append(types, bi.Type)
+		}
+		if padding == 0 {
+			assert.Equal(t, []BoxType{BoxTypeFtyp(), BoxTypeFree(), BoxTypeMoov(), BoxTypeMdat()}, types)
+		} else {
+			assert.Equal(t, []BoxType{BoxTypeFtyp(), BoxTypeFree(), BoxTypeMoov(), BoxTypeFree(), BoxTypeMdat()}, types)
+			assert.Equal(t, padding+8, bis[3].Size)
+		}
+	}
+}
+
+func TestFastStartWithoutMoov(t *testing.T) {
+	input := []byte{0x00, 0x00, 0x00, 0x08, 'f', 'r', 'e', 'e'}
+	err := FastStart(bytes.NewReader(input), bytes.NewBuffer(nil), nil)
+	assert.Error(t, err)
+}
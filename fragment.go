@@ -0,0 +1,661 @@
+package mp4
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	// sample_depends_on=2
+	sampleFlagsSync = 0x02000000
+	// sample_depends_on=1, sample_is_non_sync_sample=1
+	sampleFlagsNonSync = 0x01010000
+)
+
+// FragmentOptions is options for Fragmenter and Fragment.
+type FragmentOptions struct {
+	// FragmentDuration is the target duration of fragments in seconds.
+	// Fragments are cut at sync samples of the reference track, which is the first video track or the first track.
+	// Therefore fragments can be longer than FragmentDuration. Default value is 2 seconds.
+	FragmentDuration float64
+
+	// Styp adds a styp box to the head of each media segment. It is ignored by Fragment.
+	Styp bool
+
+	// Sidx adds sidx box. Fragmenter adds a sidx box to each media segment,
+	// and Fragment adds a sidx box which refers to all fragments after the moov box.
+	Sidx bool
+
+	// Mfra adds mfra box to the end of the file. It is used only by Fragment.
+	Mfra bool
+}
+
+// Fragmenter converts a progressive MP4 file to fragmented MP4 segments.
+// Every fragment has a traf box for each track which has samples in the fragment,
+// and another traf box from each sample which switches the sample entry.
+// Sample groups are kept, but tracks which have sample auxiliary information are not supported.
+type Fragmenter struct {
+	r      io.ReadSeeker
+	opts   FragmentOptions
+	ftyp   *Ftyp
+	moov   *BoxNode
+	tracks []*fragmenterTrack
+	ref    *fragmenterTrack
+	seq    uint32
+	tfras  map[uint32]*Tfra
+}
+
+type fragmenterTrack struct {
+	trackID   uint32
+	timescale uint32
+	it        *SampleIterator
+	next      *MediaSample
+	sbgps     []*Sbgp // sample groups of the sample table, which are split into traf boxes
+}
+
+type fragmentSamples [][]*MediaSample
+
+// NewFragmenter returns a new Fragmenter. opts can be nil.
+func NewFragmenter(r io.ReadSeeker, opts *FragmentOptions) (*Fragmenter, error) {
+	f := &Fragmenter{r: r, tfras: make(map[uint32]*Tfra)}
+	if opts != nil {
+		f.opts = *opts
+	}
+	if f.opts.FragmentDuration <= 0 {
+		f.opts.FragmentDuration = 2
+	}
+
+	bis, err := ExtractBoxes(r, nil, []BoxPath{{BoxTypeFtyp()}, {BoxTypeMoov()}})
+	if err != nil {
+		return nil, err
+	}
+	for _, bi := range bis {
+		switch bi.Type {
+		case BoxTypeFtyp():
+			if _, err := bi.SeekToPayload(r); err != nil {
+				return nil, err
+			}
+			var ftyp Ftyp
+			if _, err := Unmarshal(r, bi.Size-bi.HeaderSize, &ftyp, bi.Context); err != nil {
+				return nil, err
+			}
+			f.ftyp = &ftyp
+		case BoxTypeMoov():
+			if f.moov, err = ReadBoxSubtree(r, bi); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if f.moov == nil {
+		return nil, errors.New("moov box not found")
+	}
+	if f.moov.FindFirst(BoxPath{BoxTypeMvex()}) != nil {
+		return nil, errors.New("input is already fragmented")
+	}
+	for _, stbl := range f.moov.Find(BoxPath{BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()}) {
+		for _, c := range stbl.Children {
+			switch c.Info.Type {
+			case BoxTypeSaiz(), BoxTypeSaio(), BoxTypeSenc():
+				return nil, errors.New("track which has sample auxiliary information is not supported")
+			}
+		}
+	}
+	if f.ftyp == nil {
+		f.ftyp = &Ftyp{MajorBrand: BrandISOM(), CompatibleBrands: []CompatibleBrandElem{{CompatibleBrand: BrandISOM()}}}
+	}
+	f.ftyp.AddCompatibleBrand(BrandISO6())
+
+	if err := f.reset(); err != nil {
+		return nil, err
+	}
+	for _, trak := range f.moov.Find(BoxPath{BoxTypeTrak()}) {
+		hdlr := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeHdlr()})
+		tkhd := trak.FindFirst(BoxPath{BoxTypeTkhd()})
+		if hdlr == nil || tkhd == nil {
+			continue
+		}
+		if hdlr.Payload.(*Hdlr).HandlerType == [4]byte{'v', 'i', 'd', 'e'} {
+			for _, t := range f.tracks {
+				if t.trackID == tkhd.Payload.(*Tkhd).TrackID {
+					f.ref = t
+				}
+			}
+			break
+		}
+	}
+	if f.ref == nil && len(f.tracks) != 0 {
+		f.ref = f.tracks[0]
+	}
+	f.buildInitMoov()
+	return f, nil
+}
+
+// reset rewinds the sample iterators.
+func (f *Fragmenter) reset() error {
+	its, err := NewSampleIterators(f.r)
+	if err != nil {
+		return err
+	}
+	for i, it := range its {
+		if i < len(f.tracks) {
+			f.tracks[i].it = it
+			f.tracks[i].next = nil
+			continue
+		}
+		f.tracks = append(f.tracks, &fragmenterTrack{
+			trackID:   it.TrackID(),
+			timescale: it.Timescale(),
+			it:        it,
+		})
+	}
+	for _, t := range f.tracks {
+		if err := t.advance(); err != nil {
+			return err
+		}
+	}
+	f.seq = 0
+	return nil
+}
+
+func (t *fragmenterTrack) advance() error {
+	s, err := t.it.Next()
+	if err == io.EOF {
+		t.next = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	t.next = s
+	return nil
+}
+
+// buildInitMoov removes the sample tables and adds mvex box.
+func (f *Fragmenter) buildInitMoov() {
+	mvex := NewBoxNode(&Mvex{})
+	if mvhdNode := f.moov.FindFirst(BoxPath{BoxTypeMvhd()}); mvhdNode != nil {
+		mvhd := mvhdNode.Payload.(*Mvhd)
+		mehd := &Mehd{FullBox: FullBox{Version: 1}}
+		if mvhd.GetVersion() == 0 {
+			mehd.FragmentDurationV1 = uint64(mvhd.DurationV0)
+		} else {
+			mehd.FragmentDurationV1 = mvhd.DurationV1
+		}
+		mvhd.DurationV0, mvhd.DurationV1 = 0, 0
+		mvex.AppendChild(NewBoxNode(mehd))
+	}
+
+	var lastTrak *BoxNode
+	for _, trak := range f.moov.Find(BoxPath{BoxTypeTrak()}) {
+		lastTrak = trak
+		if tkhdNode := trak.FindFirst(BoxPath{BoxTypeTkhd()}); tkhdNode != nil {
+			tkhd := tkhdNode.Payload.(*Tkhd)
+			tkhd.DurationV0, tkhd.DurationV1 = 0, 0
+			mvex.AppendChild(NewBoxNode(&Trex{TrackID: tkhd.TrackID, DefaultSampleDescriptionIndex: 1}))
+		}
+		if mdhdNode := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMdhd()}); mdhdNode != nil {
+			mdhd := mdhdNode.Payload.(*Mdhd)
+			mdhd.DurationV0, mdhd.DurationV1 = 0, 0
+		}
+		stbl := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+		if stbl == nil {
+			continue
+		}
+		if t := f.track(trak); t != nil {
+			for _, n := range stbl.Find(BoxPath{BoxTypeSbgp()}) {
+				t.sbgps = append(t.sbgps, n.Payload.(*Sbgp))
+			}
+		}
+		for _, c := range append([]*BoxNode{}, stbl.Children...) {
+			if c.Info.Type != BoxTypeStsd() && c.Info.Type != BoxTypeSgpd() {
+				c.Remove()
+			}
+		}
+		stbl.AppendChild(NewBoxNode(&Stts{}))
+		stbl.AppendChild(NewBoxNode(&Stsc{}))
+		stbl.AppendChild(NewBoxNode(&Stsz{}))
+		stbl.AppendChild(NewBoxNode(&Stco{}))
+	}
+	if lastTrak != nil {
+		f.moov.InsertAfter(lastTrak, mvex)
+	} else {
+		f.moov.AppendChild(mvex)
+	}
+}
+
+// track returns the track of the trak box.
+func (f *Fragmenter) track(trak *BoxNode) *fragmenterTrack {
+	tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd)
+	if !ok {
+		return nil
+	}
+	for _, t := range f.tracks {
+		if t.trackID == tkhd.TrackID {
+			return t
+		}
+	}
+	return nil
+}
+
+// WriteInitSegment writes the initialization segment which consists of ftyp box and moov box.
+func (f *Fragmenter) WriteInitSegment(w io.Writer) error {
+	return f.writeInit(&offsetWriter{writer: w})
+}
+
+func (f *Fragmenter) writeInit(w *offsetWriter) error {
+	for _, n := range []*BoxNode{NewBoxNode(f.ftyp), f.moov} {
+		if err := w.writeNode(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteNextSegment writes the next media segment. It returns io.EOF when no more samples exist.
+func (f *Fragmenter) WriteNextSegment(w io.Writer) error {
+	samples, err := f.nextFragment()
+	if err != nil {
+		return err
+	}
+	ow := &offsetWriter{writer: w}
+	if f.opts.Styp {
+		styp := &Styp{
+			MajorBrand:       [4]byte{'m', 's', 'd', 'h'},
+			CompatibleBrands: []CompatibleBrandElem{{CompatibleBrand: [4]byte{'m', 's', 'd', 'h'}}},
+		}
+		if f.opts.Sidx {
+			// indexed media segments
+			styp.CompatibleBrands = append(styp.CompatibleBrands, CompatibleBrandElem{CompatibleBrand: [4]byte{'m', 's', 'i', 'x'}})
+		}
+		if err := ow.writeNode(NewBoxNode(styp)); err != nil {
+			return err
+		}
+	}
+	moof, mdatSize, err := f.buildMoof(samples)
+	if err != nil {
+		return err
+	}
+	if f.opts.Sidx {
+		sidx := f.newSidx()
+		sidx.ReferenceCount = 1
+		sidx.References = []SidxReference{f.sidxReference(samples, moof.Info.Size+mdatSize)}
+		sidx.EarliestPresentationTimeV1 = f.earliestPresentationTime(samples)
+		node := NewBoxNode(sidx)
+		if err := ow.writeNode(node); err != nil {
+			return err
+		}
+	}
+	return f.writeFragment(ow, samples, moof, mdatSize)
+}
+
+// nextFragment reads the samples of the next fragment.
+func (f *Fragmenter) nextFragment() (fragmentSamples, error) {
+	var exists bool
+	for _, t := range f.tracks {
+		exists = exists || t.next != nil
+	}
+	if !exists {
+		return nil, io.EOF
+	}
+
+	samples := make(fragmentSamples, len(f.tracks))
+	var endTime uint64 = math.MaxUint64
+	for i, t := range f.tracks {
+		if t != f.ref || t.next == nil {
+			continue
+		}
+		target := uint64(f.opts.FragmentDuration * float64(t.timescale))
+		start := t.next.DecodeTime
+		for t.next != nil {
+			if len(samples[i]) != 0 && t.next.IsSync && t.next.DecodeTime-start >= target {
+				endTime = t.next.DecodeTime
+				break
+			}
+			samples[i] = append(samples[i], t.next)
+			if err := t.advance(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, t := range f.tracks {
+		if t == f.ref {
+			continue
+		}
+		for t.next != nil && (endTime == math.MaxUint64 || rescaleTime(t.next.DecodeTime, f.ref.timescale, t.timescale) < endTime) {
+			samples[i] = append(samples[i], t.next)
+			if err := t.advance(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return samples, nil
+}
+
+// buildMoof returns the moof box of the fragment and the size of the mdat box.
+// The data offsets assume that the mdat box follows the moof box.
+func (f *Fragmenter) buildMoof(samples fragmentSamples) (*BoxNode, uint64, error) {
+	f.seq++
+	trackIDs := make([]uint32, len(f.tracks))
+	sbgps := make([][]*Sbgp, len(f.tracks))
+	for i, t := range f.tracks {
+		trackIDs[i] = t.trackID
+		sbgps[i] = t.sbgps
+	}
+	return newMoof(f.seq, trackIDs, samples, nil, sbgps)
+}
+
+// trafRun is a run of the samples of a track which share the sample description index.
+type trafRun struct {
+	track int
+	start int
+	end   int
+}
+
+// newMoof returns the moof box which has a traf box for each track which has samples, and the size of the mdat box.
+// Samples which switch the sample entry start another traf box of the track.
+// The data offsets assume that the mdat box follows the moof box and has the samples in the order of the tracks.
+// subs holds the subs box of each track, which can be nil, and sbgps holds the sbgp boxes of each track
+// which describe the samples by their indices in the track.
+func newMoof(seq uint32, trackIDs []uint32, samples fragmentSamples, subs []*Subs, sbgps [][]*Sbgp) (*BoxNode, uint64, error) {
+	var runs []trafRun
+	for i := range trackIDs {
+		for j := range samples[i] {
+			if j == 0 || samples[i][j].SampleDescriptionIndex != samples[i][j-1].SampleDescriptionIndex {
+				runs = append(runs, trafRun{track: i, start: j})
+			}
+			runs[len(runs)-1].end = j + 1
+		}
+	}
+
+	moof := NewBoxNode(&Moof{}, NewBoxNode(&Mfhd{SequenceNumber: seq}))
+	var truns []*Trun
+	var dataSize uint64
+	for _, run := range runs {
+		i := run.track
+		rs := samples[i][run.start:run.end]
+		tfhd := &Tfhd{TrackID: trackIDs[i]}
+		tfhd.AddFlag(TfhdDefaultBaseIsMoof)
+		if idx := rs[0].SampleDescriptionIndex; idx != 1 && idx != 0 {
+			tfhd.AddFlag(TfhdSampleDescriptionIndexPresent)
+			tfhd.SampleDescriptionIndex = idx
+		}
+		tfdt := &Tfdt{FullBox: FullBox{Version: 1}, BaseMediaDecodeTimeV1: rs[0].DecodeTime}
+		trun := &Trun{SampleCount: uint32(len(rs)), Entries: make([]TrunEntry, len(rs))}
+		trun.AddFlag(TrunDataOffsetPresent | TrunSampleDurationPresent | TrunSampleSizePresent | TrunSampleFlagsPresent)
+		for j, s := range rs {
+			e := &trun.Entries[j]
+			e.SampleDuration = s.Duration
+			e.SampleSize = s.Size
+			if s.IsSync {
+				e.SampleFlags = sampleFlagsSync
+			} else {
+				e.SampleFlags = sampleFlagsNonSync
+			}
+			if s.CompositionTimeOffset != 0 {
+				trun.AddFlag(TrunSampleCompositionTimeOffsetPresent)
+			}
+			if s.CompositionTimeOffset < 0 {
+				trun.SetVersion(1)
+			}
+			dataSize += uint64(s.Size)
+		}
+		if trun.CheckFlag(TrunSampleCompositionTimeOffsetPresent) {
+			for j, s := range rs {
+				if trun.GetVersion() == 0 {
+					trun.Entries[j].SampleCompositionTimeOffsetV0 = uint32(s.CompositionTimeOffset)
+				} else {
+					trun.Entries[j].SampleCompositionTimeOffsetV1 = int32(s.CompositionTimeOffset)
+				}
+			}
+		}
+		traf := NewBoxNode(&Traf{}, NewBoxNode(tfhd), NewBoxNode(tfdt), NewBoxNode(trun))
+		if i < len(sbgps) {
+			for _, src := range sbgps[i] {
+				sbgp := *src
+				sliceSbgp(&sbgp, uint32(rs[0].Index), uint32(rs[len(rs)-1].Index+1))
+				if sbgp.EntryCount != 0 {
+					traf.AppendChild(NewBoxNode(&sbgp))
+				}
+			}
+		}
+		if i < len(subs) && subs[i] != nil {
+			if rsubs := sliceSubs(subs[i], run.start, run.end); rsubs != nil {
+				traf.AppendChild(NewBoxNode(rsubs))
+			}
+		}
+		moof.AppendChild(traf)
+		truns = append(truns, trun)
+	}
+	if _, err := moof.layout(0); err != nil {
+		return nil, 0, err
+	}
+
+	mdatHeaderSize := uint64(SmallHeaderSize)
+	if dataSize+SmallHeaderSize > math.MaxUint32 {
+		mdatHeaderSize = LargeHeaderSize
+	}
+	offset := moof.Info.Size + mdatHeaderSize
+	for ti, run := range runs {
+		if offset > math.MaxInt32 {
+			return nil, 0, errors.New("too large fragment")
+		}
+		truns[ti].DataOffset = int32(offset)
+		for _, s := range samples[run.track][run.start:run.end] {
+			offset += uint64(s.Size)
+		}
+	}
+	return moof, mdatHeaderSize + dataSize, nil
+}
+
+// sliceSubs returns the subs box which describes the samples from start to end. It returns nil when no entries remain.
+func sliceSubs(subs *Subs, start, end int) *Subs {
+	sliced := &Subs{FullBox: subs.FullBox}
+	var num int // 1-based sample number of the entry
+	for _, e := range subs.Entries {
+		num += int(e.SampleDelta)
+		if num <= start || num > end {
+			continue
+		}
+		if len(sliced.Entries) == 0 {
+			e.SampleDelta = uint32(num - start)
+		}
+		sliced.Entries = append(sliced.Entries, e)
+	}
+	if len(sliced.Entries) == 0 {
+		return nil
+	}
+	sliced.EntryCount = uint32(len(sliced.Entries))
+	return sliced
+}
+
+// writeFragment writes the moof box and the mdat box of the fragment.
+func (f *Fragmenter) writeFragment(w *offsetWriter, samples fragmentSamples, moof *BoxNode, mdatSize uint64) error {
+	moofOffset := uint64(w.offset)
+	if err := moof.writeTo(w); err != nil {
+		return err
+	}
+
+	// tfra entries refer to the first traf box of each track
+	trafNums := make(map[uint32]uint32)
+	for k, traf := range moof.Find(BoxPath{BoxTypeTraf()}) {
+		if tfhd, ok := findPayload(traf, BoxTypeTfhd()).(*Tfhd); ok && trafNums[tfhd.TrackID] == 0 {
+			trafNums[tfhd.TrackID] = uint32(k + 1)
+		}
+	}
+	for i, t := range f.tracks {
+		if len(samples[i]) == 0 || !samples[i][0].IsSync {
+			continue
+		}
+		tfra := f.tfras[t.trackID]
+		if tfra == nil {
+			tfra = &Tfra{FullBox: FullBox{Version: 1}, TrackID: t.trackID}
+			f.tfras[t.trackID] = tfra
+		}
+		time := samples[i][0].CompositionTime()
+		if time < 0 {
+			time = 0
+		}
+		tfra.Entries = append(tfra.Entries, TfraEntry{
+			TimeV1:       uint64(time),
+			MoofOffsetV1: moofOffset,
+			TrafNumber:   trafNums[t.trackID],
+			TrunNumber:   1,
+			SampleNumber: 1,
+		})
+		tfra.NumberOfEntry++
+	}
+
+	mdat := &BoxInfo{Type: BoxTypeMdat(), Size: mdatSize, HeaderSize: SmallHeaderSize}
+	if mdatSize > math.MaxUint32 {
+		mdat.HeaderSize = LargeHeaderSize
+	}
+	if _, err := WriteBoxInfo(w, mdat); err != nil {
+		return err
+	}
+	for i := range f.tracks {
+		for j := 0; j < len(samples[i]); {
+			// copy contiguous samples at once
+			offset := samples[i][j].Offset
+			end := offset
+			for ; j < len(samples[i]) && samples[i][j].Offset == end; j++ {
+				end += uint64(samples[i][j].Size)
+			}
+			if _, err := f.r.Seek(int64(offset), io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, f.r, int64(end-offset)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *Fragmenter) newSidx() *Sidx {
+	sidx := &Sidx{FullBox: FullBox{Version: 1}}
+	if f.ref != nil {
+		sidx.ReferenceID = f.ref.trackID
+		sidx.Timescale = f.ref.timescale
+	}
+	return sidx
+}
+
+// sidxReference returns the reference of sidx box to the fragment, whose times are in the reference track timescale.
+func (f *Fragmenter) sidxReference(samples fragmentSamples, size uint64) SidxReference {
+	ref := SidxReference{ReferencedSize: uint32(size)}
+	for i, t := range f.tracks {
+		if t != f.ref {
+			continue
+		}
+		for _, s := range samples[i] {
+			ref.SubsegmentDuration += s.Duration
+		}
+		if len(samples[i]) != 0 && samples[i][0].IsSync {
+			ref.StartsWithSAP = true
+			ref.SAPType = 1
+		}
+	}
+	return ref
+}
+
+// earliestPresentationTime returns the earliest presentation time of the reference track in the fragment.
+func (f *Fragmenter) earliestPresentationTime(samples fragmentSamples) uint64 {
+	var ept int64
+	found := false
+	for i, t := range f.tracks {
+		if t != f.ref {
+			continue
+		}
+		for _, s := range samples[i] {
+			if !found || s.CompositionTime() < ept {
+				ept = s.CompositionTime()
+				found = true
+			}
+		}
+	}
+	if ept < 0 {
+		return 0
+	}
+	return uint64(ept)
+}
+
+// Fragment converts a progressive MP4 file to a single fragmented MP4 file. opts can be nil.
+func Fragment(r io.ReadSeeker, w io.Writer, opts *FragmentOptions) error {
+	f, err := NewFragmenter(r, opts)
+	if err != nil {
+		return err
+	}
+	ow := &offsetWriter{writer: w}
+	if err := f.writeInit(ow); err != nil {
+		return err
+	}
+
+	if f.opts.Sidx {
+		// compute sizes of all fragments in advance
+		sidx := f.newSidx()
+		first := true
+		for {
+			samples, err := f.nextFragment()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			moof, mdatSize, err := f.buildMoof(samples)
+			if err != nil {
+				return err
+			}
+			if first {
+				sidx.EarliestPresentationTimeV1 = f.earliestPresentationTime(samples)
+				first = false
+			}
+			sidx.References = append(sidx.References, f.sidxReference(samples, moof.Info.Size+mdatSize))
+		}
+		if len(sidx.References) > math.MaxUint16 {
+			return errors.New("too many fragments for sidx box")
+		}
+		sidx.ReferenceCount = uint16(len(sidx.References))
+		if err := f.reset(); err != nil {
+			return err
+		}
+		node := NewBoxNode(sidx)
+		if err := ow.writeNode(node); err != nil {
+			return err
+		}
+	}
+
+	for {
+		samples, err := f.nextFragment()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		moof, mdatSize, err := f.buildMoof(samples)
+		if err != nil {
+			return err
+		}
+		if err := f.writeFragment(ow, samples, moof, mdatSize); err != nil {
+			return err
+		}
+	}
+
+	if f.opts.Mfra {
+		mfra := NewBoxNode(&Mfra{})
+		for _, t := range f.tracks {
+			if tfra := f.tfras[t.trackID]; tfra != nil {
+				mfra.AppendChild(NewBoxNode(tfra))
+			}
+		}
+		mfro := &Mfro{}
+		mfra.AppendChild(NewBoxNode(mfro))
+		if _, err := mfra.layout(uint64(ow.offset)); err != nil {
+			return err
+		}
+		mfro.Size = uint32(mfra.Info.Size)
+		if err := mfra.writeTo(ow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
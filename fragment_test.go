@@ -0,0 +1,232 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sampleSummary struct {
+	TrackID                uint32
+	DecodeTime             uint64
+	CompositionTimeOffset  int64
+	Duration               uint32
+	Size                   uint32
+	IsSync                 bool
+	SampleDescriptionIndex uint32
+}
+
+func readSampleSummaries(t *testing.T, r io.ReadSeeker) []sampleSummary {
+	its, err := NewSampleIterators(r)
+	require.NoError(t, err)
+	var summaries []sampleSummary
+	for _, it := range its {
+		for _, s := range readAllSamples(t, it) {
+			summaries = append(summaries, sampleSummary{
+				TrackID:                s.TrackID,
+				DecodeTime:             s.DecodeTime,
+				CompositionTimeOffset:  s.CompositionTimeOffset,
+				Duration:               s.Duration,
+				Size:                   s.Size,
+				IsSync:                 s.IsSync,
+				SampleDescriptionIndex: s.SampleDescriptionIndex,
+			})
+		}
+	}
+	return summaries
+}
+
+// readSampleWithSyncSamples returns sample.mp4 whose video samples are all sync samples.
+func readSampleWithSyncSamples(t *testing.T) []byte {
+	input, err := os.ReadFile("./testdata/sample.mp4")
+	require.NoError(t, err)
+	tree, err := ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	stss := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStss()}).Payload.(*Stss)
+	stss.SampleNumber = []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	stss.EntryCount = 10
+	return writeBoxTree(t, tree)
+}
+
+func TestFragment(t *testing.T) {
+	for _, name := range []string{"sample.mp4", "all sync samples"} {
+		t.Run(name, func(t *testing.T) {
+			var input []byte
+			if name == "sample.mp4" {
+				var err error
+				input, err = os.ReadFile("./testdata/sample.mp4")
+				require.NoError(t, err)
+			} else {
+				input = readSampleWithSyncSamples(t)
+			}
+			expectedSamples := readSampleSummaries(t, bytes.NewReader(input))
+			expectedData := readAllSampleData(t, bytes.NewReader(input))
+
+			output := bytes.NewBuffer(nil)
+			require.NoError(t, Fragment(bytes.NewReader(input), output, &FragmentOptions{
+				FragmentDuration: 0.2,
+				Sidx:             true,
+				Mfra:             true,
+			}))
+			r := bytes.NewReader(output.Bytes())
+			assert.Equal(t, expectedSamples, readSampleSummaries(t, r))
+			assert.Equal(t, expectedData, readAllSampleData(t, r))
+
+			tree, err := ReadBoxTree(r)
+			require.NoError(t, err)
+			moofs := tree.Find(BoxPath{BoxTypeMoof()})
+			mdats := tree.Find(BoxPath{BoxTypeMdat()})
+			require.NotEmpty(t, moofs)
+			require.Len(t, mdats, len(moofs))
+			assert.Len(t, tree.Find(BoxPath{BoxTypeMoov(), BoxTypeMvex(), BoxTypeTrex()}), 2)
+			assert.Empty(t, tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStss()}))
+
+			// sidx refers to all fragments
+			sidxNode := tree.FindFirst(BoxPath{BoxTypeSidx()})
+			require.NotNil(t, sidxNode)
+			sidx := sidxNode.Payload.(*Sidx)
+			require.Len(t, sidx.References, len(moofs))
+			offset := sidxNode.Info.Offset + sidxNode.Info.Size + sidx.GetFirstOffset()
+			for i, ref := range sidx.References {
+				assert.Equal(t, moofs[i].Info.Offset, offset)
+				assert.True(t, ref.StartsWithSAP)
+				offset += uint64(ref.ReferencedSize)
+			}
+
+			// tfra refers to moof boxes
+			tfras := tree.Find(BoxPath{BoxTypeMfra(), BoxTypeTfra()})
+			require.NotEmpty(t, tfras)
+			for _, tfra := range tfras {
+				for i := range tfra.Payload.(*Tfra).Entries {
+					moofOffset := tfra.Payload.(*Tfra).GetMoofOffset(i)
+					var found bool
+					for _, moof := range moofs {
+						found = found || moof.Info.Offset == moofOffset
+					}
+					assert.True(t, found)
+				}
+			}
+			mfra := tree.FindFirst(BoxPath{BoxTypeMfra()})
+			assert.Equal(t, uint32(mfra.Info.Size), mfra.FindFirst(BoxPath{BoxTypeMfro()}).Payload.(*Mfro).Size)
+
+			// each fragment starts with a sync sample of the video track
+			for _, moof := range moofs {
+				tfhd := moof.FindFirst(BoxPath{BoxTypeTraf(), BoxTypeTfhd()}).Payload.(*Tfhd)
+				assert.Equal(t, uint32(1), tfhd.TrackID)
+				trun := moof.FindFirst(BoxPath{BoxTypeTraf(), BoxTypeTrun()}).Payload.(*Trun)
+				assert.Equal(t, uint32(sampleFlagsSync), trun.Entries[0].SampleFlags)
+			}
+			if name == "sample.mp4" {
+				assert.Len(t, moofs, 1)
+			} else {
+				assert.Len(t, moofs, 5)
+			}
+		})
+	}
+}
+
+func TestFragmenterSegments(t *testing.T) {
+	input := readSampleWithSyncSamples(t)
+	expected := readAllSampleData(t, bytes.NewReader(input))
+
+	f, err := NewFragmenter(bytes.NewReader(input), &FragmentOptions{FragmentDuration: 0.2, Styp: true, Sidx: true})
+	require.NoError(t, err)
+	init := bytes.NewBuffer(nil)
+	require.NoError(t, f.WriteInitSegment(init))
+	all := bytes.NewBuffer(nil)
+	all.Write(init.Bytes())
+	var segments int
+	for {
+		seg := bytes.NewBuffer(nil)
+		err := f.WriteNextSegment(seg)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		segments++
+
+		bis, err := ExtractBoxes(bytes.NewReader(seg.Bytes()), nil, []BoxPath{{BoxTypeAny()}})
+		require.NoError(t, err)
+		require.Len(t, bis, 4)
+		assert.Equal(t, BoxTypeStyp(), bis[0].Type)
+		assert.Equal(t, BoxTypeSidx(), bis[1].Type)
+		assert.Equal(t, BoxTypeMoof(), bis[2].Type)
+		assert.Equal(t, BoxTypeMdat(), bis[3].Type)
+		all.Write(seg.Bytes())
+	}
+	assert.Greater(t, segments, 1)
+	assert.Equal(t, expected, readAllSampleData(t, bytes.NewReader(all.Bytes())))
+
+	_, err = NewFragmenter(bytes.NewReader(all.Bytes()), nil)
+	assert.Error(t, err)
+}
+
+func TestFragmentSampleEntries(t *testing.T) {
+	// the video track switches to the second sample entry from the second chunk
+	input := readFile(t, "./testdata/sample.mp4")
+	tree, err := ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	stbl := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+	stsd := stbl.FindFirst(BoxPath{BoxTypeStsd()})
+	entry := stsd.Children[0]
+	stsd.AppendChild(NewRawBoxNode(entry.Info.Type, input[entry.Info.Offset+entry.Info.HeaderSize:entry.Info.Offset+entry.Info.Size]))
+	stsd.Payload.(*Stsd).EntryCount = 2
+	stbl.FindFirst(BoxPath{BoxTypeStsc()}).Payload.(*Stsc).Entries[1].SampleDescriptionIndex = 2
+	input = writeBoxTree(t, tree)
+
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Fragment(bytes.NewReader(input), output, &FragmentOptions{FragmentDuration: 10}))
+	r := bytes.NewReader(output.Bytes())
+	assert.Equal(t, readSampleSummaries(t, bytes.NewReader(input)), readSampleSummaries(t, r))
+	assert.Equal(t, readAllSampleData(t, bytes.NewReader(input)), readAllSampleData(t, r))
+
+	tree, err = ReadBoxTree(r)
+	require.NoError(t, err)
+	moofs := tree.Find(BoxPath{BoxTypeMoof()})
+	require.Len(t, moofs, 1)
+	var descIdxs []uint32
+	var groupedSamples uint32
+	for _, traf := range moofs[0].Find(BoxPath{BoxTypeTraf()}) {
+		tfhd := traf.FindFirst(BoxPath{BoxTypeTfhd()}).Payload.(*Tfhd)
+		if tfhd.TrackID == 1 {
+			descIdxs = append(descIdxs, tfhd.SampleDescriptionIndex)
+			continue
+		}
+		// the roll group of the audio track is kept
+		for _, n := range traf.Find(BoxPath{BoxTypeSbgp()}) {
+			for _, e := range n.Payload.(*Sbgp).Entries {
+				assert.Equal(t, uint32(1), e.GroupDescriptionIndex)
+				groupedSamples += e.SampleCount
+			}
+		}
+	}
+	assert.Equal(t, []uint32{0, 2}, descIdxs)
+	assert.Equal(t, uint32(44), groupedSamples)
+}
+
+func TestFragmenterStyp(t *testing.T) {
+	for _, sidx := range []bool{false, true} {
+		f, err := NewFragmenter(bytes.NewReader(readFile(t, "./testdata/sample.mp4")), &FragmentOptions{Styp: true, Sidx: sidx})
+		require.NoError(t, err)
+		seg := bytes.NewBuffer(nil)
+		require.NoError(t, f.WriteNextSegment(seg))
+		tree, err := ReadBoxTree(bytes.NewReader(seg.Bytes()))
+		require.NoError(t, err)
+		styp := tree.FindFirst(BoxPath{BoxTypeStyp()}).Payload.(*Styp)
+		// msix is listed only for indexed segments
+		assert.Equal(t, sidx, styp.CompatibleBrands[len(styp.CompatibleBrands)-1].CompatibleBrand == [4]byte{'m', 's', 'i', 'x'})
+	}
+}
+
+func TestFragmentProtectedInput(t *testing.T) {
+	tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample.mp4")))
+	require.NoError(t, err)
+	stbl := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+	stbl.AppendChild(NewBoxNode(&Saiz{DefaultSampleInfoSize: 8, SampleCount: 10}))
+	_, err = NewFragmenter(bytes.NewReader(writeBoxTree(t, tree)), nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,622 @@
+package mp4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// ImportFormat is the format of an elementary stream file which Import reads.
+type ImportFormat int
+
+const (
+	ImportFormatUnknown ImportFormat = iota
+	// ImportFormatH264 is H.264 Annex B byte stream.
+	ImportFormatH264
+	// ImportFormatH265 is H.265 Annex B byte stream.
+	ImportFormatH265
+	// ImportFormatADTS is AAC in ADTS frames.
+	ImportFormatADTS
+	// ImportFormatIVF is VP9 or AV1 in IVF container.
+	ImportFormatIVF
+	// ImportFormatWAV is integer or floating point PCM in WAV container.
+	ImportFormatWAV
+	// ImportFormatWebVTT is WebVTT text.
+	ImportFormatWebVTT
+)
+
+// ImportOptions is options for Import.
+type ImportOptions struct {
+	// FrameRate is the frame rate of H.264 and H.265 streams, which have no timestamps.
+	// Default value is 25.
+	FrameRate float64
+
+	// Language is the ISO-639-2/T language code of the track. Default value is "und".
+	Language string
+
+	// Muxer is options for the output file. It can be nil.
+	Muxer *MuxerOptions
+}
+
+// importSource reads samples of an elementary stream.
+type importSource interface {
+	// track returns the track declaration, which is available before reading samples.
+	track() (*MuxerTrack, error)
+
+	// next returns the next sample in decoding order, or io.EOF at the end of the stream.
+	next() (*MuxerSample, error)
+}
+
+// Import reads an elementary stream and writes an MP4 file which has one track.
+// The sample entry is built from the stream: avc1 and avcC for H.264, hvc1 and hvcC for H.265,
+// mp4a and esds for AAC, vp09 and vpcC for VP9, av01 and av1C for AV1, ipcm or fpcm and pcmC for PCM,
+// and wvtt and vttC for WebVTT.
+//
+// H.264 and H.265 streams are read into memory at once to derive the parameter sets and the presentation order.
+// Their presentation times are derived from picture order counts in the slice headers and the frame rate.
+// For H.264, pic_order_cnt_type 1 is treated as the decoding order, and field pictures are not supported.
+func Import(r io.Reader, format ImportFormat, w io.Writer, opts *ImportOptions) error {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	var src importSource
+	var err error
+	switch format {
+	case ImportFormatH264:
+		src, err = newAnnexBSource(r, CodecAVC1, opts.FrameRate)
+	case ImportFormatH265:
+		src, err = newAnnexBSource(r, CodecHEVC, opts.FrameRate)
+	case ImportFormatADTS:
+		src = newADTSSource(r)
+	case ImportFormatIVF:
+		src, err = newIVFSource(r)
+	case ImportFormatWAV:
+		src, err = newWAVSource(r)
+	case ImportFormatWebVTT:
+		src, err = newWebVTTSource(r)
+	default:
+		return errors.New("unknown import format")
+	}
+	if err != nil {
+		return err
+	}
+
+	track, err := src.track()
+	if err != nil {
+		return err
+	}
+	track.Language = opts.Language
+	m, err := NewMuxer(w, opts.Muxer)
+	if err != nil {
+		return err
+	}
+	trackID, err := m.AddTrack(*track)
+	if err != nil {
+		return err
+	}
+	for {
+		sample, err := src.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := m.WriteSample(trackID, sample); err != nil {
+			return err
+		}
+	}
+	return m.Close()
+}
+
+/*************************** Annex B ****************************/
+
+// annexBSource reads H.264 or H.265 Annex B byte stream.
+type annexBSource struct {
+	codec     Codec
+	converter *AnnexBConverter
+	samples   []*MuxerSample
+	timescale uint32
+	width     uint16
+	height    uint16
+
+	avcSPS  map[uint32]*avcSPS
+	avcPPS  map[uint32]*avcPPS
+	hevcSPS map[uint32]*hevcSPS
+	hevcPPS map[uint32]*hevcPPS
+
+	// picture order count of the previous picture used for the derivation of PicOrderCntMsb
+	prevPOCMsb int32
+	prevPOCLsb uint32
+}
+
+// annexBAccessUnit is an access unit with its position in decoding order and its picture order count.
+type annexBAccessUnit struct {
+	sample *MuxerSample
+	index  int // in decoding order
+	poc    int32
+}
+
+func newAnnexBSource(r io.Reader, codec Codec, frameRate float64) (*annexBSource, error) {
+	if frameRate == 0 {
+		frameRate = 25
+	}
+	if frameRate < 0 || math.IsInf(frameRate, 0) || math.IsNaN(frameRate) {
+		return nil, fmt.Errorf("invalid frame rate: %g", frameRate)
+	}
+	timescale, duration := frameRateToTimescale(frameRate)
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	converter, err := NewAnnexBConverter(codec, false)
+	if err != nil {
+		return nil, err
+	}
+	s := &annexBSource{
+		codec:     codec,
+		converter: converter,
+		timescale: timescale,
+		avcSPS:    make(map[uint32]*avcSPS),
+		avcPPS:    make(map[uint32]*avcPPS),
+		hevcSPS:   make(map[uint32]*hevcSPS),
+		hevcPPS:   make(map[uint32]*hevcPPS),
+	}
+
+	// access units between the pictures which reset picture order count
+	var group []*annexBAccessUnit
+	var delay int // maximum distance which a picture is presented before in decoding order
+	var aus []*annexBAccessUnit
+	flush := func() {
+		if len(group) == 0 {
+			return
+		}
+		start := group[0].index
+		sort.SliceStable(group, func(i, j int) bool { return group[i].poc < group[j].poc })
+		for i, au := range group {
+			presentation := start + i
+			au.sample.PresentationTime = uint64(presentation)
+			if au.index-presentation > delay {
+				delay = au.index - presentation
+			}
+		}
+		group = group[:0]
+	}
+	var nalus [][]byte
+	var hasVCL bool
+	emit := func() error {
+		if !hasVCL {
+			return nil
+		}
+		au, reset, err := s.newAccessUnit(nalus, len(aus))
+		if err != nil {
+			return err
+		}
+		if reset {
+			flush()
+		}
+		group = append(group, au)
+		aus = append(aus, au)
+		nalus = nalus[:0]
+		hasVCL = false
+		return nil
+	}
+	for _, nalu := range SplitAnnexB(data) {
+		if len(nalu) < 2 {
+			continue
+		}
+		first, vcl, err := s.inspectNALUnit(nalu)
+		if err != nil {
+			return nil, err
+		}
+		if first && hasVCL {
+			if err := emit(); err != nil {
+				return nil, err
+			}
+		}
+		nalus = append(nalus, nalu)
+		hasVCL = hasVCL || vcl
+	}
+	if err := emit(); err != nil {
+		return nil, err
+	}
+	flush()
+	if len(aus) == 0 {
+		return nil, errors.New("no picture is found")
+	}
+
+	for _, au := range aus {
+		au.sample.DecodeTime = uint64(au.index) * uint64(duration)
+		au.sample.PresentationTime = (au.sample.PresentationTime + uint64(delay)) * uint64(duration)
+		au.sample.Duration = duration
+		s.samples = append(s.samples, au.sample)
+	}
+	return s, nil
+}
+
+// frameRateToTimescale returns the timescale and the frame duration which represent the frame rate.
+// NTSC frame rates such as 29.97 are represented by 1001 units of the timescale.
+func frameRateToTimescale(frameRate float64) (uint32, uint32) {
+	if ntsc := frameRate * 1.001; math.Abs(ntsc-math.Round(ntsc)) < 0.005 && math.Abs(frameRate-math.Round(frameRate)) >= 0.005 {
+		return uint32(math.Round(ntsc)) * 1000, 1001
+	}
+	return uint32(math.Round(frameRate * 1000)), 1000
+}
+
+// inspectNALUnit updates the parameter sets and reports whether the NAL unit starts a new access unit
+// when it follows a picture, defined at ISO/IEC 14496-10 7.4.1.2.3 and ISO/IEC 23008-2 7.4.2.4.4.
+// It also reports whether the NAL unit is a VCL NAL unit.
+func (s *annexBSource) inspectNALUnit(nalu []byte) (bool, bool, error) {
+	if s.codec == CodecAVC1 {
+		switch t := avcNALType(nalu); {
+		case t == avcNALSPS:
+			sps, err := parseAVCSPS(nalu)
+			if err != nil {
+				return false, false, err
+			}
+			s.avcSPS[sps.id] = sps
+			return true, false, nil
+		case t == avcNALPPS:
+			pps, err := parseAVCPPS(nalu)
+			if err != nil {
+				return false, false, err
+			}
+			s.avcPPS[pps.id] = pps
+			return true, false, nil
+		case t == 6 || t == avcNALAUD || (t >= 14 && t <= 18):
+			// SEI, access unit delimiter, prefix NAL unit and reserved
+			return true, false, nil
+		case t >= 1 && t <= avcNALIDR:
+			// first_mb_in_slice is 0, whose exp-Golomb code is 1
+			return nalu[1]&0x80 != 0, true, nil
+		}
+		return false, false, nil
+	}
+
+	switch t := hevcNALType(nalu); {
+	case t == hevcNALSPS:
+		sps, err := parseHEVCSPS(nalu)
+		if err != nil {
+			return false, false, err
+		}
+		s.hevcSPS[sps.id] = sps
+		return true, false, nil
+	case t == hevcNALPPS:
+		pps, err := parseHEVCPPS(nalu)
+		if err != nil {
+			return false, false, err
+		}
+		s.hevcPPS[pps.id] = pps
+		return true, false, nil
+	case t == hevcNALVPS || t == hevcNALAUD || t == 39 || (t >= 41 && t <= 44) || (t >= 48 && t <= 55):
+		// prefix SEI, reserved and unspecified
+		return true, false, nil
+	case t <= 31:
+		// first_slice_segment_in_pic_flag
+		return len(nalu) > 2 && nalu[2]&0x80 != 0, true, nil
+	}
+	return false, false, nil
+}
+
+// newAccessUnit converts the NAL units to a sample and derives its picture order count.
+// It also reports whether the picture resets picture order count.
+func (s *annexBSource) newAccessUnit(nalus [][]byte, index int) (*annexBAccessUnit, bool, error) {
+	sample, isSync, err := s.converter.Convert(JoinAnnexB(nalus))
+	if err != nil {
+		return nil, false, err
+	}
+	au := &annexBAccessUnit{
+		sample: &MuxerSample{IsSync: isSync, Data: sample},
+		index:  index,
+	}
+	var reset bool
+	for _, nalu := range nalus {
+		if s.codec == CodecAVC1 {
+			t := avcNALType(nalu)
+			if t < 1 || t > avcNALIDR {
+				continue
+			}
+			sh, err := parseAVCSliceHeader(nalu, s.avcPPS, s.avcSPS)
+			if err != nil {
+				return nil, false, err
+			}
+			if sh.fieldPic {
+				return nil, false, errors.New("field pictures are not supported")
+			}
+			s.setSize(sh.sps.width, sh.sps.height)
+			reset = t == avcNALIDR
+			if sh.sps.picOrderCntType != 0 {
+				// pictures are presented in decoding order
+				au.poc = int32(index)
+				break
+			}
+			isRef := nalu[0]&0x60 != 0
+			au.poc = s.pictureOrderCount(sh.picOrderCntLsb, sh.sps.log2MaxPicOrderCnt, reset, isRef)
+			break
+		}
+
+		t := hevcNALType(nalu)
+		if t > 31 {
+			continue
+		}
+		sh, err := parseHEVCSliceHeader(nalu, s.hevcPPS, s.hevcSPS)
+		if err != nil {
+			return nil, false, err
+		}
+		if !sh.firstSliceSegmentInPic {
+			continue
+		}
+		s.setSize(sh.sps.width, sh.sps.height)
+		// IDR and BLA pictures, and CRA pictures at the head of the stream, have NoRaslOutputFlag of 1
+		reset = t >= hevcNALBLAWLP && t <= hevcNALIDRNLP || t == 21 && index == 0
+		temporalID := nalu[1]&0x07 - 1
+		// prevTid0Pic excludes RASL, RADL and sub-layer non-reference pictures
+		isRef := temporalID == 0 && !(t >= 6 && t <= 9) && !(t <= 14 && t%2 == 0)
+		au.poc = s.pictureOrderCount(sh.picOrderCntLsb, sh.sps.log2MaxPicOrderCnt, reset, isRef)
+		break
+	}
+	return au, reset, nil
+}
+
+// pictureOrderCount derives picture order count from its LSBs,
+// defined at ISO/IEC 14496-10 8.2.1.1 and ISO/IEC 23008-2 8.3.1.
+func (s *annexBSource) pictureOrderCount(lsb uint32, log2Max uint, reset, isRef bool) int32 {
+	if reset {
+		s.prevPOCMsb, s.prevPOCLsb = 0, 0
+	}
+	max := uint32(1) << log2Max
+	msb := s.prevPOCMsb
+	if lsb < s.prevPOCLsb && s.prevPOCLsb-lsb >= max/2 {
+		msb += int32(max)
+	} else if lsb > s.prevPOCLsb && lsb-s.prevPOCLsb > max/2 {
+		msb -= int32(max)
+	}
+	if reset && s.codec == CodecHEVC {
+		msb = 0
+	}
+	if isRef || reset {
+		s.prevPOCMsb, s.prevPOCLsb = msb, lsb
+	}
+	return msb + int32(lsb)
+}
+
+func (s *annexBSource) setSize(width, height uint16) {
+	if s.width == 0 && s.height == 0 {
+		s.width, s.height = width, height
+	}
+}
+
+func (s *annexBSource) track() (*MuxerTrack, error) {
+	track := &MuxerTrack{
+		Timescale: s.timescale,
+		Width:     s.width,
+		Height:    s.height,
+	}
+	var err error
+	if s.codec == CodecAVC1 {
+		track.AVC, err = s.converter.AVCDecoderConfiguration()
+	} else {
+		track.HEVC, err = s.converter.HvcC()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return track, nil
+}
+
+func (s *annexBSource) next() (*MuxerSample, error) {
+	if len(s.samples) == 0 {
+		return nil, io.EOF
+	}
+	sample := s.samples[0]
+	s.samples = s.samples[1:]
+	return sample, nil
+}
+
+/*************************** ADTS ****************************/
+
+// adtsSource reads AAC frames in ADTS, defined at ISO/IEC 14496-3 1.A.2.
+type adtsSource struct {
+	r      *bufio.Reader
+	header []byte // fixed header of the first frame
+	config []byte // AudioSpecificConfig
+	index  uint64
+}
+
+func newADTSSource(r io.Reader) *adtsSource {
+	return &adtsSource{r: bufio.NewReader(r)}
+}
+
+// readHeader reads adts_fixed_header and adts_variable_header, and returns the size of the raw data block.
+func (s *adtsSource) readHeader() ([]byte, int, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.New("truncated ADTS header")
+		}
+		return nil, 0, err
+	}
+	if header[0] != 0xff || header[1]&0xf6 != 0xf0 {
+		return nil, 0, errors.New("ADTS syncword not found")
+	}
+	if header[6]&0x03 != 0 {
+		return nil, 0, errors.New("multiple raw data blocks in ADTS frame are not supported")
+	}
+	headerSize := 7
+	if header[1]&0x01 == 0 {
+		// CRC
+		if _, err := s.r.Discard(2); err != nil {
+			return nil, 0, err
+		}
+		headerSize += 2
+	}
+	frameLength := int(header[3]&0x03)<<11 | int(header[4])<<3 | int(header[5])>>5
+	if frameLength < headerSize {
+		return nil, 0, fmt.Errorf("invalid ADTS frame length: %d", frameLength)
+	}
+	return header, frameLength - headerSize, nil
+}
+
+func (s *adtsSource) track() (*MuxerTrack, error) {
+	header, err := s.r.Peek(7)
+	if err != nil {
+		return nil, errors.New("ADTS header not found")
+	}
+	profile := header[2] >> 6
+	samplingFrequencyIndex := (header[2] >> 2) & 0x0f
+	channelConfiguration := (header[2]&0x01)<<2 | header[3]>>6
+	if AACSamplingFrequency(samplingFrequencyIndex) == 0 {
+		return nil, fmt.Errorf("invalid sampling frequency index: %d", samplingFrequencyIndex)
+	}
+	if channelConfiguration == 0 {
+		// the channel layout is given by program_config_element in the raw data blocks
+		return nil, errors.New("ADTS channel configuration 0 is not supported")
+	}
+	s.header = append([]byte{}, header[:4]...)
+	// audioObjectType (5 bits), samplingFrequencyIndex (4 bits), channelConfiguration (4 bits) and GASpecificConfig
+	aot := profile + 1
+	s.config = []byte{aot<<3 | samplingFrequencyIndex>>1, samplingFrequencyIndex<<7 | channelConfiguration<<3}
+	return &MuxerTrack{AAC: s.config}, nil
+}
+
+func (s *adtsSource) next() (*MuxerSample, error) {
+	header, size, err := s.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	// profile, sampling_frequency_index and channel_configuration must not change
+	if header[2]&0xfd != s.header[2]&0xfd || header[3]&0xc0 != s.header[3]&0xc0 {
+		return nil, errors.New("ADTS header changes in the stream")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return nil, fmt.Errorf("truncated ADTS frame: %w", err)
+	}
+	sample := &MuxerSample{
+		DecodeTime:       s.index * 1024,
+		PresentationTime: s.index * 1024,
+		Duration:         1024,
+		IsSync:           true,
+		Data:             data,
+	}
+	s.index++
+	return sample, nil
+}
+
+/*************************** WAV ****************************/
+
+// wavFramesPerSample is the number of PCM frames which are stored in a sample.
+const wavFramesPerSample = 1024
+
+// wavSource reads PCM in WAV.
+type wavSource struct {
+	r          io.Reader
+	remaining  uint32 // size of the data chunk which is not read
+	formatTag  uint16
+	channels   uint16
+	rate       uint32
+	blockAlign uint16
+	bits       uint16
+	time       uint64
+}
+
+func newWAVSource(r io.Reader) (*wavSource, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, errors.New("not a WAV file")
+	}
+	s := &wavSource{r: r}
+	for {
+		chunk := make([]byte, 8)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, errors.New("data chunk not found")
+		}
+		size := binary.LittleEndian.Uint32(chunk[4:])
+		switch string(chunk[0:4]) {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("too short fmt chunk")
+			}
+			fmtData := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, fmtData); err != nil {
+				return nil, err
+			}
+			s.formatTag = binary.LittleEndian.Uint16(fmtData[0:])
+			s.channels = binary.LittleEndian.Uint16(fmtData[2:])
+			s.rate = binary.LittleEndian.Uint32(fmtData[4:])
+			s.blockAlign = binary.LittleEndian.Uint16(fmtData[12:])
+			s.bits = binary.LittleEndian.Uint16(fmtData[14:])
+			if s.formatTag == 0xfffe && size >= 40 {
+				// WAVE_FORMAT_EXTENSIBLE has the format tag at the head of SubFormat GUID
+				s.formatTag = binary.LittleEndian.Uint16(fmtData[24:])
+			}
+		case "data":
+			if s.formatTag == 0 {
+				return nil, errors.New("fmt chunk not found")
+			}
+			s.remaining = size
+			return s, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size+size%2)); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (s *wavSource) track() (*MuxerTrack, error) {
+	if s.formatTag != 1 && s.formatTag != 3 {
+		return nil, fmt.Errorf("unsupported WAV format: 0x%04x", s.formatTag)
+	}
+	if s.bits == 0 || s.bits%8 != 0 || s.bits > 64 || s.channels == 0 ||
+		uint32(s.blockAlign) != uint32(s.channels)*uint32(s.bits/8) {
+		return nil, errors.New("invalid WAV format")
+	}
+	return &MuxerTrack{
+		ChannelCount: s.channels,
+		SampleRate:   s.rate,
+		PCM: &PcmC{
+			FormatFlags:   0x01, // little endian
+			PCMSampleSize: uint8(s.bits),
+		},
+		FloatPCM: s.formatTag == 3,
+	}, nil
+}
+
+func (s *wavSource) next() (*MuxerSample, error) {
+	size := uint32(s.blockAlign) * wavFramesPerSample
+	if size > s.remaining {
+		size = s.remaining - s.remaining%uint32(s.blockAlign)
+	}
+	if size == 0 {
+		return nil, io.EOF
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return nil, fmt.Errorf("truncated WAV data: %w", err)
+	}
+	s.remaining -= size
+	if s.bits == 8 && s.formatTag == 1 {
+		// 8-bit samples are unsigned in WAV and signed in ISO/IEC 23003-5
+		for i := range data {
+			data[i] ^= 0x80
+		}
+	}
+	frames := size / uint32(s.blockAlign)
+	sample := &MuxerSample{
+		DecodeTime:       s.time,
+		PresentationTime: s.time,
+		Duration:         frames,
+		IsSync:           true,
+		Data:             data,
+	}
+	s.time += uint64(frames)
+	return sample, nil
+}
@@ -0,0 +1,324 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// packBits packs the pairs of bit width and value in MSB first order.
+func packBits(fields ...[2]uint64) []byte {
+	var data []byte
+	var n uint
+	for _, f := range fields {
+		for i := int(f[0]) - 1; i >= 0; i-- {
+			if n%8 == 0 {
+				data = append(data, 0)
+			}
+			data[len(data)-1] |= byte((f[1]>>uint(i))&1) << (7 - n%8)
+			n++
+		}
+	}
+	return data
+}
+
+func importStream(t *testing.T, input []byte, format ImportFormat, opts *ImportOptions) ([]byte, *BoxTree) {
+	output := bytes.NewBuffer(nil)
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	opts.Muxer = &MuxerOptions{Fragmented: true}
+	require.NoError(t, Import(bytes.NewReader(input), format, output, opts))
+	tree, err := ReadBoxTree(bytes.NewReader(output.Bytes()))
+	require.NoError(t, err)
+	return output.Bytes(), tree
+}
+
+func newIVF(fourcc string, rate uint32, frames [][]byte) []byte {
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint16(header[12:], 320)
+	binary.LittleEndian.PutUint16(header[14:], 180)
+	binary.LittleEndian.PutUint32(header[16:], rate)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(frames)))
+	for i, frame := range frames {
+		frameHeader := make([]byte, 12)
+		binary.LittleEndian.PutUint32(frameHeader, uint32(len(frame)))
+		binary.LittleEndian.PutUint64(frameHeader[4:], uint64(i))
+		header = append(header, frameHeader...)
+		header = append(header, frame...)
+	}
+	return header
+}
+
+func TestImportH264(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+	_, annexB := demuxTrack(t, input, 1)
+	it, err := NewSampleIterator(bytes.NewReader(input), 1)
+	require.NoError(t, err)
+	samples := readAllSamples(t, it)
+	data := readTrackSampleData(t, bytes.NewReader(input), 1)
+
+	output, tree := importStream(t, annexB, ImportFormatH264, &ImportOptions{FrameRate: 10, Language: "jpn"})
+	avc1 := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAvc1()})
+	require.NotNil(t, avc1)
+	assert.Equal(t, uint16(320), avc1.Payload.(*VisualSampleEntry).Width)
+	assert.Equal(t, uint16(180), avc1.Payload.(*VisualSampleEntry).Height)
+	assert.NotNil(t, avc1.FindFirst(BoxPath{BoxTypeAvcC()}))
+	mdhd := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMdhd()}).Payload.(*Mdhd)
+	assert.Equal(t, uint32(10000), mdhd.Timescale)
+	assert.Equal(t, [3]byte{'j' - 0x60, 'p' - 0x60, 'n' - 0x60}, mdhd.Language)
+
+	// the presentation order is restored from picture order counts
+	it, err = NewSampleIterator(bytes.NewReader(output), 1)
+	require.NoError(t, err)
+	imported := readAllSamples(t, it)
+	require.Len(t, imported, len(samples))
+	for i, s := range imported {
+		assert.Equal(t, uint64(i*1000), s.DecodeTime, "sample %d", i)
+		assert.Equal(t, uint32(1000), s.Duration, "sample %d", i)
+		assert.Equal(t, samples[i].CompositionTimeOffset/1024, s.CompositionTimeOffset/1000, "sample %d", i)
+		assert.Equal(t, samples[i].IsSync, s.IsSync, "sample %d", i)
+	}
+	assert.Equal(t, data, readTrackSampleData(t, bytes.NewReader(output), 1))
+}
+
+func TestImportH265(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09}
+	sps := []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93, 0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x80, 0x80, 0x82}
+	pps := []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+	idr := []byte{0x26, 0x01, 0xaf, 0x06, 0x1c}               // IDR_W_RADL
+	trail := []byte{0x02, 0x01, 0xd0, 0x09, 0x7e, 0xc7, 0xe0} // TRAIL_R
+	aud := []byte{0x46, 0x01, 0x10}
+	input := JoinAnnexB([][]byte{aud, vps, sps, pps, idr, aud, trail})
+
+	output, tree := importStream(t, input, ImportFormatH265, &ImportOptions{FrameRate: 29.97})
+	hvc1 := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeHvc1()})
+	require.NotNil(t, hvc1)
+	assert.Equal(t, uint16(1280), hvc1.Payload.(*VisualSampleEntry).Width)
+	assert.Equal(t, uint16(720), hvc1.Payload.(*VisualSampleEntry).Height)
+	hvcC := hvc1.FindFirst(BoxPath{BoxTypeHvcC()}).Payload.(*HvcC)
+	assert.Equal(t, uint8(93), hvcC.GeneralLevelIdc)
+	mdhd := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMdhd()}).Payload.(*Mdhd)
+	assert.Equal(t, uint32(30000), mdhd.Timescale)
+
+	it, err := NewSampleIterator(bytes.NewReader(output), 1)
+	require.NoError(t, err)
+	samples := readAllSamples(t, it)
+	require.Len(t, samples, 2)
+	assert.True(t, samples[0].IsSync)
+	assert.False(t, samples[1].IsSync)
+	assert.Equal(t, uint64(1001), samples[1].DecodeTime)
+	assert.Equal(t, int64(0), samples[1].CompositionTimeOffset)
+	expected1, err := JoinLengthPrefixed([][]byte{aud, idr}, 4)
+	require.NoError(t, err)
+	expected2, err := JoinLengthPrefixed([][]byte{aud, trail}, 4)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{expected1, expected2}, readTrackSampleData(t, bytes.NewReader(output), 1))
+}
+
+func TestImportADTS(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+	_, adts := demuxTrack(t, input, 2)
+	data := readTrackSampleData(t, bytes.NewReader(input), 2)
+
+	output, tree := importStream(t, adts, ImportFormatADTS, nil)
+	esds := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeMp4a(), BoxTypeEsds()})
+	require.NotNil(t, esds)
+	config, err := getAudioSpecificConfig(esds.Payload.(*Esds))
+	require.NoError(t, err)
+	asc, err := ParseAudioSpecificConfig(config)
+	require.NoError(t, err)
+	assert.Equal(t, AACObjectTypeLC, asc.AudioObjectType)
+	assert.Equal(t, uint32(44100), asc.SamplingFrequency)
+	assert.Equal(t, uint8(2), asc.ChannelConfiguration)
+
+	it, err := NewSampleIterator(bytes.NewReader(output), 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(44100), it.Timescale())
+	for i, s := range readAllSamples(t, it) {
+		assert.Equal(t, uint64(i*1024), s.DecodeTime)
+		assert.Equal(t, uint32(1024), s.Duration)
+	}
+	assert.Equal(t, data, readTrackSampleData(t, bytes.NewReader(output), 1))
+
+	err = Import(bytes.NewReader([]byte{0xff, 0xf1, 0x50, 0x80, 0x00, 0x1f, 0xfc}), ImportFormatADTS, bytes.NewBuffer(nil), &ImportOptions{Muxer: &MuxerOptions{Fragmented: true}})
+	assert.Error(t, err, "frame length is shorter than the header")
+
+	err = Import(bytes.NewReader([]byte{0xff, 0xf1, 0x50, 0x00, 0x01, 0x1f, 0xfc, 0x00}), ImportFormatADTS, bytes.NewBuffer(nil), &ImportOptions{Muxer: &MuxerOptions{Fragmented: true}})
+	assert.EqualError(t, err, "ADTS channel configuration 0 is not supported")
+}
+
+func TestImportWAV(t *testing.T) {
+	newWAV := func(formatTag, channels, bits uint16, frames int) []byte {
+		blockAlign := channels * bits / 8
+		data := make([]byte, frames*int(blockAlign))
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		header := make([]byte, 44)
+		copy(header[0:], "RIFF")
+		binary.LittleEndian.PutUint32(header[4:], uint32(36+len(data)))
+		copy(header[8:], "WAVEfmt ")
+		binary.LittleEndian.PutUint32(header[16:], 16)
+		binary.LittleEndian.PutUint16(header[20:], formatTag)
+		binary.LittleEndian.PutUint16(header[22:], channels)
+		binary.LittleEndian.PutUint32(header[24:], 48000)
+		binary.LittleEndian.PutUint32(header[28:], 48000*uint32(blockAlign))
+		binary.LittleEndian.PutUint16(header[32:], blockAlign)
+		binary.LittleEndian.PutUint16(header[34:], bits)
+		copy(header[36:], "data")
+		binary.LittleEndian.PutUint32(header[40:], uint32(len(data)))
+		return append(header, data...)
+	}
+
+	testCases := []struct {
+		name      string
+		formatTag uint16
+		channels  uint16
+		bits      uint16
+		boxType   BoxType
+	}{
+		{name: "16-bit", formatTag: 1, channels: 2, bits: 16, boxType: BoxTypeIpcm()},
+		{name: "8-bit", formatTag: 1, channels: 1, bits: 8, boxType: BoxTypeIpcm()},
+		{name: "float", formatTag: 3, channels: 2, bits: 32, boxType: BoxTypeFpcm()},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			input := newWAV(tc.formatTag, tc.channels, tc.bits, 2500)
+			output, tree := importStream(t, input, ImportFormatWAV, nil)
+			entry := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), tc.boxType})
+			require.NotNil(t, entry)
+			assert.Equal(t, tc.channels, entry.Payload.(*AudioSampleEntry).ChannelCount)
+			assert.Equal(t, tc.bits, entry.Payload.(*AudioSampleEntry).SampleSize)
+			assert.Equal(t, uint32(48000<<16), entry.Payload.(*AudioSampleEntry).SampleRate)
+			pcmC := entry.FindFirst(BoxPath{BoxTypePcmC()}).Payload.(*PcmC)
+			assert.Equal(t, uint8(0x01), pcmC.FormatFlags)
+			assert.Equal(t, uint8(tc.bits), pcmC.PCMSampleSize)
+
+			it, err := NewSampleIterator(bytes.NewReader(output), 1)
+			require.NoError(t, err)
+			samples := readAllSamples(t, it)
+			require.Len(t, samples, 3)
+			assert.Equal(t, []uint32{1024, 1024, 452}, []uint32{samples[0].Duration, samples[1].Duration, samples[2].Duration})
+
+			// WAV is restored by the demuxer
+			_, wav := demuxTrack(t, output, 1)
+			assert.Equal(t, input, wav)
+		})
+	}
+
+	err := Import(bytes.NewReader(newWAV(2, 2, 4, 10)), ImportFormatWAV, bytes.NewBuffer(nil), nil)
+	assert.Error(t, err, "ADPCM is not supported")
+}
+
+func TestImportIVF(t *testing.T) {
+	t.Run("vp09", func(t *testing.T) {
+		keyFrame := append([]byte{0x82, 0x49, 0x83, 0x42}, packBits(
+			[2]uint64{3, 2},    // color_space (BT.709)
+			[2]uint64{1, 0},    // color_range
+			[2]uint64{16, 319}, // frame_width_minus_1
+			[2]uint64{16, 179}, // frame_height_minus_1
+		)...)
+		interFrame := []byte{0x86, 0x00, 0x00}
+		input := newIVF("VP90", 30, [][]byte{keyFrame, interFrame, interFrame})
+
+		output, tree := importStream(t, input, ImportFormatIVF, nil)
+		vp09 := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeVp09()})
+		require.NotNil(t, vp09)
+		assert.Equal(t, uint16(320), vp09.Payload.(*VisualSampleEntry).Width)
+		vpcC := vp09.FindFirst(BoxPath{BoxTypeVpcC()}).Payload.(*VpcC)
+		assert.Equal(t, uint8(1), vpcC.Version)
+		assert.Equal(t, uint8(0), vpcC.Profile)
+		assert.Equal(t, uint8(11), vpcC.Level)
+		assert.Equal(t, uint8(8), vpcC.BitDepth)
+		assert.Equal(t, uint8(0), vpcC.ChromaSubsampling)
+		assert.Equal(t, uint8(1), vpcC.MatrixCoefficients)
+
+		it, err := NewSampleIterator(bytes.NewReader(output), 1)
+		require.NoError(t, err)
+		samples := readAllSamples(t, it)
+		require.Len(t, samples, 3)
+		assert.Equal(t, []bool{true, false, false}, []bool{samples[0].IsSync, samples[1].IsSync, samples[2].IsSync})
+		assert.Equal(t, uint32(1), samples[2].Duration)
+
+		_, ivf := demuxTrack(t, output, 1)
+		assert.Equal(t, input, ivf)
+	})
+
+	t.Run("av01", func(t *testing.T) {
+		seqHeader := packBits(
+			[2]uint64{3, 0},    // seq_profile
+			[2]uint64{1, 0},    // still_picture
+			[2]uint64{1, 0},    // reduced_still_picture_header
+			[2]uint64{1, 0},    // timing_info_present_flag
+			[2]uint64{1, 0},    // initial_display_delay_present_flag
+			[2]uint64{5, 0},    // operating_points_cnt_minus_1
+			[2]uint64{12, 0},   // operating_point_idc[0]
+			[2]uint64{5, 8},    // seq_level_idx[0]
+			[2]uint64{1, 1},    // seq_tier[0]
+			[2]uint64{4, 9},    // frame_width_bits_minus_1
+			[2]uint64{4, 8},    // frame_height_bits_minus_1
+			[2]uint64{10, 319}, // max_frame_width_minus_1
+			[2]uint64{9, 179},  // max_frame_height_minus_1
+			[2]uint64{1, 0},    // frame_id_numbers_present_flag
+			[2]uint64{3, 0},    // use_128x128_superblock, enable_filter_intra, enable_intra_edge
+			[2]uint64{4, 0},    // enable_interintra_compound, enable_masked_compound, enable_warped_motion, enable_dual_filter
+			[2]uint64{1, 0},    // enable_order_hint
+			[2]uint64{1, 0},    // seq_choose_screen_content_tools
+			[2]uint64{1, 0},    // seq_force_screen_content_tools
+			[2]uint64{3, 0},    // enable_superres, enable_cdef, enable_restoration
+			[2]uint64{1, 1},    // high_bitdepth
+			[2]uint64{1, 0},    // mono_chrome
+			[2]uint64{1, 0},    // color_description_present_flag
+			[2]uint64{1, 0},    // color_range
+			[2]uint64{2, 1},    // chroma_sample_position
+			[2]uint64{1, 1},    // trailing_one_bit
+		)
+		seqHeaderOBU := append([]byte{0x0a, byte(len(seqHeader))}, seqHeader...)
+		td := []byte{0x12, 0x00}
+		keyFrame := []byte{0x32, 0x01, 0x10}
+		interFrame := []byte{0x32, 0x01, 0x30}
+		input := newIVF("AV01", 30, [][]byte{
+			append(append(append([]byte{}, td...), seqHeaderOBU...), keyFrame...),
+			append(append([]byte{}, td...), interFrame...),
+		})
+
+		output, tree := importStream(t, input, ImportFormatIVF, nil)
+		av1C := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAv01(), BoxTypeAv1C()}).Payload.(*Av1C)
+		assert.Equal(t, uint8(0), av1C.SeqProfile)
+		assert.Equal(t, uint8(8), av1C.SeqLevelIdx0)
+		assert.Equal(t, uint8(1), av1C.SeqTier0)
+		assert.Equal(t, uint8(1), av1C.HighBitdepth)
+		assert.Equal(t, uint8(1), av1C.ChromaSubsamplingX)
+		assert.Equal(t, uint8(1), av1C.ChromaSubsamplingY)
+		assert.Equal(t, uint8(1), av1C.ChromaSamplePosition)
+		assert.Equal(t, seqHeaderOBU, av1C.ConfigOBUs)
+
+		// temporal delimiters are removed
+		assert.Equal(t, [][]byte{append(append([]byte{}, seqHeaderOBU...), keyFrame...), interFrame},
+			readTrackSampleData(t, bytes.NewReader(output), 1))
+		it, err := NewSampleIterator(bytes.NewReader(output), 1)
+		require.NoError(t, err)
+		samples := readAllSamples(t, it)
+		require.Len(t, samples, 2)
+		assert.True(t, samples[0].IsSync)
+		assert.False(t, samples[1].IsSync)
+
+		_, ivf := demuxTrack(t, output, 1)
+		assert.Equal(t, input, ivf)
+	})
+
+	t.Run("broken frame size", func(t *testing.T) {
+		input := newIVF("VP90", 30, [][]byte{{0x82, 0x49, 0x83, 0x42}})
+		binary.LittleEndian.PutUint32(input[32:], math.MaxUint32)
+		assert.Error(t, Import(bytes.NewReader(input), ImportFormatIVF, bytes.NewBuffer(nil), nil))
+	})
+}
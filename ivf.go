@@ -0,0 +1,336 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ivfSource reads VP9 or AV1 frames in IVF.
+type ivfSource struct {
+	r         io.Reader
+	fourcc    string
+	width     uint16
+	height    uint16
+	timescale uint32
+	scale     uint32
+
+	buffered     []*MuxerSample // samples whose durations are determined by the next frames
+	eof          bool
+	lastDuration uint32
+	av1          av1KeyFrameDetector
+}
+
+func newIVFSource(r io.Reader) (*ivfSource, error) {
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[0:4]) != "DKIF" {
+		return nil, errors.New("not an IVF file")
+	}
+	if headerSize := binary.LittleEndian.Uint16(header[6:]); headerSize > 32 {
+		if _, err := io.CopyN(io.Discard, r, int64(headerSize-32)); err != nil {
+			return nil, err
+		}
+	}
+	s := &ivfSource{
+		r:         r,
+		fourcc:    string(header[8:12]),
+		width:     binary.LittleEndian.Uint16(header[12:]),
+		height:    binary.LittleEndian.Uint16(header[14:]),
+		timescale: binary.LittleEndian.Uint32(header[16:]),
+		scale:     binary.LittleEndian.Uint32(header[20:]),
+	}
+	if s.fourcc != "VP90" && s.fourcc != "AV01" {
+		return nil, fmt.Errorf("unsupported IVF codec: %s", s.fourcc)
+	}
+	if s.timescale == 0 || s.scale == 0 {
+		return nil, errors.New("invalid IVF time base")
+	}
+	return s, nil
+}
+
+// readFrame reads a frame and converts it to a sample without duration.
+func (s *ivfSource) readFrame() (*MuxerSample, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(s.r, header); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errors.New("truncated IVF frame header")
+	}
+	// the buffer grows with the read data so that a broken frame size does not allocate the memory at once
+	size := int64(binary.LittleEndian.Uint32(header))
+	buf := bytes.NewBuffer(nil)
+	if n, err := io.CopyN(buf, s.r, size); err == io.EOF {
+		return nil, fmt.Errorf("truncated IVF frame: size=%d read=%d", size, n)
+	} else if err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	pts := binary.LittleEndian.Uint64(header[4:]) * uint64(s.scale)
+	sample := &MuxerSample{DecodeTime: pts, PresentationTime: pts}
+	reader := &sampleDataReader{r: bytes.NewReader(data), size: uint64(len(data))}
+	if s.fourcc == "VP90" {
+		sample.Data = data
+		isSync, err := isVP9KeyFrame(reader)
+		if err != nil {
+			return nil, err
+		}
+		sample.IsSync = isSync
+		return sample, nil
+	}
+
+	// temporal delimiters are removed in MP4
+	obus, err := splitAV1OBUs(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, obu := range obus {
+		if av1OBUType(obu) != av1OBUTemporalDelimiter {
+			sample.Data = append(sample.Data, obu...)
+		}
+	}
+	if sample.IsSync, err = s.av1.isKeyFrame(reader); err != nil {
+		return nil, err
+	}
+	return sample, nil
+}
+
+// fill reads frames until n frames are buffered or the stream ends.
+func (s *ivfSource) fill(n int) error {
+	for !s.eof && len(s.buffered) < n {
+		sample, err := s.readFrame()
+		if err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return err
+		} else {
+			s.buffered = append(s.buffered, sample)
+		}
+	}
+	return nil
+}
+
+func (s *ivfSource) track() (*MuxerTrack, error) {
+	if err := s.fill(2); err != nil {
+		return nil, err
+	}
+	if len(s.buffered) == 0 {
+		return nil, errors.New("no frame is found")
+	}
+	first := s.buffered[0]
+	track := &MuxerTrack{
+		Timescale: s.timescale,
+		Width:     s.width,
+		Height:    s.height,
+	}
+	var err error
+	if s.fourcc == "VP90" {
+		frameDuration := uint64(s.scale)
+		if len(s.buffered) == 2 && s.buffered[1].DecodeTime > first.DecodeTime {
+			frameDuration = s.buffered[1].DecodeTime - first.DecodeTime
+		}
+		track.VP9, err = newVP9Config(first.Data, s.timescale, frameDuration)
+	} else {
+		track.AV1, err = newAV1Config(first.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return track, nil
+}
+
+func (s *ivfSource) next() (*MuxerSample, error) {
+	if err := s.fill(2); err != nil {
+		return nil, err
+	}
+	if len(s.buffered) == 0 {
+		return nil, io.EOF
+	}
+	sample := s.buffered[0]
+	s.buffered = s.buffered[1:]
+	if len(s.buffered) == 0 {
+		if s.lastDuration == 0 {
+			s.lastDuration = s.scale
+		}
+		sample.Duration = s.lastDuration
+		return sample, nil
+	}
+	if s.buffered[0].DecodeTime <= sample.DecodeTime {
+		return nil, errors.New("IVF timestamps must increase")
+	}
+	sample.Duration = uint32(s.buffered[0].DecodeTime - sample.DecodeTime)
+	s.lastDuration = sample.Duration
+	return sample, nil
+}
+
+/*************************** VP9 ****************************/
+
+// vp9Levels is the level table defined at VP9 Codec ISO Media File Format Binding,
+// which has maximum luma picture sizes and maximum luma sample rates.
+var vp9Levels = []struct {
+	level       uint8
+	pictureSize uint64
+	sampleRate  uint64
+}{
+	{10, 36864, 829440},
+	{11, 73728, 2764800},
+	{20, 122880, 4608000},
+	{21, 245760, 9216000},
+	{30, 552960, 20736000},
+	{31, 983040, 36864000},
+	{40, 2228224, 83558400},
+	{41, 2228224, 160432128},
+	{50, 8912896, 311951360},
+	{51, 8912896, 588251136},
+	{52, 8912896, 1176502272},
+	{60, 35651584, 1176502272},
+	{61, 35651584, 2353004544},
+	{62, 35651584, 4706009088},
+}
+
+// newVP9Config builds vpcC box from the uncompressed header of the key frame,
+// defined at VP9 Bitstream & Decoding Process Specification 6.2.
+// The level is estimated from the picture size and the frame rate.
+func newVP9Config(frame []byte, timescale uint32, frameDuration uint64) (*VpcC, error) {
+	r := newBitReader(frame)
+	var err error
+	read := func(width uint) uint8 {
+		var v uint8
+		if err == nil {
+			v, err = r.readUint8(width)
+		}
+		return v
+	}
+
+	if read(2) != 2 { // frame_marker
+		return nil, errors.New("invalid VP9 frame marker")
+	}
+	profile := read(1)
+	profile |= read(1) << 1
+	if profile == 3 {
+		read(1) // reserved_zero
+	}
+	if read(1) == 1 { // show_existing_frame
+		return nil, errors.New("first VP9 frame must be a key frame")
+	}
+	if read(1) != 0 { // frame_type
+		return nil, errors.New("first VP9 frame must be a key frame")
+	}
+	read(2) // show_frame, error_resilient_mode
+	if read(8) != 0x49 || read(8) != 0x83 || read(8) != 0x42 {
+		return nil, errors.New("invalid VP9 frame sync code")
+	}
+
+	vpcC := &VpcC{
+		FullBox:                 FullBox{Version: 1},
+		Profile:                 profile,
+		BitDepth:                8,
+		ColourPrimaries:         2, // unspecified
+		TransferCharacteristics: 2, // unspecified
+	}
+	if profile >= 2 {
+		vpcC.BitDepth = 10
+		if read(1) == 1 { // ten_or_twelve_bit
+			vpcC.BitDepth = 12
+		}
+	}
+	colorSpace := read(3)
+	// MatrixCoefficients of ISO/IEC 23091-2 which correspond to color_space
+	vpcC.MatrixCoefficients = [...]uint8{2, 6, 1, 6, 7, 9, 2, 0}[colorSpace]
+	subsamplingX, subsamplingY := uint8(1), uint8(1)
+	if colorSpace != 7 { // CS_RGB
+		vpcC.VideoFullRangeFlag = read(1)
+		if profile == 1 || profile == 3 {
+			subsamplingX = read(1)
+			subsamplingY = read(1)
+			read(1) // reserved_zero
+		}
+	} else {
+		vpcC.VideoFullRangeFlag = 1
+		subsamplingX, subsamplingY = 0, 0
+		if profile == 1 || profile == 3 {
+			read(1) // reserved_zero
+		}
+	}
+	switch {
+	case subsamplingX == 1 && subsamplingY == 1:
+		vpcC.ChromaSubsampling = 0 // 4:2:0 vertical
+	case subsamplingX == 1:
+		vpcC.ChromaSubsampling = 2 // 4:2:2
+	default:
+		vpcC.ChromaSubsampling = 3 // 4:4:4
+	}
+	width := uint64(read(8))<<8 | uint64(read(8))  // frame_width_minus_1
+	height := uint64(read(8))<<8 | uint64(read(8)) // frame_height_minus_1
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse VP9 frame header: %w", err)
+	}
+
+	pictureSize := (width + 1) * (height + 1)
+	sampleRate := pictureSize * uint64(timescale) / frameDuration
+	for _, l := range vp9Levels {
+		if pictureSize <= l.pictureSize && sampleRate <= l.sampleRate {
+			vpcC.Level = l.level
+			break
+		}
+	}
+	return vpcC, nil
+}
+
+/*************************** AV1 ****************************/
+
+func av1OBUType(obu []byte) uint8 {
+	return (obu[0] >> 3) & 0xf
+}
+
+// splitAV1OBUs splits the data into OBUs including their headers.
+// All OBUs must have obu_size fields as required by AV1 Codec ISO Media File Format Binding.
+func splitAV1OBUs(data []byte) ([][]byte, error) {
+	var obus [][]byte
+	for pos := 0; pos < len(data); {
+		header := data[pos]
+		headerSize := 1
+		if header&0x04 != 0 {
+			headerSize++
+		}
+		if header&0x02 == 0 {
+			return nil, errors.New("OBU without obu_size field")
+		}
+		if pos+headerSize > len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size, n, err := readLEB128(data[pos+headerSize:])
+		if err != nil {
+			return nil, err
+		}
+		end := pos + headerSize + n + int(size)
+		if size > uint64(len(data)) || end > len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		obus = append(obus, data[pos:end])
+		pos = end
+	}
+	return obus, nil
+}
+
+// newAV1Config builds av1C box from the sequence header OBU in the temporal unit.
+func newAV1Config(tu []byte) (*Av1C, error) {
+	obus, err := splitAV1OBUs(tu)
+	if err != nil {
+		return nil, err
+	}
+	for _, obu := range obus {
+		if av1OBUType(obu) == av1OBUSequenceHeader {
+			sh, err := parseAV1SequenceHeader(obu)
+			if err != nil {
+				return nil, err
+			}
+			return sh.av1C, nil
+		}
+	}
+	return nil, errors.New("AV1 sequence header is not found in the first temporal unit")
+}
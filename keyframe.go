@@ -0,0 +1,282 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// KeyFrameMismatch represents a sample whose key frame status disagrees with stss box.
+type KeyFrameMismatch struct {
+	// SampleIndex is 0-based sample index.
+	SampleIndex int
+	// IsKeyFrame represents whether the sample data is a key frame.
+	IsKeyFrame bool
+	// IsSyncSample represents whether the sample is listed in stss box.
+	IsSyncSample bool
+}
+
+// FindKeyFrames parses the sample data and returns 0-based indices of the key frames.
+// IDR pictures for AVC, IRAP pictures (BLA/IDR/CRA) for HEVC and key frames for AV1, VP8 and VP9 are detected.
+// When the track has stss box, FindKeyFrames also returns the samples which are inconsistent with it.
+func FindKeyFrames(r io.ReadSeeker, track *Track) ([]int, []KeyFrameMismatch, error) {
+	isKeyFrame, err := newKeyFrameDetector(track)
+	if err != nil || isKeyFrame == nil {
+		return nil, nil, err
+	}
+
+	idxs := make([]int, 0, 8)
+	err = walkSampleData(track, func(si int, offset uint64, size uint32) error {
+		if size == 0 {
+			return nil
+		}
+		key, err := isKeyFrame(&sampleDataReader{r: r, offset: offset, size: uint64(size)})
+		if err != nil {
+			return err
+		}
+		if key {
+			idxs = append(idxs, si)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if track.SyncSamples == nil {
+		return idxs, nil, nil
+	}
+	var mismatches []KeyFrameMismatch
+	var ki, si int
+	for i := range track.Samples {
+		for ki < len(idxs) && idxs[ki] < i {
+			ki++
+		}
+		for si < len(track.SyncSamples) && int(track.SyncSamples[si])-1 < i {
+			si++
+		}
+		key := ki < len(idxs) && idxs[ki] == i
+		sync := si < len(track.SyncSamples) && int(track.SyncSamples[si])-1 == i
+		if key != sync {
+			mismatches = append(mismatches, KeyFrameMismatch{
+				SampleIndex:  i,
+				IsKeyFrame:   key,
+				IsSyncSample: sync,
+			})
+		}
+	}
+	return idxs, mismatches, nil
+}
+
+func walkSampleData(track *Track, fn func(si int, offset uint64, size uint32) error) error {
+	var si int
+	for _, chunk := range track.Chunks {
+		end := si + int(chunk.SamplesPerChunk)
+		dataOffset := chunk.DataOffset
+		for ; si < end && si < len(track.Samples); si++ {
+			if err := fn(si, dataOffset, track.Samples[si].Size); err != nil {
+				return err
+			}
+			dataOffset += uint64(track.Samples[si].Size)
+		}
+	}
+	return nil
+}
+
+// sampleDataReader provides random access to the data of a sample.
+type sampleDataReader struct {
+	r      io.ReadSeeker
+	offset uint64
+	size   uint64
+}
+
+// readAt reads at most n bytes from pos. It reads less bytes when the sample ends.
+func (s *sampleDataReader) readAt(pos uint64, n int) ([]byte, error) {
+	if pos >= s.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if uint64(n) > s.size-pos {
+		n = int(s.size - pos)
+	}
+	if _, err := s.r.Seek(int64(s.offset+pos), io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type keyFrameDetector func(s *sampleDataReader) (bool, error)
+
+func newKeyFrameDetector(track *Track) (keyFrameDetector, error) {
+	switch track.Codec {
+	case CodecAVC1:
+		if track.AVC == nil {
+			return nil, nil
+		}
+		return newNALKeyFrameDetector(uint64(track.AVC.LengthSize), func(header byte) bool {
+			return header&0x1f == 5
+		}), nil
+	case CodecHEVC:
+		if track.HEVC == nil {
+			return nil, nil
+		}
+		return newNALKeyFrameDetector(uint64(track.HEVC.LengthSize), func(header byte) bool {
+			nalType := (header >> 1) & 0x3f
+			return nalType >= 16 && nalType <= 23
+		}), nil
+	case CodecAV1:
+		d := &av1KeyFrameDetector{}
+		if track.AV1 != nil && len(track.AV1.ConfigOBUs) != 0 {
+			configOBUs := &sampleDataReader{
+				r:    bytes.NewReader(track.AV1.ConfigOBUs),
+				size: uint64(len(track.AV1.ConfigOBUs)),
+			}
+			if _, err := d.isKeyFrame(configOBUs); err != nil {
+				return nil, err
+			}
+		}
+		return d.isKeyFrame, nil
+	case CodecVP8:
+		return isVP8KeyFrame, nil
+	case CodecVP9:
+		return isVP9KeyFrame, nil
+	default:
+		return nil, nil
+	}
+}
+
+func newNALKeyFrameDetector(lengthSize uint64, isKeyNAL func(header byte) bool) keyFrameDetector {
+	return func(s *sampleDataReader) (bool, error) {
+		for nalOffset := uint64(0); nalOffset+lengthSize+1 <= s.size; {
+			data, err := s.readAt(nalOffset, int(lengthSize)+1)
+			if err != nil {
+				return false, err
+			}
+			var length uint64
+			for i := 0; i < int(lengthSize); i++ {
+				length = (length << 8) + uint64(data[i])
+			}
+			if isKeyNAL(data[lengthSize]) {
+				return true, nil
+			}
+			nalOffset += lengthSize + length
+		}
+		return false, nil
+	}
+}
+
+// OBU types defined at AV1 Bitstream & Decoding Process Specification 6.2.2
+const (
+	av1OBUSequenceHeader       = 1
+	av1OBUTemporalDelimiter    = 2
+	av1OBUFrameHeader          = 3
+	av1OBUTileGroup            = 4
+	av1OBUFrame                = 6
+	av1OBURedundantFrameHeader = 7
+)
+
+type av1KeyFrameDetector struct {
+	reducedStillPictureHeader bool
+}
+
+// isKeyFrame reports whether the first frame of the temporal unit is a shown key frame.
+// Sequence header OBUs update reduced_still_picture_header used for the following frames.
+func (d *av1KeyFrameDetector) isKeyFrame(s *sampleDataReader) (bool, error) {
+	for pos := uint64(0); pos < s.size; {
+		// obu_header() and leb128() size field
+		header, err := s.readAt(pos, 10)
+		if err != nil {
+			return false, err
+		}
+		obuType := (header[0] >> 3) & 0xf
+		headerSize := uint64(1)
+		if header[0]&0x04 != 0 {
+			headerSize++
+		}
+		if uint64(len(header)) < headerSize {
+			return false, io.ErrUnexpectedEOF
+		}
+		var payloadSize uint64
+		if header[0]&0x02 != 0 {
+			size, n, err := readLEB128(header[headerSize:])
+			if err != nil {
+				return false, err
+			}
+			payloadSize = size
+			headerSize += uint64(n)
+		} else {
+			if headerSize > s.size-pos {
+				return false, io.ErrUnexpectedEOF
+			}
+			payloadSize = s.size - pos - headerSize
+		}
+
+		switch obuType {
+		case av1OBUSequenceHeader:
+			payload, err := s.readAt(pos+headerSize, 1)
+			if err != nil {
+				return false, err
+			}
+			// seq_profile (3bits), still_picture (1bit), reduced_still_picture_header (1bit)
+			d.reducedStillPictureHeader = payload[0]&0x08 != 0
+		case av1OBUFrameHeader, av1OBUFrame:
+			if d.reducedStillPictureHeader {
+				return true, nil
+			}
+			payload, err := s.readAt(pos+headerSize, 1)
+			if err != nil {
+				return false, err
+			}
+			// show_existing_frame (1bit), frame_type (2bits), show_frame (1bit)
+			showExistingFrame := payload[0]&0x80 != 0
+			frameType := (payload[0] >> 5) & 0x03
+			showFrame := payload[0]&0x10 != 0
+			return !showExistingFrame && frameType == 0 && showFrame, nil
+		}
+		pos += headerSize + payloadSize
+	}
+	return false, nil
+}
+
+func readLEB128(data []byte) (uint64, int, error) {
+	var value uint64
+	for i := 0; i < 8 && i < len(data); i++ {
+		value |= uint64(data[i]&0x7f) << (uint(i) * 7)
+		if data[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("invalid leb128")
+}
+
+// isVP8KeyFrame checks the frame tag defined at RFC 6386 9.1
+func isVP8KeyFrame(s *sampleDataReader) (bool, error) {
+	data, err := s.readAt(0, 1)
+	if err != nil {
+		return false, err
+	}
+	return data[0]&0x01 == 0, nil
+}
+
+// isVP9KeyFrame checks the uncompressed header defined at VP9 Bitstream Specification 6.2
+func isVP9KeyFrame(s *sampleDataReader) (bool, error) {
+	data, err := s.readAt(0, 1)
+	if err != nil {
+		return false, err
+	}
+	if data[0]>>6 != 0x2 {
+		return false, errors.New("invalid VP9 frame marker")
+	}
+	profile := (data[0]>>5)&0x1 | (data[0]>>3)&0x2
+	pos := uint(4)
+	if profile == 3 {
+		// reserved_zero
+		pos++
+	}
+	showExistingFrame := (data[0]>>(7-pos))&0x1 != 0
+	frameType := (data[0] >> (6 - pos)) & 0x1
+	return !showExistingFrame && frameType == 0, nil
+}
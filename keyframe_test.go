@@ -0,0 +1,129 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindKeyFrames(t *testing.T) {
+	testCases := []struct {
+		name               string
+		track              *Track
+		samples            [][]byte
+		expectedIdxs       []int
+		expectedMismatches []KeyFrameMismatch
+	}{
+		{
+			name: "HEVC",
+			track: &Track{
+				Codec:       CodecHEVC,
+				HEVC:        &HEVCDecConfigInfo{LengthSize: 4},
+				SyncSamples: []uint32{1, 3},
+			},
+			samples: [][]byte{
+				// AUD (35), IDR_W_RADL (19)
+				{0x00, 0x00, 0x00, 0x03, 0x46, 0x01, 0x50, 0x00, 0x00, 0x00, 0x02, 0x26, 0x01},
+				// TRAIL_R (1)
+				{0x00, 0x00, 0x00, 0x02, 0x02, 0x01},
+				// TRAIL_R (1)
+				{0x00, 0x00, 0x00, 0x02, 0x02, 0x01},
+				// CRA_NUT (21)
+				{0x00, 0x00, 0x00, 0x02, 0x2a, 0x01},
+			},
+			expectedIdxs: []int{0, 3},
+			expectedMismatches: []KeyFrameMismatch{
+				{SampleIndex: 2, IsKeyFrame: false, IsSyncSample: true},
+				{SampleIndex: 3, IsKeyFrame: true, IsSyncSample: false},
+			},
+		},
+		{
+			name: "AV1",
+			track: &Track{
+				Codec: CodecAV1,
+				AV1:   &AV1ConfigInfo{},
+			},
+			samples: [][]byte{
+				// temporal delimiter, sequence header, frame (KEY_FRAME, show_frame=1)
+				{0x12, 0x00, 0x0a, 0x02, 0x00, 0x00, 0x32, 0x02, 0x10, 0x00},
+				// temporal delimiter, frame (INTER_FRAME, show_frame=1)
+				{0x12, 0x00, 0x32, 0x02, 0x30, 0x00},
+				// temporal delimiter, frame header (show_existing_frame=1)
+				{0x12, 0x00, 0x1a, 0x01, 0x80},
+				// frame (KEY_FRAME, show_frame=0) without obu_size
+				{0x30, 0x00, 0x00},
+			},
+			expectedIdxs: []int{0},
+		},
+		{
+			name: "VP9",
+			track: &Track{
+				Codec:       CodecVP9,
+				SyncSamples: []uint32{1},
+			},
+			samples: [][]byte{
+				// frame_marker=2, profile=0, show_existing_frame=0, frame_type=KEY_FRAME
+				{0x80, 0x00},
+				// frame_marker=2, profile=0, show_existing_frame=0, frame_type=NON_KEY_FRAME
+				{0x84, 0x00},
+				// frame_marker=2, profile=3, reserved_zero, show_existing_frame=0, frame_type=KEY_FRAME
+				{0xb0, 0x00},
+			},
+			expectedIdxs: []int{0, 2},
+			expectedMismatches: []KeyFrameMismatch{
+				{SampleIndex: 2, IsKeyFrame: true, IsSyncSample: false},
+			},
+		},
+		{
+			name: "VP8",
+			track: &Track{
+				Codec: CodecVP8,
+			},
+			samples: [][]byte{
+				{0x50, 0x42, 0x00},
+				{0x51, 0x42, 0x00},
+			},
+			expectedIdxs: []int{0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data []byte
+			for _, sample := range tc.samples {
+				tc.track.Chunks = append(tc.track.Chunks, &Chunk{
+					DataOffset:      uint64(len(data)),
+					SamplesPerChunk: 1,
+				})
+				tc.track.Samples = append(tc.track.Samples, &Sample{Size: uint32(len(sample))})
+				data = append(data, sample...)
+			}
+			idxs, mismatches, err := FindKeyFrames(bytes.NewReader(data), tc.track)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedIdxs, idxs)
+			assert.Equal(t, tc.expectedMismatches, mismatches)
+
+			idxs, err = FindIDRFrames(bytes.NewReader(data), tc.track)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedIdxs, idxs)
+		})
+	}
+}
+
+func TestFindKeyFramesWithStss(t *testing.T) {
+	f, err := os.Open("./testdata/sample.mp4")
+	require.NoError(t, err)
+	defer f.Close()
+
+	info, err := Probe(f)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1}, info.Tracks[0].SyncSamples)
+	assert.Nil(t, info.Tracks[1].SyncSamples)
+
+	idxs, mismatches, err := FindKeyFrames(f, info.Tracks[0])
+	require.NoError(t, err)
+	assert.Equal(t, []int{0}, idxs)
+	assert.Empty(t, mismatches)
+}
@@ -0,0 +1,791 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const muxerMovieTimescale = 1000
+
+// MuxerOptions is options for Muxer.
+type MuxerOptions struct {
+	// Fragmented makes Muxer write a fragmented MP4 file, which does not require a seekable output.
+	Fragmented bool
+
+	// FragmentDuration is the target duration of fragments in seconds.
+	// Fragments are cut at sync samples of the reference track, which is the first video track or the first track.
+	// Default value is 2 seconds.
+	FragmentDuration float64
+
+	// FastStart places the moov box before the mdat box of a progressive file.
+	// Close moves the media data to make room for the moov box, so the output must implement io.ReadWriteSeeker.
+	FastStart bool
+}
+
+// MuxerTrack declares a track of Muxer. Exactly one of the codec configurations must be set.
+type MuxerTrack struct {
+	// Timescale is the media timescale.
+	// Default value is 90000 for video tracks, the sample rate for audio tracks and 1000 for text tracks.
+	Timescale uint32
+
+	// Language is the ISO-639-2/T language code, such as "eng". Default value is "und".
+	Language string
+
+	// Width and Height are the size of video frames.
+	Width  uint16
+	Height uint16
+
+	// ChannelCount and SampleRate are the parameters of audio tracks.
+	// They are taken from AAC or Opus when they are zero. SampleRate must not exceed 65535 Hz.
+	ChannelCount uint16
+	SampleRate   uint32
+
+	AVC  *AVCDecoderConfiguration
+	HEVC *HvcC
+	AV1  *Av1C
+	VP9  *VpcC
+	// AAC is the AudioSpecificConfig of the track.
+	AAC  []byte
+	Opus *DOps
+	// PCM declares an ipcm track, or an fpcm track when FloatPCM is true.
+	// ChannelCount and SampleRate must be set for PCM tracks.
+	PCM      *PcmC
+	FloatPCM bool
+	// WebVTT declares a wvtt track, whose samples are the cue boxes defined at ISO/IEC 14496-30.
+	WebVTT *WebVTTConfigurationBox
+	// XMLSubtitle declares an stpp track, whose samples are XML documents such as TTML and IMSC1.
+	XMLSubtitle *XMLSubtitleSampleEntry
+}
+
+// MuxerSample is an encoded frame.
+type MuxerSample struct {
+	// DecodeTime and PresentationTime are DTS and PTS in the media timescale.
+	DecodeTime       uint64
+	PresentationTime uint64
+
+	// Duration is the duration in the media timescale. When it is 0, the duration is the difference
+	// from DTS of the next sample of the track, and the last sample has the same duration as the previous one.
+	Duration uint32
+
+	IsSync bool
+	Data   []byte
+
+	// SubsampleSizes are the sizes of the subsamples which Data consists of, which are described by subs box.
+	// Their sum must be equal to the size of Data.
+	SubsampleSizes []uint32
+}
+
+// Muxer builds an MP4 file from encoded frames.
+// Tracks must be added by AddTrack before the first sample is written,
+// and samples of each track must be written in decoding order.
+// Samples of different tracks are stored in the order in which they are written,
+// so the caller should interleave them by their times.
+type Muxer struct {
+	w      io.Writer
+	opts   MuxerOptions
+	tracks []*muxerTrack
+	ref    *muxerTrack
+
+	started bool
+	closed  bool
+
+	// progressive
+	writer    *Writer
+	dataStart int64 // offset of the mdat box
+	last      *muxerTrack
+
+	// fragmented
+	ow            *offsetWriter
+	seq           uint32
+	fragmentStart uint64 // decode time of the first sample of the reference track in the current fragment
+}
+
+type muxerTrack struct {
+	MuxerTrack
+	trackID     uint32
+	handlerType [4]byte
+	sampleEntry *BoxNode
+
+	started      bool
+	firstDTS     uint64
+	lastDTS      uint64
+	pending      *muxerSample // sample whose duration is determined by the next sample
+	lastDuration uint32
+
+	// progressive
+	builder      *SampleTableBuilder
+	chunkOffsets []uint64
+	duration     uint64
+
+	// fragmented
+	samples []*muxerSample
+
+	// subsample sizes of each sample of the sample table
+	subsamples [][]uint32
+}
+
+type muxerSample struct {
+	MediaSample
+	chunk      uint32
+	data       []byte
+	subsamples []uint32
+}
+
+// NewMuxer returns a new Muxer. opts can be nil.
+// w must implement io.WriteSeeker unless opts.Fragmented is true.
+func NewMuxer(w io.Writer, opts *MuxerOptions) (*Muxer, error) {
+	m := &Muxer{w: w}
+	if opts != nil {
+		m.opts = *opts
+	}
+	if m.opts.FragmentDuration <= 0 {
+		m.opts.FragmentDuration = 2
+	}
+	if m.opts.Fragmented {
+		m.ow = &offsetWriter{writer: w}
+		return m, nil
+	}
+	ws, ok := w.(io.WriteSeeker)
+	if !ok {
+		return nil, errors.New("progressive output must implement io.WriteSeeker")
+	}
+	if _, ok := w.(io.ReadWriteSeeker); m.opts.FastStart && !ok {
+		return nil, errors.New("fast start output must implement io.ReadWriteSeeker")
+	}
+	m.writer = NewWriterWithOptions(ws, WriterOptions{LargeSize: LargeSizeReserve})
+	return m, nil
+}
+
+// AddTrack adds a track and returns its track ID.
+func (m *Muxer) AddTrack(track MuxerTrack) (uint32, error) {
+	if m.started {
+		return 0, errors.New("track can not be added after writing samples")
+	}
+	t := &muxerTrack{
+		MuxerTrack: track,
+		trackID:    uint32(len(m.tracks) + 1),
+		builder:    NewSampleTableBuilder(),
+	}
+	if t.Language == "" {
+		t.Language = "und"
+	}
+	if len(t.Language) != 3 {
+		return 0, fmt.Errorf("invalid language: %s", t.Language)
+	}
+	if err := t.buildSampleEntry(); err != nil {
+		return 0, err
+	}
+	if t.Timescale == 0 {
+		if t.handlerType == [4]byte{'v', 'i', 'd', 'e'} {
+			t.Timescale = 90000
+		} else if t.handlerType == [4]byte{'t', 'e', 'x', 't'} || t.handlerType == [4]byte{'s', 'u', 'b', 't'} {
+			t.Timescale = 1000
+		} else {
+			t.Timescale = t.SampleRate
+		}
+	}
+	if t.Timescale == 0 {
+		return 0, errors.New("timescale is unknown")
+	}
+	m.tracks = append(m.tracks, t)
+	if m.ref == nil || m.ref.handlerType != [4]byte{'v', 'i', 'd', 'e'} && t.handlerType == [4]byte{'v', 'i', 'd', 'e'} {
+		m.ref = t
+	}
+	return t.trackID, nil
+}
+
+// buildSampleEntry builds the sample entry from the codec configuration.
+func (t *muxerTrack) buildSampleEntry() error {
+	var configs int
+	for _, set := range []bool{t.AVC != nil, t.HEVC != nil, t.AV1 != nil, t.VP9 != nil, t.AAC != nil, t.Opus != nil, t.PCM != nil, t.WebVTT != nil, t.XMLSubtitle != nil} {
+		if set {
+			configs++
+		}
+	}
+	if configs != 1 {
+		return errors.New("exactly one codec configuration must be set")
+	}
+
+	switch {
+	case t.AVC != nil:
+		avcC := *t.AVC
+		avcC.SetType(BoxTypeAvcC())
+		t.sampleEntry = t.newVisualSampleEntry(BoxTypeAvc1(), NewBoxNode(&avcC))
+	case t.HEVC != nil:
+		t.sampleEntry = t.newVisualSampleEntry(BoxTypeHvc1(), NewBoxNode(t.HEVC))
+	case t.AV1 != nil:
+		t.sampleEntry = t.newVisualSampleEntry(BoxTypeAv01(), NewBoxNode(t.AV1))
+	case t.VP9 != nil:
+		t.sampleEntry = t.newVisualSampleEntry(BoxTypeVp09(), NewBoxNode(t.VP9))
+	case t.AAC != nil:
+		asc, err := ParseAudioSpecificConfig(t.AAC)
+		if err != nil {
+			return err
+		}
+		if t.ChannelCount == 0 {
+			t.ChannelCount = asc.ChannelCount()
+		}
+		if t.SampleRate == 0 {
+			t.SampleRate = asc.OutputSamplingFrequency()
+		}
+		t.sampleEntry = t.newAudioSampleEntry(BoxTypeMp4a(), NewBoxNode(newAACEsds(t.trackID, t.AAC)))
+	case t.Opus != nil:
+		if t.ChannelCount == 0 {
+			t.ChannelCount = uint16(t.Opus.OutputChannelCount)
+		}
+		if t.SampleRate == 0 {
+			t.SampleRate = 48000
+		}
+		t.sampleEntry = t.newAudioSampleEntry(BoxTypeOpus(), NewBoxNode(t.Opus))
+	case t.PCM != nil:
+		if t.ChannelCount == 0 || t.SampleRate == 0 {
+			return errors.New("channel count and sample rate of PCM track are unknown")
+		}
+		boxType := BoxTypeIpcm()
+		if t.FloatPCM {
+			boxType = BoxTypeFpcm()
+		}
+		t.sampleEntry = t.newAudioSampleEntry(boxType, NewBoxNode(t.PCM))
+		t.sampleEntry.Payload.(*AudioSampleEntry).SampleSize = uint16(t.PCM.PCMSampleSize)
+	case t.WebVTT != nil:
+		t.handlerType = [4]byte{'t', 'e', 'x', 't'}
+		t.sampleEntry = NewBoxNode(&WVTTSampleEntry{
+			SampleEntry: SampleEntry{AnyTypeBox: AnyTypeBox{Type: BoxTypeWvtt()}, DataReferenceIndex: 1},
+		}, NewBoxNode(t.WebVTT))
+	case t.XMLSubtitle != nil:
+		t.handlerType = [4]byte{'s', 'u', 'b', 't'}
+		entry := *t.XMLSubtitle
+		entry.SampleEntry = SampleEntry{AnyTypeBox: AnyTypeBox{Type: BoxTypeStpp()}, DataReferenceIndex: 1}
+		t.sampleEntry = NewBoxNode(&entry)
+	}
+	if t.SampleRate > math.MaxUint16 {
+		// the sample entry has the 16-bit integer part of the sample rate
+		return fmt.Errorf("sample rate which exceeds 65535 Hz is not supported: %d", t.SampleRate)
+	}
+	return nil
+}
+
+func (t *muxerTrack) newVisualSampleEntry(boxType BoxType, config *BoxNode) *BoxNode {
+	t.handlerType = [4]byte{'v', 'i', 'd', 'e'}
+	return NewBoxNode(&VisualSampleEntry{
+		SampleEntry:     SampleEntry{AnyTypeBox: AnyTypeBox{Type: boxType}, DataReferenceIndex: 1},
+		Width:           t.Width,
+		Height:          t.Height,
+		Horizresolution: 0x00480000, // 72 dpi
+		Vertresolution:  0x00480000, // 72 dpi
+		FrameCount:      1,
+		Depth:           0x0018,
+		PreDefined3:     -1,
+	}, config)
+}
+
+func (t *muxerTrack) newAudioSampleEntry(boxType BoxType, config *BoxNode) *BoxNode {
+	t.handlerType = [4]byte{'s', 'o', 'u', 'n'}
+	entry := &AudioSampleEntry{
+		SampleEntry:  SampleEntry{AnyTypeBox: AnyTypeBox{Type: boxType}, DataReferenceIndex: 1},
+		ChannelCount: t.ChannelCount,
+		SampleSize:   16,
+		SampleRate:   t.SampleRate << 16,
+	}
+	return NewBoxNode(entry, config)
+}
+
+// newAACEsds returns the esds box which has the AudioSpecificConfig.
+func newAACEsds(esID uint32, asc []byte) *Esds {
+	const descriptorHeaderSize = 5 // tag and 4 bytes size
+	decSpecificInfoSize := uint32(len(asc))
+	decoderConfigSize := 13 + descriptorHeaderSize + decSpecificInfoSize
+	esSize := 3 + descriptorHeaderSize + decoderConfigSize + descriptorHeaderSize + 1
+	return &Esds{
+		Descriptors: []Descriptor{
+			{
+				Tag:          ESDescrTag,
+				Size:         esSize,
+				ESDescriptor: &ESDescriptor{ESID: uint16(esID)},
+			},
+			{
+				Tag:  DecoderConfigDescrTag,
+				Size: decoderConfigSize,
+				DecoderConfigDescriptor: &DecoderConfigDescriptor{
+					ObjectTypeIndication: 0x40, // Audio ISO/IEC 14496-3
+					StreamType:           0x05, // AudioStream
+					Reserved:             true,
+				},
+			},
+			{
+				Tag:  DecSpecificInfoTag,
+				Size: decSpecificInfoSize,
+				Data: asc,
+			},
+			{
+				Tag:  SLConfigDescrTag,
+				Size: 1,
+				Data: []byte{0x02},
+			},
+		},
+	}
+}
+
+// WriteSample writes a sample of the track.
+func (m *Muxer) WriteSample(trackID uint32, sample *MuxerSample) error {
+	if m.closed {
+		return errors.New("muxer is closed")
+	}
+	if trackID == 0 || int(trackID) > len(m.tracks) {
+		return fmt.Errorf("unknown track ID: %d", trackID)
+	}
+	t := m.tracks[trackID-1]
+	if !m.started {
+		if err := m.start(); err != nil {
+			return err
+		}
+	}
+	if len(sample.Data) > math.MaxUint32 {
+		return errors.New("too large sample")
+	}
+	if len(sample.SubsampleSizes) != 0 {
+		var size uint64
+		for _, s := range sample.SubsampleSizes {
+			size += uint64(s)
+		}
+		if size != uint64(len(sample.Data)) || len(sample.SubsampleSizes) > math.MaxUint16 {
+			return errors.New("subsample sizes do not match the sample size")
+		}
+	}
+	cto := int64(sample.PresentationTime) - int64(sample.DecodeTime)
+	if cto < math.MinInt32 || cto > math.MaxInt32 {
+		return errors.New("composition time offset overflows 32 bits")
+	}
+
+	if t.started && sample.DecodeTime <= t.lastDTS {
+		return fmt.Errorf("decode time must increase: trackID=%d dts=%d", trackID, sample.DecodeTime)
+	}
+	if p := t.pending; p != nil {
+		if sample.DecodeTime-p.DecodeTime > math.MaxUint32 {
+			return fmt.Errorf("too long sample duration: trackID=%d dts=%d", trackID, p.DecodeTime)
+		}
+		p.Duration = uint32(sample.DecodeTime - p.DecodeTime)
+		t.pending = nil
+		if err := m.commit(t, p); err != nil {
+			return err
+		}
+	}
+	if !t.started {
+		t.started = true
+		t.firstDTS = sample.DecodeTime
+		if t == m.ref {
+			m.fragmentStart = sample.DecodeTime
+		}
+	}
+	t.lastDTS = sample.DecodeTime
+
+	if m.opts.Fragmented && t == m.ref && sample.IsSync &&
+		sample.DecodeTime-m.fragmentStart >= uint64(m.opts.FragmentDuration*float64(t.Timescale)) {
+		if err := m.flushFragment(); err != nil {
+			return err
+		}
+		m.fragmentStart = sample.DecodeTime
+	}
+
+	s := &muxerSample{MediaSample: MediaSample{
+		TrackID:                trackID,
+		DecodeTime:             sample.DecodeTime,
+		CompositionTimeOffset:  cto,
+		Duration:               sample.Duration,
+		Size:                   uint32(len(sample.Data)),
+		IsSync:                 sample.IsSync,
+		SampleDescriptionIndex: 1,
+	}, subsamples: sample.SubsampleSizes}
+	if m.opts.Fragmented {
+		s.data = sample.Data
+	} else {
+		offset, err := m.writer.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if m.last != t {
+			t.chunkOffsets = append(t.chunkOffsets, uint64(offset))
+			m.last = t
+		}
+		s.chunk = uint32(len(t.chunkOffsets) - 1)
+		if _, err := m.writer.Write(sample.Data); err != nil {
+			return err
+		}
+	}
+	if s.Duration == 0 {
+		t.pending = s
+		return nil
+	}
+	return m.commit(t, s)
+}
+
+// commit adds the sample whose duration is determined.
+func (m *Muxer) commit(t *muxerTrack, s *muxerSample) error {
+	t.lastDuration = s.Duration
+	if m.opts.Fragmented {
+		t.samples = append(t.samples, s)
+		return nil
+	}
+	t.duration += uint64(s.Duration)
+	t.subsamples = append(t.subsamples, s.subsamples)
+	return t.builder.AddSample(SampleTableEntry{
+		Duration:               s.Duration,
+		CompositionTimeOffset:  s.CompositionTimeOffset,
+		Size:                   s.Size,
+		IsSync:                 s.IsSync,
+		Chunk:                  s.chunk,
+		SampleDescriptionIndex: s.SampleDescriptionIndex,
+	})
+}
+
+// start writes the boxes which precede the media data.
+func (m *Muxer) start() error {
+	m.started = true
+	ftyp := NewBoxNode(m.buildFtyp())
+	if m.opts.Fragmented {
+		if err := m.ow.writeNode(ftyp); err != nil {
+			return err
+		}
+		return m.ow.writeNode(m.buildMoov())
+	}
+	if err := ftyp.Write(m.writer); err != nil {
+		return err
+	}
+	var err error
+	if m.dataStart, err = m.writer.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	_, err = m.writer.StartBox(&BoxInfo{Type: BoxTypeMdat()})
+	return err
+}
+
+// buildFtyp builds the ftyp box. Brands of codecs are not added because they are not defined for all codecs.
+func (m *Muxer) buildFtyp() *Ftyp {
+	ftyp := &Ftyp{
+		MajorBrand:   BrandISOM(),
+		MinorVersion: 0x200,
+		CompatibleBrands: []CompatibleBrandElem{
+			{CompatibleBrand: BrandISOM()},
+			{CompatibleBrand: BrandISO2()},
+		},
+	}
+	if m.opts.Fragmented {
+		ftyp.AddCompatibleBrand(BrandISO6())
+	}
+	ftyp.AddCompatibleBrand(BrandMP41())
+	return ftyp
+}
+
+// buildMoov builds the moov box without sample tables.
+func (m *Muxer) buildMoov() *BoxNode {
+	matrix := [9]int32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+	moov := NewBoxNode(&Moov{}, NewBoxNode(&Mvhd{
+		Timescale:   muxerMovieTimescale,
+		Rate:        0x00010000,
+		Volume:      0x0100,
+		Matrix:      matrix,
+		NextTrackID: uint32(len(m.tracks) + 1),
+	}))
+	mvex := NewBoxNode(&Mvex{})
+	for _, t := range m.tracks {
+		tkhd := &Tkhd{
+			TrackID: t.trackID,
+			Matrix:  matrix,
+			Width:   uint32(t.Width) << 16,
+			Height:  uint32(t.Height) << 16,
+		}
+		tkhd.AddFlag(0x000003) // track_enabled and track_in_movie
+		mdhd := &Mdhd{Timescale: t.Timescale}
+		for i := range mdhd.Language {
+			mdhd.Language[i] = t.Language[i] - 0x60
+		}
+		hdlr := &Hdlr{HandlerType: t.handlerType}
+		var mhd *BoxNode
+		switch t.handlerType {
+		case [4]byte{'v', 'i', 'd', 'e'}:
+			hdlr.Name = "VideoHandler"
+			vmhd := &Vmhd{}
+			vmhd.AddFlag(0x000001)
+			mhd = NewBoxNode(vmhd)
+		case [4]byte{'t', 'e', 'x', 't'}:
+			hdlr.Name = "TextHandler"
+			mhd = NewBoxNode(&Nmhd{})
+		case [4]byte{'s', 'u', 'b', 't'}:
+			hdlr.Name = "SubtitleHandler"
+			mhd = NewBoxNode(&Sthd{})
+		default:
+			hdlr.Name = "SoundHandler"
+			tkhd.Volume = 0x0100
+			mhd = NewBoxNode(&Smhd{})
+		}
+		url := &Url{}
+		url.AddFlag(0x000001) // self-contained
+		stbl := NewBoxNode(&Stbl{}, NewBoxNode(&Stsd{EntryCount: 1}, t.sampleEntry))
+		if m.opts.Fragmented {
+			stbl.AppendChild(NewBoxNode(&Stts{}))
+			stbl.AppendChild(NewBoxNode(&Stsc{}))
+			stbl.AppendChild(NewBoxNode(&Stsz{}))
+			stbl.AppendChild(NewBoxNode(&Stco{}))
+			mvex.AppendChild(NewBoxNode(&Trex{TrackID: t.trackID, DefaultSampleDescriptionIndex: 1}))
+		}
+		moov.AppendChild(NewBoxNode(&Trak{},
+			NewBoxNode(tkhd),
+			NewBoxNode(&Mdia{},
+				NewBoxNode(mdhd),
+				NewBoxNode(hdlr),
+				NewBoxNode(&Minf{},
+					mhd,
+					NewBoxNode(&Dinf{}, NewBoxNode(&Dref{EntryCount: 1}, NewBoxNode(url))),
+					stbl,
+				),
+			),
+		))
+	}
+	if m.opts.Fragmented {
+		moov.AppendChild(mvex)
+	}
+	return moov
+}
+
+// flushFragment writes the moof box and the mdat box of the buffered samples.
+func (m *Muxer) flushFragment() error {
+	samples := make(fragmentSamples, len(m.tracks))
+	trackIDs := make([]uint32, len(m.tracks))
+	subs := make([]*Subs, len(m.tracks))
+	var exists bool
+	for i, t := range m.tracks {
+		trackIDs[i] = t.trackID
+		subsamples := make([][]uint32, len(t.samples))
+		for j, s := range t.samples {
+			samples[i] = append(samples[i], &s.MediaSample)
+			subsamples[j] = s.subsamples
+		}
+		subs[i] = newSubs(subsamples)
+		exists = exists || len(t.samples) != 0
+	}
+	if !exists {
+		return nil
+	}
+	m.seq++
+	moof, mdatSize, err := newMoof(m.seq, trackIDs, samples, subs, nil)
+	if err != nil {
+		return err
+	}
+	if err := moof.writeTo(m.ow); err != nil {
+		return err
+	}
+	mdat := &BoxInfo{Type: BoxTypeMdat(), Size: mdatSize, HeaderSize: SmallHeaderSize}
+	if mdatSize > math.MaxUint32 {
+		mdat.HeaderSize = LargeHeaderSize
+	}
+	if _, err := WriteBoxInfo(m.ow, mdat); err != nil {
+		return err
+	}
+	for _, t := range m.tracks {
+		for _, s := range t.samples {
+			if _, err := m.ow.Write(s.data); err != nil {
+				return err
+			}
+		}
+		t.samples = nil
+	}
+	return nil
+}
+
+// Flush writes the buffered samples as a fragment, so that the next sample starts a new fragment.
+// It does nothing for progressive output. A sample whose duration is not determined yet remains buffered.
+func (m *Muxer) Flush() error {
+	if m.closed {
+		return errors.New("muxer is closed")
+	}
+	if !m.opts.Fragmented || !m.started {
+		return nil
+	}
+	return m.flushFragment()
+}
+
+// newSubs returns the subs box which describes the subsample sizes of the samples,
+// or nil when no sample has subsamples.
+func newSubs(subsamples [][]uint32) *Subs {
+	subs := &Subs{}
+	last := 0
+	for i, sizes := range subsamples {
+		if len(sizes) == 0 {
+			continue
+		}
+		entry := SubsEntry{
+			SampleDelta:    uint32(i + 1 - last),
+			SubsampleCount: uint16(len(sizes)),
+			Subsamples:     make([]SubsSubsample, len(sizes)),
+		}
+		for j, size := range sizes {
+			if size > math.MaxUint16 {
+				subs.SetVersion(1)
+			}
+			entry.Subsamples[j].SubsampleSizeV1 = size
+		}
+		subs.Entries = append(subs.Entries, entry)
+		last = i + 1
+	}
+	if len(subs.Entries) == 0 {
+		return nil
+	}
+	subs.EntryCount = uint32(len(subs.Entries))
+	if subs.GetVersion() == 0 {
+		for i := range subs.Entries {
+			for j := range subs.Entries[i].Subsamples {
+				ss := &subs.Entries[i].Subsamples[j]
+				ss.SubsampleSizeV0, ss.SubsampleSizeV1 = uint16(ss.SubsampleSizeV1), 0
+			}
+		}
+	}
+	return subs
+}
+
+// Close writes the remaining samples and the moov box. It does not close the underlying writer.
+func (m *Muxer) Close() error {
+	if m.closed {
+		return nil
+	}
+	if !m.started {
+		if err := m.start(); err != nil {
+			return err
+		}
+	}
+	m.closed = true
+	for _, t := range m.tracks {
+		if p := t.pending; p != nil {
+			p.Duration = t.lastDuration
+			t.pending = nil
+			if err := m.commit(t, p); err != nil {
+				return err
+			}
+		}
+	}
+	if m.opts.Fragmented {
+		return m.flushFragment()
+	}
+
+	if _, err := m.writer.EndBox(); err != nil {
+		return err
+	}
+	end, err := m.writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	moov := m.buildMoov()
+	start := math.Inf(1)
+	for _, t := range m.tracks {
+		if t.builder.SampleCount() != 0 {
+			start = math.Min(start, t.startTime())
+		}
+	}
+	durations := make(map[*BoxNode]uint64, len(m.tracks))
+	for i, trak := range moov.Find(BoxPath{BoxTypeTrak()}) {
+		t := m.tracks[i]
+		durations[trak] = t.duration
+		if err := t.setEditList(trak, start); err != nil {
+			return err
+		}
+	}
+	updateDurations(moov, durations)
+	if !m.opts.FastStart {
+		if err := m.buildSampleTables(moov, 0); err != nil {
+			return err
+		}
+		return moov.Write(m.writer)
+	}
+
+	// move the media data to make room for the moov box
+	var shift uint64
+	for {
+		if err := m.buildSampleTables(moov, shift); err != nil {
+			return err
+		}
+		size, err := moov.layout(uint64(m.dataStart))
+		if err != nil {
+			return err
+		}
+		if size-uint64(m.dataStart) == shift {
+			break
+		}
+		shift = size - uint64(m.dataStart)
+	}
+	rw := m.w.(io.ReadWriteSeeker)
+	if err := shiftData(rw, m.dataStart, end, int64(shift)); err != nil {
+		return err
+	}
+	if _, err := rw.Seek(m.dataStart, io.SeekStart); err != nil {
+		return err
+	}
+	if err := moov.writeTo(&offsetWriter{writer: rw, offset: m.dataStart}); err != nil {
+		return err
+	}
+	_, err = rw.Seek(end+int64(shift), io.SeekStart)
+	return err
+}
+
+// buildSampleTables replaces the sample tables of the moov box with ones whose chunk offsets are shifted.
+func (m *Muxer) buildSampleTables(moov *BoxNode, shift uint64) error {
+	for i, stbl := range moov.Find(BoxPath{BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()}) {
+		t := m.tracks[i]
+		offsets := make([]uint64, len(t.chunkOffsets))
+		for j, offset := range t.chunkOffsets {
+			offsets[j] = offset + shift
+		}
+		st, err := t.builder.Build(offsets)
+		if err != nil {
+			return err
+		}
+		stbl.Children = stbl.Children[:1] // stsd
+		for _, box := range st.Boxes() {
+			stbl.AppendChild(NewBoxNode(box))
+		}
+		if subs := newSubs(t.subsamples); subs != nil {
+			stbl.AppendChild(NewBoxNode(subs))
+		}
+	}
+	return nil
+}
+
+// setEditList adds an edit list which maps the presentation times of the samples to the movie timeline,
+// which starts at start seconds, the earliest presentation time of all tracks.
+// An empty edit is used when the track starts later, and the media time skips the composition delay.
+func (t *muxerTrack) setEditList(trak *BoxNode, start float64) error {
+	if t.builder.SampleCount() == 0 {
+		return nil
+	}
+	var entries []ElstEntry
+	if delay := t.startTime() - start; delay > 0 {
+		entries = append(entries, ElstEntry{
+			SegmentDurationV1: uint64(math.Round(delay * muxerMovieTimescale)),
+			MediaTimeV1:       -1,
+			MediaRateInteger:  1,
+		})
+	}
+	mediaTime := t.builder.minCT
+	if mediaTime < 0 {
+		// samples which are presented before the first decode time are not presented
+		mediaTime = 0
+	}
+	if (len(entries) == 0 && mediaTime == 0) || t.builder.maxCT <= mediaTime {
+		return nil
+	}
+	entries = append(entries, ElstEntry{
+		SegmentDurationV1: rescaleTime(uint64(t.builder.maxCT-mediaTime), muxerMovieTimescale, t.Timescale),
+		MediaTimeV1:       mediaTime,
+		MediaRateInteger:  1,
+	})
+	return setEditList(trak, newElst(entries))
+}
+
+// startTime returns the earliest presentation time of the track in seconds.
+func (t *muxerTrack) startTime() float64 {
+	pts := int64(t.firstDTS) + t.builder.minCT
+	if pts < 0 {
+		pts = 0
+	}
+	return float64(pts) / float64(t.Timescale)
+}
@@ -0,0 +1,221 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+)
+
+type muxTestTrack struct {
+	config  MuxerTrack
+	samples []*MediaSample
+	data    [][]byte
+}
+
+// readMuxTestTracks reads the codec configurations and the samples of sample.mp4.
+func readMuxTestTracks(t *testing.T) []*muxTestTrack {
+	input := readFile(t, "./testdata/sample.mp4")
+	tree, err := ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	avc1 := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAvc1()})
+	require.NotNil(t, avc1)
+	esds := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeMp4a(), BoxTypeEsds()})
+	require.NotNil(t, esds)
+	var asc []byte
+	for _, d := range esds.Payload.(*Esds).Descriptors {
+		if d.Tag == DecSpecificInfoTag {
+			asc = d.Data
+		}
+	}
+
+	tracks := []*muxTestTrack{
+		{config: MuxerTrack{
+			Timescale: 10240,
+			Language:  "eng",
+			Width:     avc1.Payload.(*VisualSampleEntry).Width,
+			Height:    avc1.Payload.(*VisualSampleEntry).Height,
+			AVC:       avc1.FindFirst(BoxPath{BoxTypeAvcC()}).Payload.(*AVCDecoderConfiguration),
+		}},
+		{config: MuxerTrack{AAC: asc}},
+	}
+	for i, track := range tracks {
+		it, err := NewSampleIterator(bytes.NewReader(input), uint32(i+1))
+		require.NoError(t, err)
+		track.samples = readAllSamples(t, it)
+		track.data = readTrackSampleData(t, bytes.NewReader(input), uint32(i+1))
+	}
+	return tracks
+}
+
+// muxTestTracks writes the samples of the tracks in the order of their decode times.
+// The durations of video samples are omitted.
+func muxTestTracks(t *testing.T, w io.Writer, opts *MuxerOptions, tracks []*muxTestTrack) {
+	m, err := NewMuxer(w, opts)
+	require.NoError(t, err)
+	type entry struct {
+		trackID uint32
+		time    float64
+		sample  *MuxerSample
+	}
+	var entries []entry
+	for i, track := range tracks {
+		trackID, err := m.AddTrack(track.config)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(i+1), trackID)
+		timescale := float64(10240)
+		if track.config.AAC != nil {
+			timescale = 44100
+		}
+		for j, s := range track.samples {
+			sample := &MuxerSample{
+				DecodeTime:       s.DecodeTime,
+				PresentationTime: uint64(s.CompositionTime()),
+				IsSync:           s.IsSync,
+				Data:             track.data[j],
+			}
+			if track.config.AVC == nil {
+				sample.Duration = s.Duration
+			}
+			entries = append(entries, entry{trackID: trackID, time: float64(s.DecodeTime) / timescale, sample: sample})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time < entries[j].time
+	})
+	for _, e := range entries {
+		require.NoError(t, m.WriteSample(e.trackID, e.sample))
+	}
+	require.NoError(t, m.Close())
+	assert.Error(t, m.WriteSample(1, &MuxerSample{}))
+}
+
+func assertMuxedSamples(t *testing.T, r io.ReadSeeker, tracks []*muxTestTrack) {
+	for i, track := range tracks {
+		it, err := NewSampleIterator(r, uint32(i+1))
+		require.NoError(t, err)
+		samples := readAllSamples(t, it)
+		require.Len(t, samples, len(track.samples))
+		for j, s := range samples {
+			assert.Equal(t, track.samples[j].DecodeTime, s.DecodeTime, "track %d sample %d", i+1, j)
+			assert.Equal(t, track.samples[j].CompositionTimeOffset, s.CompositionTimeOffset, "track %d sample %d", i+1, j)
+			assert.Equal(t, track.samples[j].Duration, s.Duration, "track %d sample %d", i+1, j)
+			assert.Equal(t, track.samples[j].IsSync, s.IsSync, "track %d sample %d", i+1, j)
+		}
+		assert.Equal(t, track.data, readTrackSampleData(t, r, uint32(i+1)))
+	}
+}
+
+func TestMuxer(t *testing.T) {
+	tracks := readMuxTestTracks(t)
+	for _, fastStart := range []bool{false, true} {
+		output, err := memfs.New().Create("output.mp4")
+		require.NoError(t, err)
+		defer output.Close()
+		muxTestTracks(t, output, &MuxerOptions{FastStart: fastStart}, tracks)
+		_, err = output.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		data, err := io.ReadAll(output)
+		require.NoError(t, err)
+		r := bytes.NewReader(data)
+		assertMuxedSamples(t, r, tracks)
+
+		info, err := Probe(r)
+		require.NoError(t, err)
+		assert.Equal(t, [4]byte{'i', 's', 'o', 'm'}, info.MajorBrand)
+		assert.Equal(t, fastStart, info.FastStart)
+		require.Len(t, info.Tracks, 2)
+		assert.Equal(t, CodecAVC1, info.Tracks[0].Codec)
+		assert.Equal(t, uint32(10240), info.Tracks[0].Timescale)
+		// the video track is presented after the audio track by the composition delay
+		assert.Equal(t, EditList{
+			{MediaTime: -1, SegmentDuration: 200, MediaRate: 1},
+			{MediaTime: 2048, SegmentDuration: 1000, MediaRate: 1},
+		}, info.Tracks[0].EditList)
+		assert.Equal(t, CodecMP4A, info.Tracks[1].Codec)
+		assert.Equal(t, uint32(44100), info.Tracks[1].Timescale)
+		assert.Equal(t, uint64(45124), info.Tracks[1].Duration)
+		assert.Empty(t, info.Tracks[1].EditList)
+		assert.EqualValues(t, 1200, info.Duration)
+
+		tree, err := ReadBoxTree(r)
+		require.NoError(t, err)
+		assert.Len(t, tree.Find(BoxPath{BoxTypeMdat()}), 1)
+		langs := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMdhd()})
+		require.Len(t, langs, 2)
+		assert.Equal(t, [3]byte{'e' - 0x60, 'n' - 0x60, 'g' - 0x60}, langs[0].Payload.(*Mdhd).Language)
+		assert.Equal(t, [3]byte{'u' - 0x60, 'n' - 0x60, 'd' - 0x60}, langs[1].Payload.(*Mdhd).Language)
+	}
+
+	// the composition delay of the only track is skipped
+	output, err := memfs.New().Create("output.mp4")
+	require.NoError(t, err)
+	defer output.Close()
+	muxTestTracks(t, output, nil, tracks[:1])
+	info, err := Probe(output)
+	require.NoError(t, err)
+	require.Len(t, info.Tracks, 1)
+	assert.Equal(t, EditList{{MediaTime: 2048, SegmentDuration: 1000, MediaRate: 1}}, info.Tracks[0].EditList)
+}
+
+func TestMuxerFragmented(t *testing.T) {
+	tracks := readMuxTestTracks(t)
+	output := bytes.NewBuffer(nil)
+	muxTestTracks(t, output, &MuxerOptions{Fragmented: true, FragmentDuration: 0.3}, tracks)
+	r := bytes.NewReader(output.Bytes())
+	assertMuxedSamples(t, r, tracks)
+
+	tree, err := ReadBoxTree(r)
+	require.NoError(t, err)
+	ftyp := tree.FindFirst(BoxPath{BoxTypeFtyp()}).Payload.(*Ftyp)
+	assert.Equal(t, []CompatibleBrandElem{
+		{CompatibleBrand: BrandISOM()},
+		{CompatibleBrand: BrandISO2()},
+		{CompatibleBrand: BrandISO6()},
+		{CompatibleBrand: BrandMP41()},
+	}, ftyp.CompatibleBrands)
+	assert.Len(t, tree.Find(BoxPath{BoxTypeMoov(), BoxTypeMvex(), BoxTypeTrex()}), 2)
+	assert.NotEmpty(t, tree.Find(BoxPath{BoxTypeMoof()}))
+
+	// fragments are cut at every sync sample of the audio track after the fragment duration
+	output = bytes.NewBuffer(nil)
+	muxTestTracks(t, output, &MuxerOptions{Fragmented: true, FragmentDuration: 0.3}, tracks[1:])
+	r = bytes.NewReader(output.Bytes())
+	assertMuxedSamples(t, r, tracks[1:])
+	tree, err = ReadBoxTree(r)
+	require.NoError(t, err)
+	moofs := tree.Find(BoxPath{BoxTypeMoof()})
+	require.Len(t, moofs, 4)
+	for i, moof := range moofs {
+		assert.Equal(t, uint32(i+1), moof.FindFirst(BoxPath{BoxTypeMfhd()}).Payload.(*Mfhd).SequenceNumber)
+	}
+}
+
+func TestMuxerErrors(t *testing.T) {
+	tracks := readMuxTestTracks(t)
+
+	_, err := NewMuxer(bytes.NewBuffer(nil), nil)
+	assert.Error(t, err, "progressive output must be seekable")
+
+	m, err := NewMuxer(bytes.NewBuffer(nil), &MuxerOptions{Fragmented: true})
+	require.NoError(t, err)
+	_, err = m.AddTrack(MuxerTrack{})
+	assert.Error(t, err, "no codec configuration")
+	_, err = m.AddTrack(MuxerTrack{AVC: tracks[0].config.AVC, Opus: &DOps{}})
+	assert.Error(t, err, "multiple codec configurations")
+	_, err = m.AddTrack(MuxerTrack{AVC: tracks[0].config.AVC, Language: "english"})
+	assert.Error(t, err)
+	_, err = m.AddTrack(MuxerTrack{Opus: &DOps{OutputChannelCount: 2}, SampleRate: 96000})
+	assert.Error(t, err, "sample rate exceeds 65535 Hz")
+	trackID, err := m.AddTrack(tracks[0].config)
+	require.NoError(t, err)
+	assert.Error(t, m.WriteSample(trackID+1, &MuxerSample{}))
+	require.NoError(t, m.WriteSample(trackID, &MuxerSample{DecodeTime: 1024, IsSync: true}))
+	assert.Error(t, m.WriteSample(trackID, &MuxerSample{DecodeTime: 1024}), "decode time must increase")
+	_, err = m.AddTrack(tracks[1].config)
+	assert.Error(t, err, "track can not be added after writing samples")
+}
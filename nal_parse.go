@@ -0,0 +1,1270 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+)
+
+// unescapeRBSP removes emulation_prevention_three_byte from the NAL unit.
+func unescapeRBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	var zeros int
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// readUE reads ue(v) defined at ISO/IEC 14496-10 9.1
+func (r *bitReader) readUE() (uint32, error) {
+	var leadingZeros uint
+	for {
+		bit, err := r.readFlag()
+		if err != nil {
+			return 0, err
+		}
+		if bit {
+			break
+		}
+		leadingZeros++
+		if leadingZeros > 31 {
+			return 0, errors.New("too long exp-Golomb code")
+		}
+	}
+	v, err := r.readUint32(leadingZeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<leadingZeros - 1) + v, nil
+}
+
+// readSE reads se(v) defined at ISO/IEC 14496-10 9.1.1
+func (r *bitReader) readSE() (int32, error) {
+	v, err := r.readUE()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int32(v/2 + 1), nil
+	}
+	return -int32(v / 2), nil
+}
+
+type avcSPS struct {
+	id                   uint32
+	profile              uint8
+	constraints          uint8
+	level                uint8
+	chromaFormat         uint8
+	separateColourPlane  bool
+	bitDepthLumaMinus8   uint8
+	bitDepthChromaMinus8 uint8
+	log2MaxFrameNum      uint
+	picOrderCntType      uint32
+	log2MaxPicOrderCnt   uint
+	// deltaPicOrderAlwaysZero is delta_pic_order_always_zero_flag of pic_order_cnt_type 1.
+	deltaPicOrderAlwaysZero bool
+	widthInMbs              uint32
+	heightInMapUnits        uint32
+	frameMbsOnly            bool
+	width                   uint16
+	height                  uint16
+}
+
+// chromaArrayType returns ChromaArrayType defined at ISO/IEC 14496-10 7.4.2.1.1
+func (sps *avcSPS) chromaArrayType() uint8 {
+	if sps.separateColourPlane {
+		return 0
+	}
+	return sps.chromaFormat
+}
+
+// parseAVCSPS parses seq_parameter_set_data defined at ISO/IEC 14496-10 7.3.2.1.1 until frame cropping.
+func parseAVCSPS(nalu []byte) (*avcSPS, error) {
+	rbsp := unescapeRBSP(nalu)
+	if len(rbsp) < 4 {
+		return nil, errors.New("too short SPS")
+	}
+	sps := &avcSPS{
+		profile:      rbsp[1],
+		constraints:  rbsp[2],
+		level:        rbsp[3],
+		chromaFormat: 1, // 4:2:0
+	}
+	r := newBitReader(rbsp[4:])
+	var err error
+	read := func(width uint) uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUint32(width)
+		}
+		return v
+	}
+	readUE := func() uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUE()
+		}
+		return v
+	}
+	readSE := func() {
+		if err == nil {
+			_, err = r.readSE()
+		}
+	}
+
+	sps.id = readUE()
+	switch sps.profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.chromaFormat = uint8(readUE())
+		if sps.chromaFormat == 3 {
+			sps.separateColourPlane = read(1) == 1
+		}
+		sps.bitDepthLumaMinus8 = uint8(readUE())
+		sps.bitDepthChromaMinus8 = uint8(readUE())
+		read(1)           // qpprime_y_zero_transform_bypass_flag
+		if read(1) == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if sps.chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists && err == nil; i++ {
+				if read(1) == 0 { // seq_scaling_list_present_flag
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				err = skipScalingList(r, size)
+			}
+		}
+	}
+	sps.log2MaxFrameNum = uint(readUE()) + 4
+	sps.picOrderCntType = readUE()
+	switch sps.picOrderCntType {
+	case 0:
+		sps.log2MaxPicOrderCnt = uint(readUE()) + 4
+	case 1:
+		sps.deltaPicOrderAlwaysZero = read(1) == 1
+		readSE() // offset_for_non_ref_pic
+		readSE() // offset_for_top_to_bottom_field
+		n := readUE()
+		for i := uint32(0); i < n && err == nil; i++ {
+			readSE() // offset_for_ref_frame
+		}
+	}
+	readUE() // max_num_ref_frames
+	read(1)  // gaps_in_frame_num_value_allowed_flag
+	sps.widthInMbs = readUE() + 1
+	sps.heightInMapUnits = readUE() + 1
+	sps.frameMbsOnly = read(1) == 1
+	if !sps.frameMbsOnly {
+		read(1) // mb_adaptive_frame_field_flag
+	}
+	read(1) // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if read(1) == 1 { // frame_cropping_flag
+		cropLeft, cropRight, cropTop, cropBottom = readUE(), readUE(), readUE(), readUE()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SPS: %w", err)
+	}
+
+	// ISO/IEC 14496-10 7.4.2.1.1 CropUnitX and CropUnitY
+	frameHeightFactor := uint32(2)
+	if sps.frameMbsOnly {
+		frameHeightFactor = 1
+	}
+	cropUnitX, cropUnitY := uint32(1), frameHeightFactor
+	if sps.chromaFormat != 0 && !sps.separateColourPlane {
+		if sps.chromaFormat != 3 {
+			cropUnitX = 2
+		}
+		if sps.chromaFormat == 1 {
+			cropUnitY *= 2
+		}
+	}
+	sps.width = uint16(sps.widthInMbs*16 - (cropLeft+cropRight)*cropUnitX)
+	sps.height = uint16(frameHeightFactor*sps.heightInMapUnits*16 - (cropTop+cropBottom)*cropUnitY)
+	return sps, nil
+}
+
+// skipScalingList skips scaling_list defined at ISO/IEC 14496-10 7.3.2.1.1.1
+func skipScalingList(r *bitReader, size int) error {
+	lastScale, nextScale := int32(8), int32(8)
+	for j := 0; j < size && nextScale != 0; j++ {
+		delta, err := r.readSE()
+		if err != nil {
+			return err
+		}
+		nextScale = (lastScale + delta + 256) % 256
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+	return nil
+}
+
+type avcPPS struct {
+	id                                uint32
+	spsID                             uint32
+	entropyCodingMode                 bool
+	bottomFieldPicOrderInFramePresent bool
+	numSliceGroupsMinus1              uint32
+	sliceGroupMapType                 uint32
+	sliceGroupChangeRateMinus1        uint32
+	numRefIdxL0DefaultActiveMinus1    uint32
+	numRefIdxL1DefaultActiveMinus1    uint32
+	weightedPred                      bool
+	weightedBipredIdc                 uint8
+	deblockingFilterControlPresent    bool
+	redundantPicCntPresent            bool
+}
+
+// parseAVCPPS parses pic_parameter_set_rbsp defined at ISO/IEC 14496-10 7.3.2.2 until redundant_pic_cnt_present_flag.
+func parseAVCPPS(nalu []byte) (*avcPPS, error) {
+	r := newBitReader(unescapeRBSP(nalu[1:]))
+	pps := &avcPPS{}
+	var err error
+	read := func(width uint) uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUint32(width)
+		}
+		return v
+	}
+	readUE := func() uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUE()
+		}
+		return v
+	}
+	readSE := func() {
+		if err == nil {
+			_, err = r.readSE()
+		}
+	}
+
+	pps.id = readUE()
+	pps.spsID = readUE()
+	pps.entropyCodingMode = read(1) == 1
+	pps.bottomFieldPicOrderInFramePresent = read(1) == 1
+	pps.numSliceGroupsMinus1 = readUE()
+	if pps.numSliceGroupsMinus1 > 0 {
+		pps.sliceGroupMapType = readUE()
+		switch pps.sliceGroupMapType {
+		case 0:
+			for i := uint32(0); i <= pps.numSliceGroupsMinus1 && err == nil; i++ {
+				readUE() // run_length_minus1
+			}
+		case 2:
+			for i := uint32(0); i < pps.numSliceGroupsMinus1 && err == nil; i++ {
+				readUE() // top_left
+				readUE() // bottom_right
+			}
+		case 3, 4, 5:
+			read(1) // slice_group_change_direction_flag
+			pps.sliceGroupChangeRateMinus1 = readUE()
+		case 6:
+			n := readUE() + 1 // pic_size_in_map_units_minus1
+			width := ceilLog2(pps.numSliceGroupsMinus1 + 1)
+			for i := uint32(0); i < n && err == nil; i++ {
+				read(width) // slice_group_id
+			}
+		}
+	}
+	pps.numRefIdxL0DefaultActiveMinus1 = readUE()
+	pps.numRefIdxL1DefaultActiveMinus1 = readUE()
+	pps.weightedPred = read(1) == 1
+	pps.weightedBipredIdc = uint8(read(2))
+	readSE() // pic_init_qp_minus26
+	readSE() // pic_init_qs_minus26
+	readSE() // chroma_qp_index_offset
+	pps.deblockingFilterControlPresent = read(1) == 1
+	read(1) // constrained_intra_pred_flag
+	pps.redundantPicCntPresent = read(1) == 1
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PPS: %w", err)
+	}
+	return pps, nil
+}
+
+// ceilLog2 returns Ceil(Log2(n)).
+func ceilLog2(n uint32) uint {
+	var k uint
+	for uint64(1)<<k < uint64(n) {
+		k++
+	}
+	return k
+}
+
+// escapedSize returns the number of the bytes of the NAL unit payload which hold the first n bytes of its RBSP.
+func escapedSize(data []byte, n int) int {
+	var i, zeros int
+	for ; i < len(data) && n > 0; i++ {
+		if zeros >= 2 && data[i] == 0x03 {
+			zeros = 0
+			continue
+		}
+		if data[i] == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		n--
+	}
+	return i
+}
+
+// slice types of AVC defined at ISO/IEC 14496-10 Table 7-6
+const (
+	avcSliceP  = 0
+	avcSliceB  = 1
+	avcSliceI  = 2
+	avcSliceSP = 3
+	avcSliceSI = 4
+)
+
+type avcSliceHeader struct {
+	sps            *avcSPS
+	firstMbInSlice uint32
+	fieldPic       bool
+	picOrderCntLsb uint32
+	// size is the number of the bytes of the NAL unit, including the NAL unit header, which hold the slice header.
+	size int
+}
+
+// parseAVCSliceHeader parses slice_header defined at ISO/IEC 14496-10 7.3.3.
+func parseAVCSliceHeader(nalu []byte, ppss map[uint32]*avcPPS, spss map[uint32]*avcSPS) (*avcSliceHeader, error) {
+	r := newBitReader(unescapeRBSP(nalu[1:]))
+	sh := &avcSliceHeader{}
+	var err error
+	read := func(width uint) uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUint32(width)
+		}
+		return v
+	}
+	readUE := func() uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUE()
+		}
+		return v
+	}
+	readSE := func() {
+		if err == nil {
+			_, err = r.readSE()
+		}
+	}
+
+	sh.firstMbInSlice = readUE()
+	sliceType := readUE() % 5
+	ppsID := readUE()
+	if err != nil {
+		return nil, err
+	}
+	pps, ok := ppss[ppsID]
+	if !ok {
+		return nil, fmt.Errorf("PPS not found: id=%d", ppsID)
+	}
+	if sh.sps, ok = spss[pps.spsID]; !ok {
+		return nil, fmt.Errorf("SPS not found: id=%d", pps.spsID)
+	}
+	sps := sh.sps
+	if sps.separateColourPlane {
+		read(2) // colour_plane_id
+	}
+	read(sps.log2MaxFrameNum) // frame_num
+	if !sps.frameMbsOnly {
+		sh.fieldPic = read(1) == 1
+		if sh.fieldPic {
+			read(1) // bottom_field_flag
+		}
+	}
+	isIDR := avcNALType(nalu) == avcNALIDR
+	if isIDR {
+		readUE() // idr_pic_id
+	}
+	if sps.picOrderCntType == 0 {
+		sh.picOrderCntLsb = read(sps.log2MaxPicOrderCnt)
+		if pps.bottomFieldPicOrderInFramePresent && !sh.fieldPic {
+			readSE() // delta_pic_order_cnt_bottom
+		}
+	}
+	if sps.picOrderCntType == 1 && !sps.deltaPicOrderAlwaysZero {
+		readSE() // delta_pic_order_cnt[0]
+		if pps.bottomFieldPicOrderInFramePresent && !sh.fieldPic {
+			readSE() // delta_pic_order_cnt[1]
+		}
+	}
+	if pps.redundantPicCntPresent {
+		readUE() // redundant_pic_cnt
+	}
+	if sliceType == avcSliceB {
+		read(1) // direct_spatial_mv_pred_flag
+	}
+	numRefIdxL0ActiveMinus1 := pps.numRefIdxL0DefaultActiveMinus1
+	numRefIdxL1ActiveMinus1 := pps.numRefIdxL1DefaultActiveMinus1
+	if sliceType == avcSliceP || sliceType == avcSliceSP || sliceType == avcSliceB {
+		if read(1) == 1 { // num_ref_idx_active_override_flag
+			numRefIdxL0ActiveMinus1 = readUE()
+			if sliceType == avcSliceB {
+				numRefIdxL1ActiveMinus1 = readUE()
+			}
+		}
+	}
+
+	// ref_pic_list_modification
+	lists := 0
+	if sliceType != avcSliceI && sliceType != avcSliceSI {
+		lists = 1
+		if sliceType == avcSliceB {
+			lists = 2
+		}
+	}
+	for i := 0; i < lists && err == nil; i++ {
+		if read(1) == 0 { // ref_pic_list_modification_flag_lX
+			continue
+		}
+		for err == nil {
+			idc := readUE() // modification_of_pic_nums_idc
+			if idc == 3 {
+				break
+			} else if idc > 3 {
+				return nil, fmt.Errorf("invalid modification_of_pic_nums_idc: %d", idc)
+			}
+			readUE() // abs_diff_pic_num_minus1 or long_term_pic_num
+		}
+	}
+
+	if pps.weightedPred && (sliceType == avcSliceP || sliceType == avcSliceSP) ||
+		pps.weightedBipredIdc == 1 && sliceType == avcSliceB {
+		// pred_weight_table
+		readUE() // luma_log2_weight_denom
+		if sps.chromaArrayType() != 0 {
+			readUE() // chroma_log2_weight_denom
+		}
+		counts := []uint32{numRefIdxL0ActiveMinus1 + 1}
+		if sliceType == avcSliceB {
+			counts = append(counts, numRefIdxL1ActiveMinus1+1)
+		}
+		for _, n := range counts {
+			for i := uint32(0); i < n && err == nil; i++ {
+				if read(1) == 1 { // luma_weight_lX_flag
+					readSE() // luma_weight_lX
+					readSE() // luma_offset_lX
+				}
+				if sps.chromaArrayType() != 0 && read(1) == 1 { // chroma_weight_lX_flag
+					for j := 0; j < 4; j++ {
+						readSE() // chroma_weight_lX and chroma_offset_lX
+					}
+				}
+			}
+		}
+	}
+
+	if nalu[0]&0x60 != 0 {
+		// dec_ref_pic_marking
+		if isIDR {
+			read(2) // no_output_of_prior_pics_flag, long_term_reference_flag
+		} else if read(1) == 1 { // adaptive_ref_pic_marking_mode_flag
+			for err == nil {
+				mmco := readUE() // memory_management_control_operation
+				if mmco == 0 {
+					break
+				} else if mmco > 6 {
+					return nil, fmt.Errorf("invalid memory_management_control_operation: %d", mmco)
+				}
+				if mmco != 5 {
+					readUE()
+				}
+				if mmco == 3 {
+					readUE()
+				}
+			}
+		}
+	}
+	if pps.entropyCodingMode && sliceType != avcSliceI && sliceType != avcSliceSI {
+		readUE() // cabac_init_idc
+	}
+	readSE() // slice_qp_delta
+	if sliceType == avcSliceSP || sliceType == avcSliceSI {
+		if sliceType == avcSliceSP {
+			read(1) // sp_for_switch_flag
+		}
+		readSE() // slice_qs_delta
+	}
+	if pps.deblockingFilterControlPresent {
+		if readUE() != 1 { // disable_deblocking_filter_idc
+			readSE() // slice_alpha_c0_offset_div2
+			readSE() // slice_beta_offset_div2
+		}
+	}
+	if pps.numSliceGroupsMinus1 > 0 && pps.sliceGroupMapType >= 3 && pps.sliceGroupMapType <= 5 {
+		// Ceil(Log2(PicSizeInMapUnits ÷ SliceGroupChangeRate + 1))
+		picSize := uint64(sps.widthInMbs) * uint64(sps.heightInMapUnits)
+		rate := uint64(pps.sliceGroupChangeRateMinus1) + 1
+		var width uint
+		for (uint64(1)<<width)*rate < picSize+rate {
+			width++
+		}
+		read(width) // slice_group_change_cycle
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse slice header: %w", err)
+	}
+	sh.size = 1 + escapedSize(nalu[1:], (r.read+7)/8)
+	return sh, nil
+}
+
+type hevcSPS struct {
+	id                   uint32
+	maxSubLayersMinus1   uint8
+	temporalIDNesting    bool
+	profileSpace         uint8
+	tierFlag             bool
+	profileIdc           uint8
+	profileCompatibility [32]bool
+	constraintIndicator  [6]uint8
+	levelIdc             uint8
+	chromaFormatIdc      uint8
+	separateColourPlane  bool
+	width                uint16
+	height               uint16
+	bitDepthLumaMinus8   uint8
+	bitDepthChromaMinus8 uint8
+	log2MaxPicOrderCnt   uint
+	picSizeInCtbs        uint32
+	sampleAdaptiveOffset bool
+	stRefPicSets         []*hevcStRefPicSet
+	// usedByCurrPicLtSps is used_by_curr_pic_lt_sps_flag, whose length is num_long_term_ref_pics_sps.
+	usedByCurrPicLtSps     []bool
+	longTermRefPicsPresent bool
+	temporalMVPEnabled     bool
+}
+
+// chromaArrayType returns ChromaArrayType defined at ISO/IEC 23008-2 7.4.3.2.1
+func (sps *hevcSPS) chromaArrayType() uint8 {
+	if sps.separateColourPlane {
+		return 0
+	}
+	return sps.chromaFormatIdc
+}
+
+// parseHEVCSPS parses seq_parameter_set_rbsp defined at ISO/IEC 23008-2 7.3.2.2 until strong_intra_smoothing_enabled_flag.
+func parseHEVCSPS(nalu []byte) (*hevcSPS, error) {
+	rbsp := unescapeRBSP(nalu)
+	if len(rbsp) < 2 {
+		return nil, errors.New("too short SPS")
+	}
+	r := newBitReader(rbsp[2:])
+	sps := &hevcSPS{}
+	var err error
+	read := func(width uint) uint8 {
+		var v uint8
+		if err == nil {
+			v, err = r.readUint8(width)
+		}
+		return v
+	}
+	readUE := func() uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUE()
+		}
+		return v
+	}
+	skip := func(width uint) {
+		if err == nil {
+			err = r.skip(width)
+		}
+	}
+
+	read(4) // sps_video_parameter_set_id
+	sps.maxSubLayersMinus1 = read(3)
+	sps.temporalIDNesting = read(1) == 1
+
+	// profile_tier_level
+	sps.profileSpace = read(2)
+	sps.tierFlag = read(1) == 1
+	sps.profileIdc = read(5)
+	for i := range sps.profileCompatibility {
+		sps.profileCompatibility[i] = read(1) == 1
+	}
+	for i := range sps.constraintIndicator {
+		sps.constraintIndicator[i] = read(8)
+	}
+	sps.levelIdc = read(8)
+	subLayerProfilePresent := make([]bool, sps.maxSubLayersMinus1)
+	subLayerLevelPresent := make([]bool, sps.maxSubLayersMinus1)
+	for i := range subLayerProfilePresent {
+		subLayerProfilePresent[i] = read(1) == 1
+		subLayerLevelPresent[i] = read(1) == 1
+	}
+	if sps.maxSubLayersMinus1 > 0 {
+		for i := sps.maxSubLayersMinus1; i < 8; i++ {
+			read(2) // reserved_zero_2bits
+		}
+	}
+	for i := range subLayerProfilePresent {
+		if err == nil && subLayerProfilePresent[i] {
+			err = r.skip(88)
+		}
+		if err == nil && subLayerLevelPresent[i] {
+			err = r.skip(8)
+		}
+	}
+
+	sps.id = readUE()
+	sps.chromaFormatIdc = uint8(readUE())
+	if sps.chromaFormatIdc == 3 {
+		sps.separateColourPlane = read(1) == 1
+	}
+	width := readUE()  // pic_width_in_luma_samples
+	height := readUE() // pic_height_in_luma_samples
+	var confLeft, confRight, confTop, confBottom uint32
+	if read(1) == 1 { // conformance_window_flag
+		confLeft, confRight, confTop, confBottom = readUE(), readUE(), readUE(), readUE()
+	}
+	sps.bitDepthLumaMinus8 = uint8(readUE())
+	sps.bitDepthChromaMinus8 = uint8(readUE())
+	sps.log2MaxPicOrderCnt = uint(readUE()) + 4
+	i := sps.maxSubLayersMinus1
+	if read(1) == 1 { // sps_sub_layer_ordering_info_present_flag
+		i = 0
+	}
+	for ; i <= sps.maxSubLayersMinus1 && err == nil; i++ {
+		readUE() // sps_max_dec_pic_buffering_minus1
+		readUE() // sps_max_num_reorder_pics
+		readUE() // sps_max_latency_increase_plus1
+	}
+	log2CtbSize := uint(readUE()) + 3 // log2_min_luma_coding_block_size_minus3
+	log2CtbSize += uint(readUE())     // log2_diff_max_min_luma_coding_block_size
+	readUE()                          // log2_min_luma_transform_block_size_minus2
+	readUE()                          // log2_diff_max_min_luma_transform_block_size
+	readUE()                          // max_transform_hierarchy_depth_inter
+	readUE()                          // max_transform_hierarchy_depth_intra
+	if read(1) == 1 && read(1) == 1 { // scaling_list_enabled_flag, sps_scaling_list_data_present_flag
+		if err == nil {
+			err = skipHEVCScalingListData(r)
+		}
+	}
+	read(1) // amp_enabled_flag
+	sps.sampleAdaptiveOffset = read(1) == 1
+	if read(1) == 1 { // pcm_enabled_flag
+		read(8)  // pcm_sample_bit_depth_luma_minus1, pcm_sample_bit_depth_chroma_minus1
+		readUE() // log2_min_pcm_luma_coding_block_size_minus3
+		readUE() // log2_diff_max_min_pcm_luma_coding_block_size
+		read(1)  // pcm_loop_filter_disabled_flag
+	}
+	numStRefPicSets := readUE()
+	if numStRefPicSets > 64 {
+		return nil, fmt.Errorf("invalid num_short_term_ref_pic_sets: %d", numStRefPicSets)
+	}
+	for j := uint32(0); j < numStRefPicSets && err == nil; j++ {
+		var set *hevcStRefPicSet
+		if set, err = parseHEVCStRefPicSet(r, sps.stRefPicSets, false); err == nil {
+			sps.stRefPicSets = append(sps.stRefPicSets, set)
+		}
+	}
+	sps.longTermRefPicsPresent = read(1) == 1
+	if sps.longTermRefPicsPresent {
+		n := readUE() // num_long_term_ref_pics_sps
+		if n > 32 {
+			return nil, fmt.Errorf("invalid num_long_term_ref_pics_sps: %d", n)
+		}
+		sps.usedByCurrPicLtSps = make([]bool, n)
+		for j := range sps.usedByCurrPicLtSps {
+			skip(sps.log2MaxPicOrderCnt) // lt_ref_pic_poc_lsb_sps
+			sps.usedByCurrPicLtSps[j] = read(1) == 1
+		}
+	}
+	sps.temporalMVPEnabled = read(1) == 1
+	read(1) // strong_intra_smoothing_enabled_flag
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SPS: %w", err)
+	}
+	if log2CtbSize > 16 {
+		return nil, fmt.Errorf("invalid CTB size: log2=%d", log2CtbSize)
+	}
+	ctbSize := uint32(1) << log2CtbSize
+	sps.picSizeInCtbs = ((width + ctbSize - 1) / ctbSize) * ((height + ctbSize - 1) / ctbSize)
+
+	// ISO/IEC 23008-2 Table 6-1 SubWidthC and SubHeightC
+	subWidth, subHeight := uint32(1), uint32(1)
+	if !sps.separateColourPlane && (sps.chromaFormatIdc == 1 || sps.chromaFormatIdc == 2) {
+		subWidth = 2
+		if sps.chromaFormatIdc == 1 {
+			subHeight = 2
+		}
+	}
+	sps.width = uint16(width - (confLeft+confRight)*subWidth)
+	sps.height = uint16(height - (confTop+confBottom)*subHeight)
+	return sps, nil
+}
+
+// skipHEVCScalingListData skips scaling_list_data defined at ISO/IEC 23008-2 7.3.4
+func skipHEVCScalingListData(r *bitReader) error {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			predMode, err := r.readFlag()
+			if err != nil {
+				return err
+			}
+			if !predMode {
+				if _, err := r.readUE(); err != nil { // scaling_list_pred_matrix_id_delta
+					return err
+				}
+				continue
+			}
+			coefNum := 1 << (4 + uint(sizeID)<<1)
+			if coefNum > 64 {
+				coefNum = 64
+			}
+			if sizeID > 1 {
+				coefNum++ // scaling_list_dc_coef_minus8
+			}
+			for i := 0; i < coefNum; i++ {
+				if _, err := r.readSE(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hevcStRefPicSet is the short-term reference picture set derived at ISO/IEC 23008-2 7.4.8.
+type hevcStRefPicSet struct {
+	deltaPocS0 []int32
+	deltaPocS1 []int32
+	usedS0     []bool
+	usedS1     []bool
+}
+
+// numDeltaPocs returns NumDeltaPocs.
+func (s *hevcStRefPicSet) numDeltaPocs() int {
+	return len(s.deltaPocS0) + len(s.deltaPocS1)
+}
+
+// numUsed returns the number of the pictures used for reference by the current picture.
+func (s *hevcStRefPicSet) numUsed() int {
+	var n int
+	for _, used := range s.usedS0 {
+		if used {
+			n++
+		}
+	}
+	for _, used := range s.usedS1 {
+		if used {
+			n++
+		}
+	}
+	return n
+}
+
+// parseHEVCStRefPicSet parses st_ref_pic_set defined at ISO/IEC 23008-2 7.3.7.
+// sets are the sets preceding it in SPS, and inSliceHeader reports whether it is in slice segment header.
+func parseHEVCStRefPicSet(r *bitReader, sets []*hevcStRefPicSet, inSliceHeader bool) (*hevcStRefPicSet, error) {
+	var err error
+	read := func(width uint) uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUint32(width)
+		}
+		return v
+	}
+	readUE := func() uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUE()
+		}
+		return v
+	}
+
+	set := &hevcStRefPicSet{}
+	if len(sets) != 0 && read(1) == 1 { // inter_ref_pic_set_prediction_flag
+		deltaIdx := 1
+		if inSliceHeader {
+			deltaIdx += int(readUE()) // delta_idx_minus1
+		}
+		if deltaIdx > len(sets) {
+			return nil, fmt.Errorf("invalid delta_idx_minus1: %d", deltaIdx-1)
+		}
+		ref := sets[len(sets)-deltaIdx]
+		sign := read(1) // delta_rps_sign
+		deltaRps := int32(readUE()) + 1
+		if sign == 1 {
+			deltaRps = -deltaRps
+		}
+		n := ref.numDeltaPocs() + 1
+		usedByCurrPic := make([]bool, n)
+		useDelta := make([]bool, n)
+		for j := 0; j < n; j++ {
+			usedByCurrPic[j] = read(1) == 1
+			useDelta[j] = usedByCurrPic[j] || read(1) == 1
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// equations 7-61 and 7-62
+		numNegative := len(ref.deltaPocS0)
+		for j := len(ref.deltaPocS1) - 1; j >= 0; j-- {
+			if dPoc := ref.deltaPocS1[j] + deltaRps; dPoc < 0 && useDelta[numNegative+j] {
+				set.deltaPocS0 = append(set.deltaPocS0, dPoc)
+				set.usedS0 = append(set.usedS0, usedByCurrPic[numNegative+j])
+			}
+		}
+		if deltaRps < 0 && useDelta[n-1] {
+			set.deltaPocS0 = append(set.deltaPocS0, deltaRps)
+			set.usedS0 = append(set.usedS0, usedByCurrPic[n-1])
+		}
+		for j := 0; j < numNegative; j++ {
+			if dPoc := ref.deltaPocS0[j] + deltaRps; dPoc < 0 && useDelta[j] {
+				set.deltaPocS0 = append(set.deltaPocS0, dPoc)
+				set.usedS0 = append(set.usedS0, usedByCurrPic[j])
+			}
+		}
+		for j := numNegative - 1; j >= 0; j-- {
+			if dPoc := ref.deltaPocS0[j] + deltaRps; dPoc > 0 && useDelta[j] {
+				set.deltaPocS1 = append(set.deltaPocS1, dPoc)
+				set.usedS1 = append(set.usedS1, usedByCurrPic[j])
+			}
+		}
+		if deltaRps > 0 && useDelta[n-1] {
+			set.deltaPocS1 = append(set.deltaPocS1, deltaRps)
+			set.usedS1 = append(set.usedS1, usedByCurrPic[n-1])
+		}
+		for j := range ref.deltaPocS1 {
+			if dPoc := ref.deltaPocS1[j] + deltaRps; dPoc > 0 && useDelta[numNegative+j] {
+				set.deltaPocS1 = append(set.deltaPocS1, dPoc)
+				set.usedS1 = append(set.usedS1, usedByCurrPic[numNegative+j])
+			}
+		}
+		return set, nil
+	}
+
+	numNegative := readUE()
+	numPositive := readUE()
+	if numNegative > 16 || numPositive > 16 {
+		return nil, fmt.Errorf("too many pictures in short-term reference picture set: negative=%d, positive=%d", numNegative, numPositive)
+	}
+	var poc int32
+	for i := uint32(0); i < numNegative && err == nil; i++ {
+		poc -= int32(readUE()) + 1 // delta_poc_s0_minus1
+		set.deltaPocS0 = append(set.deltaPocS0, poc)
+		set.usedS0 = append(set.usedS0, read(1) == 1)
+	}
+	poc = 0
+	for i := uint32(0); i < numPositive && err == nil; i++ {
+		poc += int32(readUE()) + 1 // delta_poc_s1_minus1
+		set.deltaPocS1 = append(set.deltaPocS1, poc)
+		set.usedS1 = append(set.usedS1, read(1) == 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+type hevcPPS struct {
+	id                              uint32
+	spsID                           uint32
+	dependentSliceSegmentsEnabled   bool
+	outputFlagPresent               bool
+	numExtraSliceHeaderBits         uint
+	cabacInitPresent                bool
+	numRefIdxL0DefaultActiveMinus1  uint32
+	numRefIdxL1DefaultActiveMinus1  uint32
+	sliceChromaQpOffsetsPresent     bool
+	weightedPred                    bool
+	weightedBipred                  bool
+	tilesEnabled                    bool
+	entropyCodingSyncEnabled        bool
+	loopFilterAcrossSlicesEnabled   bool
+	deblockingFilterOverrideEnabled bool
+	deblockingFilterDisabled        bool
+	listsModificationPresent        bool
+	sliceSegmentHeaderExtension     bool
+	chromaQpOffsetListEnabled       bool
+	// unsupportedExtension reports whether the multilayer, 3D or SCC extension, which adds fields to slice segment header, is present.
+	unsupportedExtension bool
+}
+
+// parseHEVCPPS parses pic_parameter_set_rbsp defined at ISO/IEC 23008-2 7.3.2.3.1 until pps_range_extension.
+func parseHEVCPPS(nalu []byte) (*hevcPPS, error) {
+	rbsp := unescapeRBSP(nalu)
+	if len(rbsp) < 2 {
+		return nil, errors.New("too short PPS")
+	}
+	r := newBitReader(rbsp[2:])
+	pps := &hevcPPS{}
+	var err error
+	read := func(width uint) uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUint32(width)
+		}
+		return v
+	}
+	readUE := func() uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUE()
+		}
+		return v
+	}
+	readSE := func() {
+		if err == nil {
+			_, err = r.readSE()
+		}
+	}
+
+	pps.id = readUE()
+	pps.spsID = readUE()
+	pps.dependentSliceSegmentsEnabled = read(1) == 1
+	pps.outputFlagPresent = read(1) == 1
+	pps.numExtraSliceHeaderBits = uint(read(3))
+	read(1) // sign_data_hiding_enabled_flag
+	pps.cabacInitPresent = read(1) == 1
+	pps.numRefIdxL0DefaultActiveMinus1 = readUE()
+	pps.numRefIdxL1DefaultActiveMinus1 = readUE()
+	readSE() // init_qp_minus26
+	read(1)  // constrained_intra_pred_flag
+	transformSkipEnabled := read(1) == 1
+	if read(1) == 1 { // cu_qp_delta_enabled_flag
+		readUE() // diff_cu_qp_delta_depth
+	}
+	readSE() // pps_cb_qp_offset
+	readSE() // pps_cr_qp_offset
+	pps.sliceChromaQpOffsetsPresent = read(1) == 1
+	pps.weightedPred = read(1) == 1
+	pps.weightedBipred = read(1) == 1
+	read(1) // transquant_bypass_enabled_flag
+	pps.tilesEnabled = read(1) == 1
+	pps.entropyCodingSyncEnabled = read(1) == 1
+	if pps.tilesEnabled {
+		columns := readUE() // num_tile_columns_minus1
+		rows := readUE()    // num_tile_rows_minus1
+		if read(1) == 0 {   // uniform_spacing_flag
+			for i := uint32(0); i < columns+rows && err == nil; i++ {
+				readUE() // column_width_minus1 and row_height_minus1
+			}
+		}
+		read(1) // loop_filter_across_tiles_enabled_flag
+	}
+	pps.loopFilterAcrossSlicesEnabled = read(1) == 1
+	if read(1) == 1 { // deblocking_filter_control_present_flag
+		pps.deblockingFilterOverrideEnabled = read(1) == 1
+		pps.deblockingFilterDisabled = read(1) == 1
+		if !pps.deblockingFilterDisabled {
+			readSE() // pps_beta_offset_div2
+			readSE() // pps_tc_offset_div2
+		}
+	}
+	if read(1) == 1 && err == nil { // pps_scaling_list_data_present_flag
+		err = skipHEVCScalingListData(r)
+	}
+	pps.listsModificationPresent = read(1) == 1
+	readUE() // log2_parallel_merge_level_minus2
+	pps.sliceSegmentHeaderExtension = read(1) == 1
+	if read(1) == 1 { // pps_extension_present_flag
+		rangeExtension := read(1) == 1
+		pps.unsupportedExtension = read(3) != 0 // pps_multilayer_extension_flag, pps_3d_extension_flag, pps_scc_extension_flag
+		read(4)                                 // pps_extension_4bits
+		if rangeExtension {
+			if transformSkipEnabled {
+				readUE() // log2_max_transform_skip_block_size_minus2
+			}
+			read(1) // cross_component_prediction_enabled_flag
+			pps.chromaQpOffsetListEnabled = read(1) == 1
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PPS: %w", err)
+	}
+	return pps, nil
+}
+
+// slice types of HEVC defined at ISO/IEC 23008-2 Table 7-7
+const (
+	hevcSliceB = 0
+	hevcSliceP = 1
+)
+
+type hevcSliceHeader struct {
+	sps                    *hevcSPS
+	firstSliceSegmentInPic bool
+	picOrderCntLsb         uint32
+	// size is the number of the bytes of the NAL unit, including the NAL unit header, which hold the slice segment header.
+	size int
+}
+
+// parseHEVCSliceHeader parses slice_segment_header defined at ISO/IEC 23008-2 7.3.6.1.
+// Slice segments whose nuh_layer_id is greater than 0 are not supported.
+func parseHEVCSliceHeader(nalu []byte, ppss map[uint32]*hevcPPS, spss map[uint32]*hevcSPS) (*hevcSliceHeader, error) {
+	if len(nalu) < 2 {
+		return nil, errors.New("too short slice segment")
+	}
+	if nalu[0]&0x01 != 0 || nalu[1]&0xf8 != 0 {
+		return nil, errors.New("slice segments of nuh_layer_id greater than 0 are not supported")
+	}
+	r := newBitReader(unescapeRBSP(nalu[2:]))
+	sh := &hevcSliceHeader{}
+	var err error
+	read := func(width uint) uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUint32(width)
+		}
+		return v
+	}
+	readUE := func() uint32 {
+		var v uint32
+		if err == nil {
+			v, err = r.readUE()
+		}
+		return v
+	}
+	readSE := func() {
+		if err == nil {
+			_, err = r.readSE()
+		}
+	}
+
+	sh.firstSliceSegmentInPic = read(1) == 1
+	nalType := hevcNALType(nalu)
+	if nalType >= hevcNALBLAWLP && nalType <= hevcNALRSVIRAP23 {
+		read(1) // no_output_of_prior_pics_flag
+	}
+	ppsID := readUE()
+	if err != nil {
+		return nil, err
+	}
+	pps, ok := ppss[ppsID]
+	if !ok {
+		return nil, fmt.Errorf("PPS not found: id=%d", ppsID)
+	}
+	if sh.sps, ok = spss[pps.spsID]; !ok {
+		return nil, fmt.Errorf("SPS not found: id=%d", pps.spsID)
+	}
+	if pps.unsupportedExtension {
+		return nil, errors.New("PPS extensions other than range extension are not supported")
+	}
+	sps := sh.sps
+	var dependentSliceSegment bool
+	if !sh.firstSliceSegmentInPic {
+		if pps.dependentSliceSegmentsEnabled {
+			dependentSliceSegment = read(1) == 1
+		}
+		read(ceilLog2(sps.picSizeInCtbs)) // slice_segment_address
+	}
+	if !dependentSliceSegment {
+		read(pps.numExtraSliceHeaderBits) // slice_reserved_flag
+		sliceType := readUE()
+		if pps.outputFlagPresent {
+			read(1) // pic_output_flag
+		}
+		if sps.separateColourPlane {
+			read(2) // colour_plane_id
+		}
+		var numPicTotalCurr int
+		var sliceTemporalMVPEnabled bool
+		if nalType != hevcNALIDRWRADL && nalType != hevcNALIDRNLP {
+			sh.picOrderCntLsb = read(sps.log2MaxPicOrderCnt)
+			var set *hevcStRefPicSet
+			if read(1) == 0 { // short_term_ref_pic_set_sps_flag
+				if err == nil {
+					set, err = parseHEVCStRefPicSet(r, sps.stRefPicSets, true)
+				}
+			} else if len(sps.stRefPicSets) == 0 {
+				return nil, errors.New("short-term reference picture set not found")
+			} else {
+				idx := read(ceilLog2(uint32(len(sps.stRefPicSets)))) // short_term_ref_pic_set_idx
+				if int(idx) >= len(sps.stRefPicSets) {
+					return nil, fmt.Errorf("invalid short_term_ref_pic_set_idx: %d", idx)
+				}
+				set = sps.stRefPicSets[idx]
+			}
+			if set != nil {
+				numPicTotalCurr += set.numUsed()
+			}
+			if sps.longTermRefPicsPresent {
+				var numLongTermSps uint32
+				if len(sps.usedByCurrPicLtSps) != 0 {
+					numLongTermSps = readUE()
+				}
+				numLongTermPics := readUE()
+				if numLongTermSps+numLongTermPics > 32 {
+					return nil, fmt.Errorf("too many long-term reference pictures: %d", numLongTermSps+numLongTermPics)
+				}
+				for i := uint32(0); i < numLongTermSps+numLongTermPics && err == nil; i++ {
+					if i < numLongTermSps {
+						idx := read(ceilLog2(uint32(len(sps.usedByCurrPicLtSps)))) // lt_idx_sps
+						if int(idx) >= len(sps.usedByCurrPicLtSps) {
+							return nil, fmt.Errorf("invalid lt_idx_sps: %d", idx)
+						}
+						if sps.usedByCurrPicLtSps[idx] {
+							numPicTotalCurr++
+						}
+					} else {
+						read(sps.log2MaxPicOrderCnt) // poc_lsb_lt
+						if read(1) == 1 {            // used_by_curr_pic_lt_flag
+							numPicTotalCurr++
+						}
+					}
+					if read(1) == 1 { // delta_poc_msb_present_flag
+						readUE() // delta_poc_msb_cycle_lt
+					}
+				}
+			}
+			if sps.temporalMVPEnabled {
+				sliceTemporalMVPEnabled = read(1) == 1
+			}
+		}
+		var saoLuma, saoChroma bool
+		if sps.sampleAdaptiveOffset {
+			saoLuma = read(1) == 1
+			if sps.chromaArrayType() != 0 {
+				saoChroma = read(1) == 1
+			}
+		}
+		if sliceType == hevcSliceP || sliceType == hevcSliceB {
+			numRefIdx := []uint32{pps.numRefIdxL0DefaultActiveMinus1 + 1}
+			if sliceType == hevcSliceB {
+				numRefIdx = append(numRefIdx, pps.numRefIdxL1DefaultActiveMinus1+1)
+			}
+			if read(1) == 1 { // num_ref_idx_active_override_flag
+				for i := range numRefIdx {
+					numRefIdx[i] = readUE() + 1 // num_ref_idx_lX_active_minus1
+				}
+			}
+			for _, n := range numRefIdx {
+				if n > 16 {
+					return nil, fmt.Errorf("too many active reference indices: %d", n)
+				}
+			}
+			if pps.listsModificationPresent && numPicTotalCurr > 1 {
+				// ref_pic_lists_modification
+				for _, n := range numRefIdx {
+					if read(1) == 1 { // ref_pic_list_modification_flag_lX
+						for i := uint32(0); i < n; i++ {
+							read(ceilLog2(uint32(numPicTotalCurr))) // list_entry_lX
+						}
+					}
+				}
+			}
+			if sliceType == hevcSliceB {
+				read(1) // mvd_l1_zero_flag
+			}
+			if pps.cabacInitPresent {
+				read(1) // cabac_init_flag
+			}
+			if sliceTemporalMVPEnabled {
+				collocatedFromL0 := true
+				if sliceType == hevcSliceB {
+					collocatedFromL0 = read(1) == 1
+				}
+				if collocatedFromL0 && numRefIdx[0] > 1 || !collocatedFromL0 && numRefIdx[1] > 1 {
+					readUE() // collocated_ref_idx
+				}
+			}
+			if pps.weightedPred && sliceType == hevcSliceP || pps.weightedBipred && sliceType == hevcSliceB {
+				// pred_weight_table
+				readUE() // luma_log2_weight_denom
+				if sps.chromaArrayType() != 0 {
+					readSE() // delta_chroma_log2_weight_denom
+				}
+				for _, n := range numRefIdx {
+					lumaWeight := make([]bool, n)
+					chromaWeight := make([]bool, n)
+					for i := range lumaWeight {
+						lumaWeight[i] = read(1) == 1
+					}
+					if sps.chromaArrayType() != 0 {
+						for i := range chromaWeight {
+							chromaWeight[i] = read(1) == 1
+						}
+					}
+					for i := range lumaWeight {
+						if lumaWeight[i] {
+							readSE() // delta_luma_weight_lX
+							readSE() // luma_offset_lX
+						}
+						if chromaWeight[i] {
+							for j := 0; j < 4; j++ {
+								readSE() // delta_chroma_weight_lX and delta_chroma_offset_lX
+							}
+						}
+					}
+				}
+			}
+			readUE() // five_minus_max_num_merge_cand
+		}
+		readSE() // slice_qp_delta
+		if pps.sliceChromaQpOffsetsPresent {
+			readSE() // slice_cb_qp_offset
+			readSE() // slice_cr_qp_offset
+		}
+		if pps.chromaQpOffsetListEnabled {
+			read(1) // cu_chroma_qp_offset_enabled_flag
+		}
+		deblockingFilterDisabled := pps.deblockingFilterDisabled
+		if pps.deblockingFilterOverrideEnabled && read(1) == 1 { // deblocking_filter_override_flag
+			deblockingFilterDisabled = read(1) == 1
+			if !deblockingFilterDisabled {
+				readSE() // slice_beta_offset_div2
+				readSE() // slice_tc_offset_div2
+			}
+		}
+		if pps.loopFilterAcrossSlicesEnabled && (saoLuma || saoChroma || !deblockingFilterDisabled) {
+			read(1) // slice_loop_filter_across_slices_enabled_flag
+		}
+	}
+	if pps.tilesEnabled || pps.entropyCodingSyncEnabled {
+		n := readUE() // num_entry_point_offsets
+		if n > 0 {
+			offsetLen := readUE() + 1 // offset_len_minus1
+			if offsetLen > 32 {
+				return nil, fmt.Errorf("invalid offset_len_minus1: %d", offsetLen-1)
+			}
+			for i := uint32(0); i < n && err == nil; i++ {
+				read(uint(offsetLen)) // entry_point_offset_minus1
+			}
+		}
+	}
+	if pps.sliceSegmentHeaderExtension {
+		n := readUE() // slice_segment_header_extension_length
+		for i := uint32(0); i < n && err == nil; i++ {
+			read(8) // slice_segment_header_extension_data_byte
+		}
+	}
+	// byte_alignment
+	read(1) // alignment_bit_equal_to_one
+	if err == nil {
+		err = r.align()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse slice segment header: %w", err)
+	}
+	sh.size = 2 + escapedSize(nalu[2:], r.read/8)
+	return sh, nil
+}
@@ -0,0 +1,193 @@
+package mp4
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parameter sets and slices of AVC Baseline profile, 320x240
+var (
+	testAVCSPS = append([]byte{0x67, 0x42, 0x00, 0x1e}, packBits(
+		[2]uint64{1, 1},  // seq_parameter_set_id
+		[2]uint64{1, 1},  // log2_max_frame_num_minus4
+		[2]uint64{3, 3},  // pic_order_cnt_type
+		[2]uint64{3, 2},  // max_num_ref_frames
+		[2]uint64{1, 0},  // gaps_in_frame_num_value_allowed_flag
+		[2]uint64{9, 20}, // pic_width_in_mbs_minus1
+		[2]uint64{7, 15}, // pic_height_in_map_units_minus1
+		[2]uint64{2, 3},  // frame_mbs_only_flag, direct_8x8_inference_flag
+		[2]uint64{2, 0},  // frame_cropping_flag, vui_parameters_present_flag
+		[2]uint64{1, 1},  // rbsp_stop_one_bit
+	)...)
+	testAVCPPS = append([]byte{0x68}, packBits(
+		[2]uint64{2, 3}, // pic_parameter_set_id, seq_parameter_set_id
+		[2]uint64{2, 0}, // entropy_coding_mode_flag, bottom_field_pic_order_in_frame_present_flag
+		[2]uint64{3, 7}, // num_slice_groups_minus1, num_ref_idx_l0/l1_default_active_minus1
+		[2]uint64{3, 0}, // weighted_pred_flag, weighted_bipred_idc
+		[2]uint64{3, 7}, // pic_init_qp_minus26, pic_init_qs_minus26, chroma_qp_index_offset
+		[2]uint64{3, 4}, // deblocking_filter_control_present_flag, constrained_intra_pred_flag, redundant_pic_cnt_present_flag
+		[2]uint64{1, 1}, // rbsp_stop_one_bit
+	)...)
+	testAVCIDR = append([]byte{0x65}, packBits(
+		[2]uint64{1, 1}, // first_mb_in_slice
+		[2]uint64{7, 8}, // slice_type (I)
+		[2]uint64{1, 1}, // pic_parameter_set_id
+		[2]uint64{4, 0}, // frame_num
+		[2]uint64{1, 1}, // idr_pic_id
+		[2]uint64{2, 0}, // no_output_of_prior_pics_flag, long_term_reference_flag
+		[2]uint64{1, 1}, // slice_qp_delta
+		[2]uint64{3, 2}, // disable_deblocking_filter_idc
+	)...)
+	testAVCNonIDR = append([]byte{0x41}, packBits(
+		[2]uint64{1, 1}, // first_mb_in_slice
+		[2]uint64{5, 6}, // slice_type (P)
+		[2]uint64{1, 1}, // pic_parameter_set_id
+		[2]uint64{4, 1}, // frame_num
+		[2]uint64{3, 0}, // num_ref_idx_active_override_flag, ref_pic_list_modification_flag_l0, adaptive_ref_pic_marking_mode_flag
+		[2]uint64{1, 1}, // slice_qp_delta
+		[2]uint64{3, 2}, // disable_deblocking_filter_idc
+	)...)
+)
+
+// parameter sets and slice segment headers of HEVC Main profile, 1280x720
+var (
+	testHEVCSPS   = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93, 0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x80, 0x80, 0x82}
+	testHEVCPPS   = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+	testHEVCIDR   = []byte{0x26, 0x01, 0xaf, 0x06, 0x1c}             // IDR_W_RADL
+	testHEVCTrail = []byte{0x02, 0x01, 0xd0, 0x09, 0x7e, 0xc7, 0xe0} // TRAIL_R
+)
+
+func TestUnescapeRBSP(t *testing.T) {
+	data := []byte{0x65, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x03, 0x00, 0x03}
+	assert.Equal(t, []byte{0x65, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x03}, unescapeRBSP(data))
+	// the first 3 bytes of the RBSP are held by 4 bytes
+	assert.Equal(t, 4, escapedSize(data[1:], 3))
+	assert.Equal(t, 2, escapedSize(data[1:], 2))
+}
+
+func TestReadExpGolomb(t *testing.T) {
+	r := newBitReader(packBits(
+		[2]uint64{1, 1},  // 0
+		[2]uint64{3, 2},  // 1
+		[2]uint64{3, 3},  // 2
+		[2]uint64{5, 4},  // 3
+		[2]uint64{5, 5},  // 4
+		[2]uint64{7, 15}, // 14
+	))
+	for _, expected := range []uint32{0, 1, 2} {
+		v, err := r.readUE()
+		require.NoError(t, err)
+		assert.Equal(t, expected, v)
+	}
+	for _, expected := range []int32{2, -2, -7} {
+		v, err := r.readSE()
+		require.NoError(t, err)
+		assert.Equal(t, expected, v)
+	}
+	_, err := newBitReader(make([]byte, 5)).readUE()
+	assert.Error(t, err, "too long exp-Golomb code")
+}
+
+func TestParseAVCParameterSets(t *testing.T) {
+	sps, err := parseAVCSPS(testAVCSPS)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), sps.id)
+	assert.Equal(t, AVCBaselineProfile, sps.profile)
+	assert.Equal(t, uint8(30), sps.level)
+	assert.Equal(t, uint8(1), sps.chromaArrayType())
+	assert.Equal(t, uint(4), sps.log2MaxFrameNum)
+	assert.Equal(t, uint32(2), sps.picOrderCntType)
+	assert.True(t, sps.frameMbsOnly)
+	assert.Equal(t, uint16(320), sps.width)
+	assert.Equal(t, uint16(240), sps.height)
+
+	pps, err := parseAVCPPS(testAVCPPS)
+	require.NoError(t, err)
+	assert.Equal(t, &avcPPS{deblockingFilterControlPresent: true}, pps)
+
+	_, err = parseAVCSPS(testAVCSPS[:3])
+	assert.Error(t, err)
+	_, err = parseAVCPPS(testAVCPPS[:1])
+	assert.Error(t, err)
+}
+
+func TestParseAVCSliceHeader(t *testing.T) {
+	sps, err := parseAVCSPS(testAVCSPS)
+	require.NoError(t, err)
+	pps, err := parseAVCPPS(testAVCPPS)
+	require.NoError(t, err)
+	spss := map[uint32]*avcSPS{0: sps}
+	ppss := map[uint32]*avcPPS{0: pps}
+
+	for _, slice := range [][]byte{testAVCIDR, testAVCNonIDR} {
+		sh, err := parseAVCSliceHeader(append(append([]byte{}, slice...), 0xa5, 0xa5), ppss, spss)
+		require.NoError(t, err)
+		assert.Same(t, sps, sh.sps)
+		assert.Equal(t, uint32(0), sh.firstMbInSlice)
+		assert.False(t, sh.fieldPic)
+		assert.Equal(t, len(slice), sh.size)
+	}
+
+	_, err = parseAVCSliceHeader(testAVCIDR, map[uint32]*avcPPS{}, spss)
+	assert.Error(t, err, "PPS not found")
+	_, err = parseAVCSliceHeader(testAVCIDR, ppss, map[uint32]*avcSPS{})
+	assert.Error(t, err, "SPS not found")
+}
+
+func TestParseHEVCParameterSets(t *testing.T) {
+	sps, err := parseHEVCSPS(testHEVCSPS)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), sps.id)
+	assert.Equal(t, uint8(0), sps.maxSubLayersMinus1)
+	assert.True(t, sps.temporalIDNesting)
+	assert.Equal(t, uint8(1), sps.profileIdc)
+	assert.Equal(t, [6]uint8{0x90, 0, 0, 0, 0, 0}, sps.constraintIndicator)
+	assert.Equal(t, uint8(93), sps.levelIdc)
+	assert.Equal(t, uint8(1), sps.chromaArrayType())
+	assert.Equal(t, uint16(1280), sps.width)
+	assert.Equal(t, uint16(720), sps.height)
+	assert.Equal(t, uint(8), sps.log2MaxPicOrderCnt)
+	assert.Equal(t, uint32(240), sps.picSizeInCtbs)
+	assert.True(t, sps.sampleAdaptiveOffset)
+	assert.True(t, sps.temporalMVPEnabled)
+
+	pps, err := parseHEVCPPS(testHEVCPPS)
+	require.NoError(t, err)
+	assert.Equal(t, &hevcPPS{
+		weightedPred:                  true,
+		entropyCodingSyncEnabled:      true,
+		loopFilterAcrossSlicesEnabled: true,
+	}, pps)
+
+	_, err = parseHEVCSPS(testHEVCSPS[:8])
+	assert.Error(t, err)
+	_, err = parseHEVCPPS(testHEVCPPS[:2])
+	assert.Error(t, err)
+}
+
+func TestParseHEVCSliceHeader(t *testing.T) {
+	sps, err := parseHEVCSPS(testHEVCSPS)
+	require.NoError(t, err)
+	pps, err := parseHEVCPPS(testHEVCPPS)
+	require.NoError(t, err)
+	spss := map[uint32]*hevcSPS{0: sps}
+	ppss := map[uint32]*hevcPPS{0: pps}
+
+	sh, err := parseHEVCSliceHeader(append(append([]byte{}, testHEVCIDR...), 0xa5, 0xa5), ppss, spss)
+	require.NoError(t, err)
+	assert.Same(t, sps, sh.sps)
+	assert.True(t, sh.firstSliceSegmentInPic)
+	assert.Equal(t, len(testHEVCIDR), sh.size)
+
+	sh, err = parseHEVCSliceHeader(append(append([]byte{}, testHEVCTrail...), 0xa5), ppss, spss)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), sh.picOrderCntLsb)
+	assert.Equal(t, len(testHEVCTrail), sh.size)
+
+	_, err = parseHEVCSliceHeader(testHEVCIDR, map[uint32]*hevcPPS{}, spss)
+	assert.Error(t, err, "PPS not found")
+	_, err = parseHEVCSliceHeader(testHEVCIDR[:1], ppss, spss)
+	assert.Error(t, err)
+}
@@ -1,11 +1,8 @@
 package mp4
 
 import (
-	"bytes"
 	"errors"
 	"io"
-
-	"github.com/abema/go-mp4/internal/bitio"
 )
 
 type ProbeInfo struct {
@@ -36,8 +33,14 @@ type Track struct {
 	EditList  EditList
 	Samples   Samples
 	Chunks    Chunks
-	AVC       *AVCDecConfigInfo
-	MP4A      *MP4AInfo
+	// SyncSamples holds 1-based sample numbers of stss box.
+	// It is nil when stss box is absent, which means that every sample is a sync sample.
+	SyncSamples []uint32
+	AVC         *AVCDecConfigInfo
+	HEVC        *HEVCDecConfigInfo
+	AV1         *AV1ConfigInfo
+	VP          *VPConfigInfo
+	MP4A        *MP4AInfo
 }
 
 type Codec int
@@ -46,6 +49,10 @@ const (
 	CodecUnknown Codec = iota
 	CodecAVC1
 	CodecMP4A
+	CodecHEVC
+	CodecAV1
+	CodecVP8
+	CodecVP9
 )
 
 type EditList []*EditListEntry
@@ -53,6 +60,7 @@ type EditList []*EditListEntry
 type EditListEntry struct {
 	MediaTime       int64
 	SegmentDuration uint64
+	MediaRate       int16
 }
 
 type Samples []*Sample
@@ -80,10 +88,45 @@ type AVCDecConfigInfo struct {
 	Height               uint16
 }
 
+type HEVCDecConfigInfo struct {
+	ConfigurationVersion uint8
+	GeneralProfileSpace  uint8
+	GeneralTierFlag      bool
+	GeneralProfileIdc    uint8
+	GeneralLevelIdc      uint8
+	LengthSize           uint16
+	Width                uint16
+	Height               uint16
+}
+
+type AV1ConfigInfo struct {
+	SeqProfile   uint8
+	SeqLevelIdx0 uint8
+	SeqTier0     uint8
+	BitDepth     uint8
+	Monochrome   bool
+	ConfigOBUs   []byte
+	Width        uint16
+	Height       uint16
+}
+
+type VPConfigInfo struct {
+	Profile  uint8
+	Level    uint8
+	BitDepth uint8
+	Width    uint16
+	Height   uint16
+}
+
 type MP4AInfo struct {
 	OTI          uint8
 	AudOTI       uint8
 	ChannelCount uint16
+
+	// the following fields are set when AudioSpecificConfig is available
+	Profile             AACProfile
+	SampleRate          uint32
+	AudioSpecificConfig *AudioSpecificConfig
 }
 
 type Segments []*Segment
@@ -189,6 +232,17 @@ func probeTrak(r io.ReadSeeker, bi *BoxInfo) (*Track, error) {
 		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAvc1(), BoxTypeAvcC()},
 		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeEncv()},
 		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeEncv(), BoxTypeAvcC()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeEncv(), BoxTypeHvcC()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeHvc1()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeHvc1(), BoxTypeHvcC()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeHev1()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeHev1(), BoxTypeHvcC()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAv01()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeAv01(), BoxTypeAv1C()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeVp08()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeVp08(), BoxTypeVpcC()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeVp09()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeVp09(), BoxTypeVpcC()},
 		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeMp4a()},
 		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeMp4a(), BoxTypeEsds()},
 		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeMp4a(), BoxTypeWave(), BoxTypeEsds()},
@@ -200,6 +254,7 @@ func probeTrak(r io.ReadSeeker, bi *BoxInfo) (*Track, error) {
 		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeCtts()},
 		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsc()},
 		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsz()},
+		{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStss()},
 	})
 	if err != nil {
 		return nil, err
@@ -209,14 +264,13 @@ func probeTrak(r io.ReadSeeker, bi *BoxInfo) (*Track, error) {
 	var mdhd *Mdhd
 	var avc1 *VisualSampleEntry
 	var avcC *AVCDecoderConfiguration
+	var visualSampleEntry *VisualSampleEntry
+	var hvcC *HvcC
+	var av1C *Av1C
+	var vpcC *VpcC
 	var audioSampleEntry *AudioSampleEntry
 	var esds *Esds
-	var stco *Stco
-	var stts *Stts
-	var stsc *Stsc
-	var ctts *Ctts
-	var stsz *Stsz
-	var co64 *Co64
+	var st SampleTable
 	for _, bip := range bips {
 		switch bip.Info.Type {
 		case BoxTypeTkhd():
@@ -233,6 +287,26 @@ func probeTrak(r io.ReadSeeker, bi *BoxInfo) (*Track, error) {
 		case BoxTypeEncv():
 			track.Codec = CodecAVC1
 			track.Encrypted = true
+			visualSampleEntry = bip.Payload.(*VisualSampleEntry)
+		case BoxTypeHvc1(), BoxTypeHev1():
+			track.Codec = CodecHEVC
+			visualSampleEntry = bip.Payload.(*VisualSampleEntry)
+		case BoxTypeHvcC():
+			track.Codec = CodecHEVC
+			hvcC = bip.Payload.(*HvcC)
+		case BoxTypeAv01():
+			track.Codec = CodecAV1
+			visualSampleEntry = bip.Payload.(*VisualSampleEntry)
+		case BoxTypeAv1C():
+			av1C = bip.Payload.(*Av1C)
+		case BoxTypeVp08():
+			track.Codec = CodecVP8
+			visualSampleEntry = bip.Payload.(*VisualSampleEntry)
+		case BoxTypeVp09():
+			track.Codec = CodecVP9
+			visualSampleEntry = bip.Payload.(*VisualSampleEntry)
+		case BoxTypeVpcC():
+			vpcC = bip.Payload.(*VpcC)
 		case BoxTypeMp4a():
 			track.Codec = CodecMP4A
 			audioSampleEntry = bip.Payload.(*AudioSampleEntry)
@@ -243,17 +317,19 @@ func probeTrak(r io.ReadSeeker, bi *BoxInfo) (*Track, error) {
 		case BoxTypeEsds():
 			esds = bip.Payload.(*Esds)
 		case BoxTypeStco():
-			stco = bip.Payload.(*Stco)
+			st.Stco = bip.Payload.(*Stco)
 		case BoxTypeStts():
-			stts = bip.Payload.(*Stts)
+			st.Stts = bip.Payload.(*Stts)
 		case BoxTypeStsc():
-			stsc = bip.Payload.(*Stsc)
+			st.Stsc = bip.Payload.(*Stsc)
 		case BoxTypeCtts():
-			ctts = bip.Payload.(*Ctts)
+			st.Ctts = bip.Payload.(*Ctts)
 		case BoxTypeStsz():
-			stsz = bip.Payload.(*Stsz)
+			st.Stsz = bip.Payload.(*Stsz)
 		case BoxTypeCo64():
-			co64 = bip.Payload.(*Co64)
+			st.Co64 = bip.Payload.(*Co64)
+		case BoxTypeStss():
+			st.Stss = bip.Payload.(*Stss)
 		}
 	}
 
@@ -268,6 +344,7 @@ func probeTrak(r io.ReadSeeker, bi *BoxInfo) (*Track, error) {
 			editList = append(editList, &EditListEntry{
 				MediaTime:       elst.GetMediaTime(i),
 				SegmentDuration: elst.GetSegmentDuration(i),
+				MediaRate:       elst.Entries[i].MediaRateInteger,
 			})
 		}
 		track.EditList = editList
@@ -291,175 +368,117 @@ func probeTrak(r io.ReadSeeker, bi *BoxInfo) (*Track, error) {
 		}
 	}
 
-	if audioSampleEntry != nil && esds != nil {
-		oti, audOTI, err := detectAACProfile(esds)
-		if err != nil {
-			return nil, err
-		}
-		track.MP4A = &MP4AInfo{
-			OTI:          oti,
-			AudOTI:       audOTI,
-			ChannelCount: audioSampleEntry.ChannelCount,
+	if visualSampleEntry != nil && hvcC != nil {
+		track.HEVC = &HEVCDecConfigInfo{
+			ConfigurationVersion: hvcC.ConfigurationVersion,
+			GeneralProfileSpace:  hvcC.GeneralProfileSpace,
+			GeneralTierFlag:      hvcC.GeneralTierFlag,
+			GeneralProfileIdc:    hvcC.GeneralProfileIdc,
+			GeneralLevelIdc:      hvcC.GeneralLevelIdc,
+			LengthSize:           uint16(hvcC.LengthSizeMinusOne) + 1,
+			Width:                visualSampleEntry.Width,
+			Height:               visualSampleEntry.Height,
 		}
 	}
 
-	track.Chunks = make([]*Chunk, 0)
-	if stco != nil {
-		for _, offset := range stco.ChunkOffset {
-			track.Chunks = append(track.Chunks, &Chunk{
-				DataOffset: uint64(offset),
-			})
+	if visualSampleEntry != nil && av1C != nil {
+		bitDepth := uint8(8)
+		if av1C.HighBitdepth != 0 {
+			bitDepth = 10
+			if av1C.TwelveBit != 0 {
+				bitDepth = 12
+			}
 		}
-	} else if co64 != nil {
-		for _, offset := range co64.ChunkOffset {
-			track.Chunks = append(track.Chunks, &Chunk{
-				DataOffset: offset,
-			})
+		track.AV1 = &AV1ConfigInfo{
+			SeqProfile:   av1C.SeqProfile,
+			SeqLevelIdx0: av1C.SeqLevelIdx0,
+			SeqTier0:     av1C.SeqTier0,
+			BitDepth:     bitDepth,
+			Monochrome:   av1C.Monochrome != 0,
+			ConfigOBUs:   av1C.ConfigOBUs,
+			Width:        visualSampleEntry.Width,
+			Height:       visualSampleEntry.Height,
 		}
-	} else {
-		return nil, errors.New("stco/co64 box not found")
 	}
 
-	if stts == nil {
-		return nil, errors.New("stts box not found")
-	}
-	track.Samples = make([]*Sample, 0)
-	for _, entry := range stts.Entries {
-		for i := uint32(0); i < entry.SampleCount; i++ {
-			track.Samples = append(track.Samples, &Sample{
-				TimeDelta: entry.SampleDelta,
-			})
+	if visualSampleEntry != nil && vpcC != nil {
+		track.VP = &VPConfigInfo{
+			Profile:  vpcC.Profile,
+			Level:    vpcC.Level,
+			BitDepth: vpcC.BitDepth,
+			Width:    visualSampleEntry.Width,
+			Height:   visualSampleEntry.Height,
 		}
 	}
 
-	if stsc == nil {
-		return nil, errors.New("stsc box not found")
-	}
-	for si, entry := range stsc.Entries {
-		end := uint32(len(track.Chunks))
-		if si != len(stsc.Entries)-1 && stsc.Entries[si+1].FirstChunk-1 < end {
-			end = stsc.Entries[si+1].FirstChunk - 1
+	if audioSampleEntry != nil && esds != nil {
+		oti, asc, err := detectAACProfile(esds)
+		if err != nil {
+			return nil, err
+		}
+		track.MP4A = &MP4AInfo{
+			OTI:          oti,
+			ChannelCount: audioSampleEntry.ChannelCount,
 		}
-		for ci := entry.FirstChunk - 1; ci < end; ci++ {
-			track.Chunks[ci].SamplesPerChunk = entry.SamplesPerChunk
+		if asc != nil {
+			track.MP4A.AudOTI = asc.AudOTI()
+			track.MP4A.Profile = asc.Profile()
+			track.MP4A.SampleRate = asc.OutputSamplingFrequency()
+			track.MP4A.AudioSpecificConfig = asc
+			if n := asc.ChannelCount(); n != 0 {
+				track.MP4A.ChannelCount = n
+			}
 		}
 	}
 
-	if ctts != nil {
-		var si uint32
-		for ci, entry := range ctts.Entries {
-			for i := uint32(0); i < entry.SampleCount; i++ {
-				if si >= uint32(len(track.Samples)) {
-					break
-				}
-				track.Samples[si].CompositionTimeOffset = ctts.GetSampleOffset(ci)
-				si++
-			}
+	samples, chunkOffsets, err := ExpandSampleTable(&st)
+	if err != nil {
+		return nil, err
+	}
+	track.Chunks = make([]*Chunk, 0, len(chunkOffsets))
+	for _, offset := range chunkOffsets {
+		track.Chunks = append(track.Chunks, &Chunk{DataOffset: offset})
+	}
+	track.Samples = make([]*Sample, 0, len(samples))
+	for _, s := range samples {
+		if int(s.Chunk) < len(track.Chunks) {
+			track.Chunks[s.Chunk].SamplesPerChunk++
 		}
+		track.Samples = append(track.Samples, &Sample{
+			Size:                  s.Size,
+			TimeDelta:             s.Duration,
+			CompositionTimeOffset: s.CompositionTimeOffset,
+		})
 	}
 
-	if stsz != nil {
-		for i := 0; i < len(stsz.EntrySize) && i < len(track.Samples); i++ {
-			track.Samples[i].Size = stsz.EntrySize[i]
+	if st.Stss != nil {
+		track.SyncSamples = st.Stss.SampleNumber
+		if track.SyncSamples == nil {
+			track.SyncSamples = []uint32{}
 		}
 	}
 
 	return track, nil
 }
 
-func detectAACProfile(esds *Esds) (oti, audOTI uint8, err error) {
+func detectAACProfile(esds *Esds) (oti uint8, asc *AudioSpecificConfig, err error) {
 	configDscr := findDescriptorByTag(esds.Descriptors, DecoderConfigDescrTag)
 	if configDscr == nil || configDscr.DecoderConfigDescriptor == nil {
-		return 0, 0, nil
+		return 0, nil, nil
 	}
 	if configDscr.DecoderConfigDescriptor.ObjectTypeIndication != 0x40 {
-		return configDscr.DecoderConfigDescriptor.ObjectTypeIndication, 0, nil
-	}
-
-	specificDscr := findDescriptorByTag(esds.Descriptors, DecSpecificInfoTag)
-	if specificDscr == nil {
-		return 0, 0, errors.New("DecoderSpecificationInfoDescriptor not found")
-	}
-
-	r := bitio.NewReader(bytes.NewReader(specificDscr.Data))
-	remaining := len(specificDscr.Data) * 8
-
-	// audio object type
-	audioObjectType, read, err := getAudioObjectType(r)
-	if err != nil {
-		return 0, 0, err
+		return configDscr.DecoderConfigDescriptor.ObjectTypeIndication, nil, nil
 	}
-	remaining -= read
 
-	// sampling frequency index
-	samplingFrequencyIndex, err := r.ReadBits(4)
+	data, err := getAudioSpecificConfig(esds)
 	if err != nil {
-		return 0, 0, err
-	}
-	remaining -= 4
-	if samplingFrequencyIndex[0] == 0x0f {
-		if _, err = r.ReadBits(24); err != nil {
-			return 0, 0, err
-		}
-		remaining -= 24
+		return 0, nil, err
 	}
-
-	if audioObjectType == 2 && remaining >= 20 {
-		if _, err = r.ReadBits(4); err != nil {
-			return 0, 0, err
-		}
-		remaining -= 4
-		syncExtensionType, err := r.ReadBits(11)
-		if err != nil {
-			return 0, 0, err
-		}
-		remaining -= 11
-		if syncExtensionType[0] == 0x2 && syncExtensionType[1] == 0xb7 {
-			extAudioObjectType, _, err := getAudioObjectType(r)
-			if err != nil {
-				return 0, 0, err
-			}
-			if extAudioObjectType == 5 || extAudioObjectType == 22 {
-				sbr, err := r.ReadBits(1)
-				if err != nil {
-					return 0, 0, err
-				}
-				remaining--
-				if sbr[0] != 0 {
-					if extAudioObjectType == 5 {
-						sfi, err := r.ReadBits(4)
-						if err != nil {
-							return 0, 0, err
-						}
-						remaining -= 4
-						if sfi[0] == 0xf {
-							if _, err := r.ReadBits(24); err != nil {
-								return 0, 0, err
-							}
-							remaining -= 24
-						}
-						if remaining >= 12 {
-							syncExtensionType, err := r.ReadBits(11)
-							if err != nil {
-								return 0, 0, err
-							}
-							if syncExtensionType[0] == 0x5 && syncExtensionType[1] == 0x48 {
-								ps, err := r.ReadBits(1)
-								if err != nil {
-									return 0, 0, err
-								}
-								if ps[0] != 0 {
-									return 0x40, 29, nil
-								}
-							}
-						}
-					}
-					return 0x40, 5, nil
-				}
-			}
-		}
+	if asc, err = ParseAudioSpecificConfig(data); err != nil {
+		// short or broken configs are left to the decoder
+		return 0x40, nil, nil
 	}
-	return 0x40, audioObjectType, nil
+	return 0x40, asc, nil
 }
 
 func findDescriptorByTag(dscrs []Descriptor, tag int8) *Descriptor {
@@ -471,21 +490,6 @@ func findDescriptorByTag(dscrs []Descriptor, tag int8) *Descriptor {
 	return nil
 }
 
-func getAudioObjectType(r bitio.Reader) (byte, int, error) {
-	audioObjectType, err := r.ReadBits(5)
-	if err != nil {
-		return 0, 0, err
-	}
-	if audioObjectType[0] != 0x1f {
-		return audioObjectType[0], 5, nil
-	}
-	audioObjectType, err = r.ReadBits(6)
-	if err != nil {
-		return 0, 0, err
-	}
-	return audioObjectType[0] + 32, 11, nil
-}
-
 func probeMoof(r io.ReadSeeker, bi *BoxInfo) (*Segment, error) {
 	bips, err := ExtractBoxesWithPayload(r, bi, []BoxPath{
 		{BoxTypeTraf(), BoxTypeTfhd()},
@@ -566,46 +570,11 @@ func probeMoof(r io.ReadSeeker, bi *BoxInfo) (*Segment, error) {
 	return segment, nil
 }
 
+// FindIDRFrames returns indices of the random access pictures found by parsing the sample data:
+// IDR pictures for AVC, IRAP pictures for HEVC and key frames for AV1, VP8 and VP9.
 func FindIDRFrames(r io.ReadSeeker, trackInfo *TrackInfo) ([]int, error) {
-	if trackInfo.AVC == nil {
-		return nil, nil
-	}
-	lengthSize := uint32(trackInfo.AVC.LengthSize)
-
-	var si int
-	idxs := make([]int, 0, 8)
-	for _, chunk := range trackInfo.Chunks {
-		end := si + int(chunk.SamplesPerChunk)
-		dataOffset := chunk.DataOffset
-		for ; si < end && si < len(trackInfo.Samples); si++ {
-			sample := trackInfo.Samples[si]
-			if sample.Size == 0 {
-				continue
-			}
-			for nalOffset := uint32(0); nalOffset+lengthSize+1 <= sample.Size; {
-				if _, err := r.Seek(int64(dataOffset+uint64(nalOffset)), io.SeekStart); err != nil {
-					return nil, err
-				}
-				data := make([]byte, lengthSize+1)
-				if _, err := io.ReadFull(r, data); err != nil {
-					return nil, err
-				}
-				var length uint32
-				for i := 0; i < int(lengthSize); i++ {
-					length = (length << 8) + uint32(data[i])
-				}
-				nalHeader := data[lengthSize]
-				nalType := nalHeader & 0x1f
-				if nalType == 5 {
-					idxs = append(idxs, si)
-					break
-				}
-				nalOffset += lengthSize + length
-			}
-			dataOffset += uint64(sample.Size)
-		}
-	}
-	return idxs, nil
+	idxs, _, err := FindKeyFrames(r, trackInfo)
+	return idxs, err
 }
 
 func (samples Samples) GetBitrate(timescale uint32) uint64 {
@@ -223,6 +223,21 @@ func TestDetectAACProfile(t *testing.T) {
 	}{
 		{
 			name: "40.2",
+			esds: &Esds{
+				Descriptors: []Descriptor{
+					{Tag: DecoderConfigDescrTag, DecoderConfigDescriptor: &DecoderConfigDescriptor{ObjectTypeIndication: 0x40}},
+					{Tag: DecSpecificInfoTag, Data: []byte{
+						// audio-object-type=0x2 (5bits), sample-frequency-index=0x3 (4bits),
+						// channel-configuration=0x2 (4bits), GASpecificConfig (3bits)
+						0x11, 0x90,
+					}},
+				},
+			},
+			expectedOTI:    0x40,
+			expectedAudOTI: 2,
+		},
+		{
+			name: "40.2 short",
 			esds: &Esds{
 				Descriptors: []Descriptor{
 					{Tag: DecoderConfigDescrTag, DecoderConfigDescriptor: &DecoderConfigDescriptor{ObjectTypeIndication: 0x40}},
@@ -233,7 +248,7 @@ func TestDetectAACProfile(t *testing.T) {
 				},
 			},
 			expectedOTI:    0x40,
-			expectedAudOTI: 2,
+			expectedAudOTI: 0,
 		},
 		{
 			name: "40.5 ExtAudType=5 SBR=1 SFI=0x0",
@@ -241,11 +256,10 @@ func TestDetectAACProfile(t *testing.T) {
 				Descriptors: []Descriptor{
 					{Tag: DecoderConfigDescrTag, DecoderConfigDescriptor: &DecoderConfigDescriptor{ObjectTypeIndication: 0x40}},
 					{Tag: DecSpecificInfoTag, Data: []byte{
-						// audio-object-type=0x2 (5bits), sample-frequency-index (4bits),
-						// channel config (4bits), sync-extension-type=0x2b7 (11bits),
-						0x10, 0x02, 0xb7,
-						// audio-object-type=0x5 (5bits), sbr=1 (1bit), sfi=0x0 (4bits), padding (6bits)
-						0x2c, 0x00,
+						// audio-object-type=0x2 (5bits), sample-frequency-index=0x3 (4bits),
+						// channel-configuration=0x2 (4bits), GASpecificConfig (3bits), sync-extension-type=0x2b7 (11bits),
+						// audio-object-type=0x5 (5bits), sbr=1 (1bit), sfi=0x0 (4bits), padding (3bits)
+						0x11, 0x90, 0x56, 0xe5, 0x80,
 					}},
 				},
 			},
@@ -258,12 +272,11 @@ func TestDetectAACProfile(t *testing.T) {
 				Descriptors: []Descriptor{
 					{Tag: DecoderConfigDescrTag, DecoderConfigDescriptor: &DecoderConfigDescriptor{ObjectTypeIndication: 0x40}},
 					{Tag: DecSpecificInfoTag, Data: []byte{
-						// audio-object-type=0x2 (5bits), sample-frequency-index (4bits),
-						// channel config (4bits), sync-extension-type=0x2b7 (11bits),
-						0x10, 0x02, 0xb7,
+						// audio-object-type=0x2 (5bits), sample-frequency-index=0x3 (4bits),
+						// channel-configuration=0x2 (4bits), GASpecificConfig (3bits), sync-extension-type=0x2b7 (11bits),
 						// audio-object-type=0x5 (5bits), sbr=1 (1bit), sfi=0xf (4bits), ext (24bits),
-						// sync-extension-type=0x548 (11bits), ps=1 (1bit), padding (2bits)
-						0x2f, 0xc0, 0x00, 0x00, 0x2a, 0x44,
+						// sync-extension-type=0x548 (11bits), ps=1 (1bit), padding (7bits)
+						0x11, 0x90, 0x56, 0xe5, 0xf8, 0x0b, 0xb8, 0x05, 0x48, 0x80,
 					}},
 				},
 			},
@@ -276,12 +289,11 @@ func TestDetectAACProfile(t *testing.T) {
 				Descriptors: []Descriptor{
 					{Tag: DecoderConfigDescrTag, DecoderConfigDescriptor: &DecoderConfigDescriptor{ObjectTypeIndication: 0x40}},
 					{Tag: DecSpecificInfoTag, Data: []byte{
-						// audio-object-type=0x2 (5bits), sample-frequency-index (4bits),
-						// channel config (4bits), sync-extension-type=0x2b7 (11bits),
-						0x10, 0x02, 0xb7,
+						// audio-object-type=0x2 (5bits), sample-frequency-index=0x3 (4bits),
+						// channel-configuration=0x2 (4bits), GASpecificConfig (3bits), sync-extension-type=0x2b7 (11bits),
 						// audio-object-type=0x5 (5bits), sbr=1 (1bit), sfi=0xf (4bits), ext (24bits),
-						// sync-extension-type=0x548 (11bits), ps=1 (1bit), padding (2bits)
-						0x2f, 0xc0, 0x00, 0x00, 0x2a, 0x40,
+						// sync-extension-type=0x548 (11bits), ps=0 (1bit), padding (7bits)
+						0x11, 0x90, 0x56, 0xe5, 0xf8, 0x0b, 0xb8, 0x05, 0x48, 0x00,
 					}},
 				},
 			},
@@ -294,8 +306,9 @@ func TestDetectAACProfile(t *testing.T) {
 				Descriptors: []Descriptor{
 					{Tag: DecoderConfigDescrTag, DecoderConfigDescriptor: &DecoderConfigDescriptor{ObjectTypeIndication: 0x40}},
 					{Tag: DecSpecificInfoTag, Data: []byte{
-						// audio-object-type=0x2 (5bits), sample-frequency-index=0xf (4bits), ext(24bits), padding(7bits)
-						0x17, 0x80, 0x00, 0x00, 0x00,
+						// audio-object-type=0x2 (5bits), sample-frequency-index=0xf (4bits), ext (24bits),
+						// channel-configuration=0x2 (4bits), GASpecificConfig (3bits), padding (4bits)
+						0x17, 0x80, 0x56, 0x22, 0x10,
 					}},
 				},
 			},
@@ -308,9 +321,10 @@ func TestDetectAACProfile(t *testing.T) {
 				Descriptors: []Descriptor{
 					{Tag: DecoderConfigDescrTag, DecoderConfigDescriptor: &DecoderConfigDescriptor{ObjectTypeIndication: 0x40}},
 					{Tag: DecSpecificInfoTag, Data: []byte{
-						// audio-object-type=0x1f (5bits), 0xa (6bits)
-						// sample-frequency-index (4bits), padding (1bits)
-						0xf9, 0x40,
+						// audio-object-type=0x1f (5bits), 0xa (6bits), sample-frequency-index=0x3 (4bits),
+						// channel-configuration=0x2 (4bits), usac-sampling-frequency-index=0x3 (5bits),
+						// core-sbr-frame-length-index=0x1 (3bits), channel-configuration-index=0x2 (5bits)
+						0xf9, 0x46, 0x43, 0x22,
 					}},
 				},
 			},
@@ -320,12 +334,26 @@ func TestDetectAACProfile(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			oti, audOTI, err := detectAACProfile(tc.esds)
+			oti, asc, err := detectAACProfile(tc.esds)
 			require.NoError(t, err)
 			assert.Equal(t, tc.expectedOTI, oti)
-			assert.Equal(t, tc.expectedAudOTI, audOTI)
+			if tc.expectedAudOTI == 0 {
+				assert.Nil(t, asc)
+			} else {
+				require.NotNil(t, asc)
+				assert.Equal(t, tc.expectedAudOTI, asc.AudOTI())
+			}
 		})
 	}
+
+	t.Run("no DecoderSpecificInfo", func(t *testing.T) {
+		_, _, err := detectAACProfile(&Esds{
+			Descriptors: []Descriptor{
+				{Tag: DecoderConfigDescrTag, DecoderConfigDescriptor: &DecoderConfigDescriptor{ObjectTypeIndication: 0x40}},
+			},
+		})
+		assert.Error(t, err)
+	})
 }
 
 func TestSamplesGetBitrate(t *testing.T) {
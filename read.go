@@ -88,6 +88,8 @@ func readBoxStructureFromInternal(r io.ReadSeeker, bi *BoxInfo, path BoxPath, ha
 		}
 	} else if bi.Type == BoxTypeUdta() {
 		ctx.UnderUdta = true
+	} else if bi.Type == BoxTypeTref() {
+		ctx.UnderTref = true
 	}
 
 	newPath := make(BoxPath, len(path)+1)
@@ -0,0 +1,503 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Relocate updates the file offsets held in box payloads so that they keep referring to the same data
+// after the tree is written from offset.
+// Chunk offsets of stco/co64 boxes, base_data_offset of tfhd boxes, data_offset of trun boxes,
+// offsets of saio boxes, first_offset and referenced_size of sidx boxes, moof offsets of tfra boxes and
+// mfra size of mfro boxes are rewritten.
+// stco boxes are promoted to co64 boxes, and saio, sidx and tfra boxes are promoted to version 1
+// when offsets exceed 32 bits.
+// BoxTree.Write calls Relocate implicitly.
+func (t *BoxTree) Relocate(offset uint64) error {
+	return t.relocate(offset, findTrexs(&t.BoxNode))
+}
+
+// relocate is Relocate whose fragments take their defaults from trexs by track ID.
+// It allows fragments to be relocated apart from the moov box.
+func (t *BoxTree) relocate(offset uint64, trexs map[uint32]*Trex) error {
+	rl := newRelocator(t, trexs)
+	for {
+		if _, err := layoutBoxNodes(t.Children, offset); err != nil {
+			return err
+		}
+		promoted, err := rl.fix(false)
+		if err != nil {
+			return err
+		}
+		if !promoted {
+			break
+		}
+	}
+	if _, err := rl.fix(true); err != nil {
+		return err
+	}
+
+	// the payloads refer to the new positions from now on
+	t.Walk(func(n *BoxNode) bool {
+		n.origOffset = n.Info.Offset
+		n.origSize = n.Info.Size
+		n.origHeaderSize = n.Info.HeaderSize
+		n.hasOrig = true
+		return true
+	})
+	return nil
+}
+
+// layoutBoxNodes computes offsets and sizes of the nodes which are written from offset.
+func layoutBoxNodes(nodes []*BoxNode, offset uint64) (uint64, error) {
+	for _, n := range nodes {
+		end, err := n.layout(offset)
+		if err != nil {
+			return 0, err
+		}
+		offset = end
+	}
+	return offset, nil
+}
+
+func (n *BoxNode) layout(offset uint64) (uint64, error) {
+	var payloadSize uint64
+	if n.Payload != nil {
+		size, err := Marshal(io.Discard, n.Payload, n.Info.Context)
+		if err != nil {
+			return 0, err
+		}
+		payloadSize = size
+	} else {
+		payloadSize = n.rawSize()
+	}
+
+	headerSize := uint64(SmallHeaderSize)
+	if n.Info.HeaderSize == LargeHeaderSize {
+		headerSize = LargeHeaderSize
+	}
+	for {
+		end, err := layoutBoxNodes(n.Children, offset+headerSize+payloadSize)
+		if err != nil {
+			return 0, err
+		}
+		if end-offset > math.MaxUint32 && headerSize == SmallHeaderSize && !n.Info.ExtendToEOF {
+			headerSize = LargeHeaderSize
+			continue
+		}
+		n.Info.Offset = offset
+		n.Info.Size = end - offset
+		n.Info.HeaderSize = headerSize
+		return end, nil
+	}
+}
+
+type relocator struct {
+	tree  *BoxTree
+	nodes []*BoxNode // top level nodes sorted by original offsets
+	trexs map[uint32]*Trex
+}
+
+func newRelocator(t *BoxTree, trexs map[uint32]*Trex) *relocator {
+	rl := &relocator{tree: t, trexs: trexs}
+	for _, n := range t.Children {
+		if n.hasOrig {
+			rl.nodes = append(rl.nodes, n)
+		}
+	}
+	sort.SliceStable(rl.nodes, func(i, j int) bool {
+		return rl.nodes[i].origOffset < rl.nodes[j].origOffset
+	})
+	return rl
+}
+
+// findTrexs returns the trex boxes in the tree by track ID.
+func findTrexs(t *BoxNode) map[uint32]*Trex {
+	trexs := make(map[uint32]*Trex)
+	for _, n := range t.Find(BoxPath{BoxTypeMoov(), BoxTypeMvex(), BoxTypeTrex()}) {
+		if trex, ok := n.Payload.(*Trex); ok {
+			trexs[trex.TrackID] = trex
+		}
+	}
+	return trexs
+}
+
+// trafBaseOffset returns the base offset of the traf box, which the data offsets of trun boxes
+// and the offsets of saio boxes are relative to.
+func trafBaseOffset(traf *BoxNode, trexs map[uint32]*Trex) (uint64, error) {
+	moof := traf.Parent
+	if moof == nil {
+		return 0, errors.New("moof box not found")
+	}
+	var base, end uint64
+	for i, n := range moof.Find(BoxPath{BoxTypeTraf()}) {
+		tfhd, ok := findPayload(n, BoxTypeTfhd()).(*Tfhd)
+		if !ok {
+			return 0, errors.New("tfhd box not found")
+		}
+		if tfhd.CheckFlag(TfhdBaseDataOffsetPresent) {
+			base = tfhd.BaseDataOffset
+		} else if tfhd.CheckFlag(TfhdDefaultBaseIsMoof) || i == 0 {
+			base = moof.Info.Offset
+		} else {
+			// the base is the end of the data of the preceding traf box
+			base = end
+		}
+		if n == traf {
+			return base, nil
+		}
+
+		defaultSize := tfhd.DefaultSampleSize
+		if !tfhd.CheckFlag(TfhdDefaultSampleSizePresent) {
+			defaultSize = 0
+			if trex := trexs[tfhd.TrackID]; trex != nil {
+				defaultSize = trex.DefaultSampleSize
+			}
+		}
+		end = base
+		for _, t := range n.Find(BoxPath{BoxTypeTrun()}) {
+			trun, ok := t.Payload.(*Trun)
+			if !ok {
+				continue
+			}
+			if trun.CheckFlag(TrunDataOffsetPresent) {
+				end = uint64(int64(base) + int64(trun.DataOffset))
+			}
+			for j := 0; j < int(trun.SampleCount); j++ {
+				if trun.CheckFlag(TrunSampleSizePresent) && j < len(trun.Entries) {
+					end += uint64(trun.Entries[j].SampleSize)
+				} else {
+					end += uint64(defaultSize)
+				}
+			}
+		}
+	}
+	return 0, errors.New("traf box not found in the moof box")
+}
+
+// relocate returns the new position of the data at the original position.
+// It returns false when the data is not held by the tree.
+func (rl *relocator) relocate(pos uint64) (uint64, bool) {
+	i := sort.Search(len(rl.nodes), func(i int) bool {
+		return rl.nodes[i].origOffset > pos
+	})
+	if i == 0 {
+		return 0, false
+	}
+	n := rl.nodes[i-1]
+	if pos >= n.origOffset+n.origSize {
+		return 0, false
+	}
+	for {
+		var child *BoxNode
+		for _, c := range n.Children {
+			if c.hasOrig && pos >= c.origOffset && pos < c.origOffset+c.origSize {
+				child = c
+				break
+			}
+		}
+		if child == nil {
+			if pos < n.origOffset+n.origHeaderSize {
+				return n.Info.Offset + (pos - n.origOffset), true
+			}
+			// the payload follows the header whose size may have changed
+			return n.Info.Offset + n.Info.HeaderSize + (pos - n.origOffset - n.origHeaderSize), true
+		}
+		n = child
+	}
+}
+
+// relocateEnd returns the new position of the end of the data which ends at the original position.
+func (rl *relocator) relocateEnd(pos uint64) (uint64, bool) {
+	if pos == 0 {
+		return 0, true
+	}
+	newPos, ok := rl.relocate(pos - 1)
+	return newPos + 1, ok
+}
+
+// fix computes the new offsets and widens the fields which cannot hold them.
+// The new offsets are stored into the payloads only when apply is true.
+func (rl *relocator) fix(apply bool) (bool, error) {
+	var promoted bool
+	var err error
+	var walk func(parent *BoxNode, nodes []*BoxNode)
+	walk = func(parent *BoxNode, nodes []*BoxNode) {
+		for _, n := range nodes {
+			if err != nil {
+				return
+			}
+			var p bool
+			switch box := n.Payload.(type) {
+			case *Stco:
+				p = rl.fixStco(n, box, apply)
+			case *Co64:
+				rl.fixCo64(box, apply)
+			case *Saio:
+				if parent == nil || parent.Info.Type != BoxTypeTraf() {
+					p = rl.fixSaio(box, 0, 0, apply)
+				}
+			case *Sidx:
+				p, err = rl.fixSidx(n, box, apply)
+			case *Tfra:
+				p = rl.fixTfra(box, apply)
+			case *Mfro:
+				if apply && parent != nil && parent.Info.Type == BoxTypeMfra() && parent.Info.Size <= math.MaxUint32 {
+					box.Size = uint32(parent.Info.Size)
+				}
+			case *Moof:
+				p, err = rl.fixMoof(n, apply)
+				promoted = promoted || p
+				continue
+			}
+			promoted = promoted || p
+			walk(n, n.Children)
+		}
+	}
+	walk(nil, rl.tree.Children)
+	return promoted, err
+}
+
+func (rl *relocator) fixStco(n *BoxNode, stco *Stco, apply bool) bool {
+	newOffsets := make([]uint32, len(stco.ChunkOffset))
+	for i, offset := range stco.ChunkOffset {
+		newOffsets[i] = offset
+		newOffset, ok := rl.relocate(uint64(offset))
+		if !ok {
+			continue
+		}
+		if newOffset > math.MaxUint32 {
+			co64 := &Co64{
+				FullBox:     stco.FullBox,
+				EntryCount:  stco.EntryCount,
+				ChunkOffset: make([]uint64, len(stco.ChunkOffset)),
+			}
+			for j := range stco.ChunkOffset {
+				co64.ChunkOffset[j] = uint64(stco.ChunkOffset[j])
+			}
+			n.Payload = co64
+			n.Info.Type = BoxTypeCo64()
+			return true
+		}
+		newOffsets[i] = uint32(newOffset)
+	}
+	if apply {
+		copy(stco.ChunkOffset, newOffsets)
+	}
+	return false
+}
+
+func (rl *relocator) fixCo64(co64 *Co64, apply bool) {
+	if !apply {
+		return
+	}
+	for i, offset := range co64.ChunkOffset {
+		if newOffset, ok := rl.relocate(offset); ok {
+			co64.ChunkOffset[i] = newOffset
+		}
+	}
+}
+
+// fixSaio relocates the offsets of saio box which are relative to base.
+func (rl *relocator) fixSaio(saio *Saio, oldBase, newBase uint64, apply bool) bool {
+	newOffsets := make([]uint64, saio.EntryCount)
+	for i := range newOffsets {
+		newOffsets[i] = saio.GetOffset(i)
+		if newOffset, ok := rl.relocate(oldBase + saio.GetOffset(i)); ok {
+			newOffsets[i] = newOffset - newBase
+		}
+		if saio.GetVersion() == 0 && newOffsets[i] > math.MaxUint32 {
+			saio.SetVersion(1)
+			saio.OffsetV1 = make([]uint64, len(saio.OffsetV0))
+			for j := range saio.OffsetV0 {
+				saio.OffsetV1[j] = uint64(saio.OffsetV0[j])
+			}
+			saio.OffsetV0 = nil
+			return true
+		}
+	}
+	if apply {
+		for i := range newOffsets {
+			if saio.GetVersion() == 0 {
+				saio.OffsetV0[i] = uint32(newOffsets[i])
+			} else {
+				saio.OffsetV1[i] = newOffsets[i]
+			}
+		}
+	}
+	return false
+}
+
+func (rl *relocator) fixSidx(n *BoxNode, sidx *Sidx, apply bool) (bool, error) {
+	if !n.hasOrig {
+		return false, nil
+	}
+	oldAnchor := n.origOffset + n.origSize
+	newAnchor := n.Info.Offset + n.Info.Size
+	start := oldAnchor + sidx.GetFirstOffset()
+	newStart, ok := rl.relocate(start)
+	if !ok {
+		return false, nil
+	}
+	if newStart < newAnchor {
+		return false, errors.New("sidx box refers to preceding data")
+	}
+	newFirstOffset := newStart - newAnchor
+	if sidx.GetVersion() == 0 && newFirstOffset > math.MaxUint32 {
+		sidx.SetVersion(1)
+		sidx.EarliestPresentationTimeV1 = uint64(sidx.EarliestPresentationTimeV0)
+		sidx.FirstOffsetV1 = uint64(sidx.FirstOffsetV0)
+		sidx.EarliestPresentationTimeV0 = 0
+		sidx.FirstOffsetV0 = 0
+		return true, nil
+	}
+
+	newSizes := make([]uint32, len(sidx.References))
+	for i, ref := range sidx.References {
+		end := start + uint64(ref.ReferencedSize)
+		newRefStart, ok1 := rl.relocate(start)
+		newRefEnd, ok2 := rl.relocateEnd(end)
+		newSizes[i] = ref.ReferencedSize
+		if ok1 && ok2 && ref.ReferencedSize != 0 {
+			if newRefEnd < newRefStart || newRefEnd-newRefStart >= 1<<31 {
+				return false, fmt.Errorf("too large referenced size of sidx: %d", newRefEnd-newRefStart)
+			}
+			newSizes[i] = uint32(newRefEnd - newRefStart)
+		}
+		start = end
+	}
+	if apply {
+		if sidx.GetVersion() == 0 {
+			sidx.FirstOffsetV0 = uint32(newFirstOffset)
+		} else {
+			sidx.FirstOffsetV1 = newFirstOffset
+		}
+		for i := range sidx.References {
+			sidx.References[i].ReferencedSize = newSizes[i]
+		}
+	}
+	return false, nil
+}
+
+func (rl *relocator) fixTfra(tfra *Tfra, apply bool) bool {
+	newOffsets := make([]uint64, len(tfra.Entries))
+	for i := range tfra.Entries {
+		newOffsets[i] = tfra.GetMoofOffset(i)
+		if newOffset, ok := rl.relocate(newOffsets[i]); ok {
+			newOffsets[i] = newOffset
+		}
+		if tfra.GetVersion() == 0 && newOffsets[i] > math.MaxUint32 {
+			tfra.SetVersion(1)
+			for j := range tfra.Entries {
+				e := &tfra.Entries[j]
+				e.TimeV1, e.MoofOffsetV1 = uint64(e.TimeV0), uint64(e.MoofOffsetV0)
+				e.TimeV0, e.MoofOffsetV0 = 0, 0
+			}
+			return true
+		}
+	}
+	if apply {
+		for i := range tfra.Entries {
+			if tfra.GetVersion() == 0 {
+				tfra.Entries[i].MoofOffsetV0 = uint32(newOffsets[i])
+			} else {
+				tfra.Entries[i].MoofOffsetV1 = newOffsets[i]
+			}
+		}
+	}
+	return false
+}
+
+// fixMoof relocates the offsets of the boxes in the moof box.
+// The data offsets are derived as defined at ISO/IEC 14496-12 8.8.7.1.
+func (rl *relocator) fixMoof(moof *BoxNode, apply bool) (bool, error) {
+	if !moof.hasOrig {
+		return false, nil
+	}
+	var promoted bool
+	var oldPrevEnd, newPrevEnd uint64
+	for ti, traf := range moof.Find(BoxPath{BoxTypeTraf()}) {
+		tfhdNode := traf.FindFirst(BoxPath{BoxTypeTfhd()})
+		if tfhdNode == nil {
+			return false, errors.New("tfhd box not found")
+		}
+		tfhd, ok := tfhdNode.Payload.(*Tfhd)
+		if !ok {
+			return false, errors.New("tfhd box not found")
+		}
+
+		var oldBase, newBase uint64
+		if tfhd.CheckFlag(TfhdBaseDataOffsetPresent) {
+			oldBase = tfhd.BaseDataOffset
+			newBase = oldBase
+			if newOffset, ok := rl.relocate(oldBase); ok {
+				newBase = newOffset
+			}
+		} else if tfhd.CheckFlag(TfhdDefaultBaseIsMoof) || ti == 0 {
+			oldBase = moof.origOffset
+			newBase = moof.Info.Offset
+		} else {
+			oldBase = oldPrevEnd
+			newBase = newPrevEnd
+		}
+
+		defaultSize := tfhd.DefaultSampleSize
+		if !tfhd.CheckFlag(TfhdDefaultSampleSizePresent) {
+			defaultSize = 0
+			if trex := rl.trexs[tfhd.TrackID]; trex != nil {
+				defaultSize = trex.DefaultSampleSize
+			}
+		}
+
+		oldPos, newPos := oldBase, newBase
+		for _, n := range traf.Children {
+			switch box := n.Payload.(type) {
+			case *Trun:
+				if box.CheckFlag(TrunDataOffsetPresent) {
+					oldPos = uint64(int64(oldBase) + int64(box.DataOffset))
+				}
+				newStart := oldPos
+				if newOffset, ok := rl.relocate(oldPos); ok {
+					newStart = newOffset
+				}
+				newDataOffset := int64(newStart) - int64(newBase)
+				if newDataOffset < math.MinInt32 || newDataOffset > math.MaxInt32 {
+					return false, fmt.Errorf("too large data offset of trun: %d", newDataOffset)
+				}
+				if !box.CheckFlag(TrunDataOffsetPresent) && newStart != newPos {
+					// the data is not contiguous any more
+					box.AddFlag(TrunDataOffsetPresent)
+					box.DataOffset = int32(int64(oldPos) - int64(oldBase))
+					promoted = true
+				}
+				if apply && box.CheckFlag(TrunDataOffsetPresent) {
+					box.DataOffset = int32(newDataOffset)
+				}
+				for i := 0; i < int(box.SampleCount); i++ {
+					if box.CheckFlag(TrunSampleSizePresent) && i < len(box.Entries) {
+						oldPos += uint64(box.Entries[i].SampleSize)
+					} else {
+						oldPos += uint64(defaultSize)
+					}
+				}
+				newPos = oldPos
+				if newOffset, ok := rl.relocateEnd(oldPos); ok {
+					newPos = newOffset
+				}
+			case *Saio:
+				// offsets are relative to the same base as the data offsets of trun boxes
+				if rl.fixSaio(box, oldBase, newBase, apply) {
+					promoted = true
+				}
+			}
+		}
+		if apply && tfhd.CheckFlag(TfhdBaseDataOffsetPresent) {
+			tfhd.BaseDataOffset = newBase
+		}
+		oldPrevEnd, newPrevEnd = oldPos, newPos
+	}
+	return promoted, nil
+}
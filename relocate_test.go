@@ -0,0 +1,282 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+)
+
+func readAllSampleData(t *testing.T, r io.ReadSeeker) [][]byte {
+	its, err := NewSampleIterators(r)
+	require.NoError(t, err)
+	var data [][]byte
+	for _, it := range its {
+		for _, s := range readAllSamples(t, it) {
+			_, err := r.Seek(int64(s.Offset), io.SeekStart)
+			require.NoError(t, err)
+			buf := make([]byte, s.Size)
+			_, err = io.ReadFull(r, buf)
+			require.NoError(t, err)
+			data = append(data, buf)
+		}
+	}
+	return data
+}
+
+func writeBoxTree(t *testing.T, tree *BoxTree) []byte {
+	output, err := memfs.New().Create("output.mp4")
+	require.NoError(t, err)
+	defer output.Close()
+	require.NoError(t, tree.Write(NewWriter(output)))
+	_, err = output.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	data, err := io.ReadAll(output)
+	require.NoError(t, err)
+	return data
+}
+
+func TestRelocateSampleData(t *testing.T) {
+	testCases := []struct {
+		name string
+		file string
+		edit func(t *testing.T, tree *BoxTree)
+	}{
+		{
+			name: "insert box before mdat",
+			file: "./testdata/sample.mp4",
+			edit: func(t *testing.T, tree *BoxTree) {
+				mdat := tree.FindFirst(BoxPath{BoxTypeMdat()})
+				require.NoError(t, tree.InsertBefore(mdat, NewRawBoxNode(BoxTypeFree(), make([]byte, 100))))
+			},
+		},
+		{
+			name: "move moov to head",
+			file: "./testdata/sample.mp4",
+			edit: func(t *testing.T, tree *BoxTree) {
+				moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+				tree.InsertChild(1, moov)
+				moov.FindFirst(BoxPath{BoxTypeUdta()}).Remove()
+			},
+		},
+		{
+			name: "grow moof",
+			file: "./testdata/sample_fragmented.mp4",
+			edit: func(t *testing.T, tree *BoxTree) {
+				for _, traf := range tree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf()}) {
+					traf.AppendChild(NewRawBoxNode(BoxTypeFree(), make([]byte, 30)))
+				}
+				moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+				moov.AppendChild(NewRawBoxNode(BoxTypeFree(), make([]byte, 1000)))
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			input, err := os.ReadFile(tc.file)
+			require.NoError(t, err)
+			expected := readAllSampleData(t, bytes.NewReader(input))
+			require.NotEmpty(t, expected)
+
+			tree, err := ReadBoxTree(bytes.NewReader(input))
+			require.NoError(t, err)
+			tc.edit(t, tree)
+			output := writeBoxTree(t, tree)
+			assert.NotEqual(t, len(input), len(output))
+			assert.Equal(t, expected, readAllSampleData(t, bytes.NewReader(output)))
+
+			// the tree can be written again
+			assert.Equal(t, output, writeBoxTree(t, tree))
+		})
+	}
+}
+
+func TestRelocateFragmentIndex(t *testing.T) {
+	sidx := &Sidx{
+		FullBox:        FullBox{Version: 0},
+		ReferenceID:    1,
+		Timescale:      1000,
+		ReferenceCount: 1,
+		References:     []SidxReference{{SubsegmentDuration: 1000, StartsWithSAP: true, SAPType: 1}},
+	}
+	tfhd := &Tfhd{FullBox: FullBox{Flags: [3]byte{0x02, 0x00, 0x00}}, TrackID: 1}
+	trun := &Trun{
+		FullBox:     FullBox{Flags: [3]byte{0x00, 0x02, 0x01}},
+		SampleCount: 2,
+		Entries:     []TrunEntry{{SampleSize: 4}, {SampleSize: 4}},
+	}
+	saio := &Saio{EntryCount: 1, OffsetV0: []uint32{0}}
+	tfra := &Tfra{TrackID: 1, NumberOfEntry: 1, Entries: []TfraEntry{{TrafNumber: 1, TrunNumber: 1, SampleNumber: 1}}}
+	mfro := &Mfro{}
+	traf := NewBoxNode(&Traf{},
+		NewBoxNode(tfhd),
+		NewBoxNode(trun),
+		NewBoxNode(saio),
+	)
+	moof := NewBoxNode(&Moof{}, NewBoxNode(&Mfhd{SequenceNumber: 1}), traf)
+	mdat := NewRawBoxNode(BoxTypeMdat(), []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	tree := &BoxTree{}
+	tree.AppendChild(NewBoxNode(&Ftyp{MajorBrand: [4]byte{'i', 's', 'o', '6'}}))
+	tree.AppendChild(NewBoxNode(sidx))
+	tree.AppendChild(moof)
+	tree.AppendChild(mdat)
+	tree.AppendChild(NewBoxNode(&Mfra{}, NewBoxNode(tfra), NewBoxNode(mfro)))
+
+	// fill offsets in the initial layout
+	require.NoError(t, tree.Relocate(0))
+	sidxNode := tree.FindFirst(BoxPath{BoxTypeSidx()})
+	sidx.FirstOffsetV0 = uint32(moof.Info.Offset - (sidxNode.Info.Offset + sidxNode.Info.Size))
+	sidx.References[0].ReferencedSize = uint32(moof.Info.Size + mdat.Info.Size)
+	trun.DataOffset = int32(mdat.Info.Offset + mdat.Info.HeaderSize - moof.Info.Offset)
+	saio.OffsetV0[0] = uint32(mdat.Info.Offset + mdat.Info.HeaderSize + 8 - moof.Info.Offset)
+	tfra.Entries[0].MoofOffsetV0 = uint32(moof.Info.Offset)
+	input := writeBoxTree(t, tree)
+	assert.Equal(t, uint32(tree.FindFirst(BoxPath{BoxTypeMfra()}).Info.Size), mfro.Size)
+
+	tree, err := ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	tree.FindFirst(BoxPath{BoxTypeMoof(), BoxTypeTraf()}).AppendChild(NewRawBoxNode(BoxTypeFree(), make([]byte, 20)))
+	require.NoError(t, tree.InsertBefore(tree.FindFirst(BoxPath{BoxTypeSidx()}), NewRawBoxNode(BoxTypeFree(), make([]byte, 50))))
+	output := writeBoxTree(t, tree)
+	require.Equal(t, len(input)+28+58, len(output))
+
+	tree, err = ReadBoxTree(bytes.NewReader(output))
+	require.NoError(t, err)
+	sidxNode = tree.FindFirst(BoxPath{BoxTypeSidx()})
+	moof = tree.FindFirst(BoxPath{BoxTypeMoof()})
+	mdat = tree.FindFirst(BoxPath{BoxTypeMdat()})
+	mfra := tree.FindFirst(BoxPath{BoxTypeMfra()})
+	sidx = sidxNode.Payload.(*Sidx)
+	assert.Equal(t, uint32(moof.Info.Offset-(sidxNode.Info.Offset+sidxNode.Info.Size)), sidx.FirstOffsetV0)
+	assert.Equal(t, uint32(moof.Info.Size+mdat.Info.Size), sidx.References[0].ReferencedSize)
+	trun = moof.FindFirst(BoxPath{BoxTypeTraf(), BoxTypeTrun()}).Payload.(*Trun)
+	assert.Equal(t, int32(mdat.Info.Offset+mdat.Info.HeaderSize-moof.Info.Offset), trun.DataOffset)
+	saio = moof.FindFirst(BoxPath{BoxTypeTraf(), BoxTypeSaio()}).Payload.(*Saio)
+	assert.Equal(t, uint32(mdat.Info.Offset+mdat.Info.HeaderSize+8-moof.Info.Offset), saio.OffsetV0[0])
+	tfra = mfra.FindFirst(BoxPath{BoxTypeTfra()}).Payload.(*Tfra)
+	assert.Equal(t, uint32(moof.Info.Offset), tfra.Entries[0].MoofOffsetV0)
+	assert.Equal(t, uint32(mfra.Info.Size), mfra.FindFirst(BoxPath{BoxTypeMfro()}).Payload.(*Mfro).Size)
+
+	// promote to version 1
+	require.NoError(t, tree.Relocate(math.MaxUint32))
+	assert.Equal(t, uint8(1), tfra.GetVersion())
+	assert.Equal(t, moof.Info.Offset, tfra.Entries[0].MoofOffsetV1)
+	assert.Equal(t, uint8(0), sidx.GetVersion())
+}
+
+func TestRelocateSaioOfContiguousTraf(t *testing.T) {
+	// the second traf has neither base-data-offset nor default-base-is-moof,
+	// so its trun and saio are relative to the end of the data of the first traf
+	tfhd1 := &Tfhd{TrackID: 1}
+	tfhd1.SetFlags(TfhdDefaultBaseIsMoof)
+	trun1 := &Trun{SampleCount: 2, Entries: []TrunEntry{{SampleSize: 4}, {SampleSize: 4}}}
+	trun1.SetFlags(TrunDataOffsetPresent | TrunSampleSizePresent)
+	tfhd2 := &Tfhd{TrackID: 2, DefaultSampleSize: 2}
+	tfhd2.SetFlags(TfhdDefaultSampleSizePresent)
+	trun2 := &Trun{SampleCount: 1, Entries: make([]TrunEntry, 1)}
+	saio := &Saio{EntryCount: 1, OffsetV0: []uint32{0}}
+	traf2 := NewBoxNode(&Traf{}, NewBoxNode(tfhd2), NewBoxNode(trun2), NewBoxNode(saio))
+	moof := NewBoxNode(&Moof{},
+		NewBoxNode(&Mfhd{SequenceNumber: 1}),
+		NewBoxNode(&Traf{}, NewBoxNode(tfhd1), NewBoxNode(trun1)),
+		traf2,
+	)
+	mdat := NewRawBoxNode(BoxTypeMdat(), make([]byte, 512))
+	tree := &BoxTree{}
+	tree.AppendChild(moof)
+	tree.AppendChild(mdat)
+	require.NoError(t, tree.Relocate(0))
+	trun1.DataOffset = int32(mdat.Info.Offset + mdat.Info.HeaderSize - moof.Info.Offset)
+	base, err := trafBaseOffset(traf2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, mdat.Info.Offset+mdat.Info.HeaderSize+8, base)
+	// the auxiliary information is placed in mdat box, whichever base is taken
+	auxOffset := uint32(moof.Info.Size + 4)
+	saio.OffsetV0[0] = auxOffset
+	input := writeBoxTree(t, tree)
+
+	tree, err = ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	tree.FindFirst(BoxPath{BoxTypeMoof(), BoxTypeTraf()}).AppendChild(NewRawBoxNode(BoxTypeFree(), make([]byte, 20)))
+	output := writeBoxTree(t, tree)
+
+	tree, err = ReadBoxTree(bytes.NewReader(output))
+	require.NoError(t, err)
+	mdat = tree.FindFirst(BoxPath{BoxTypeMdat()})
+	traf2 = tree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf()})[1]
+	base, err = trafBaseOffset(traf2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, mdat.Info.Offset+mdat.Info.HeaderSize+8, base)
+	assert.Equal(t, auxOffset, traf2.FindFirst(BoxPath{BoxTypeSaio()}).Payload.(*Saio).OffsetV0[0])
+}
+
+func TestRelocatePromoteStco(t *testing.T) {
+	f, err := os.Open("./testdata/sample.mp4")
+	require.NoError(t, err)
+	defer f.Close()
+
+	tree, err := ReadBoxTree(f)
+	require.NoError(t, err)
+	stcos := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStco()})
+	require.Len(t, stcos, 2)
+	expected := make([]uint64, 0)
+	for _, stco := range stcos {
+		for _, offset := range stco.Payload.(*Stco).ChunkOffset {
+			expected = append(expected, uint64(offset)+math.MaxUint32)
+		}
+	}
+
+	require.NoError(t, tree.Relocate(math.MaxUint32))
+	var actual []uint64
+	for _, n := range stcos {
+		assert.Equal(t, BoxTypeCo64(), n.Info.Type)
+		co64, ok := n.Payload.(*Co64)
+		require.True(t, ok)
+		actual = append(actual, co64.ChunkOffset...)
+	}
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, uint64(math.MaxUint32), tree.Children[0].Info.Offset)
+}
+
+func TestRelocatePromoteMdatHeader(t *testing.T) {
+	t.Run("stco", func(t *testing.T) {
+		tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample.mp4")))
+		require.NoError(t, err)
+		var expected []uint32
+		stcos := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStco()})
+		for _, n := range stcos {
+			for _, offset := range n.Payload.(*Stco).ChunkOffset {
+				expected = append(expected, offset+LargeHeaderSize-SmallHeaderSize)
+			}
+		}
+
+		// the mdat box grows beyond 4 GiB without moving its beginning
+		mdat := tree.FindFirst(BoxPath{BoxTypeMdat()})
+		mdat.srcSize += math.MaxUint32
+		require.NoError(t, tree.Relocate(0))
+		assert.Equal(t, uint64(LargeHeaderSize), mdat.Info.HeaderSize)
+		var actual []uint32
+		for _, n := range stcos {
+			actual = append(actual, n.Payload.(*Stco).ChunkOffset...)
+		}
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("trun", func(t *testing.T) {
+		tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample_fragmented.mp4")))
+		require.NoError(t, err)
+		mdat := tree.FindFirst(BoxPath{BoxTypeMdat()})
+		trun := tree.FindFirst(BoxPath{BoxTypeMoof(), BoxTypeTraf(), BoxTypeTrun()}).Payload.(*Trun)
+		expected := trun.DataOffset + LargeHeaderSize - SmallHeaderSize
+
+		mdat.srcSize += math.MaxUint32
+		require.NoError(t, tree.Relocate(0))
+		assert.Equal(t, uint64(LargeHeaderSize), mdat.Info.HeaderSize)
+		assert.Equal(t, expected, trun.DataOffset)
+	})
+}
@@ -0,0 +1,360 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// TrackSelector selects tracks. Zero values of the fields match any track.
+type TrackSelector struct {
+	TrackID uint32
+
+	// HandlerType is the handler type of the hdlr box, such as "vide" and "soun".
+	HandlerType string
+
+	// Language is the ISO-639-2/T language code of the mdhd box, such as "eng".
+	Language string
+}
+
+func (s *TrackSelector) match(trak *BoxNode) bool {
+	if s.TrackID != 0 {
+		if tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd); !ok || tkhd.TrackID != s.TrackID {
+			return false
+		}
+	}
+	if s.HandlerType != "" {
+		if hdlr, ok := findPayload(trak, BoxTypeMdia(), BoxTypeHdlr()).(*Hdlr); !ok || string(hdlr.HandlerType[:]) != s.HandlerType {
+			return false
+		}
+	}
+	if s.Language != "" {
+		mdhd, ok := findPayload(trak, BoxTypeMdia(), BoxTypeMdhd()).(*Mdhd)
+		if !ok {
+			return false
+		}
+		lang := []byte{mdhd.Language[0] + 0x60, mdhd.Language[1] + 0x60, mdhd.Language[2] + 0x60}
+		if string(lang) != s.Language {
+			return false
+		}
+	}
+	return true
+}
+
+// RemuxInput is an input file of Remux.
+type RemuxInput struct {
+	Reader io.ReadSeeker
+
+	// Tracks selects the tracks which match any of the selectors. All tracks are selected when it is empty.
+	Tracks []TrackSelector
+
+	// Drop excludes the tracks which match any of the selectors.
+	Drop []TrackSelector
+}
+
+func (in *RemuxInput) selects(trak *BoxNode) bool {
+	selected := len(in.Tracks) == 0
+	for i := range in.Tracks {
+		selected = selected || in.Tracks[i].match(trak)
+	}
+	for i := range in.Drop {
+		selected = selected && !in.Drop[i].match(trak)
+	}
+	return selected
+}
+
+// Remux writes the selected tracks of the inputs to a new MP4 file.
+// The boxes of the first input other than the trak boxes, such as mvhd and udta, are kept,
+// and the selected trak boxes of the other inputs are added after the ones of the first input.
+// Track IDs are renumbered from 1 in that order, and mvhd.next_track_ID, tref boxes and trex boxes are updated.
+//
+// Progressive inputs are written with one mdat box where the chunks of all tracks are interleaved
+// in the order of their decode times, and the durations of mvhd and tkhd boxes are updated.
+// A fragmented input can not be merged with other inputs. Its traf boxes of the dropped tracks are removed,
+// and the mdat boxes are kept as they are.
+func Remux(inputs []*RemuxInput, w io.Writer) error {
+	if len(inputs) == 0 {
+		return errors.New("no input")
+	}
+	var trees []*BoxTree
+	var moovs []*BoxNode
+	var fragmented bool
+	for i, in := range inputs {
+		tree, err := ReadBoxTree(in.Reader)
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+		if moov == nil {
+			return fmt.Errorf("input %d: moov box not found", i)
+		}
+		if moov.FindFirst(BoxPath{BoxTypeMvex()}) != nil {
+			fragmented = true
+		}
+		trees = append(trees, tree)
+		moovs = append(moovs, moov)
+	}
+	if fragmented && len(inputs) != 1 {
+		return errors.New("fragmented file can not be merged with other files")
+	}
+
+	// select tracks and renumber them
+	base := moovs[0]
+	mvhd, ok := findPayload(base, BoxTypeMvhd()).(*Mvhd)
+	if !ok {
+		return errors.New("mvhd box not found")
+	}
+	var tracks []*remuxTrack
+	idMaps := make([]map[uint32]uint32, len(inputs)) // input index -> original track ID -> new track ID
+	for i, in := range inputs {
+		idMaps[i] = make(map[uint32]uint32)
+		var movieTimescale uint32
+		if mvhd, ok := findPayload(moovs[i], BoxTypeMvhd()).(*Mvhd); ok {
+			movieTimescale = mvhd.Timescale
+		}
+		for _, trak := range moovs[i].Find(BoxPath{BoxTypeTrak()}) {
+			tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd)
+			if !ok {
+				return fmt.Errorf("input %d: tkhd box not found", i)
+			}
+			if !in.selects(trak) {
+				trak.Remove()
+				continue
+			}
+			t := &remuxTrack{input: i, trak: trak, trackID: uint32(len(tracks) + 1)}
+			idMaps[i][tkhd.TrackID] = t.trackID
+			tkhd.TrackID = t.trackID
+			if i != 0 {
+				if err := rescaleEditList(trak, mvhd.Timescale, movieTimescale); err != nil {
+					return err
+				}
+			}
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return errors.New("no track is selected")
+	}
+	mvhd.NextTrackID = uint32(len(tracks) + 1)
+	for _, t := range tracks {
+		updateTrackReferences(t.trak, idMaps[t.input])
+	}
+
+	// move the trak boxes of the other inputs to the moov box of the first input
+	ref := base.FindFirst(BoxPath{BoxTypeMvhd()})
+	for _, t := range tracks {
+		if t.input == 0 {
+			ref = t.trak
+			continue
+		}
+		t.trak.Remove()
+		if err := base.InsertAfter(ref, t.trak); err != nil {
+			return err
+		}
+		ref = t.trak
+	}
+
+	if fragmented {
+		if err := remuxFragments(trees[0], idMaps[0]); err != nil {
+			return err
+		}
+		_, err := trees[0].WriteTo(w)
+		return err
+	}
+	return remuxSamples(inputs, trees[0], tracks, w)
+}
+
+type remuxTrack struct {
+	input   int
+	trak    *BoxNode
+	trackID uint32
+	stbl    *BoxNode
+	chunks  []*remuxChunk
+}
+
+type remuxChunk struct {
+	mediaChunk
+	r    io.ReadSeeker
+	time float64 // decode time of the first sample in seconds
+}
+
+// rescaleEditList converts the segment durations of the edit list to the movie timescale.
+func rescaleEditList(trak *BoxNode, to, from uint32) error {
+	elst, ok := findPayload(trak, BoxTypeEdts(), BoxTypeElst()).(*Elst)
+	if !ok || to == from {
+		return nil
+	}
+	if from == 0 {
+		return errors.New("movie timescale is zero")
+	}
+	var entries []ElstEntry
+	for i := range elst.Entries {
+		entries = append(entries, ElstEntry{
+			SegmentDurationV1: rescaleTime(elst.GetSegmentDuration(i), to, from),
+			MediaTimeV1:       elst.GetMediaTime(i),
+			MediaRateInteger:  elst.Entries[i].MediaRateInteger,
+		})
+	}
+	return setEditList(trak, newElst(entries))
+}
+
+// updateTrackReferences renumbers the track IDs in the tref box.
+// References to the dropped tracks and references of unknown types are removed.
+func updateTrackReferences(trak *BoxNode, idMap map[uint32]uint32) {
+	tref := trak.FindFirst(BoxPath{BoxTypeTref()})
+	if tref == nil {
+		return
+	}
+	for _, c := range append([]*BoxNode(nil), tref.Children...) {
+		ref, ok := c.Payload.(*TrackReferenceType)
+		if !ok {
+			c.Remove()
+			continue
+		}
+		var ids []uint32
+		for _, id := range ref.TrackIDs {
+			if newID, ok := idMap[id]; ok {
+				ids = append(ids, newID)
+			}
+		}
+		if len(ids) == 0 {
+			c.Remove()
+			continue
+		}
+		ref.TrackIDs = ids
+	}
+	if len(tref.Children) == 0 {
+		tref.Remove()
+	}
+}
+
+// remuxSamples writes the selected tracks of progressive inputs with one mdat box.
+func remuxSamples(inputs []*RemuxInput, tree *BoxTree, tracks []*remuxTrack, w io.Writer) error {
+	var chunks []*remuxChunk
+	durations := make(map[*BoxNode]uint64, len(tracks))
+	for _, t := range tracks {
+		st, err := readStblTrack(t.trak)
+		if err != nil {
+			return err
+		}
+		t.stbl = st.stbl
+		for _, s := range st.samples {
+			durations[t.trak] += uint64(s.Duration)
+		}
+		r := inputs[t.input].Reader
+		for k, s := range st.samples {
+			if k == 0 || s.Chunk != st.samples[k-1].Chunk {
+				for int(s.Chunk) >= len(t.chunks) {
+					// chunks which have no sample keep their positions
+					t.chunks = append(t.chunks, &remuxChunk{
+						mediaChunk: mediaChunk{srcOffset: st.offsets[k]},
+						r:          r,
+						time:       float64(st.dts[k]) / float64(st.timescale),
+					})
+				}
+			}
+			c := t.chunks[s.Chunk]
+			c.size += uint64(s.Size)
+			c.sampleCount++
+		}
+		chunks = append(chunks, t.chunks...)
+	}
+	updateDurations(tree.FindFirst(BoxPath{BoxTypeMoov()}), durations)
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].time < chunks[j].time
+	})
+	var dataSize uint64
+	for _, c := range chunks {
+		c.dstOffset = dataSize
+		dataSize += c.size
+	}
+
+	build := func(base uint64) error {
+		for _, t := range tracks {
+			offsets := make([]uint64, len(t.chunks))
+			for i, c := range t.chunks {
+				offsets[i] = base + c.dstOffset
+			}
+			if err := setChunkOffsets(t.stbl, offsets); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	writeData := func(w io.Writer) error {
+		for _, c := range chunks {
+			if err := copyChunks(w, c.r, []*mediaChunk{&c.mediaChunk}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return writeWithMdat(w, replaceMdats(tree), dataSize, build, writeData)
+}
+
+// setChunkOffsets replaces the stco or co64 box of the stbl box.
+// co64 box is used only when an offset exceeds 32 bits.
+func setChunkOffsets(stbl *BoxNode, offsets []uint64) error {
+	var box IBox
+	if len(offsets) != 0 && offsets[len(offsets)-1] > math.MaxUint32 {
+		box = &Co64{EntryCount: uint32(len(offsets)), ChunkOffset: offsets}
+	} else {
+		stco := &Stco{EntryCount: uint32(len(offsets)), ChunkOffset: make([]uint32, len(offsets))}
+		for i, offset := range offsets {
+			stco.ChunkOffset[i] = uint32(offset)
+		}
+		box = stco
+	}
+	for _, c := range stbl.Children {
+		if c.Info.Type == BoxTypeStco() || c.Info.Type == BoxTypeCo64() {
+			return c.Replace(NewBoxNode(box))
+		}
+	}
+	stbl.AppendChild(NewBoxNode(box))
+	return nil
+}
+
+// remuxFragments removes the boxes of the dropped tracks from the fragmented file and renumbers the track IDs.
+func remuxFragments(tree *BoxTree, idMap map[uint32]uint32) error {
+	for _, n := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypeMvex(), BoxTypeTrex()}) {
+		if trex, ok := n.Payload.(*Trex); ok {
+			if id, ok := idMap[trex.TrackID]; ok {
+				trex.TrackID = id
+			} else {
+				n.Remove()
+			}
+		}
+	}
+	for _, n := range tree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf()}) {
+		tfhd, ok := findPayload(n, BoxTypeTfhd()).(*Tfhd)
+		if !ok {
+			return errors.New("tfhd box not found")
+		}
+		if id, ok := idMap[tfhd.TrackID]; ok {
+			tfhd.TrackID = id
+		} else {
+			n.Remove()
+		}
+	}
+	for _, n := range tree.Find(BoxPath{BoxTypeSidx()}) {
+		if sidx, ok := n.Payload.(*Sidx); ok {
+			if id, ok := idMap[sidx.ReferenceID]; ok {
+				sidx.ReferenceID = id
+			} else {
+				n.Remove()
+			}
+		}
+	}
+	for _, n := range tree.Find(BoxPath{BoxTypeMfra(), BoxTypeTfra()}) {
+		if tfra, ok := n.Payload.(*Tfra); ok {
+			if id, ok := idMap[tfra.TrackID]; ok {
+				tfra.TrackID = id
+			} else {
+				n.Remove()
+			}
+		}
+	}
+	return nil
+}
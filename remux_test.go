@@ -0,0 +1,145 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemux(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+
+	// renumbered tracks which have references
+	tree, err := ReadBoxTree(bytes.NewReader(input))
+	require.NoError(t, err)
+	traks := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak()})
+	traks[0].FindFirst(BoxPath{BoxTypeTkhd()}).Payload.(*Tkhd).TrackID = 3
+	traks[1].FindFirst(BoxPath{BoxTypeTkhd()}).Payload.(*Tkhd).TrackID = 5
+	traks[1].InsertChild(1, NewBoxNode(&Tref{},
+		NewBoxNode(&TrackReferenceType{AnyTypeBox: AnyTypeBox{Type: StrToBoxType("sync")}, TrackIDs: []uint32{3, 9}}),
+		NewBoxNode(&TrackReferenceType{AnyTypeBox: AnyTypeBox{Type: StrToBoxType("hint")}, TrackIDs: []uint32{9}}),
+	))
+	edited := writeBoxTree(t, tree)
+
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Remux([]*RemuxInput{{Reader: bytes.NewReader(edited)}}, output))
+	r := bytes.NewReader(output.Bytes())
+	assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), 1), readTrackSampleData(t, r, 1))
+	assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), 2), readTrackSampleData(t, r, 2))
+
+	tree, err = ReadBoxTree(r)
+	require.NoError(t, err)
+	assert.Len(t, tree.Find(BoxPath{BoxTypeMdat()}), 1)
+	assert.Equal(t, uint32(3), tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeMvhd()}).Payload.(*Mvhd).NextTrackID)
+	refs := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeTref(), StrToBoxType("sync")})
+	require.Len(t, refs, 1)
+	assert.Equal(t, []uint32{1}, refs[0].Payload.(*TrackReferenceType).TrackIDs)
+	assert.Empty(t, tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeTref(), StrToBoxType("hint")}))
+}
+
+func TestRemuxSelectAndMerge(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+	video := readTrackSampleData(t, bytes.NewReader(input), 1)
+	audio := readTrackSampleData(t, bytes.NewReader(input), 2)
+
+	// extract the audio track
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Remux([]*RemuxInput{{
+		Reader: bytes.NewReader(input),
+		Tracks: []TrackSelector{{HandlerType: "soun", Language: "eng"}},
+	}}, output))
+	r := bytes.NewReader(output.Bytes())
+	info, err := Probe(r)
+	require.NoError(t, err)
+	require.Len(t, info.Tracks, 1)
+	assert.Equal(t, uint32(1), info.Tracks[0].TrackID)
+	assert.Equal(t, CodecMP4A, info.Tracks[0].Codec)
+	assert.Equal(t, audio, readTrackSampleData(t, r, 1))
+
+	// add the audio track of the second input as a dubbed audio track
+	merged := bytes.NewBuffer(nil)
+	require.NoError(t, Remux([]*RemuxInput{
+		{Reader: bytes.NewReader(input)},
+		{Reader: bytes.NewReader(output.Bytes())},
+	}, merged))
+	r = bytes.NewReader(merged.Bytes())
+	info, err = Probe(r)
+	require.NoError(t, err)
+	require.Len(t, info.Tracks, 3)
+	assert.Equal(t, video, readTrackSampleData(t, r, 1))
+	assert.Equal(t, audio, readTrackSampleData(t, r, 2))
+	assert.Equal(t, audio, readTrackSampleData(t, r, 3))
+	assert.Equal(t, info.Tracks[1].EditList, info.Tracks[2].EditList)
+
+	// chunks are interleaved in the order of their decode times
+	type chunk struct {
+		offset uint64
+		time   float64
+	}
+	var chunks []chunk
+	for _, track := range info.Tracks {
+		var dts uint64
+		var i uint32
+		for _, c := range track.Chunks {
+			chunks = append(chunks, chunk{offset: c.DataOffset, time: float64(dts) / float64(track.Timescale)})
+			for j := uint32(0); j < c.SamplesPerChunk; j++ {
+				dts += uint64(track.Samples[i].TimeDelta)
+				i++
+			}
+		}
+	}
+	for _, a := range chunks {
+		for _, b := range chunks {
+			if a.time < b.time {
+				assert.Less(t, a.offset, b.offset)
+			}
+		}
+	}
+
+	// drop the video track
+	output = bytes.NewBuffer(nil)
+	require.NoError(t, Remux([]*RemuxInput{{
+		Reader: bytes.NewReader(merged.Bytes()),
+		Drop:   []TrackSelector{{TrackID: 1}},
+	}}, output))
+	info, err = Probe(bytes.NewReader(output.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, info.Tracks, 2)
+	assert.Equal(t, uint32(1), info.Tracks[0].TrackID)
+	assert.Equal(t, uint32(2), info.Tracks[1].TrackID)
+}
+
+func TestRemuxFragmented(t *testing.T) {
+	input := readFile(t, "./testdata/sample_fragmented.mp4")
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, Remux([]*RemuxInput{{
+		Reader: bytes.NewReader(input),
+		Tracks: []TrackSelector{{Language: "eng"}},
+	}}, output))
+	r := bytes.NewReader(output.Bytes())
+	assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), 2), readTrackSampleData(t, r, 1))
+
+	tree, err := ReadBoxTree(r)
+	require.NoError(t, err)
+	assert.Len(t, tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak()}), 1)
+	trexs := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeMvex(), BoxTypeTrex()})
+	require.Len(t, trexs, 1)
+	assert.Equal(t, uint32(1), trexs[0].Payload.(*Trex).TrackID)
+	for _, tfhd := range tree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf(), BoxTypeTfhd()}) {
+		assert.Equal(t, uint32(1), tfhd.Payload.(*Tfhd).TrackID)
+	}
+	for _, tfra := range tree.Find(BoxPath{BoxTypeMfra(), BoxTypeTfra()}) {
+		assert.Equal(t, uint32(1), tfra.Payload.(*Tfra).TrackID)
+	}
+}
+
+func TestRemuxErrors(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+	fragmented := readFile(t, "./testdata/sample_fragmented.mp4")
+	assert.Error(t, Remux(nil, io.Discard))
+	assert.Error(t, Remux([]*RemuxInput{{Reader: bytes.NewReader(input), Tracks: []TrackSelector{{HandlerType: "text"}}}}, io.Discard))
+	assert.Error(t, Remux([]*RemuxInput{{Reader: bytes.NewReader(input)}, {Reader: bytes.NewReader(fragmented)}}, io.Discard))
+}
@@ -0,0 +1,490 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var ErrSampleNotFound = errors.New("sample not found")
+
+// ByteRange represents a contiguous range of the file.
+type ByteRange struct {
+	Offset uint64
+	Size   uint64
+}
+
+// SampleIndex answers time-based and index-based queries about samples of a track.
+// It keeps only run-length encoded tables of stbl box and a summary of each movie fragment,
+// so the memory usage does not grow with per-sample objects even for long files.
+// Samples of a movie fragment are loaded on demand by parsing the moof box.
+type SampleIndex struct {
+	r         io.ReadSeeker
+	trackID   uint32
+	timescale uint32
+	trexs     map[uint32]*Trex
+
+	// progressive part
+	sttsRuns     []sttsRun
+	cttsRuns     []cttsRun
+	stscRuns     []stscRun
+	chunkOffsets []uint64
+	sampleSize   uint32
+	entrySizes   []uint32
+	syncSamples  []uint32 // 1-based, nil means all samples are sync samples
+	stblCount    uint64
+	stblEndDTS   uint64
+
+	// fragmented part
+	fragments []*fragmentSummary
+	cache     *fragmentSummary
+	cached    []*MediaSample
+
+	minCTO int64
+	maxCTO int64
+}
+
+type sttsRun struct {
+	firstSample uint64
+	firstDTS    uint64
+	count       uint32
+	delta       uint32
+}
+
+type cttsRun struct {
+	firstSample uint64
+	count       uint32
+	offset      int64
+}
+
+type stscRun struct {
+	firstSample     uint64
+	firstChunk      uint32 // 0-based
+	chunkCount      uint32
+	samplesPerChunk uint32
+	descIdx         uint32
+}
+
+type fragmentSummary struct {
+	moof        *BoxInfo
+	firstSample uint64
+	firstDTS    uint64
+	endDTS      uint64
+	sampleCount uint64
+	syncSamples []uint32 // 0-based indices in the fragment
+}
+
+// NewSampleIndex builds SampleIndex of the specified track.
+// Movie fragments are found by scanning moof boxes at the top level.
+func NewSampleIndex(r io.ReadSeeker, trackID uint32) (*SampleIndex, error) {
+	it, err := NewSampleIterator(r, trackID)
+	if err != nil {
+		return nil, err
+	}
+	idx := &SampleIndex{
+		r:         r,
+		trackID:   trackID,
+		timescale: it.timescale,
+		trexs:     it.trexs,
+	}
+	first := true
+	updateCTO := func(cto int64) {
+		if first || cto < idx.minCTO {
+			idx.minCTO = cto
+		}
+		if first || cto > idx.maxCTO {
+			idx.maxCTO = cto
+		}
+		first = false
+	}
+
+	if c := it.stbl; c != nil {
+		if err := idx.buildSampleTables(c); err != nil {
+			return nil, err
+		}
+		if idx.stblCount != 0 {
+			if len(idx.cttsRuns) == 0 {
+				updateCTO(0)
+			}
+			for _, run := range idx.cttsRuns {
+				updateCTO(run.offset)
+			}
+		}
+	}
+
+	fit := &SampleIterator{r: r, trackID: trackID, trexs: it.trexs, nextDTS: idx.stblEndDTS}
+	next := idx.stblCount
+	for _, moof := range it.moofs {
+		samples, err := fit.readFragment(moof)
+		if err != nil {
+			return nil, err
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		f := &fragmentSummary{
+			moof:        moof,
+			firstSample: next,
+			firstDTS:    samples[0].DecodeTime,
+			sampleCount: uint64(len(samples)),
+		}
+		for i, s := range samples {
+			updateCTO(s.CompositionTimeOffset)
+			if s.IsSync {
+				f.syncSamples = append(f.syncSamples, uint32(i))
+			}
+			f.endDTS = s.DecodeTime + uint64(s.Duration)
+		}
+		idx.fragments = append(idx.fragments, f)
+		next += f.sampleCount
+	}
+	return idx, nil
+}
+
+func (idx *SampleIndex) buildSampleTables(c *stblCursor) error {
+	var sample, dts uint64
+	for _, e := range c.stts.Entries {
+		if e.SampleCount == 0 {
+			continue
+		}
+		idx.sttsRuns = append(idx.sttsRuns, sttsRun{firstSample: sample, firstDTS: dts, count: e.SampleCount, delta: e.SampleDelta})
+		sample += uint64(e.SampleCount)
+		dts += uint64(e.SampleCount) * uint64(e.SampleDelta)
+	}
+	idx.stblCount = sample
+	if uint64(c.stsz.SampleCount) < idx.stblCount {
+		idx.stblCount = uint64(c.stsz.SampleCount)
+	}
+	idx.stblEndDTS = dts
+
+	if c.ctts != nil {
+		sample = 0
+		for i, e := range c.ctts.Entries {
+			idx.cttsRuns = append(idx.cttsRuns, cttsRun{firstSample: sample, count: e.SampleCount, offset: c.ctts.GetSampleOffset(i)})
+			sample += uint64(e.SampleCount)
+		}
+	}
+
+	idx.chunkOffsets = c.chunkOffsets
+	sample = 0
+	for i, e := range c.stsc.Entries {
+		if e.FirstChunk == 0 || int(e.FirstChunk) > len(c.chunkOffsets) {
+			break
+		}
+		lastChunk := uint32(len(c.chunkOffsets))
+		if i+1 < len(c.stsc.Entries) && c.stsc.Entries[i+1].FirstChunk-1 < lastChunk {
+			lastChunk = c.stsc.Entries[i+1].FirstChunk - 1
+		}
+		if lastChunk < e.FirstChunk-1 {
+			continue
+		}
+		run := stscRun{
+			firstSample:     sample,
+			firstChunk:      e.FirstChunk - 1,
+			chunkCount:      lastChunk - (e.FirstChunk - 1),
+			samplesPerChunk: e.SamplesPerChunk,
+			descIdx:         e.SampleDescriptionIndex,
+		}
+		idx.stscRuns = append(idx.stscRuns, run)
+		sample += uint64(run.chunkCount) * uint64(run.samplesPerChunk)
+	}
+	if sample < idx.stblCount {
+		return fmt.Errorf("samples are not covered by chunks: samples=%d chunked=%d", idx.stblCount, sample)
+	}
+
+	idx.sampleSize = c.stsz.SampleSize
+	idx.entrySizes = c.stsz.EntrySize
+	if c.stss != nil {
+		idx.syncSamples = c.stss.SampleNumber
+		if idx.syncSamples == nil {
+			idx.syncSamples = []uint32{}
+		}
+	}
+	return nil
+}
+
+// TrackID returns the track ID of the indexed track.
+func (idx *SampleIndex) TrackID() uint32 {
+	return idx.trackID
+}
+
+// Timescale returns the media timescale of the indexed track.
+func (idx *SampleIndex) Timescale() uint32 {
+	return idx.timescale
+}
+
+// SampleCount returns the total number of samples including movie fragments.
+func (idx *SampleIndex) SampleCount() uint64 {
+	if len(idx.fragments) != 0 {
+		last := idx.fragments[len(idx.fragments)-1]
+		return last.firstSample + last.sampleCount
+	}
+	return idx.stblCount
+}
+
+// Sample returns the sample of the 0-based index.
+func (idx *SampleIndex) Sample(i uint64) (*MediaSample, error) {
+	if i < idx.stblCount {
+		return idx.stblSample(i), nil
+	}
+	f := idx.findFragmentBySample(i)
+	if f == nil {
+		return nil, ErrSampleNotFound
+	}
+	samples, err := idx.loadFragment(f)
+	if err != nil {
+		return nil, err
+	}
+	s := *samples[i-f.firstSample]
+	return &s, nil
+}
+
+// SampleAtTime returns the sample which is presented at the composition time t.
+// The sample has the greatest composition time which is not greater than t.
+func (idx *SampleIndex) SampleAtTime(t int64) (*MediaSample, error) {
+	count := idx.SampleCount()
+	if count == 0 {
+		return nil, ErrSampleNotFound
+	}
+	// PTS = DTS + CTO, so the candidates have DTS in [t-maxCTO, t-minCTO]
+	lo := idx.decodeIndexAt(t - idx.maxCTO)
+	hi := idx.decodeIndexAt(t - idx.minCTO)
+	var found *MediaSample
+	for i := lo; i <= hi && i < count; i++ {
+		s, err := idx.Sample(i)
+		if err != nil {
+			return nil, err
+		}
+		if pts := s.CompositionTime(); pts <= t && (found == nil || pts > found.CompositionTime()) {
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, ErrSampleNotFound
+	}
+	last := idx.lastEndTime()
+	if t >= last && found.CompositionTime()+int64(found.Duration) <= t {
+		return nil, ErrSampleNotFound
+	}
+	return found, nil
+}
+
+// SyncSampleBefore returns the nearest sync sample which precedes or equals the sample of the 0-based index.
+func (idx *SampleIndex) SyncSampleBefore(i uint64) (*MediaSample, error) {
+	if i >= idx.SampleCount() {
+		return nil, ErrSampleNotFound
+	}
+	for fi := len(idx.fragments) - 1; fi >= 0; fi-- {
+		f := idx.fragments[fi]
+		if f.firstSample > i {
+			continue
+		}
+		rel := uint32(i - f.firstSample)
+		n := sort.Search(len(f.syncSamples), func(k int) bool { return f.syncSamples[k] > rel })
+		if n > 0 {
+			return idx.Sample(f.firstSample + uint64(f.syncSamples[n-1]))
+		}
+		if f.firstSample == 0 {
+			return nil, ErrSampleNotFound
+		}
+		// continue from the last sample which precedes the fragment
+		i = f.firstSample - 1
+	}
+	if i >= idx.stblCount || idx.stblCount == 0 {
+		return nil, ErrSampleNotFound
+	}
+	if idx.syncSamples == nil {
+		return idx.Sample(i)
+	}
+	n := sort.Search(len(idx.syncSamples), func(k int) bool { return uint64(idx.syncSamples[k]) > i+1 })
+	if n == 0 {
+		return nil, ErrSampleNotFound
+	}
+	return idx.Sample(uint64(idx.syncSamples[n-1]) - 1)
+}
+
+// SyncSampleAtTime returns the nearest sync sample which precedes or equals the sample presented at t.
+func (idx *SampleIndex) SyncSampleAtTime(t int64) (*MediaSample, error) {
+	s, err := idx.SampleAtTime(t)
+	if err != nil {
+		return nil, err
+	}
+	return idx.SyncSampleBefore(s.Index)
+}
+
+// ByteRanges returns the byte ranges which cover samples from i to j (inclusive).
+// Adjacent samples are merged into one range.
+func (idx *SampleIndex) ByteRanges(i, j uint64) ([]ByteRange, error) {
+	if i > j || j >= idx.SampleCount() {
+		return nil, ErrSampleNotFound
+	}
+	var ranges []ByteRange
+	add := func(offset, size uint64) {
+		if n := len(ranges); n != 0 && ranges[n-1].Offset+ranges[n-1].Size == offset {
+			ranges[n-1].Size += size
+			return
+		}
+		ranges = append(ranges, ByteRange{Offset: offset, Size: size})
+	}
+	for k := i; k <= j; k++ {
+		s, err := idx.Sample(k)
+		if err != nil {
+			return nil, err
+		}
+		add(s.Offset, uint64(s.Size))
+		// samples in the same chunk are contiguous
+		offset := s.Offset + uint64(s.Size)
+		for k+1 <= j && k+1 < idx.stblCount && !idx.isChunkHead(k+1) {
+			k++
+			size := uint64(idx.sampleSizeOf(k))
+			add(offset, size)
+			offset += size
+		}
+	}
+	return ranges, nil
+}
+
+func (idx *SampleIndex) lastEndTime() int64 {
+	if len(idx.fragments) != 0 {
+		return int64(idx.fragments[len(idx.fragments)-1].endDTS) + idx.maxCTO
+	}
+	return int64(idx.stblEndDTS) + idx.maxCTO
+}
+
+// decodeIndexAt returns the index of the sample which is decoded at dts.
+func (idx *SampleIndex) decodeIndexAt(dts int64) uint64 {
+	if dts < 0 {
+		return 0
+	}
+	t := uint64(dts)
+	if t < idx.stblEndDTS || len(idx.fragments) == 0 {
+		n := sort.Search(len(idx.sttsRuns), func(k int) bool { return idx.sttsRuns[k].firstDTS > t })
+		if n == 0 {
+			return 0
+		}
+		run := idx.sttsRuns[n-1]
+		k := uint64(run.count) - 1
+		if run.delta != 0 && (t-run.firstDTS)/uint64(run.delta) < k {
+			k = (t - run.firstDTS) / uint64(run.delta)
+		}
+		return run.firstSample + k
+	}
+	n := sort.Search(len(idx.fragments), func(k int) bool { return idx.fragments[k].firstDTS > t })
+	if n == 0 {
+		if idx.stblCount != 0 {
+			return idx.stblCount - 1
+		}
+		return 0
+	}
+	f := idx.fragments[n-1]
+	samples, err := idx.loadFragment(f)
+	if err != nil || len(samples) == 0 {
+		return f.firstSample
+	}
+	m := sort.Search(len(samples), func(k int) bool { return samples[k].DecodeTime > t })
+	if m == 0 {
+		return f.firstSample
+	}
+	return f.firstSample + uint64(m-1)
+}
+
+func (idx *SampleIndex) stblSample(i uint64) *MediaSample {
+	s := &MediaSample{
+		TrackID: idx.trackID,
+		Index:   i,
+		IsSync:  true,
+	}
+
+	n := sort.Search(len(idx.sttsRuns), func(k int) bool { return idx.sttsRuns[k].firstSample > i })
+	if n > 0 {
+		run := idx.sttsRuns[n-1]
+		s.DecodeTime = run.firstDTS + (i-run.firstSample)*uint64(run.delta)
+		s.Duration = run.delta
+	}
+
+	n = sort.Search(len(idx.cttsRuns), func(k int) bool { return idx.cttsRuns[k].firstSample > i })
+	if n > 0 && i < idx.cttsRuns[n-1].firstSample+uint64(idx.cttsRuns[n-1].count) {
+		s.CompositionTimeOffset = idx.cttsRuns[n-1].offset
+	}
+
+	s.Size = idx.sampleSizeOf(i)
+	if run := idx.findStscRun(i); run != nil && run.samplesPerChunk != 0 {
+		rel := i - run.firstSample
+		chunk := run.firstChunk + uint32(rel/uint64(run.samplesPerChunk))
+		first := i - rel%uint64(run.samplesPerChunk)
+		s.Offset = idx.chunkOffsets[chunk]
+		if idx.sampleSize != 0 {
+			s.Offset += (i - first) * uint64(idx.sampleSize)
+		} else {
+			for k := first; k < i; k++ {
+				s.Offset += uint64(idx.sampleSizeOf(k))
+			}
+		}
+		s.SampleDescriptionIndex = run.descIdx
+	}
+
+	if idx.syncSamples != nil {
+		n = sort.Search(len(idx.syncSamples), func(k int) bool { return uint64(idx.syncSamples[k]) >= i+1 })
+		s.IsSync = n < len(idx.syncSamples) && uint64(idx.syncSamples[n]) == i+1
+	}
+	if !s.IsSync {
+		s.Flags |= SampleFlagIsNonSyncSample
+	}
+	return s
+}
+
+func (idx *SampleIndex) sampleSizeOf(i uint64) uint32 {
+	if idx.sampleSize != 0 {
+		return idx.sampleSize
+	}
+	if i < uint64(len(idx.entrySizes)) {
+		return idx.entrySizes[i]
+	}
+	return 0
+}
+
+func (idx *SampleIndex) findStscRun(i uint64) *stscRun {
+	n := sort.Search(len(idx.stscRuns), func(k int) bool { return idx.stscRuns[k].firstSample > i })
+	if n == 0 {
+		return nil
+	}
+	return &idx.stscRuns[n-1]
+}
+
+func (idx *SampleIndex) isChunkHead(i uint64) bool {
+	run := idx.findStscRun(i)
+	return run == nil || run.samplesPerChunk == 0 || (i-run.firstSample)%uint64(run.samplesPerChunk) == 0
+}
+
+func (idx *SampleIndex) findFragmentBySample(i uint64) *fragmentSummary {
+	n := sort.Search(len(idx.fragments), func(k int) bool { return idx.fragments[k].firstSample > i })
+	if n == 0 {
+		return nil
+	}
+	f := idx.fragments[n-1]
+	if i >= f.firstSample+f.sampleCount {
+		return nil
+	}
+	return f
+}
+
+func (idx *SampleIndex) loadFragment(f *fragmentSummary) ([]*MediaSample, error) {
+	if idx.cache == f {
+		return idx.cached, nil
+	}
+	it := &SampleIterator{r: idx.r, trackID: idx.trackID, trexs: idx.trexs, nextDTS: f.firstDTS}
+	samples, err := it.readFragment(f.moof)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(samples)) != f.sampleCount {
+		return nil, fmt.Errorf("inconsistent sample count: moofOffset=%d", f.moof.Offset)
+	}
+	for i, s := range samples {
+		s.Index = f.firstSample + uint64(i)
+	}
+	idx.cache = f
+	idx.cached = samples
+	return samples, nil
+}
@@ -0,0 +1,165 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleIndex(t *testing.T) {
+	testCases := []struct {
+		name string
+		file string
+	}{
+		{name: "progressive", file: "./testdata/sample.mp4"},
+		{name: "fragmented", file: "./testdata/sample_fragmented.mp4"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.Open(tc.file)
+			require.NoError(t, err)
+			defer f.Close()
+
+			its, err := NewSampleIterators(f)
+			require.NoError(t, err)
+			for _, it := range its {
+				samples := readAllSamples(t, it)
+				require.NotEmpty(t, samples)
+
+				idx, err := NewSampleIndex(f, it.TrackID())
+				require.NoError(t, err)
+				assert.Equal(t, it.TrackID(), idx.TrackID())
+				assert.Equal(t, it.Timescale(), idx.Timescale())
+				require.Equal(t, uint64(len(samples)), idx.SampleCount())
+
+				// random access in reverse order
+				for i := len(samples) - 1; i >= 0; i-- {
+					s, err := idx.Sample(uint64(i))
+					require.NoError(t, err)
+					assert.Equal(t, samples[i], s)
+				}
+				_, err = idx.Sample(uint64(len(samples)))
+				assert.Equal(t, ErrSampleNotFound, err)
+
+				// sample at time
+				for _, s := range samples {
+					for _, tm := range []int64{s.CompositionTime(), s.CompositionTime() + int64(s.Duration)/2} {
+						expected := samples[0]
+						for _, c := range samples {
+							if c.CompositionTime() <= tm && c.CompositionTime() > expected.CompositionTime() {
+								expected = c
+							}
+						}
+						found, err := idx.SampleAtTime(tm)
+						require.NoError(t, err)
+						assert.Equal(t, expected.Index, found.Index, "time=%d", tm)
+					}
+				}
+				last := samples[len(samples)-1]
+				_, err = idx.SampleAtTime(last.CompositionTime() + int64(last.Duration) + 1000000)
+				assert.Equal(t, ErrSampleNotFound, err)
+
+				// sync sample
+				for i := range samples {
+					var expected *MediaSample
+					for k := i; k >= 0; k-- {
+						if samples[k].IsSync {
+							expected = samples[k]
+							break
+						}
+					}
+					s, err := idx.SyncSampleBefore(uint64(i))
+					if expected == nil {
+						assert.Equal(t, ErrSampleNotFound, err)
+						continue
+					}
+					require.NoError(t, err)
+					assert.Equal(t, expected.Index, s.Index)
+					assert.True(t, s.IsSync)
+				}
+
+				// byte ranges
+				ranges, err := idx.ByteRanges(0, uint64(len(samples)-1))
+				require.NoError(t, err)
+				var total, covered uint64
+				for _, s := range samples {
+					total += uint64(s.Size)
+				}
+				for i, r := range ranges {
+					covered += r.Size
+					if i != 0 {
+						assert.NotEqual(t, ranges[i-1].Offset+ranges[i-1].Size, r.Offset)
+					}
+				}
+				assert.Equal(t, total, covered)
+
+				ranges, err = idx.ByteRanges(1, 1)
+				require.NoError(t, err)
+				assert.Equal(t, []ByteRange{{Offset: samples[1].Offset, Size: uint64(samples[1].Size)}}, ranges)
+
+				_, err = idx.ByteRanges(1, 0)
+				assert.Equal(t, ErrSampleNotFound, err)
+			}
+		})
+	}
+}
+
+func TestSampleIndexSyncSampleBeforeFragments(t *testing.T) {
+	// samples in stbl box are followed by a fragment which has no sync samples
+	tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample.mp4")))
+	require.NoError(t, err)
+	moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+	moov.AppendChild(NewBoxNode(&Mvex{},
+		NewBoxNode(&Trex{TrackID: 1, DefaultSampleDescriptionIndex: 1}),
+		NewBoxNode(&Trex{TrackID: 2, DefaultSampleDescriptionIndex: 1}),
+	))
+	tfhd := &Tfhd{TrackID: 1, DefaultSampleDuration: 512, DefaultSampleSize: 10, DefaultSampleFlags: SampleFlagIsNonSyncSample}
+	tfhd.SetFlags(TfhdDefaultBaseIsMoof | TfhdDefaultSampleDurationPresent | TfhdDefaultSampleSizePresent | TfhdDefaultSampleFlagsPresent)
+	trun := &Trun{SampleCount: 2, Entries: make([]TrunEntry, 2)}
+	trun.SetFlags(TrunDataOffsetPresent)
+	moof := NewBoxNode(&Moof{},
+		NewBoxNode(&Mfhd{SequenceNumber: 1}),
+		NewBoxNode(&Traf{}, NewBoxNode(tfhd), NewBoxNode(trun)),
+	)
+	tree.AppendChild(moof)
+	tree.AppendChild(NewRawBoxNode(BoxTypeMdat(), make([]byte, 20)))
+	require.NoError(t, tree.Relocate(0))
+	trun.DataOffset = int32(moof.Info.Size + 8)
+	output := bytes.NewBuffer(nil)
+	_, err = tree.WriteTo(output)
+	require.NoError(t, err)
+
+	r := bytes.NewReader(output.Bytes())
+	it, err := NewSampleIterator(r, 1)
+	require.NoError(t, err)
+	samples := readAllSamples(t, it)
+	idx, err := NewSampleIndex(r, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(samples)), idx.SampleCount())
+	require.False(t, samples[len(samples)-1].IsSync)
+
+	for i := len(samples) - 2; i < len(samples); i++ {
+		s, err := idx.SyncSampleBefore(uint64(i))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(0), s.Index)
+		assert.True(t, s.IsSync)
+	}
+}
+
+func TestSampleIndexUncoveredSamples(t *testing.T) {
+	// stsz and stts describe more samples than the chunks hold
+	tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample.mp4")))
+	require.NoError(t, err)
+	stco := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStco()}).Payload.(*Stco)
+	stco.ChunkOffset = stco.ChunkOffset[:len(stco.ChunkOffset)-1]
+	stco.EntryCount--
+	output := bytes.NewBuffer(nil)
+	_, err = tree.WriteTo(output)
+	require.NoError(t, err)
+
+	_, err = NewSampleIndex(bytes.NewReader(output.Bytes()), 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,456 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SampleFlagIsNonSyncSample is sample_is_non_sync_sample bit of sample_flags defined at ISO/IEC 14496-12 8.8.3.1
+const SampleFlagIsNonSyncSample = 0x00010000
+
+// MediaSample represents a sample which is described by stbl box or trun box.
+type MediaSample struct {
+	TrackID uint32
+	// Index is 0-based sample index in the track.
+	Index uint64
+	// DecodeTime is DTS in the media timescale.
+	DecodeTime uint64
+	// CompositionTimeOffset is the difference between PTS and DTS.
+	CompositionTimeOffset int64
+	Duration              uint32
+	Size                  uint32
+	// Offset is the absolute offset of the sample data in the file.
+	Offset                 uint64
+	IsSync                 bool
+	SampleDescriptionIndex uint32
+	// Flags has the same layout as sample_flags of trun box.
+	// For samples described by stbl box, it is built from stss and sdtp boxes.
+	Flags uint32
+	// MoofOffset is the offset of moof box which contains the sample.
+	// It is 0 for samples described by stbl box.
+	MoofOffset uint64
+}
+
+// CompositionTime returns PTS in the media timescale.
+func (s *MediaSample) CompositionTime() int64 {
+	return int64(s.DecodeTime) + s.CompositionTimeOffset
+}
+
+// SampleIterator iterates samples of a track in decoding order.
+// Samples described by stbl box are returned first, followed by samples of movie fragments.
+type SampleIterator struct {
+	r         io.ReadSeeker
+	trackID   uint32
+	timescale uint32
+	stbl      *stblCursor
+	trexs     map[uint32]*Trex
+	moofs     []*BoxInfo
+	moofIdx   int
+	fragment  []*MediaSample
+	index     uint64
+	nextDTS   uint64
+}
+
+// NewSampleIterators returns a SampleIterator for each track in the file.
+func NewSampleIterators(r io.ReadSeeker) ([]*SampleIterator, error) {
+	bis, err := ExtractBoxes(r, nil, []BoxPath{
+		{BoxTypeMoov(), BoxTypeTrak()},
+		{BoxTypeMoov(), BoxTypeMvex(), BoxTypeTrex()},
+		{BoxTypeMoof()},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var traks []*BoxInfo
+	var moofs []*BoxInfo
+	trexs := make(map[uint32]*Trex)
+	for _, bi := range bis {
+		switch bi.Type {
+		case BoxTypeTrak():
+			traks = append(traks, bi)
+		case BoxTypeMoof():
+			moofs = append(moofs, bi)
+		case BoxTypeTrex():
+			if _, err := bi.SeekToPayload(r); err != nil {
+				return nil, err
+			}
+			var trex Trex
+			if _, err := Unmarshal(r, bi.Size-bi.HeaderSize, &trex, bi.Context); err != nil {
+				return nil, err
+			}
+			trexs[trex.TrackID] = &trex
+		}
+	}
+
+	its := make([]*SampleIterator, 0, len(traks))
+	for _, trak := range traks {
+		it := &SampleIterator{r: r, moofs: moofs, trexs: trexs}
+		if err := it.loadTrak(trak); err != nil {
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	return its, nil
+}
+
+// NewSampleIterator returns a SampleIterator for the specified track.
+func NewSampleIterator(r io.ReadSeeker, trackID uint32) (*SampleIterator, error) {
+	its, err := NewSampleIterators(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range its {
+		if it.trackID == trackID {
+			return it, nil
+		}
+	}
+	return nil, fmt.Errorf("track not found: trackID=%d", trackID)
+}
+
+// TrackID returns the track ID of the iterated track.
+func (it *SampleIterator) TrackID() uint32 {
+	return it.trackID
+}
+
+// Timescale returns the media timescale of the iterated track.
+func (it *SampleIterator) Timescale() uint32 {
+	return it.timescale
+}
+
+// Next returns the next sample. It returns io.EOF when no more samples exist.
+func (it *SampleIterator) Next() (*MediaSample, error) {
+	if it.stbl != nil {
+		if s := it.stbl.next(); s != nil {
+			s.TrackID = it.trackID
+			s.Index = it.index
+			it.index++
+			it.nextDTS = s.DecodeTime + uint64(s.Duration)
+			return s, nil
+		}
+		it.stbl = nil
+	}
+
+	for len(it.fragment) == 0 {
+		if it.moofIdx >= len(it.moofs) {
+			return nil, io.EOF
+		}
+		samples, err := it.readFragment(it.moofs[it.moofIdx])
+		if err != nil {
+			return nil, err
+		}
+		it.moofIdx++
+		it.fragment = samples
+	}
+	s := it.fragment[0]
+	it.fragment = it.fragment[1:]
+	s.Index = it.index
+	it.index++
+	return s, nil
+}
+
+func (it *SampleIterator) loadTrak(trak *BoxInfo) error {
+	stblPath := BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()}
+	bips, err := ExtractBoxesWithPayload(it.r, trak, []BoxPath{
+		{BoxTypeTkhd()},
+		{BoxTypeMdia(), BoxTypeMdhd()},
+		append(stblPath, BoxTypeStts()),
+		append(stblPath, BoxTypeCtts()),
+		append(stblPath, BoxTypeStss()),
+		append(stblPath, BoxTypeStsc()),
+		append(stblPath, BoxTypeStsz()),
+		append(stblPath, BoxTypeStco()),
+		append(stblPath, BoxTypeCo64()),
+		append(stblPath, BoxTypeSdtp()),
+	})
+	if err != nil {
+		return err
+	}
+
+	c := new(stblCursor)
+	var tkhd *Tkhd
+	var mdhd *Mdhd
+	for _, bip := range bips {
+		switch box := bip.Payload.(type) {
+		case *Tkhd:
+			tkhd = box
+		case *Mdhd:
+			mdhd = box
+		case *Stts:
+			c.stts = box
+		case *Ctts:
+			c.ctts = box
+		case *Stss:
+			c.stss = box
+		case *Stsc:
+			c.stsc = box
+		case *Stsz:
+			c.stsz = box
+		case *Stco:
+			c.chunkOffsets = make([]uint64, len(box.ChunkOffset))
+			for i := range box.ChunkOffset {
+				c.chunkOffsets[i] = uint64(box.ChunkOffset[i])
+			}
+		case *Co64:
+			c.chunkOffsets = box.ChunkOffset
+		case *Sdtp:
+			c.sdtp = box
+		}
+	}
+	if tkhd == nil {
+		return errors.New("tkhd box not found")
+	}
+	if mdhd == nil {
+		return errors.New("mdhd box not found")
+	}
+	it.trackID = tkhd.TrackID
+	it.timescale = mdhd.Timescale
+	if c.stts != nil && c.stsc != nil && c.stsz != nil {
+		it.stbl = c
+	}
+	return nil
+}
+
+// stblCursor walks run-length encoded sample tables without expanding them.
+type stblCursor struct {
+	stts         *Stts
+	ctts         *Ctts
+	stss         *Stss
+	stsc         *Stsc
+	stsz         *Stsz
+	sdtp         *Sdtp
+	chunkOffsets []uint64
+
+	si        uint32
+	dts       uint64
+	sttsIdx   int
+	sttsUsed  uint32
+	cttsIdx   int
+	cttsUsed  uint32
+	stssIdx   int
+	stscIdx   int
+	chunkIdx  int
+	chunkRem  uint32
+	offset    uint64
+	started   bool
+	exhausted bool
+}
+
+func (c *stblCursor) next() *MediaSample {
+	if c.exhausted || c.si >= c.stsz.SampleCount {
+		return nil
+	}
+
+	// move to the next chunk
+	if !c.started {
+		c.started = true
+		c.chunkIdx = -1
+	}
+	for c.chunkRem == 0 {
+		c.chunkIdx++
+		if c.chunkIdx >= len(c.chunkOffsets) {
+			c.exhausted = true
+			return nil
+		}
+		for c.stscIdx+1 < len(c.stsc.Entries) && int(c.stsc.Entries[c.stscIdx+1].FirstChunk)-1 <= c.chunkIdx {
+			c.stscIdx++
+		}
+		if c.stscIdx >= len(c.stsc.Entries) || int(c.stsc.Entries[c.stscIdx].FirstChunk)-1 > c.chunkIdx {
+			continue
+		}
+		c.chunkRem = c.stsc.Entries[c.stscIdx].SamplesPerChunk
+		c.offset = c.chunkOffsets[c.chunkIdx]
+	}
+
+	// decoding time
+	for c.sttsIdx < len(c.stts.Entries) && c.sttsUsed >= c.stts.Entries[c.sttsIdx].SampleCount {
+		c.sttsIdx++
+		c.sttsUsed = 0
+	}
+	if c.sttsIdx >= len(c.stts.Entries) {
+		c.exhausted = true
+		return nil
+	}
+
+	s := &MediaSample{
+		DecodeTime:             c.dts,
+		Duration:               c.stts.Entries[c.sttsIdx].SampleDelta,
+		Offset:                 c.offset,
+		SampleDescriptionIndex: c.stsc.Entries[c.stscIdx].SampleDescriptionIndex,
+		IsSync:                 true,
+	}
+	c.sttsUsed++
+	c.dts += uint64(s.Duration)
+
+	// composition time offset
+	if c.ctts != nil {
+		for c.cttsIdx < len(c.ctts.Entries) && c.cttsUsed >= c.ctts.Entries[c.cttsIdx].SampleCount {
+			c.cttsIdx++
+			c.cttsUsed = 0
+		}
+		if c.cttsIdx < len(c.ctts.Entries) {
+			s.CompositionTimeOffset = c.ctts.GetSampleOffset(c.cttsIdx)
+			c.cttsUsed++
+		}
+	}
+
+	// size
+	if c.stsz.SampleSize != 0 {
+		s.Size = c.stsz.SampleSize
+	} else if int(c.si) < len(c.stsz.EntrySize) {
+		s.Size = c.stsz.EntrySize[c.si]
+	}
+
+	// sync sample
+	if c.stss != nil {
+		for c.stssIdx < len(c.stss.SampleNumber) && c.stss.SampleNumber[c.stssIdx] < c.si+1 {
+			c.stssIdx++
+		}
+		s.IsSync = c.stssIdx < len(c.stss.SampleNumber) && c.stss.SampleNumber[c.stssIdx] == c.si+1
+	}
+	if c.sdtp != nil && int(c.si) < len(c.sdtp.Samples) {
+		e := c.sdtp.Samples[c.si]
+		s.Flags = uint32(e.IsLeading)<<26 |
+			uint32(e.SampleDependsOn)<<24 |
+			uint32(e.SampleIsDependedOn)<<22 |
+			uint32(e.SampleHasRedundancy)<<20
+		if c.stss == nil && e.SampleDependsOn == 1 {
+			s.IsSync = false
+		}
+	}
+	if !s.IsSync {
+		s.Flags |= SampleFlagIsNonSyncSample
+	}
+
+	c.si++
+	c.chunkRem--
+	c.offset += uint64(s.Size)
+	return s
+}
+
+// readFragment returns the samples of the track in the movie fragment.
+func (it *SampleIterator) readFragment(moof *BoxInfo) ([]*MediaSample, error) {
+	trafs, err := ExtractBox(it.r, moof, BoxPath{BoxTypeTraf()})
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []*MediaSample
+	var prevTrafEnd uint64
+	for ti, traf := range trafs {
+		bips, err := ExtractBoxesWithPayload(it.r, traf, []BoxPath{
+			{BoxTypeTfhd()},
+			{BoxTypeTfdt()},
+			{BoxTypeTrun()},
+			{BoxTypeSdtp()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		var tfhd *Tfhd
+		var tfdt *Tfdt
+		var sdtp *Sdtp
+		var truns []*Trun
+		for _, bip := range bips {
+			switch box := bip.Payload.(type) {
+			case *Tfhd:
+				tfhd = box
+			case *Tfdt:
+				tfdt = box
+			case *Sdtp:
+				sdtp = box
+			case *Trun:
+				truns = append(truns, box)
+			}
+		}
+		if tfhd == nil {
+			return nil, errors.New("tfhd box not found")
+		}
+
+		// base data offset
+		var baseOffset uint64
+		if tfhd.CheckFlag(TfhdBaseDataOffsetPresent) {
+			baseOffset = tfhd.BaseDataOffset
+		} else if tfhd.CheckFlag(TfhdDefaultBaseIsMoof) || ti == 0 {
+			baseOffset = moof.Offset
+		} else {
+			baseOffset = prevTrafEnd
+		}
+
+		isTarget := tfhd.TrackID == it.trackID
+		// each traf takes the defaults from the trex of its own track
+		var trex Trex
+		if t := it.trexs[tfhd.TrackID]; t != nil {
+			trex = *t
+		}
+		descIdx := trex.DefaultSampleDescriptionIndex
+		if tfhd.CheckFlag(TfhdSampleDescriptionIndexPresent) {
+			descIdx = tfhd.SampleDescriptionIndex
+		}
+		defaultDuration := trex.DefaultSampleDuration
+		if tfhd.CheckFlag(TfhdDefaultSampleDurationPresent) {
+			defaultDuration = tfhd.DefaultSampleDuration
+		}
+		defaultSize := trex.DefaultSampleSize
+		if tfhd.CheckFlag(TfhdDefaultSampleSizePresent) {
+			defaultSize = tfhd.DefaultSampleSize
+		}
+		defaultFlags := trex.DefaultSampleFlags
+		if tfhd.CheckFlag(TfhdDefaultSampleFlagsPresent) {
+			defaultFlags = tfhd.DefaultSampleFlags
+		}
+		if isTarget && tfdt != nil {
+			it.nextDTS = tfdt.GetBaseMediaDecodeTime()
+		}
+
+		offset := baseOffset
+		var trafSampleIdx int
+		for _, trun := range truns {
+			if trun.CheckFlag(TrunDataOffsetPresent) {
+				offset = uint64(int64(baseOffset) + int64(trun.DataOffset))
+			}
+			for i := 0; i < int(trun.SampleCount); i++ {
+				s := &MediaSample{
+					TrackID:                tfhd.TrackID,
+					Duration:               defaultDuration,
+					Size:                   defaultSize,
+					Flags:                  defaultFlags,
+					SampleDescriptionIndex: descIdx,
+					Offset:                 offset,
+					MoofOffset:             moof.Offset,
+				}
+				if i < len(trun.Entries) {
+					if trun.CheckFlag(TrunSampleDurationPresent) {
+						s.Duration = trun.Entries[i].SampleDuration
+					}
+					if trun.CheckFlag(TrunSampleSizePresent) {
+						s.Size = trun.Entries[i].SampleSize
+					}
+					if trun.CheckFlag(TrunSampleFlagsPresent) {
+						s.Flags = trun.Entries[i].SampleFlags
+					}
+					if trun.CheckFlag(TrunSampleCompositionTimeOffsetPresent) {
+						s.CompositionTimeOffset = trun.GetSampleCompositionTimeOffset(i)
+					}
+				}
+				if i == 0 && trun.CheckFlag(TrunFirstSampleFlagsPresent) {
+					s.Flags = trun.FirstSampleFlags
+				}
+				if sdtp != nil && trafSampleIdx < len(sdtp.Samples) && sdtp.Samples[trafSampleIdx].SampleDependsOn == 1 {
+					s.Flags |= SampleFlagIsNonSyncSample
+				}
+				s.IsSync = s.Flags&SampleFlagIsNonSyncSample == 0
+				offset += uint64(s.Size)
+				trafSampleIdx++
+				if isTarget {
+					s.DecodeTime = it.nextDTS
+					it.nextDTS += uint64(s.Duration)
+					samples = append(samples, s)
+				}
+			}
+		}
+		prevTrafEnd = offset
+	}
+	return samples, nil
+}
@@ -0,0 +1,176 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAllSamples(t *testing.T, it *SampleIterator) []*MediaSample {
+	var samples []*MediaSample
+	for {
+		s, err := it.Next()
+		if err == io.EOF {
+			return samples
+		}
+		require.NoError(t, err)
+		samples = append(samples, s)
+	}
+}
+
+func TestSampleIterator(t *testing.T) {
+	f, err := os.Open("./testdata/sample.mp4")
+	require.NoError(t, err)
+	defer f.Close()
+
+	info, err := Probe(f)
+	require.NoError(t, err)
+
+	its, err := NewSampleIterators(f)
+	require.NoError(t, err)
+	require.Len(t, its, 2)
+	for ti, it := range its {
+		track := info.Tracks[ti]
+		assert.Equal(t, track.TrackID, it.TrackID())
+		assert.Equal(t, track.Timescale, it.Timescale())
+
+		samples := readAllSamples(t, it)
+		require.Len(t, samples, len(track.Samples))
+		var dts uint64
+		err := walkSampleData(track, func(si int, offset uint64, size uint32) error {
+			s := samples[si]
+			assert.Equal(t, track.TrackID, s.TrackID)
+			assert.Equal(t, uint64(si), s.Index)
+			assert.Equal(t, dts, s.DecodeTime)
+			assert.Equal(t, track.Samples[si].TimeDelta, s.Duration)
+			assert.Equal(t, track.Samples[si].CompositionTimeOffset, s.CompositionTimeOffset)
+			assert.Equal(t, int64(dts)+track.Samples[si].CompositionTimeOffset, s.CompositionTime())
+			assert.Equal(t, size, s.Size)
+			assert.Equal(t, offset, s.Offset)
+			assert.Equal(t, uint32(1), s.SampleDescriptionIndex)
+			assert.Zero(t, s.MoofOffset)
+			dts += uint64(s.Duration)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	// video track has stss box
+	samples := readAllSamples(t, its[0])
+	assert.Empty(t, samples)
+	it, err := NewSampleIterator(f, 1)
+	require.NoError(t, err)
+	samples = readAllSamples(t, it)
+	assert.True(t, samples[0].IsSync)
+	assert.Zero(t, samples[0].Flags&SampleFlagIsNonSyncSample)
+	for _, s := range samples[1:] {
+		assert.False(t, s.IsSync)
+		assert.NotZero(t, s.Flags&SampleFlagIsNonSyncSample)
+	}
+
+	_, err = NewSampleIterator(f, 3)
+	assert.Error(t, err)
+}
+
+func TestSampleIteratorWithFMP4(t *testing.T) {
+	f, err := os.Open("./testdata/sample_fragmented.mp4")
+	require.NoError(t, err)
+	defer f.Close()
+
+	info, err := Probe(f)
+	require.NoError(t, err)
+
+	its, err := NewSampleIterators(f)
+	require.NoError(t, err)
+	require.Len(t, its, 2)
+	for _, it := range its {
+		samples := readAllSamples(t, it)
+		var si int
+		for _, segment := range info.Segments {
+			if segment.TrackID != it.TrackID() {
+				continue
+			}
+			require.True(t, si+int(segment.SampleCount) <= len(samples))
+			var duration uint32
+			var size uint32
+			for i := 0; i < int(segment.SampleCount); i++ {
+				s := samples[si+i]
+				assert.Equal(t, it.TrackID(), s.TrackID)
+				assert.Equal(t, uint64(si+i), s.Index)
+				assert.Equal(t, segment.MoofOffset, s.MoofOffset)
+				assert.Equal(t, segment.BaseMediaDecodeTime+uint64(duration), s.DecodeTime)
+				assert.True(t, s.Offset > s.MoofOffset)
+				if i != 0 {
+					prev := samples[si+i-1]
+					assert.Equal(t, prev.Offset+uint64(prev.Size), s.Offset)
+				}
+				duration += s.Duration
+				size += s.Size
+			}
+			assert.Equal(t, segment.Duration, duration)
+			assert.Equal(t, segment.Size, size)
+			assert.True(t, samples[si].IsSync)
+			si += int(segment.SampleCount)
+		}
+		assert.Len(t, samples, si)
+	}
+}
+
+func TestSampleIteratorWithTrexDefaults(t *testing.T) {
+	tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample_fragmented.mp4")))
+	require.NoError(t, err)
+	for _, n := range append([]*BoxNode(nil), tree.Children...) {
+		if n.Info.Type != BoxTypeFtyp() && n.Info.Type != BoxTypeMoov() {
+			n.Remove()
+		}
+	}
+	for _, n := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypeMvex(), BoxTypeTrex()}) {
+		if trex := n.Payload.(*Trex); trex.TrackID == 2 {
+			trex.DefaultSampleSize = 10
+		}
+	}
+
+	// the audio traf takes the sample size from its trex,
+	// and the video traf which follows it relies on the implicit base data offset
+	audioTrun := &Trun{SampleCount: 3, Entries: make([]TrunEntry, 3)}
+	audioTrun.SetFlags(TrunDataOffsetPresent)
+	videoTrun := &Trun{SampleCount: 2, Entries: []TrunEntry{{SampleSize: 5}, {SampleSize: 7}}}
+	videoTrun.SetFlags(TrunSampleSizePresent)
+	moof := NewBoxNode(&Moof{},
+		NewBoxNode(&Mfhd{SequenceNumber: 1}),
+		NewBoxNode(&Traf{}, NewBoxNode(&Tfhd{TrackID: 2}), NewBoxNode(audioTrun)),
+		NewBoxNode(&Traf{}, NewBoxNode(&Tfhd{TrackID: 1}), NewBoxNode(videoTrun)),
+	)
+	mdat := NewRawBoxNode(BoxTypeMdat(), make([]byte, 42))
+	tree.AppendChild(moof)
+	tree.AppendChild(mdat)
+	require.NoError(t, tree.Relocate(0))
+	audioTrun.DataOffset = int32(moof.Info.Size + 8)
+	output := bytes.NewBuffer(nil)
+	_, err = tree.WriteTo(output)
+	require.NoError(t, err)
+
+	base := mdat.Info.Offset + mdat.Info.HeaderSize
+	its, err := NewSampleIterators(bytes.NewReader(output.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, its, 2)
+	type sample struct {
+		offset uint64
+		size   uint32
+	}
+	expected := map[uint32][]sample{
+		1: {{base + 30, 5}, {base + 35, 7}},
+		2: {{base, 10}, {base + 10, 10}, {base + 20, 10}},
+	}
+	for _, it := range its {
+		var actual []sample
+		for _, s := range readAllSamples(t, it) {
+			actual = append(actual, sample{s.Offset, s.Size})
+		}
+		assert.Equal(t, expected[it.TrackID()], actual)
+	}
+}
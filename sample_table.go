@@ -0,0 +1,457 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// SampleTableEntry represents a sample in a sample table.
+type SampleTableEntry struct {
+	Duration              uint32
+	CompositionTimeOffset int64
+	Size                  uint32
+	IsSync                bool
+	// Chunk is the 0-based index of the chunk which contains the sample.
+	Chunk uint32
+	// SampleDescriptionIndex is the 1-based index of the sample entry in stsd box.
+	SampleDescriptionIndex uint32
+}
+
+// SampleTable holds the boxes which describe samples in a stbl box.
+type SampleTable struct {
+	Stts *Stts
+	// Ctts is nil when all composition time offsets are zero.
+	Ctts *Ctts
+	// Cslg is nil unless Ctts has negative composition time offsets.
+	Cslg *Cslg
+	// Stss is nil when all samples are sync samples.
+	Stss *Stss
+	Stsc *Stsc
+	Stsz *Stsz
+	// Either Stco or Co64 is non-nil.
+	Stco *Stco
+	Co64 *Co64
+}
+
+// Boxes returns the boxes of the table in the recommended order, skipping nil boxes.
+func (st *SampleTable) Boxes() []IBox {
+	boxes := []IBox{st.Stts}
+	if st.Ctts != nil {
+		boxes = append(boxes, st.Ctts)
+	}
+	if st.Cslg != nil {
+		boxes = append(boxes, st.Cslg)
+	}
+	if st.Stss != nil {
+		boxes = append(boxes, st.Stss)
+	}
+	boxes = append(boxes, st.Stsc, st.Stsz)
+	if st.Co64 != nil {
+		return append(boxes, st.Co64)
+	}
+	return append(boxes, st.Stco)
+}
+
+// SampleTableBuilder builds the minimal sample table from samples in decoding order.
+// Consecutive samples which have the same values are run-length encoded.
+type SampleTableBuilder struct {
+	sampleCount uint32
+	stts        []SttsEntry
+	ctts        []cttsRun
+	stss        []uint32
+	allSync     bool
+	sizes       []uint32
+	stsc        []StscEntry
+	chunkCount  uint32
+	chunk       StscEntry // the last chunk
+
+	dts                uint64
+	minCTO, maxCTO     int64
+	minCT, maxCT       int64
+	compositionStarted bool
+}
+
+// NewSampleTableBuilder returns a new SampleTableBuilder.
+func NewSampleTableBuilder() *SampleTableBuilder {
+	return &SampleTableBuilder{allSync: true}
+}
+
+// AddSample appends a sample. The chunk index of the sample must be equal to that of the previous sample or the next one,
+// and all samples in a chunk must have the same sample description index.
+func (b *SampleTableBuilder) AddSample(s SampleTableEntry) error {
+	if b.chunkCount == 0 {
+		if s.Chunk != 0 {
+			return errors.New("first sample must be in the first chunk")
+		}
+		b.chunkCount = 1
+		b.chunk = StscEntry{FirstChunk: 1, SampleDescriptionIndex: s.SampleDescriptionIndex}
+	} else if s.Chunk == b.chunkCount {
+		b.stsc = appendStscEntry(b.stsc, b.chunk)
+		b.chunkCount++
+		b.chunk = StscEntry{FirstChunk: b.chunkCount, SampleDescriptionIndex: s.SampleDescriptionIndex}
+	} else if s.Chunk != b.chunkCount-1 {
+		return fmt.Errorf("unexpected chunk index: chunk=%d", s.Chunk)
+	} else if s.SampleDescriptionIndex != b.chunk.SampleDescriptionIndex {
+		return fmt.Errorf("sample description index must be same in a chunk: chunk=%d", s.Chunk)
+	}
+	b.chunk.SamplesPerChunk++
+
+	b.sampleCount++
+	if n := len(b.stts); n != 0 && b.stts[n-1].SampleDelta == s.Duration {
+		b.stts[n-1].SampleCount++
+	} else {
+		b.stts = append(b.stts, SttsEntry{SampleCount: 1, SampleDelta: s.Duration})
+	}
+	if n := len(b.ctts); n != 0 && b.ctts[n-1].offset == s.CompositionTimeOffset {
+		b.ctts[n-1].count++
+	} else {
+		b.ctts = append(b.ctts, cttsRun{count: 1, offset: s.CompositionTimeOffset})
+	}
+	if s.IsSync {
+		b.stss = append(b.stss, b.sampleCount)
+	} else {
+		b.allSync = false
+	}
+	b.sizes = append(b.sizes, s.Size)
+
+	ct := int64(b.dts) + s.CompositionTimeOffset
+	if !b.compositionStarted || s.CompositionTimeOffset < b.minCTO {
+		b.minCTO = s.CompositionTimeOffset
+	}
+	if !b.compositionStarted || s.CompositionTimeOffset > b.maxCTO {
+		b.maxCTO = s.CompositionTimeOffset
+	}
+	if !b.compositionStarted || ct < b.minCT {
+		b.minCT = ct
+	}
+	if !b.compositionStarted || ct+int64(s.Duration) > b.maxCT {
+		b.maxCT = ct + int64(s.Duration)
+	}
+	b.compositionStarted = true
+	b.dts += uint64(s.Duration)
+	return nil
+}
+
+// appendStscEntry appends the chunk to stsc entries unless it has same values as the last entry.
+func appendStscEntry(entries []StscEntry, chunk StscEntry) []StscEntry {
+	if n := len(entries); n != 0 &&
+		entries[n-1].SamplesPerChunk == chunk.SamplesPerChunk &&
+		entries[n-1].SampleDescriptionIndex == chunk.SampleDescriptionIndex {
+		return entries
+	}
+	return append(entries, chunk)
+}
+
+// SampleCount returns the number of added samples.
+func (b *SampleTableBuilder) SampleCount() uint32 {
+	return b.sampleCount
+}
+
+// ChunkCount returns the number of chunks which the added samples belong to.
+func (b *SampleTableBuilder) ChunkCount() uint32 {
+	return b.chunkCount
+}
+
+// Build returns the sample table. chunkOffsets must have an offset for each chunk.
+// co64 box is used instead of stco box only when an offset exceeds 32 bits.
+// Build can be called repeatedly with different chunk offsets.
+func (b *SampleTableBuilder) Build(chunkOffsets []uint64) (*SampleTable, error) {
+	if uint32(len(chunkOffsets)) != b.chunkCount {
+		return nil, fmt.Errorf("number of chunk offsets mismatch: expected=%d actual=%d", b.chunkCount, len(chunkOffsets))
+	}
+	st := &SampleTable{
+		Stts: &Stts{EntryCount: uint32(len(b.stts)), Entries: append([]SttsEntry{}, b.stts...)},
+	}
+
+	if b.minCTO != 0 || b.maxCTO != 0 {
+		st.Ctts = &Ctts{EntryCount: uint32(len(b.ctts)), Entries: make([]CttsEntry, len(b.ctts))}
+		if b.minCTO < 0 {
+			st.Ctts.SetVersion(1)
+			if b.minCTO < math.MinInt32 || b.maxCTO > math.MaxInt32 {
+				return nil, errors.New("composition time offset overflows 32 bits")
+			}
+		} else if b.maxCTO > math.MaxUint32 {
+			return nil, errors.New("composition time offset overflows 32 bits")
+		}
+		for i, run := range b.ctts {
+			st.Ctts.Entries[i].SampleCount = run.count
+			if st.Ctts.GetVersion() == 0 {
+				st.Ctts.Entries[i].SampleOffsetV0 = uint32(run.offset)
+			} else {
+				st.Ctts.Entries[i].SampleOffsetV1 = int32(run.offset)
+			}
+		}
+		if b.minCTO < 0 {
+			st.Cslg = b.buildCslg()
+		}
+	}
+
+	if !b.allSync {
+		st.Stss = &Stss{EntryCount: uint32(len(b.stss)), SampleNumber: append([]uint32{}, b.stss...)}
+	}
+
+	stsc := append([]StscEntry{}, b.stsc...)
+	if b.chunkCount != 0 {
+		stsc = appendStscEntry(stsc, b.chunk)
+	}
+	st.Stsc = &Stsc{EntryCount: uint32(len(stsc)), Entries: stsc}
+
+	st.Stsz = &Stsz{SampleCount: b.sampleCount}
+	constant := len(b.sizes) != 0
+	for _, size := range b.sizes {
+		constant = constant && size == b.sizes[0]
+	}
+	if constant {
+		st.Stsz.SampleSize = b.sizes[0]
+	} else {
+		st.Stsz.EntrySize = append([]uint32{}, b.sizes...)
+	}
+
+	var large bool
+	for _, offset := range chunkOffsets {
+		large = large || offset > math.MaxUint32
+	}
+	if large {
+		st.Co64 = &Co64{EntryCount: uint32(len(chunkOffsets)), ChunkOffset: append([]uint64{}, chunkOffsets...)}
+	} else {
+		st.Stco = &Stco{EntryCount: uint32(len(chunkOffsets)), ChunkOffset: make([]uint32, len(chunkOffsets))}
+		for i, offset := range chunkOffsets {
+			st.Stco.ChunkOffset[i] = uint32(offset)
+		}
+	}
+	return st, nil
+}
+
+func (b *SampleTableBuilder) buildCslg() *Cslg {
+	shift := -b.minCTO
+	values := []int64{shift, b.minCTO, b.maxCTO, b.minCT, b.maxCT}
+	for _, v := range values {
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			return &Cslg{
+				FullBox:                        FullBox{Version: 1},
+				CompositionToDTSShiftV1:        shift,
+				LeastDecodeToDisplayDeltaV1:    b.minCTO,
+				GreatestDecodeToDisplayDeltaV1: b.maxCTO,
+				CompositionStartTimeV1:         b.minCT,
+				CompositionEndTimeV1:           b.maxCT,
+			}
+		}
+	}
+	return &Cslg{
+		CompositionToDTSShiftV0:        int32(shift),
+		LeastDecodeToDisplayDeltaV0:    int32(b.minCTO),
+		GreatestDecodeToDisplayDeltaV0: int32(b.maxCTO),
+		CompositionStartTimeV0:         int32(b.minCT),
+		CompositionEndTimeV0:           int32(b.maxCT),
+	}
+}
+
+// BuildSampleTable builds the minimal sample table from samples in decoding order and chunk offsets.
+func BuildSampleTable(samples []SampleTableEntry, chunkOffsets []uint64) (*SampleTable, error) {
+	b := NewSampleTableBuilder()
+	for _, s := range samples {
+		if err := b.AddSample(s); err != nil {
+			return nil, err
+		}
+	}
+	return b.Build(chunkOffsets)
+}
+
+// ExpandSampleTable expands the sample table to samples in decoding order and chunk offsets.
+// Stts, Stsc and either Stco or Co64 are required. Samples have zero sizes when Stsz is nil.
+// Entries which exceed the number of samples or chunks are ignored.
+func ExpandSampleTable(st *SampleTable) ([]SampleTableEntry, []uint64, error) {
+	var chunkOffsets []uint64
+	if st.Stco != nil {
+		chunkOffsets = make([]uint64, len(st.Stco.ChunkOffset))
+		for i, offset := range st.Stco.ChunkOffset {
+			chunkOffsets[i] = uint64(offset)
+		}
+	} else if st.Co64 != nil {
+		chunkOffsets = append([]uint64{}, st.Co64.ChunkOffset...)
+	} else {
+		return nil, nil, errors.New("stco/co64 box not found")
+	}
+
+	if st.Stts == nil {
+		return nil, nil, errors.New("stts box not found")
+	}
+	samples := make([]SampleTableEntry, 0)
+	for _, entry := range st.Stts.Entries {
+		for i := uint32(0); i < entry.SampleCount; i++ {
+			samples = append(samples, SampleTableEntry{Duration: entry.SampleDelta, IsSync: st.Stss == nil})
+		}
+	}
+
+	if st.Stsc == nil {
+		return nil, nil, errors.New("stsc box not found")
+	}
+	var si int
+	for ei, entry := range st.Stsc.Entries {
+		end := uint32(len(chunkOffsets))
+		if ei != len(st.Stsc.Entries)-1 && st.Stsc.Entries[ei+1].FirstChunk-1 < end {
+			end = st.Stsc.Entries[ei+1].FirstChunk - 1
+		}
+		for ci := entry.FirstChunk - 1; ci < end; ci++ {
+			for i := uint32(0); i < entry.SamplesPerChunk && si < len(samples); i++ {
+				samples[si].Chunk = ci
+				samples[si].SampleDescriptionIndex = entry.SampleDescriptionIndex
+				si++
+			}
+		}
+	}
+
+	if st.Ctts != nil {
+		si = 0
+		for ei, entry := range st.Ctts.Entries {
+			for i := uint32(0); i < entry.SampleCount && si < len(samples); i++ {
+				samples[si].CompositionTimeOffset = st.Ctts.GetSampleOffset(ei)
+				si++
+			}
+		}
+	}
+
+	if st.Stsz != nil {
+		if st.Stsz.SampleSize != 0 {
+			for i := range samples {
+				samples[i].Size = st.Stsz.SampleSize
+			}
+		}
+		for i := 0; i < len(st.Stsz.EntrySize) && i < len(samples); i++ {
+			samples[i].Size = st.Stsz.EntrySize[i]
+		}
+	}
+
+	if st.Stss != nil {
+		for _, num := range st.Stss.SampleNumber {
+			if num != 0 && int(num) <= len(samples) {
+				samples[num-1].IsSync = true
+			}
+		}
+	}
+	return samples, chunkOffsets, nil
+}
+
+// stblTrack is a track whose sample table is expanded.
+type stblTrack struct {
+	trak          *BoxNode
+	stbl          *BoxNode
+	trackID       uint32
+	timescale     uint32
+	mediaOffset   int64  // media time of the start of the presentation
+	emptyDuration uint64 // duration of the leading empty edits in the movie timescale
+	samples       []SampleTableEntry
+	dts           []uint64
+	offsets       []uint64
+	allSync       bool
+	preRoll       uint32 // number of samples which are required to decode a sample
+}
+
+// readStblTrack reads the sample table of the trak box.
+func readStblTrack(trak *BoxNode) (*stblTrack, error) {
+	t := &stblTrack{trak: trak}
+	if tkhd, ok := findPayload(trak, BoxTypeTkhd()).(*Tkhd); ok {
+		t.trackID = tkhd.TrackID
+	}
+	mdhd, ok := findPayload(trak, BoxTypeMdia(), BoxTypeMdhd()).(*Mdhd)
+	if !ok {
+		return nil, fmt.Errorf("mdhd box not found: trackID=%d", t.trackID)
+	}
+	t.timescale = mdhd.Timescale
+	if t.timescale == 0 {
+		return nil, fmt.Errorf("timescale is zero: trackID=%d", t.trackID)
+	}
+	t.stbl = trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+	if t.stbl == nil {
+		return nil, fmt.Errorf("stbl box not found: trackID=%d", t.trackID)
+	}
+
+	if elst, ok := findPayload(trak, BoxTypeEdts(), BoxTypeElst()).(*Elst); ok {
+		var found bool
+		for i := range elst.Entries {
+			if elst.GetMediaTime(i) == -1 {
+				if !found {
+					t.emptyDuration += elst.GetSegmentDuration(i)
+				}
+				continue
+			}
+			if found {
+				return nil, fmt.Errorf("edit list which has multiple edits is not supported: trackID=%d", t.trackID)
+			}
+			t.mediaOffset = elst.GetMediaTime(i)
+			found = true
+		}
+	}
+
+	var st SampleTable
+	for _, c := range t.stbl.Children {
+		switch box := c.Payload.(type) {
+		case *Stts:
+			st.Stts = box
+		case *Ctts:
+			st.Ctts = box
+		case *Stss:
+			st.Stss = box
+		case *Stsc:
+			st.Stsc = box
+		case *Stsz:
+			st.Stsz = box
+		case *Stco:
+			st.Stco = box
+		case *Co64:
+			st.Co64 = box
+		case *Sgpd:
+			// audio codecs such as AAC require preceding samples to decode a sample
+			if box.GroupingType == [4]byte{'r', 'o', 'l', 'l'} || box.GroupingType == [4]byte{'p', 'r', 'o', 'l'} {
+				for _, d := range box.RollDistances {
+					if d < 0 && uint32(-d) > t.preRoll {
+						t.preRoll = uint32(-d)
+					}
+				}
+			}
+		case *Saiz, *Saio:
+			return nil, fmt.Errorf("track which has sample auxiliary information is not supported: trackID=%d", t.trackID)
+		}
+	}
+	if st.Stsz == nil {
+		return nil, fmt.Errorf("stsz box not found: trackID=%d", t.trackID)
+	}
+	samples, chunkOffsets, err := ExpandSampleTable(&st)
+	if err != nil {
+		return nil, err
+	}
+	t.samples = samples
+	t.allSync = st.Stss == nil
+	t.dts = make([]uint64, len(samples))
+	t.offsets = make([]uint64, len(samples))
+	var dts, offset uint64
+	for i, s := range samples {
+		if int(s.Chunk) >= len(chunkOffsets) {
+			return nil, fmt.Errorf("chunk offset not found: trackID=%d", t.trackID)
+		}
+		if i == 0 || s.Chunk != samples[i-1].Chunk {
+			offset = chunkOffsets[s.Chunk]
+		}
+		t.dts[i] = dts
+		t.offsets[i] = offset
+		dts += uint64(s.Duration)
+		offset += uint64(s.Size)
+	}
+	return t, nil
+}
+
+func (t *stblTrack) cts(i uint32) int64 {
+	return int64(t.dts[i]) + t.samples[i].CompositionTimeOffset
+}
+
+// presentationEnd returns the end of the composition times of the samples.
+func (t *stblTrack) presentationEnd() int64 {
+	var end int64
+	for i := range t.samples {
+		if e := t.cts(uint32(i)) + int64(t.samples[i].Duration); e > end {
+			end = e
+		}
+	}
+	return end
+}
@@ -0,0 +1,140 @@
+package mp4
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildSampleTable(t *testing.T) {
+	samples := []SampleTableEntry{
+		{Duration: 100, CompositionTimeOffset: 100, Size: 10, IsSync: true, Chunk: 0, SampleDescriptionIndex: 1},
+		{Duration: 100, CompositionTimeOffset: -100, Size: 20, Chunk: 0, SampleDescriptionIndex: 1},
+		{Duration: 100, CompositionTimeOffset: 0, Size: 30, Chunk: 1, SampleDescriptionIndex: 1},
+		{Duration: 100, CompositionTimeOffset: 0, Size: 40, Chunk: 1, SampleDescriptionIndex: 1},
+		{Duration: 50, CompositionTimeOffset: 0, Size: 50, IsSync: true, Chunk: 2, SampleDescriptionIndex: 1},
+		{Duration: 50, CompositionTimeOffset: 0, Size: 60, Chunk: 2, SampleDescriptionIndex: 1},
+		{Duration: 50, CompositionTimeOffset: 0, Size: 70, Chunk: 3, SampleDescriptionIndex: 2},
+	}
+	st, err := BuildSampleTable(samples, []uint64{1000, 2000, 3000, 4000})
+	require.NoError(t, err)
+
+	assert.Equal(t, &Stts{EntryCount: 2, Entries: []SttsEntry{
+		{SampleCount: 4, SampleDelta: 100},
+		{SampleCount: 3, SampleDelta: 50},
+	}}, st.Stts)
+	assert.Equal(t, &Ctts{FullBox: FullBox{Version: 1}, EntryCount: 3, Entries: []CttsEntry{
+		{SampleCount: 1, SampleOffsetV1: 100},
+		{SampleCount: 1, SampleOffsetV1: -100},
+		{SampleCount: 5, SampleOffsetV1: 0},
+	}}, st.Ctts)
+	assert.Equal(t, &Cslg{
+		CompositionToDTSShiftV0:        100,
+		LeastDecodeToDisplayDeltaV0:    -100,
+		GreatestDecodeToDisplayDeltaV0: 100,
+		CompositionStartTimeV0:         0,
+		CompositionEndTimeV0:           550,
+	}, st.Cslg)
+	assert.Equal(t, &Stss{EntryCount: 2, SampleNumber: []uint32{1, 5}}, st.Stss)
+	assert.Equal(t, &Stsc{EntryCount: 2, Entries: []StscEntry{
+		{FirstChunk: 1, SamplesPerChunk: 2, SampleDescriptionIndex: 1},
+		{FirstChunk: 4, SamplesPerChunk: 1, SampleDescriptionIndex: 2},
+	}}, st.Stsc)
+	assert.Equal(t, &Stsz{SampleCount: 7, EntrySize: []uint32{10, 20, 30, 40, 50, 60, 70}}, st.Stsz)
+	assert.Equal(t, &Stco{EntryCount: 4, ChunkOffset: []uint32{1000, 2000, 3000, 4000}}, st.Stco)
+	assert.Nil(t, st.Co64)
+	assert.Equal(t, []IBox{st.Stts, st.Ctts, st.Cslg, st.Stss, st.Stsc, st.Stsz, st.Stco}, st.Boxes())
+
+	expanded, offsets, err := ExpandSampleTable(st)
+	require.NoError(t, err)
+	assert.Equal(t, samples, expanded)
+	assert.Equal(t, []uint64{1000, 2000, 3000, 4000}, offsets)
+}
+
+func TestBuildSampleTableMinimal(t *testing.T) {
+	b := NewSampleTableBuilder()
+	for i := 0; i < 4; i++ {
+		require.NoError(t, b.AddSample(SampleTableEntry{Duration: 1024, Size: 100, IsSync: true, Chunk: uint32(i / 2), SampleDescriptionIndex: 1}))
+	}
+	assert.Equal(t, uint32(4), b.SampleCount())
+	assert.Equal(t, uint32(2), b.ChunkCount())
+
+	st, err := b.Build([]uint64{100, math.MaxUint32 + 1})
+	require.NoError(t, err)
+	assert.Nil(t, st.Ctts)
+	assert.Nil(t, st.Cslg)
+	assert.Nil(t, st.Stss)
+	assert.Nil(t, st.Stco)
+	assert.Equal(t, &Stsz{SampleSize: 100, SampleCount: 4}, st.Stsz)
+	assert.Equal(t, &Stsc{EntryCount: 1, Entries: []StscEntry{{FirstChunk: 1, SamplesPerChunk: 2, SampleDescriptionIndex: 1}}}, st.Stsc)
+	assert.Equal(t, &Co64{EntryCount: 2, ChunkOffset: []uint64{100, math.MaxUint32 + 1}}, st.Co64)
+	assert.Equal(t, []IBox{st.Stts, st.Stsc, st.Stsz, st.Co64}, st.Boxes())
+
+	// positive composition time offsets use version 0
+	require.NoError(t, b.AddSample(SampleTableEntry{Duration: 1024, CompositionTimeOffset: 2048, Size: 100, Chunk: 2, SampleDescriptionIndex: 1}))
+	st, err = b.Build([]uint64{100, 200, 300})
+	require.NoError(t, err)
+	assert.Equal(t, &Ctts{EntryCount: 2, Entries: []CttsEntry{
+		{SampleCount: 4, SampleOffsetV0: 0},
+		{SampleCount: 1, SampleOffsetV0: 2048},
+	}}, st.Ctts)
+	assert.Nil(t, st.Cslg)
+	assert.Equal(t, &Stss{EntryCount: 4, SampleNumber: []uint32{1, 2, 3, 4}}, st.Stss)
+
+	_, err = b.Build([]uint64{100, 200})
+	assert.Error(t, err)
+}
+
+func TestSampleTableBuilderErrors(t *testing.T) {
+	b := NewSampleTableBuilder()
+	assert.Error(t, b.AddSample(SampleTableEntry{Chunk: 1, SampleDescriptionIndex: 1}))
+	require.NoError(t, b.AddSample(SampleTableEntry{Chunk: 0, SampleDescriptionIndex: 1}))
+	assert.Error(t, b.AddSample(SampleTableEntry{Chunk: 2, SampleDescriptionIndex: 1}))
+	assert.Error(t, b.AddSample(SampleTableEntry{Chunk: 0, SampleDescriptionIndex: 2}))
+	require.NoError(t, b.AddSample(SampleTableEntry{Chunk: 1, SampleDescriptionIndex: 2}))
+	assert.Error(t, b.AddSample(SampleTableEntry{Chunk: 0, SampleDescriptionIndex: 1}))
+}
+
+func TestSampleTableRoundTrip(t *testing.T) {
+	f, err := os.Open("./testdata/sample.mp4")
+	require.NoError(t, err)
+	defer f.Close()
+
+	tree, err := ReadBoxTree(f)
+	require.NoError(t, err)
+	stbls := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+	require.Len(t, stbls, 2)
+	for _, stbl := range stbls {
+		var st SampleTable
+		for _, c := range stbl.Children {
+			switch box := c.Payload.(type) {
+			case *Stts:
+				st.Stts = box
+			case *Ctts:
+				st.Ctts = box
+			case *Stss:
+				st.Stss = box
+			case *Stsc:
+				st.Stsc = box
+			case *Stsz:
+				st.Stsz = box
+			case *Stco:
+				st.Stco = box
+			}
+		}
+		samples, offsets, err := ExpandSampleTable(&st)
+		require.NoError(t, err)
+		rebuilt, err := BuildSampleTable(samples, offsets)
+		require.NoError(t, err)
+		assert.Equal(t, st.Stts, rebuilt.Stts)
+		assert.Equal(t, st.Ctts, rebuilt.Ctts)
+		assert.Equal(t, st.Stss, rebuilt.Stss)
+		assert.Equal(t, st.Stco, rebuilt.Stco)
+		actual, _, err := ExpandSampleTable(rebuilt)
+		require.NoError(t, err)
+		assert.Equal(t, samples, actual)
+	}
+}
@@ -0,0 +1,227 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// STPPSample is a sample of an XML subtitle track (stpp), defined at ISO/IEC 14496-30.
+type STPPSample struct {
+	// StartTime and EndTime are the presentation time range of the sample in the media timescale.
+	StartTime uint64
+	EndTime   uint64
+
+	// Document is the XML document, such as TTML and IMSC1, which is the first subsample.
+	Document []byte
+
+	// Resources are the following subsamples, such as PNG images which the document refers to.
+	Resources [][]byte
+}
+
+// STPPTrack is an XML subtitle track.
+type STPPTrack struct {
+	Timescale uint32
+
+	// Language is the ISO-639-2/T language code, such as "eng".
+	Language string
+
+	// Namespace, SchemaLocation and AuxiliaryMIMETypes are space-separated lists of the sample entry.
+	Namespace          string
+	SchemaLocation     string
+	AuxiliaryMIMETypes string
+
+	Samples []*STPPSample
+}
+
+// ReadSTPP reads the samples of the stpp track which has the given track ID.
+// Each sample is split into the document and the resources by the subs box.
+func ReadSTPP(r io.ReadSeeker, trackID uint32) (*STPPTrack, error) {
+	tree, err := ReadBoxTree(r)
+	if err != nil {
+		return nil, err
+	}
+	var trak *BoxNode
+	for _, t := range tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak()}) {
+		if tkhd, ok := findPayload(t, BoxTypeTkhd()).(*Tkhd); ok && tkhd.TrackID == trackID {
+			trak = t
+			break
+		}
+	}
+	if trak == nil {
+		return nil, fmt.Errorf("track not found: trackID=%d", trackID)
+	}
+	mdhd, ok := findPayload(trak, BoxTypeMdia(), BoxTypeMdhd()).(*Mdhd)
+	if !ok {
+		return nil, errors.New("mdhd box not found")
+	}
+	stbl := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+	if stbl == nil {
+		return nil, errors.New("stbl box not found")
+	}
+	entry, ok := findPayload(stbl, BoxTypeStsd(), BoxTypeStpp()).(*XMLSubtitleSampleEntry)
+	if !ok {
+		return nil, errors.New("stpp sample entry not found")
+	}
+	track := &STPPTrack{
+		Timescale:          mdhd.Timescale,
+		Language:           string([]byte{mdhd.Language[0] + 0x60, mdhd.Language[1] + 0x60, mdhd.Language[2] + 0x60}),
+		Namespace:          entry.Namespace,
+		SchemaLocation:     entry.SchemaLocation,
+		AuxiliaryMIMETypes: entry.AuxiliaryMIMETypes,
+	}
+
+	subsamples, err := readSubsampleSizes(tree, stbl, trackID)
+	if err != nil {
+		return nil, err
+	}
+	it, err := NewSampleIterator(r, trackID)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		s, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if _, err := r.Seek(int64(s.Offset), io.SeekStart); err != nil {
+			return nil, err
+		}
+		data := make([]byte, s.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		start := uint64(int64(s.DecodeTime) + s.CompositionTimeOffset)
+		sample := &STPPSample{
+			StartTime: start,
+			EndTime:   start + uint64(s.Duration),
+			Document:  data,
+		}
+		if sizes := subsamples[s.Index]; len(sizes) != 0 {
+			var parts [][]byte
+			for _, size := range sizes {
+				if uint64(size) > uint64(len(data)) {
+					return nil, fmt.Errorf("subsamples exceed the sample: index=%d", s.Index)
+				}
+				parts = append(parts, data[:size])
+				data = data[size:]
+			}
+			if len(data) != 0 {
+				return nil, fmt.Errorf("subsamples do not cover the sample: index=%d", s.Index)
+			}
+			sample.Document = parts[0]
+			sample.Resources = parts[1:]
+		}
+		track.Samples = append(track.Samples, sample)
+	}
+	return track, nil
+}
+
+// readSubsampleSizes returns the subsample sizes of the samples described by subs boxes, indexed by the sample index.
+// The samples of the sample table precede the samples of the movie fragments.
+func readSubsampleSizes(tree *BoxTree, stbl *BoxNode, trackID uint32) (map[uint64][]uint32, error) {
+	sizes := make(map[uint64][]uint32)
+	add := func(subs *Subs, base uint64) {
+		index := base
+		for i, entry := range subs.Entries {
+			index += uint64(entry.SampleDelta)
+			for j := range entry.Subsamples {
+				sizes[index-1] = append(sizes[index-1], subs.GetSubsampleSize(i, j))
+			}
+		}
+	}
+
+	var count uint64
+	if stsz, ok := findPayload(stbl, BoxTypeStsz()).(*Stsz); ok {
+		count = uint64(stsz.SampleCount)
+	}
+	if subs, ok := findPayload(stbl, BoxTypeSubs()).(*Subs); ok {
+		add(subs, 0)
+	}
+	for _, traf := range tree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf()}) {
+		tfhd, ok := findPayload(traf, BoxTypeTfhd()).(*Tfhd)
+		if !ok {
+			return nil, errors.New("tfhd box not found")
+		}
+		if tfhd.TrackID != trackID {
+			continue
+		}
+		if subs, ok := findPayload(traf, BoxTypeSubs()).(*Subs); ok {
+			add(subs, count)
+		}
+		for _, trun := range traf.Find(BoxPath{BoxTypeTrun()}) {
+			count += uint64(trun.Payload.(*Trun).SampleCount)
+		}
+	}
+	return sizes, nil
+}
+
+// WriteSTPP writes a fragmented MP4 file which has the stpp track.
+// Each sample is written as a fragment, so that the gaps between the samples are kept.
+// The resources of a sample are stored as subsamples following the document, which are described by subs box.
+// Namespace defaults to "http://www.w3.org/ns/ttml", and AuxiliaryMIMETypes defaults to "image/png" when any sample has resources.
+func WriteSTPP(w io.Writer, track *STPPTrack) error {
+	entry := &XMLSubtitleSampleEntry{
+		Namespace:          track.Namespace,
+		SchemaLocation:     track.SchemaLocation,
+		AuxiliaryMIMETypes: track.AuxiliaryMIMETypes,
+	}
+	if entry.Namespace == "" {
+		entry.Namespace = "http://www.w3.org/ns/ttml"
+	}
+	if entry.AuxiliaryMIMETypes == "" {
+		for _, s := range track.Samples {
+			if len(s.Resources) != 0 {
+				entry.AuxiliaryMIMETypes = "image/png"
+				break
+			}
+		}
+	}
+
+	m, err := NewMuxer(w, &MuxerOptions{Fragmented: true})
+	if err != nil {
+		return err
+	}
+	trackID, err := m.AddTrack(MuxerTrack{
+		Timescale:   track.Timescale,
+		Language:    track.Language,
+		XMLSubtitle: entry,
+	})
+	if err != nil {
+		return err
+	}
+	var end uint64
+	for i, s := range track.Samples {
+		if s.EndTime <= s.StartTime || s.EndTime-s.StartTime > 0xffffffff {
+			return fmt.Errorf("invalid time range: index=%d", i)
+		}
+		if i != 0 && s.StartTime < end {
+			return fmt.Errorf("sample overlaps the previous sample: index=%d", i)
+		}
+		end = s.EndTime
+		sample := &MuxerSample{
+			DecodeTime:       s.StartTime,
+			PresentationTime: s.StartTime,
+			Duration:         uint32(s.EndTime - s.StartTime),
+			IsSync:           true,
+			Data:             s.Document,
+		}
+		if len(s.Resources) != 0 {
+			sample.Data = append([]byte{}, s.Document...)
+			sample.SubsampleSizes = []uint32{uint32(len(s.Document))}
+			for _, res := range s.Resources {
+				sample.Data = append(sample.Data, res...)
+				sample.SubsampleSizes = append(sample.SubsampleSizes, uint32(len(res)))
+			}
+		}
+		if err := m.WriteSample(trackID, sample); err != nil {
+			return err
+		}
+		if err := m.Flush(); err != nil {
+			return err
+		}
+	}
+	return m.Close()
+}
@@ -0,0 +1,128 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+)
+
+func TestSTPP(t *testing.T) {
+	png := func(size int) []byte {
+		data := make([]byte, size)
+		copy(data, "\x89PNG\r\n\x1a\n")
+		for i := 8; i < size; i++ {
+			data[i] = byte(i)
+		}
+		return data
+	}
+	doc := func(body string) []byte {
+		return []byte(`<?xml version="1.0" encoding="UTF-8"?><tt xmlns="http://www.w3.org/ns/ttml"><body>` + body + `</body></tt>`)
+	}
+	track := &STPPTrack{
+		Timescale: 1000,
+		Language:  "eng",
+		Samples: []*STPPSample{
+			{StartTime: 0, EndTime: 2000, Document: doc("text")},
+			{StartTime: 3000, EndTime: 5000, Document: doc("images"), Resources: [][]byte{png(100), png(200)}},
+			{StartTime: 5000, EndTime: 6000, Document: doc("large image"), Resources: [][]byte{png(70000)}},
+		},
+	}
+
+	output := bytes.NewBuffer(nil)
+	require.NoError(t, WriteSTPP(output, track))
+
+	tree, err := ReadBoxTree(bytes.NewReader(output.Bytes()))
+	require.NoError(t, err)
+	hdlr := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeHdlr()}).Payload.(*Hdlr)
+	assert.Equal(t, [4]byte{'s', 'u', 'b', 't'}, hdlr.HandlerType)
+	assert.NotNil(t, tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeSthd()}))
+	entry := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeStpp()}).Payload.(*XMLSubtitleSampleEntry)
+	assert.Equal(t, "http://www.w3.org/ns/ttml", entry.Namespace)
+	assert.Equal(t, "image/png", entry.AuxiliaryMIMETypes)
+
+	// each sample is a fragment
+	trafs := tree.Find(BoxPath{BoxTypeMoof(), BoxTypeTraf()})
+	require.Len(t, trafs, 3)
+	assert.Equal(t, uint64(3000), findPayload(trafs[1], BoxTypeTfdt()).(*Tfdt).BaseMediaDecodeTimeV1)
+	assert.Nil(t, findPayload(trafs[0], BoxTypeSubs()))
+	assert.Equal(t, uint8(0), findPayload(trafs[1], BoxTypeSubs()).(*Subs).GetVersion())
+	assert.Equal(t, uint8(1), findPayload(trafs[2], BoxTypeSubs()).(*Subs).GetVersion())
+
+	read, err := ReadSTPP(bytes.NewReader(output.Bytes()), 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1000), read.Timescale)
+	assert.Equal(t, "eng", read.Language)
+	assert.Equal(t, track.Samples, read.Samples)
+
+	t.Run("progressive", func(t *testing.T) {
+		f, err := memfs.New().Create("output.mp4")
+		require.NoError(t, err)
+		defer f.Close()
+		m, err := NewMuxer(f, nil)
+		require.NoError(t, err)
+		trackID, err := m.AddTrack(MuxerTrack{XMLSubtitle: &XMLSubtitleSampleEntry{Namespace: "http://www.w3.org/ns/ttml"}})
+		require.NoError(t, err)
+		for _, s := range track.Samples {
+			// the duration is derived from the next sample, since a sample table can not have gaps
+			sample := &MuxerSample{
+				DecodeTime:       s.StartTime,
+				PresentationTime: s.StartTime,
+				IsSync:           true,
+				Data:             s.Document,
+			}
+			if len(s.Resources) != 0 {
+				sample.Data = bytes.Join(append([][]byte{s.Document}, s.Resources...), nil)
+				sample.SubsampleSizes = []uint32{uint32(len(s.Document))}
+				for _, res := range s.Resources {
+					sample.SubsampleSizes = append(sample.SubsampleSizes, uint32(len(res)))
+				}
+			}
+			require.NoError(t, m.WriteSample(trackID, sample))
+		}
+		require.NoError(t, m.Close())
+
+		_, err = f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		tree, err := ReadBoxTree(bytes.NewReader(data))
+		require.NoError(t, err)
+		subs := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeSubs()}).Payload.(*Subs)
+		assert.Equal(t, uint32(2), subs.EntryCount)
+		assert.Equal(t, uint32(2), subs.Entries[0].SampleDelta)
+		assert.Equal(t, uint32(1), subs.Entries[1].SampleDelta)
+
+		read, err := ReadSTPP(bytes.NewReader(data), trackID)
+		require.NoError(t, err)
+		assert.Equal(t, "und", read.Language)
+		assert.Equal(t, uint64(3000), read.Samples[0].EndTime)
+		for i, s := range read.Samples {
+			assert.Equal(t, track.Samples[i].StartTime, s.StartTime)
+			assert.Equal(t, track.Samples[i].Document, s.Document)
+			assert.Equal(t, track.Samples[i].Resources, s.Resources)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		assert.Error(t, WriteSTPP(io.Discard, &STPPTrack{Samples: []*STPPSample{
+			{StartTime: 0, EndTime: 2000, Document: doc("a")},
+			{StartTime: 1000, EndTime: 3000, Document: doc("b")},
+		}}), "overlap")
+		assert.Error(t, WriteSTPP(io.Discard, &STPPTrack{Samples: []*STPPSample{
+			{StartTime: 1000, EndTime: 1000, Document: doc("a")},
+		}}), "empty time range")
+
+		m, err := NewMuxer(io.Discard, &MuxerOptions{Fragmented: true})
+		require.NoError(t, err)
+		trackID, err := m.AddTrack(MuxerTrack{XMLSubtitle: &XMLSubtitleSampleEntry{}})
+		require.NoError(t, err)
+		assert.Error(t, m.WriteSample(trackID, &MuxerSample{Duration: 1, Data: []byte("abc"), SubsampleSizes: []uint32{1, 1}}))
+
+		_, err = ReadSTPP(bytes.NewReader(readFile(t, "./testdata/sample.mp4")), 1)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,218 @@
+package mp4
+
+import (
+	"math/bits"
+)
+
+// TimelineSegment is an edit of the edit list whose times are converted to the media timescale.
+type TimelineSegment struct {
+	// PresentationTime is the start time of the segment on the presentation timeline.
+	PresentationTime uint64
+	// Duration is the duration of the segment on the presentation timeline.
+	Duration uint64
+	// MediaTime is the start time of the segment on the media timeline. It is -1 for empty edits.
+	MediaTime int64
+	// MediaRate is 1 for normal edits and 0 for dwell edits.
+	MediaRate int16
+}
+
+// IsEmpty returns true when the segment is an empty edit.
+func (s *TimelineSegment) IsEmpty() bool {
+	return s.MediaTime == -1
+}
+
+// IsDwell returns true when the segment is a dwell edit which shows the media at MediaTime for Duration.
+func (s *TimelineSegment) IsDwell() bool {
+	return !s.IsEmpty() && s.MediaRate == 0
+}
+
+// Timeline maps the media timeline of a track to the presentation timeline by the edit list.
+// Every time value of Timeline is represented in the media timescale.
+type Timeline struct {
+	MovieTimescale uint32
+	MediaTimescale uint32
+	Segments       []*TimelineSegment
+
+	// MediaStart is the earliest composition time of the samples.
+	MediaStart int64
+	// MediaEnd is the end of the latest composed sample.
+	MediaEnd int64
+}
+
+// NewTimeline builds Timeline of the track.
+// movieTimescale must be the timescale of mvhd box, which is used by segment_duration of elst box.
+// When the track has no edit list, the whole media is mapped to the presentation timeline from 0.
+func NewTimeline(track *Track, movieTimescale uint32) *Timeline {
+	tl := &Timeline{
+		MovieTimescale: movieTimescale,
+		MediaTimescale: track.Timescale,
+	}
+
+	var dts int64
+	for i, sample := range track.Samples {
+		cts := dts + sample.CompositionTimeOffset
+		if i == 0 || cts < tl.MediaStart {
+			tl.MediaStart = cts
+		}
+		if end := cts + int64(sample.TimeDelta); end > tl.MediaEnd {
+			tl.MediaEnd = end
+		}
+		dts += int64(sample.TimeDelta)
+	}
+	if len(track.Samples) == 0 {
+		tl.MediaEnd = int64(track.Duration)
+	}
+
+	if len(track.EditList) == 0 {
+		tl.Segments = []*TimelineSegment{{
+			Duration:  uint64(tl.MediaEnd - tl.MediaStart),
+			MediaTime: tl.MediaStart,
+			MediaRate: 1,
+		}}
+		return tl
+	}
+
+	var pt uint64
+	for i, entry := range track.EditList {
+		seg := &TimelineSegment{
+			PresentationTime: pt,
+			Duration:         rescaleTime(entry.SegmentDuration, track.Timescale, movieTimescale),
+			MediaTime:        entry.MediaTime,
+			MediaRate:        entry.MediaRate,
+		}
+		if entry.SegmentDuration == 0 && i == len(track.EditList)-1 && !seg.IsEmpty() && !seg.IsDwell() &&
+			tl.MediaEnd > seg.MediaTime {
+			// zero duration of the last edit means that it extends to the end of the media (ISO/IEC 14496-12 8.6.6.1)
+			seg.Duration = uint64(tl.MediaEnd - seg.MediaTime)
+		}
+		tl.Segments = append(tl.Segments, seg)
+		pt += seg.Duration
+	}
+	return tl
+}
+
+// rescaleTime converts t in the timescale "from" to the timescale "to" with rounding down.
+func rescaleTime(t uint64, to, from uint32) uint64 {
+	if from == 0 || to == from {
+		return t
+	}
+	hi, lo := bits.Mul64(t, uint64(to))
+	if hi >= uint64(from) {
+		// overflow
+		return ^uint64(0)
+	}
+	q, _ := bits.Div64(hi, lo, uint64(from))
+	return q
+}
+
+// PresentationDuration returns the total duration of the presentation timeline including empty edits.
+func (tl *Timeline) PresentationDuration() uint64 {
+	var d uint64
+	for _, seg := range tl.Segments {
+		d += seg.Duration
+	}
+	return d
+}
+
+// VisibleDuration returns the duration in which the media is presented, excluding empty edits.
+func (tl *Timeline) VisibleDuration() uint64 {
+	var d uint64
+	for _, seg := range tl.Segments {
+		if !seg.IsEmpty() {
+			d += seg.Duration
+		}
+	}
+	return d
+}
+
+// PresentationStartOffset returns the presentation time at which the media is presented first.
+// It is the total duration of the leading empty edits.
+func (tl *Timeline) PresentationStartOffset() uint64 {
+	for _, seg := range tl.Segments {
+		if !seg.IsEmpty() {
+			return seg.PresentationTime
+		}
+	}
+	return tl.PresentationDuration()
+}
+
+// EncoderDelay returns the media duration which is skipped at the beginning of the media by the edit list.
+// For audio tracks, it represents the priming samples.
+func (tl *Timeline) EncoderDelay() uint64 {
+	for _, seg := range tl.Segments {
+		if !seg.IsEmpty() {
+			if seg.MediaTime > tl.MediaStart {
+				return uint64(seg.MediaTime - tl.MediaStart)
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// Padding returns the media duration which is cut at the end of the media by the edit list.
+// For audio tracks, it represents the remainder samples used for gapless playback.
+func (tl *Timeline) Padding() uint64 {
+	var end int64
+	var found bool
+	for _, seg := range tl.Segments {
+		if seg.IsEmpty() {
+			continue
+		}
+		segEnd := seg.MediaTime
+		if !seg.IsDwell() {
+			segEnd += int64(seg.Duration)
+		}
+		if !found || segEnd > end {
+			end = segEnd
+			found = true
+		}
+	}
+	if !found || end >= tl.MediaEnd {
+		return 0
+	}
+	return uint64(tl.MediaEnd - end)
+}
+
+// MediaToPresentation returns the first presentation time at which the media time is presented.
+// It returns false when the media time is not presented.
+func (tl *Timeline) MediaToPresentation(mediaTime int64) (uint64, bool) {
+	for _, seg := range tl.Segments {
+		if seg.IsEmpty() {
+			continue
+		}
+		if seg.IsDwell() {
+			if mediaTime == seg.MediaTime {
+				return seg.PresentationTime, true
+			}
+			continue
+		}
+		if mediaTime >= seg.MediaTime && mediaTime < seg.MediaTime+int64(seg.Duration) {
+			return seg.PresentationTime + uint64(mediaTime-seg.MediaTime), true
+		}
+	}
+	return 0, false
+}
+
+// PresentationToMedia returns the media time which is presented at the presentation time.
+// It returns false when the presentation time is in an empty edit or out of the timeline.
+func (tl *Timeline) PresentationToMedia(presentationTime uint64) (int64, bool) {
+	for _, seg := range tl.Segments {
+		if presentationTime < seg.PresentationTime || presentationTime-seg.PresentationTime >= seg.Duration {
+			continue
+		}
+		if seg.IsEmpty() {
+			return 0, false
+		}
+		if seg.IsDwell() {
+			return seg.MediaTime, true
+		}
+		return seg.MediaTime + int64(presentationTime-seg.PresentationTime), true
+	}
+	return 0, false
+}
+
+// ToMovieTimescale converts the time in the media timescale to the movie timescale.
+func (tl *Timeline) ToMovieTimescale(t uint64) uint64 {
+	return rescaleTime(t, tl.MovieTimescale, tl.MediaTimescale)
+}
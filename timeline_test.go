@@ -0,0 +1,130 @@
+package mp4
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeline(t *testing.T) {
+	f, err := os.Open("./testdata/sample.mp4")
+	require.NoError(t, err)
+	defer f.Close()
+
+	info, err := Probe(f)
+	require.NoError(t, err)
+
+	tl := NewTimeline(info.Tracks[0], info.Timescale)
+	require.Len(t, tl.Segments, 1)
+	assert.Equal(t, uint64(10240), tl.Segments[0].Duration)
+	assert.Equal(t, int64(2048), tl.Segments[0].MediaTime)
+	assert.Equal(t, int16(1), tl.Segments[0].MediaRate)
+	assert.Equal(t, int64(2048), tl.MediaStart)
+	assert.Equal(t, int64(12288), tl.MediaEnd)
+	assert.Equal(t, uint64(0), tl.PresentationStartOffset())
+	assert.Equal(t, uint64(0), tl.EncoderDelay())
+	assert.Equal(t, uint64(10240), tl.VisibleDuration())
+	pt, ok := tl.MediaToPresentation(2048)
+	require.True(t, ok)
+	assert.Equal(t, uint64(0), pt)
+	assert.Equal(t, uint64(1000), tl.ToMovieTimescale(10240))
+}
+
+func TestTimelineWithoutEditList(t *testing.T) {
+	track := &Track{
+		Timescale: 48000,
+		Samples: Samples{
+			{TimeDelta: 1024},
+			{TimeDelta: 1024},
+			{TimeDelta: 1024},
+		},
+	}
+	tl := NewTimeline(track, 1000)
+	require.Len(t, tl.Segments, 1)
+	assert.Equal(t, uint64(3072), tl.PresentationDuration())
+	assert.Equal(t, uint64(0), tl.EncoderDelay())
+	assert.Equal(t, uint64(0), tl.Padding())
+	mt, ok := tl.PresentationToMedia(1500)
+	require.True(t, ok)
+	assert.Equal(t, int64(1500), mt)
+}
+
+func TestTimelineGapless(t *testing.T) {
+	// 10 AAC frames with 2112 priming samples and 288 remainder samples
+	track := &Track{
+		Timescale: 48000,
+		EditList: EditList{
+			// empty edit (0.5 sec)
+			{MediaTime: -1, SegmentDuration: 500, MediaRate: 1},
+			{MediaTime: 2112, SegmentDuration: 160, MediaRate: 1},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		track.Samples = append(track.Samples, &Sample{TimeDelta: 1024})
+	}
+	tl := NewTimeline(track, 1000)
+	require.Len(t, tl.Segments, 2)
+	assert.True(t, tl.Segments[0].IsEmpty())
+	assert.Equal(t, uint64(24000), tl.Segments[0].Duration)
+	assert.Equal(t, uint64(24000), tl.Segments[1].PresentationTime)
+	assert.Equal(t, uint64(7680), tl.Segments[1].Duration)
+	assert.Equal(t, uint64(24000), tl.PresentationStartOffset())
+	assert.Equal(t, uint64(2112), tl.EncoderDelay())
+	assert.Equal(t, uint64(448), tl.Padding())
+	assert.Equal(t, uint64(7680), tl.VisibleDuration())
+	assert.Equal(t, uint64(31680), tl.PresentationDuration())
+
+	_, ok := tl.MediaToPresentation(1000)
+	assert.False(t, ok)
+	pt, ok := tl.MediaToPresentation(2112)
+	require.True(t, ok)
+	assert.Equal(t, uint64(24000), pt)
+
+	_, ok = tl.PresentationToMedia(100)
+	assert.False(t, ok)
+	mt, ok := tl.PresentationToMedia(24100)
+	require.True(t, ok)
+	assert.Equal(t, int64(2212), mt)
+	_, ok = tl.PresentationToMedia(31680)
+	assert.False(t, ok)
+}
+
+func TestTimelineMultipleSegments(t *testing.T) {
+	track := &Track{
+		Timescale: 90000,
+		EditList: EditList{
+			{MediaTime: 0, SegmentDuration: 1000, MediaRate: 1},
+			// dwell edit: freeze the frame at 3 sec for 2 sec
+			{MediaTime: 270000, SegmentDuration: 2000, MediaRate: 0},
+			{MediaTime: 270000, SegmentDuration: 0, MediaRate: 1},
+		},
+	}
+	for i := 0; i < 150; i++ {
+		track.Samples = append(track.Samples, &Sample{TimeDelta: 3000})
+	}
+	tl := NewTimeline(track, 1000)
+	require.Len(t, tl.Segments, 3)
+	assert.True(t, tl.Segments[1].IsDwell())
+	assert.Equal(t, uint64(90000), tl.Segments[1].PresentationTime)
+	assert.Equal(t, uint64(270000), tl.Segments[2].PresentationTime)
+	// the last edit with zero duration extends to the end of the media
+	assert.Equal(t, uint64(180000), tl.Segments[2].Duration)
+
+	mt, ok := tl.PresentationToMedia(200000)
+	require.True(t, ok)
+	assert.Equal(t, int64(270000), mt)
+	mt, ok = tl.PresentationToMedia(280000)
+	require.True(t, ok)
+	assert.Equal(t, int64(280000), mt)
+	pt, ok := tl.MediaToPresentation(270000)
+	require.True(t, ok)
+	assert.Equal(t, uint64(90000), pt)
+	pt, ok = tl.MediaToPresentation(273000)
+	require.True(t, ok)
+	assert.Equal(t, uint64(273000), pt)
+	_, ok = tl.MediaToPresentation(100000)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(0), tl.Padding())
+}
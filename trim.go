@@ -0,0 +1,481 @@
+package mp4
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+// TrimOptions is options for Trim.
+type TrimOptions struct {
+	// Start is the start time of the range in seconds.
+	Start float64
+
+	// End is the end time of the range in seconds. The range continues to the end of the file when End is 0.
+	End float64
+
+	// ExactStart keeps the exact start time by an edit list whose media time skips the samples
+	// between the preceding sync sample and the start time.
+	// Otherwise the range starts at the preceding sync sample of the video tracks.
+	ExactStart bool
+}
+
+// Trim cuts a progressive MP4 file to the time range without re-encoding.
+// Times are on the presentation timeline, that is, the edit lists of the input are applied.
+// Tracks which have non-sync samples, such as video tracks, start from the preceding sync sample,
+// and the other tracks are cut at the sample boundaries.
+// Sample tables are rebuilt, and one mdat box which has only the kept samples replaces the mdat boxes.
+// The other boxes, such as udta, meta and sgpd boxes, are kept.
+func Trim(r io.ReadSeeker, w io.Writer, opts *TrimOptions) error {
+	if opts == nil {
+		opts = &TrimOptions{}
+	}
+	if opts.Start < 0 || opts.End < 0 || (opts.End != 0 && opts.End <= opts.Start) {
+		return errors.New("invalid time range")
+	}
+
+	tree, err := ReadBoxTree(r)
+	if err != nil {
+		return err
+	}
+	moov := tree.FindFirst(BoxPath{BoxTypeMoov()})
+	if moov == nil {
+		return errors.New("moov box not found")
+	}
+	if moov.FindFirst(BoxPath{BoxTypeMvex()}) != nil {
+		return errors.New("fragmented file is not supported")
+	}
+	var movieTimescale uint32
+	if mvhd, ok := findPayload(moov, BoxTypeMvhd()).(*Mvhd); ok {
+		movieTimescale = mvhd.Timescale
+	}
+
+	var tracks []*trimTrack
+	for _, trak := range moov.Find(BoxPath{BoxTypeTrak()}) {
+		t, err := newTrimTrack(trak, movieTimescale)
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, t)
+	}
+
+	var exists bool
+	for _, t := range tracks {
+		exists = exists || t.presentationEnd() > t.toMediaTime(opts.Start)
+	}
+	if !exists {
+		return errors.New("no samples in the range")
+	}
+
+	start := opts.Start
+	if !opts.ExactStart {
+		for _, t := range tracks {
+			if snapped := t.syncTimeBefore(opts.Start); snapped < start {
+				start = snapped
+			}
+		}
+	}
+	for _, t := range tracks {
+		t.selectSamples(start, opts.End)
+	}
+
+	var chunks []*mediaChunk
+	durations := make(map[*BoxNode]uint64, len(tracks))
+	for _, t := range tracks {
+		if err := t.trim(); err != nil {
+			return err
+		}
+		chunks = append(chunks, t.chunks...)
+		durations[t.trak] = t.duration
+	}
+	updateDurations(moov, durations)
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].srcOffset < chunks[j].srcOffset
+	})
+	var dataSize uint64
+	for _, c := range chunks {
+		c.dstOffset = dataSize
+		dataSize += c.size
+	}
+
+	build := func(base uint64) error {
+		for _, t := range tracks {
+			if err := t.buildSampleTable(base); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	writeData := func(w io.Writer) error {
+		return copyChunks(w, r, chunks)
+	}
+	return writeWithMdat(w, replaceMdats(tree), dataSize, build, writeData)
+}
+
+// replaceMdats returns the top-level boxes of the tree where the first mdat box is replaced by nil,
+// which is a placeholder of a new mdat box, and the other mdat boxes are removed.
+func replaceMdats(tree *BoxTree) []*BoxNode {
+	var children []*BoxNode
+	var mdatAppeared bool
+	for _, c := range tree.Children {
+		if c.Info.Type != BoxTypeMdat() {
+			children = append(children, c)
+		} else if !mdatAppeared {
+			children = append(children, nil)
+			mdatAppeared = true
+		}
+	}
+	if !mdatAppeared {
+		children = append(children, nil)
+	}
+	return children
+}
+
+// writeWithMdat writes the boxes and an mdat box which has dataSize bytes at the nil placeholder.
+// build is called with the offset of the payload of the mdat box until the layout becomes stable,
+// and writeData writes the payload of the mdat box.
+func writeWithMdat(w io.Writer, children []*BoxNode, dataSize uint64, build func(base uint64) error, writeData func(w io.Writer) error) error {
+	mdat := &BoxInfo{Type: BoxTypeMdat(), HeaderSize: SmallHeaderSize}
+	if dataSize+SmallHeaderSize > math.MaxUint32 {
+		mdat.HeaderSize = LargeHeaderSize
+	}
+	mdat.Size = mdat.HeaderSize + dataSize
+
+	var base uint64
+	for {
+		if err := build(base); err != nil {
+			return err
+		}
+		var offset uint64
+		for _, c := range children {
+			if c == nil {
+				mdat.Offset = offset
+				offset += mdat.Size
+				continue
+			}
+			var err error
+			if offset, err = c.layout(offset); err != nil {
+				return err
+			}
+		}
+		if mdat.Offset+mdat.HeaderSize == base {
+			break
+		}
+		base = mdat.Offset + mdat.HeaderSize
+	}
+
+	ow := &offsetWriter{writer: w}
+	for _, c := range children {
+		if c != nil {
+			if err := ow.writeNode(c); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := WriteBoxInfo(ow, mdat); err != nil {
+			return err
+		}
+		if err := writeData(ow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyChunks copies the data of the chunks from r to w.
+func copyChunks(w io.Writer, r io.ReadSeeker, chunks []*mediaChunk) error {
+	for _, chunk := range chunks {
+		if _, err := r.Seek(int64(chunk.srcOffset), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, int64(chunk.size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type trimTrack struct {
+	*stblTrack
+
+	movieTimescale uint32
+	first, end     uint32 // range of kept samples
+	startMedia     int64
+	endMedia       int64
+	emptyEdit      uint64 // duration of the leading empty edit of the output in the movie timescale
+
+	builder  *SampleTableBuilder
+	chunks   []*mediaChunk
+	duration uint64
+}
+
+func newTrimTrack(trak *BoxNode, movieTimescale uint32) (*trimTrack, error) {
+	st, err := readStblTrack(trak)
+	if err != nil {
+		return nil, err
+	}
+	return &trimTrack{stblTrack: st, movieTimescale: movieTimescale}, nil
+}
+
+// emptySeconds returns the duration of the leading empty edits of the input in seconds.
+func (t *trimTrack) emptySeconds() float64 {
+	if t.movieTimescale == 0 {
+		return 0
+	}
+	return float64(t.emptyDuration) / float64(t.movieTimescale)
+}
+
+// toMediaTime converts the presentation time to the media time.
+// Times in the leading empty edits are converted to the media times before the media offset.
+func (t *trimTrack) toMediaTime(sec float64) int64 {
+	return t.mediaOffset + int64(math.Round((sec-t.emptySeconds())*float64(t.timescale)))
+}
+
+// syncTimeBefore returns the presentation time of the sync sample which precedes the time.
+// It returns the time itself when all samples are sync samples.
+func (t *trimTrack) syncTimeBefore(sec float64) float64 {
+	if t.allSync {
+		return sec
+	}
+	target := t.toMediaTime(sec)
+	var found bool
+	var cts int64
+	for i := range t.samples {
+		if t.samples[i].IsSync && t.cts(uint32(i)) <= target {
+			cts = t.cts(uint32(i))
+			found = true
+		}
+	}
+	if !found {
+		return sec
+	}
+	snapped := float64(cts-t.mediaOffset)/float64(t.timescale) + t.emptySeconds()
+	if snapped < 0 {
+		return 0
+	}
+	return snapped
+}
+
+// selectSamples selects the samples which are presented in the range.
+// The first sample is the last sync sample whose composition time is not later than the start.
+func (t *trimTrack) selectSamples(start, end float64) {
+	t.startMedia = t.toMediaTime(start)
+	t.endMedia = math.MaxInt64
+	if end != 0 {
+		t.endMedia = t.toMediaTime(end)
+	}
+
+	// the part of the leading empty edits in the range remains
+	t.emptyEdit = 0
+	emptyEnd := t.emptySeconds()
+	if end != 0 && end < emptyEnd {
+		emptyEnd = end
+	}
+	if emptyEnd > start {
+		t.emptyEdit = uint64(math.Round((emptyEnd - start) * float64(t.movieTimescale)))
+	}
+
+	t.first = uint32(len(t.samples))
+	for i := range t.samples {
+		if t.samples[i].IsSync && t.cts(uint32(i)) <= t.startMedia {
+			t.first = uint32(i)
+		}
+	}
+	if t.first == uint32(len(t.samples)) {
+		// the range starts before the first sync sample
+		for i := range t.samples {
+			if t.samples[i].IsSync {
+				t.first = uint32(i)
+				break
+			}
+		}
+	}
+	if t.allSync {
+		// keep the samples for pre-roll, which are skipped by the edit list
+		if t.first < t.preRoll {
+			t.first = 0
+		} else {
+			t.first -= t.preRoll
+		}
+	}
+	t.end = t.first
+	for i := t.first; i < uint32(len(t.samples)); i++ {
+		if t.cts(i) < t.endMedia {
+			t.end = i + 1
+		}
+	}
+}
+
+// trim builds the sample table builder, the chunks, the edit list and the sample groups of the kept samples.
+func (t *trimTrack) trim() error {
+	t.builder = NewSampleTableBuilder()
+	t.duration = 0
+	var chunk *mediaChunk
+	var presentationEnd int64
+	for i := t.first; i < t.end; i++ {
+		s := t.samples[i]
+		if chunk == nil || s.Chunk != t.samples[i-1].Chunk {
+			chunk = &mediaChunk{srcOffset: t.offsets[i], descIdx: s.SampleDescriptionIndex}
+			t.chunks = append(t.chunks, chunk)
+		}
+		chunk.size += uint64(s.Size)
+		chunk.sampleCount++
+		s.Chunk = uint32(len(t.chunks) - 1)
+		if err := t.builder.AddSample(s); err != nil {
+			return err
+		}
+		t.duration += uint64(s.Duration)
+		if end := t.cts(i) + int64(s.Duration); end > presentationEnd {
+			presentationEnd = end
+		}
+	}
+
+	// edit list
+	var entries []ElstEntry
+	if t.emptyEdit != 0 {
+		entries = append(entries, ElstEntry{SegmentDurationV1: t.emptyEdit, MediaTimeV1: -1, MediaRateInteger: 1})
+	}
+	var mediaTime int64
+	var segmentDuration uint64
+	if t.end > t.first {
+		startMedia := t.startMedia
+		if startMedia < t.mediaOffset {
+			// the range starts in the leading empty edits
+			startMedia = t.mediaOffset
+		}
+		mediaTime = startMedia - int64(t.dts[t.first])
+		if mediaTime < 0 {
+			mediaTime = 0
+		}
+		if t.endMedia < presentationEnd {
+			presentationEnd = t.endMedia
+		}
+		if d := presentationEnd - (int64(t.dts[t.first]) + mediaTime); d > 0 {
+			segmentDuration = rescaleTime(uint64(d), t.movieTimescale, t.timescale)
+		}
+	}
+	entries = append(entries, ElstEntry{SegmentDurationV1: segmentDuration, MediaTimeV1: mediaTime, MediaRateInteger: 1})
+	if err := setEditList(t.trak, newElst(entries)); err != nil {
+		return err
+	}
+
+	// sample groups, sub-sample information and sample dependencies
+	for _, c := range t.stbl.Children {
+		switch box := c.Payload.(type) {
+		case *Sbgp:
+			sliceSbgp(box, t.first, t.end)
+		case *Subs:
+			if sliced := sliceSubs(box, int(t.first), int(t.end)); sliced != nil {
+				*box = *sliced
+			} else {
+				box.Entries = nil
+				box.EntryCount = 0
+			}
+		case *Sdtp:
+			if int(t.end) <= len(box.Samples) {
+				box.Samples = box.Samples[t.first:t.end]
+			} else {
+				box.Samples = nil
+			}
+		}
+	}
+	return nil
+}
+
+// buildSampleTable replaces the sample table of the stbl box by the table of the kept samples.
+// base is the offset of the payload of the new mdat box.
+func (t *trimTrack) buildSampleTable(base uint64) error {
+	offsets := make([]uint64, len(t.chunks))
+	for i, c := range t.chunks {
+		offsets[i] = base + c.dstOffset
+	}
+	st, err := t.builder.Build(offsets)
+	if err != nil {
+		return err
+	}
+
+	var children []*BoxNode
+	var inserted bool
+	for _, c := range t.stbl.Children {
+		switch c.Info.Type {
+		case BoxTypeStts(), BoxTypeCtts(), BoxTypeCslg(), BoxTypeStss(), BoxTypeStsc(), BoxTypeStsz(),
+			BoxTypeStco(), BoxTypeCo64(), StrToBoxType("stps"):
+			c.Parent = nil
+			if !inserted {
+				for _, box := range st.Boxes() {
+					children = append(children, NewBoxNode(box))
+				}
+				inserted = true
+			}
+		case BoxTypeSdtp(), BoxTypeSubs():
+			if isEmptyTable(c.Payload) {
+				c.Parent = nil
+				continue
+			}
+			children = append(children, c)
+		default:
+			children = append(children, c)
+		}
+	}
+	if !inserted {
+		for _, box := range st.Boxes() {
+			children = append(children, NewBoxNode(box))
+		}
+	}
+	t.stbl.Children = nil
+	for _, c := range children {
+		t.stbl.AppendChild(c)
+	}
+	return nil
+}
+
+// isEmptyTable reports whether the sdtp or subs box has no entries.
+func isEmptyTable(payload IBox) bool {
+	switch box := payload.(type) {
+	case *Sdtp:
+		return len(box.Samples) == 0
+	case *Subs:
+		return len(box.Entries) == 0
+	}
+	return false
+}
+
+// setEditList replaces the edts box of the trak box by a new one which has the elst box.
+func setEditList(trak *BoxNode, elst *Elst) error {
+	edts := NewBoxNode(&Edts{}, NewBoxNode(elst))
+	if old := trak.FindFirst(BoxPath{BoxTypeEdts()}); old != nil {
+		return old.Replace(edts)
+	}
+	if tkhd := trak.FindFirst(BoxPath{BoxTypeTkhd()}); tkhd != nil {
+		return trak.InsertAfter(tkhd, edts)
+	}
+	trak.InsertChild(0, edts)
+	return nil
+}
+
+// sliceSbgp keeps the entries of the samples from first to end (exclusive).
+func sliceSbgp(sbgp *Sbgp, first, end uint32) {
+	var entries []SbgpEntry
+	var pos uint32
+	for _, e := range sbgp.Entries {
+		from, to := pos, pos+e.SampleCount
+		pos = to
+		if from < first {
+			from = first
+		}
+		if to > end {
+			to = end
+		}
+		if from >= to {
+			continue
+		}
+		if n := len(entries); n != 0 && entries[n-1].GroupDescriptionIndex == e.GroupDescriptionIndex {
+			entries[n-1].SampleCount += to - from
+			continue
+		}
+		entries = append(entries, SbgpEntry{SampleCount: to - from, GroupDescriptionIndex: e.GroupDescriptionIndex})
+	}
+	sbgp.Entries = entries
+	sbgp.EntryCount = uint32(len(entries))
+}
@@ -0,0 +1,195 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTrackSampleData(t *testing.T, r io.ReadSeeker, trackID uint32) [][]byte {
+	it, err := NewSampleIterator(r, trackID)
+	require.NoError(t, err)
+	var data [][]byte
+	for _, s := range readAllSamples(t, it) {
+		_, err := r.Seek(int64(s.Offset), io.SeekStart)
+		require.NoError(t, err)
+		buf := make([]byte, s.Size)
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+		data = append(data, buf)
+	}
+	return data
+}
+
+func TestTrim(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    func(t *testing.T) []byte
+		opts     TrimOptions
+		elst     []EditListEntry // video, audio
+		video    [2]int          // range of video samples
+		audio    [2]int          // range of audio samples
+		duration uint64
+	}{
+		{
+			name:  "snap to sync sample",
+			input: func(t *testing.T) []byte { return readFile(t, "./testdata/sample.mp4") },
+			opts:  TrimOptions{Start: 0.25, End: 0.75},
+			elst: []EditListEntry{
+				{MediaTime: 2048, SegmentDuration: 750, MediaRate: 1},
+				{MediaTime: 1024, SegmentDuration: 750, MediaRate: 1},
+			},
+			video:    [2]int{0, 8},
+			audio:    [2]int{0, 33},
+			duration: 750,
+		},
+		{
+			name:  "exact start",
+			input: func(t *testing.T) []byte { return readFile(t, "./testdata/sample.mp4") },
+			opts:  TrimOptions{Start: 0.3, End: 0.6, ExactStart: true},
+			elst: []EditListEntry{
+				{MediaTime: 2048 + 3072, SegmentDuration: 300, MediaRate: 1},
+				// the 13th sample includes the start, and the 12th sample is kept for pre-roll
+				{MediaTime: 1024 + 13230 - (2529 + 1024*10), SegmentDuration: 300, MediaRate: 1},
+			},
+			video:    [2]int{0, 6},
+			audio:    [2]int{12, 27},
+			duration: 300,
+		},
+		{
+			name:  "all sync samples",
+			input: readSampleWithSyncSamples,
+			opts:  TrimOptions{Start: 0.25},
+			elst: []EditListEntry{
+				// the 5th sample whose composition time is 0.2 seconds has no composition time offset
+				{MediaTime: 0, SegmentDuration: 800, MediaRate: 1},
+				{MediaTime: 1024 + 8820 - (2529 + 1024*6), SegmentDuration: 800, MediaRate: 1},
+			},
+			video:    [2]int{4, 10},
+			audio:    [2]int{8, 44},
+			duration: 800,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			input := tc.input(t)
+			output := bytes.NewBuffer(nil)
+			require.NoError(t, Trim(bytes.NewReader(input), output, &tc.opts))
+			r := bytes.NewReader(output.Bytes())
+
+			info, err := Probe(r)
+			require.NoError(t, err)
+			assert.Equal(t, tc.duration, info.Duration)
+			require.Len(t, info.Tracks, 2)
+			for i, track := range info.Tracks {
+				require.Len(t, track.EditList, 1)
+				assert.Equal(t, tc.elst[i], *track.EditList[0], "track %d", track.TrackID)
+			}
+			assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), 1)[tc.video[0]:tc.video[1]], readTrackSampleData(t, r, 1))
+			assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), 2)[tc.audio[0]:tc.audio[1]], readTrackSampleData(t, r, 2))
+
+			// unaffected boxes are kept
+			tree, err := ReadBoxTree(r)
+			require.NoError(t, err)
+			assert.Len(t, tree.Find(BoxPath{BoxTypeMdat()}), 1)
+			assert.NotNil(t, tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeUdta(), BoxTypeMeta()}))
+			stbl := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})[1]
+			assert.NotNil(t, stbl.FindFirst(BoxPath{BoxTypeSgpd()}))
+			sbgp := stbl.FindFirst(BoxPath{BoxTypeSbgp()}).Payload.(*Sbgp)
+			assert.Equal(t, []SbgpEntry{{SampleCount: uint32(tc.audio[1] - tc.audio[0]), GroupDescriptionIndex: 1}}, sbgp.Entries)
+		})
+	}
+}
+
+func TestTrimEmptyEdit(t *testing.T) {
+	// the audio track starts 0.5 seconds later and has sub-sample information of the 3rd, 6th and 13th samples
+	tree, err := ReadBoxTree(bytes.NewReader(readFile(t, "./testdata/sample.mp4")))
+	require.NoError(t, err)
+	trak := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak()})[1]
+	elst := findPayload(trak, BoxTypeEdts(), BoxTypeElst()).(*Elst)
+	require.Equal(t, uint8(0), elst.GetVersion())
+	elst.Entries = append([]ElstEntry{{SegmentDurationV0: 500, MediaTimeV0: -1, MediaRateInteger: 1}}, elst.Entries...)
+	elst.EntryCount = uint32(len(elst.Entries))
+	stbl := trak.FindFirst(BoxPath{BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})
+	subsample := []SubsSubsample{{SubsampleSizeV0: 4}}
+	stbl.AppendChild(NewBoxNode(&Subs{EntryCount: 3, Entries: []SubsEntry{
+		{SampleDelta: 3, SubsampleCount: 1, Subsamples: subsample},
+		{SampleDelta: 3, SubsampleCount: 1, Subsamples: subsample},
+		{SampleDelta: 7, SubsampleCount: 1, Subsamples: subsample},
+	}}))
+	input := writeBoxTree(t, tree)
+
+	testCases := []struct {
+		name  string
+		opts  TrimOptions
+		elst  []EditListEntry
+		audio [2]int // range of audio samples
+		subs  []uint32
+	}{
+		{
+			name: "start in empty edit",
+			opts: TrimOptions{Start: 0.25, End: 0.75, ExactStart: true},
+			elst: []EditListEntry{
+				{MediaTime: -1, SegmentDuration: 250, MediaRate: 1},
+				{MediaTime: 1024, SegmentDuration: 250, MediaRate: 1},
+			},
+			audio: [2]int{0, 12},
+			subs:  []uint32{3, 3},
+		},
+		{
+			name: "start after empty edit",
+			opts: TrimOptions{Start: 0.6, End: 0.75, ExactStart: true},
+			elst: []EditListEntry{
+				// the 5th sample includes the start, and the 4th sample is kept for pre-roll
+				{MediaTime: 1024 + 4410 - (2529 + 1024), SegmentDuration: 150, MediaRate: 1},
+			},
+			audio: [2]int{3, 12},
+			subs:  []uint32{3},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output := bytes.NewBuffer(nil)
+			require.NoError(t, Trim(bytes.NewReader(input), output, &tc.opts))
+			r := bytes.NewReader(output.Bytes())
+
+			info, err := Probe(r)
+			require.NoError(t, err)
+			require.Len(t, info.Tracks, 2)
+			editList := info.Tracks[1].EditList
+			require.Len(t, editList, len(tc.elst))
+			for i := range tc.elst {
+				assert.Equal(t, tc.elst[i], *editList[i])
+			}
+			assert.Equal(t, readTrackSampleData(t, bytes.NewReader(input), 2)[tc.audio[0]:tc.audio[1]], readTrackSampleData(t, r, 2))
+
+			tree, err := ReadBoxTree(r)
+			require.NoError(t, err)
+			stbl := tree.Find(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl()})[1]
+			subs := findPayload(stbl, BoxTypeSubs()).(*Subs)
+			var deltas []uint32
+			for _, e := range subs.Entries {
+				deltas = append(deltas, e.SampleDelta)
+			}
+			assert.Equal(t, tc.subs, deltas)
+		})
+	}
+}
+
+func TestTrimErrors(t *testing.T) {
+	input := readFile(t, "./testdata/sample.mp4")
+	assert.Error(t, Trim(bytes.NewReader(input), io.Discard, &TrimOptions{Start: 0.5, End: 0.5}))
+	assert.Error(t, Trim(bytes.NewReader(input), io.Discard, &TrimOptions{Start: 10}))
+	fragmented := readFile(t, "./testdata/sample_fragmented.mp4")
+	assert.Error(t, Trim(bytes.NewReader(fragmented), io.Discard, &TrimOptions{Start: 0.5}))
+}
+
+func readFile(t *testing.T, name string) []byte {
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	return data
+}
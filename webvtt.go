@@ -0,0 +1,223 @@
+package mp4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// vttCue is a WebVTT cue whose times are in milliseconds.
+type vttCue struct {
+	id       string
+	settings string
+	payload  string
+	start    uint64
+	end      uint64
+}
+
+// vttTimestampTag matches timestamps in cue payloads, such as "<00:00:01.000>".
+var vttTimestampTag = regexp.MustCompile(`<(\d+:)?\d{2}:\d{2}\.\d{3}>`)
+
+// parseWebVTT parses a WebVTT file into the header and the cues.
+// The header consists of the WEBVTT line and the blocks before the first cue, such as STYLE and REGION blocks.
+// Comment blocks after the first cue are discarded.
+func parseWebVTT(data []byte) (string, []*vttCue, error) {
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	var blocks [][]string
+	var block []string
+	for _, line := range strings.Split(text, "\n") {
+		if line == "" {
+			if len(block) != 0 {
+				blocks = append(blocks, block)
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if len(block) != 0 {
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 || blocks[0][0] != "WEBVTT" && !strings.HasPrefix(blocks[0][0], "WEBVTT ") &&
+		!strings.HasPrefix(blocks[0][0], "WEBVTT\t") {
+		return "", nil, errors.New("WEBVTT signature not found")
+	}
+	if strings.Contains(strings.Join(blocks[0], "\n"), "-->") {
+		return "", nil, errors.New("header must be followed by an empty line")
+	}
+
+	header := strings.Join(blocks[0], "\n")
+	var cues []*vttCue
+	for _, block := range blocks[1:] {
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			timing = 1
+		}
+		if timing >= len(block) || !strings.Contains(block[timing], "-->") {
+			if len(cues) == 0 {
+				header += "\n\n" + strings.Join(block, "\n")
+			}
+			continue
+		}
+		cue, err := parseVTTCueTiming(block[timing])
+		if err != nil {
+			return "", nil, err
+		}
+		if timing == 1 {
+			cue.id = block[0]
+		}
+		cue.payload = strings.Join(block[timing+1:], "\n")
+		cues = append(cues, cue)
+	}
+	return header, cues, nil
+}
+
+// parseVTTCueTiming parses a cue timing line, which is followed by the cue settings.
+func parseVTTCueTiming(line string) (*vttCue, error) {
+	sep := strings.Index(line, "-->")
+	fields := strings.Fields(line[sep+3:])
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid cue timing: %s", line)
+	}
+	start, err := parseVTTTimestamp(strings.TrimSpace(line[:sep]))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseVTTTimestamp(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if end <= start {
+		return nil, fmt.Errorf("cue end time must be later than start time: %s", line)
+	}
+	return &vttCue{
+		settings: strings.Join(fields[1:], " "),
+		start:    start,
+		end:      end,
+	}, nil
+}
+
+// parseVTTTimestamp parses a timestamp in the form of [hh:]mm:ss.ttt and returns it in milliseconds.
+func parseVTTTimestamp(s string) (uint64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return 0, fmt.Errorf("invalid timestamp: %s", s)
+	}
+	secs := strings.Split(parts[len(parts)-1], ".")
+	if len(secs) != 2 || len(secs[0]) != 2 || len(secs[1]) != 3 || len(parts[len(parts)-2]) != 2 || len(parts[0]) < 2 {
+		return 0, fmt.Errorf("invalid timestamp: %s", s)
+	}
+	fields := append(append([]string{}, parts[:len(parts)-1]...), secs...)
+	values := make([]uint64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp: %s", s)
+		}
+		values[i] = v
+	}
+	n := len(values)
+	if values[n-3] >= 60 || values[n-2] >= 60 {
+		return 0, fmt.Errorf("invalid timestamp: %s", s)
+	}
+	ms := values[n-3]*60000 + values[n-2]*1000 + values[n-1]
+	if n == 4 {
+		ms += values[0] * 3600000
+	}
+	return ms, nil
+}
+
+// formatVTTTimestamp formats milliseconds in the form of hh:mm:ss.ttt.
+func formatVTTTimestamp(ms uint64) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// webVTTSource splits WebVTT cues into samples defined at ISO/IEC 14496-30.
+// A sample is cut at every start and end time of the cues, so a cue which overlaps other cues
+// is repeated in the consecutive samples. Periods without cues are filled with vtte samples.
+type webVTTSource struct {
+	header string
+	cues   []*vttCue
+	times  []uint64 // boundaries of the samples
+	index  int
+}
+
+func newWebVTTSource(r io.Reader) (*webVTTSource, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	header, cues, err := parseWebVTT(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &webVTTSource{header: header, cues: cues}
+	if len(cues) != 0 {
+		times := map[uint64]bool{0: true}
+		for _, cue := range cues {
+			times[cue.start] = true
+			times[cue.end] = true
+		}
+		for t := range times {
+			s.times = append(s.times, t)
+		}
+		sort.Slice(s.times, func(i, j int) bool { return s.times[i] < s.times[j] })
+	}
+	return s, nil
+}
+
+func (s *webVTTSource) track() (*MuxerTrack, error) {
+	return &MuxerTrack{
+		Timescale: 1000,
+		WebVTT:    &WebVTTConfigurationBox{Config: s.header},
+	}, nil
+}
+
+func (s *webVTTSource) next() (*MuxerSample, error) {
+	if s.index+1 >= len(s.times) {
+		return nil, io.EOF
+	}
+	start, end := s.times[s.index], s.times[s.index+1]
+	s.index++
+
+	tree := &BoxTree{}
+	for _, cue := range s.cues {
+		if cue.start > start || cue.end <= start {
+			continue
+		}
+		vttc := NewBoxNode(&VTTCueBox{})
+		if cue.start < start && vttTimestampTag.MatchString(cue.payload) {
+			vttc.AppendChild(NewBoxNode(&CueTimeBox{CueCurrentTime: formatVTTTimestamp(start)}))
+		}
+		if cue.id != "" {
+			vttc.AppendChild(NewBoxNode(&CueIDBox{CueId: cue.id}))
+		}
+		if cue.settings != "" {
+			vttc.AppendChild(NewBoxNode(&CueSettingsBox{Settings: cue.settings}))
+		}
+		vttc.AppendChild(NewBoxNode(&CuePayloadBox{CueText: cue.payload}))
+		tree.AppendChild(vttc)
+	}
+	if len(tree.Children) == 0 {
+		tree.AppendChild(NewBoxNode(&VTTEmptyCueBox{}))
+	}
+	buf := bytes.NewBuffer(nil)
+	if _, err := tree.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return &MuxerSample{
+		DecodeTime:       start,
+		PresentationTime: start,
+		Duration:         uint32(end - start),
+		IsSync:           true,
+		Data:             buf.Bytes(),
+	}, nil
+}
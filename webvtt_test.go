@@ -0,0 +1,180 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+)
+
+const testWebVTT = `WEBVTT - sample
+
+STYLE
+::cue { color: yellow; }
+
+NOTE header comment
+
+intro
+00:00:01.000 --> 00:00:04.000 align:start line:0
+Hello
+<c.loud>World</c>
+
+00:00:02.500 --> 00:00:03.000
+Hi <00:00:02.800>there
+
+00:00:06.000 --> 01:00:07.250
+Bye
+`
+
+func TestParseVTTTimestamp(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected uint64
+		err      bool
+	}{
+		{input: "00:01.500", expected: 1500},
+		{input: "01:02:03.004", expected: 3723004},
+		{input: "100:00:00.000", expected: 360000000},
+		{input: "00:60.000", err: true},
+		{input: "1:00.000", err: true},
+		{input: "00:00:00,000", err: true},
+		{input: "00:00.00", err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			ms, err := parseVTTTimestamp(tc.input)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, ms)
+			if ms < 100*3600000 {
+				v, err := parseVTTTimestamp(formatVTTTimestamp(ms))
+				require.NoError(t, err)
+				assert.Equal(t, ms, v)
+			}
+		})
+	}
+}
+
+func TestImportWebVTT(t *testing.T) {
+	check := func(t *testing.T, output []byte) {
+		tree, err := ReadBoxTree(bytes.NewReader(output))
+		require.NoError(t, err)
+		hdlr := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeHdlr()}).Payload.(*Hdlr)
+		assert.Equal(t, [4]byte{'t', 'e', 'x', 't'}, hdlr.HandlerType)
+		assert.NotNil(t, tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeNmhd()}))
+		vttC := tree.FindFirst(BoxPath{BoxTypeMoov(), BoxTypeTrak(), BoxTypeMdia(), BoxTypeMinf(), BoxTypeStbl(), BoxTypeStsd(), BoxTypeWvtt(), BoxTypeVttC()})
+		require.NotNil(t, vttC)
+		assert.Equal(t, "WEBVTT - sample\n\nSTYLE\n::cue { color: yellow; }\n\nNOTE header comment", vttC.Payload.(*WebVTTConfigurationBox).Config)
+
+		it, err := NewSampleIterator(bytes.NewReader(output), 1)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1000), it.Timescale())
+		samples := readAllSamples(t, it)
+		var times []uint64
+		for _, s := range samples {
+			times = append(times, s.DecodeTime)
+			assert.True(t, s.IsSync)
+		}
+		assert.Equal(t, []uint64{0, 1000, 2500, 3000, 4000, 6000}, times)
+		assert.Equal(t, uint32(3601250), samples[5].Duration)
+
+		var cues [][]string
+		for _, data := range readTrackSampleData(t, bytes.NewReader(output), 1) {
+			sample, err := ReadBoxTree(bytes.NewReader(data))
+			require.NoError(t, err)
+			var texts []string
+			for _, box := range sample.Children {
+				switch payload := box.Payload.(type) {
+				case *VTTEmptyCueBox:
+					texts = append(texts, "(empty)")
+				case *VTTCueBox:
+					if ctim, ok := findPayload(box, BoxTypeCtim()).(*CueTimeBox); ok {
+						texts = append(texts, ctim.CueCurrentTime)
+					}
+					if iden, ok := findPayload(box, BoxTypeIden()).(*CueIDBox); ok {
+						texts = append(texts, iden.CueId)
+					}
+					if sttg, ok := findPayload(box, BoxTypeSttg()).(*CueSettingsBox); ok {
+						texts = append(texts, sttg.Settings)
+					}
+					texts = append(texts, findPayload(box, BoxTypePayl()).(*CuePayloadBox).CueText)
+				default:
+					t.Errorf("unexpected box: %T", payload)
+				}
+			}
+			cues = append(cues, texts)
+		}
+		assert.Equal(t, [][]string{
+			{"(empty)"},
+			{"intro", "align:start line:0", "Hello\n<c.loud>World</c>"},
+			{"intro", "align:start line:0", "Hello\n<c.loud>World</c>", "Hi <00:00:02.800>there"},
+			{"intro", "align:start line:0", "Hello\n<c.loud>World</c>"},
+			{"(empty)"},
+			{"Bye"},
+		}, cues)
+
+		// overlapping cues are restored by the demuxer
+		ext, vtt := demuxTrack(t, output, 1)
+		assert.Equal(t, "vtt", ext)
+		assert.Equal(t, "WEBVTT - sample\n\n"+
+			"STYLE\n::cue { color: yellow; }\n\n"+
+			"NOTE header comment\n\n"+
+			"intro\n00:00:01.000 --> 00:00:04.000 align:start line:0\nHello\n<c.loud>World</c>\n\n"+
+			"00:00:02.500 --> 00:00:03.000\nHi <00:00:02.800>there\n\n"+
+			"00:00:06.000 --> 01:00:07.250\nBye\n", string(vtt))
+	}
+
+	t.Run("fragmented", func(t *testing.T) {
+		output := bytes.NewBuffer(nil)
+		require.NoError(t, Import(bytes.NewReader([]byte(testWebVTT)), ImportFormatWebVTT, output, &ImportOptions{
+			Muxer: &MuxerOptions{Fragmented: true},
+		}))
+		check(t, output.Bytes())
+	})
+
+	t.Run("progressive", func(t *testing.T) {
+		output, err := memfs.New().Create("output.mp4")
+		require.NoError(t, err)
+		defer output.Close()
+		require.NoError(t, Import(bytes.NewReader([]byte("\ufeff"+testWebVTT)), ImportFormatWebVTT, output, nil))
+		_, err = output.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		data, err := io.ReadAll(output)
+		require.NoError(t, err)
+		check(t, data)
+	})
+
+	t.Run("ctim", func(t *testing.T) {
+		input := "WEBVTT\n\n00:00.000 --> 00:02.000\nA <00:00:01.500>B\n\n00:01.000 --> 00:02.000\nC\n"
+		output, _ := importStream(t, []byte(input), ImportFormatWebVTT, nil)
+		data := readTrackSampleData(t, bytes.NewReader(output), 1)
+		require.Len(t, data, 2)
+		sample, err := ReadBoxTree(bytes.NewReader(data[1]))
+		require.NoError(t, err)
+		ctim, ok := findPayload(sample.Children[0], BoxTypeCtim()).(*CueTimeBox)
+		require.True(t, ok)
+		assert.Equal(t, "00:00:01.000", ctim.CueCurrentTime)
+		assert.Nil(t, findPayload(sample.Children[1], BoxTypeCtim()))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, input := range []string{
+			"",
+			"WEBVTTX\n",
+			"WEBVTT\n00:00.000 --> 00:01.000\nA\n",
+			"WEBVTT\n\n00:01.000 --> 00:01.000\nA\n",
+			"WEBVTT\n\n00:00.000 -->\nA\n",
+		} {
+			err := Import(bytes.NewReader([]byte(input)), ImportFormatWebVTT, bytes.NewBuffer(nil), &ImportOptions{
+				Muxer: &MuxerOptions{Fragmented: true},
+			})
+			assert.Error(t, err, input)
+		}
+	})
+}
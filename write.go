@@ -1,46 +1,240 @@
 package mp4
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 )
 
+// LargeSizePolicy decides how Writer.EndBox handles a box which is started with a 32-bit size header
+// and grows beyond 4 GiB.
+type LargeSizePolicy int
+
+const (
+	// LargeSizeError makes EndBox return an error.
+	LargeSizeError LargeSizePolicy = iota
+
+	// LargeSizeReserve makes StartBox write an empty free box before each mdat box.
+	// When the mdat box exceeds 4 GiB, EndBox overwrites the free box and the mdat header with a 64-bit size header,
+	// so that the payload keeps its position. Other boxes are handled as LargeSizeError.
+	LargeSizeReserve
+
+	// LargeSizeShift makes EndBox move the payload by 8 bytes to make room for a 64-bit size header.
+	// The underlying writer must implement io.Reader. Offsets in the written boxes are not updated,
+	// so EndBox returns an error when boxes which have file offsets, such as stco, tfhd and saio boxes,
+	// are written before the end of the box.
+	LargeSizeShift
+)
+
+// WriterOptions is options for Writer.
+type WriterOptions struct {
+	// LargeSize is the policy for the boxes which exceed 4 GiB. It is ignored by streaming writers,
+	// which always use 64-bit size headers for such boxes.
+	LargeSize LargeSizePolicy
+}
+
+// maxSmallBoxSize is the largest box size which can be represented by a 32-bit size header.
+const maxSmallBoxSize = math.MaxUint32
+
+// maxSmallSize is the largest size of the boxes which EndBox writes with 32-bit size headers.
+// It is a hook for tests, which lower it to exercise LargeSizePolicy.
+var maxSmallSize uint64 = maxSmallBoxSize
+
 type Writer struct {
 	writer  io.WriteSeeker
-	biStack []*BoxInfo
+	biStack []*writerBox
+	opts    WriterOptions
+	offsets bool // boxes which have file offsets are written
+
+	// streaming mode
+	stream io.Writer
+	offset int64 // number of bytes written to stream
+}
+
+type writerBox struct {
+	bi       *BoxInfo
+	fixed    bool          // the size is declared by StartFixedSizeBox
+	reserved bool          // an empty free box is placed before the box header
+	buf      *bytes.Buffer // payload which is buffered in streaming mode
 }
 
 func NewWriter(w io.WriteSeeker) *Writer {
+	return &Writer{writer: w}
+}
+
+// NewWriterWithOptions returns a Writer which handles large boxes according to opts.
+func NewWriterWithOptions(w io.WriteSeeker, opts WriterOptions) *Writer {
 	return &Writer{
 		writer: w,
+		opts:   opts,
 	}
 }
 
+// NewStreamWriter returns a Writer which writes to w without seeking.
+// Boxes started by StartBox are buffered in memory and written when their sizes are determined by EndBox.
+// Boxes started by StartFixedSizeBox, such as large mdat boxes, are written without buffering.
+// Seek supports only getting the current offset.
+func NewStreamWriter(w io.Writer) *Writer {
+	return &Writer{stream: w}
+}
+
 func (w *Writer) Write(p []byte) (int, error) {
-	return w.writer.Write(p)
+	if w.stream == nil {
+		return w.writer.Write(p)
+	}
+	if b := w.bufferedBox(); b != nil {
+		return b.buf.Write(p)
+	}
+	n, err := w.stream.Write(p)
+	w.offset += int64(n)
+	return n, err
 }
 
 func (w *Writer) Seek(offset int64, whence int) (int64, error) {
-	return w.writer.Seek(offset, whence)
+	if w.stream == nil {
+		return w.writer.Seek(offset, whence)
+	}
+	if offset != 0 || whence != io.SeekCurrent {
+		return 0, errors.New("streaming writer does not support seeking")
+	}
+	if b := w.bufferedBox(); b != nil {
+		return int64(b.bi.Offset+b.bi.HeaderSize) + int64(b.buf.Len()), nil
+	}
+	return w.offset, nil
+}
+
+// bufferedBox returns the innermost box which is buffered in streaming mode.
+func (w *Writer) bufferedBox() *writerBox {
+	for i := len(w.biStack) - 1; i >= 0; i-- {
+		if w.biStack[i].buf != nil {
+			return w.biStack[i]
+		}
+	}
+	return nil
 }
 
 func (w *Writer) StartBox(bi *BoxInfo) (*BoxInfo, error) {
+	if w.stream != nil {
+		offset, err := w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		headerSize := uint64(SmallHeaderSize)
+		if bi.HeaderSize == LargeHeaderSize {
+			headerSize = LargeHeaderSize
+		}
+		bi := &BoxInfo{
+			Offset:      uint64(offset),
+			Size:        headerSize,
+			HeaderSize:  headerSize,
+			Type:        bi.Type,
+			ExtendToEOF: bi.ExtendToEOF,
+		}
+		w.biStack = append(w.biStack, &writerBox{bi: bi, buf: bytes.NewBuffer(nil)})
+		return bi, nil
+	}
+	var reserved bool
+	if w.opts.LargeSize == LargeSizeReserve && bi.Type == BoxTypeMdat() &&
+		bi.HeaderSize != LargeHeaderSize && !bi.ExtendToEOF {
+		if _, err := WriteBoxInfo(w.writer, &BoxInfo{Type: BoxTypeFree(), Size: SmallHeaderSize, HeaderSize: SmallHeaderSize}); err != nil {
+			return nil, err
+		}
+		reserved = true
+	}
 	bi, err := WriteBoxInfo(w.writer, bi)
 	if err != nil {
 		return nil, err
 	}
-	w.biStack = append(w.biStack, bi)
+	w.biStack = append(w.biStack, &writerBox{bi: bi, reserved: reserved})
+	w.offsets = w.offsets || hasOffsets(bi.Type, false)
 	return bi, nil
 }
 
+// StartFixedSizeBox starts a box whose size is declared by bi.Size in advance.
+// bi.Size is the size of the whole box including the header, and the header is widened when the size exceeds 32 bits.
+// The header is written immediately, and the payload is not buffered even in streaming mode.
+// EndBox returns an error when the written size differs from the declared size.
+func (w *Writer) StartFixedSizeBox(bi *BoxInfo) (*BoxInfo, error) {
+	if bi.HeaderSize == 0 {
+		bi2 := *bi
+		bi2.HeaderSize = SmallHeaderSize
+		bi = &bi2
+	}
+	bi, err := WriteBoxInfo(w, bi)
+	if err != nil {
+		return nil, err
+	}
+	w.biStack = append(w.biStack, &writerBox{bi: bi, fixed: true})
+	w.offsets = w.offsets || hasOffsets(bi.Type, false)
+	return bi, nil
+}
+
+// hasOffsets reports whether boxes of the type have file offsets.
+// Containers are included when their children are not written separately, as by CopyBox.
+func hasOffsets(boxType BoxType, container bool) bool {
+	switch boxType {
+	case BoxTypeStco(), BoxTypeCo64(), BoxTypeTfhd(), BoxTypeTrun(), BoxTypeSaio(),
+		BoxTypeSidx(), BoxTypeTfra(), StrToBoxType("iloc"):
+		return true
+	case BoxTypeMoov(), BoxTypeMoof(), BoxTypeMfra(), BoxTypeMeta():
+		return container
+	}
+	return false
+}
+
 func (w *Writer) EndBox() (*BoxInfo, error) {
-	bi := w.biStack[len(w.biStack)-1]
+	b := w.biStack[len(w.biStack)-1]
 	w.biStack = w.biStack[:len(w.biStack)-1]
+	bi := b.bi
+
+	if b.fixed {
+		end, err := w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(end)-bi.Offset != bi.Size {
+			return nil, fmt.Errorf("box size mismatch: type=%s declared=%d written=%d", bi.Type, bi.Size, uint64(end)-bi.Offset)
+		}
+		return bi, nil
+	}
+
+	if w.stream != nil {
+		bi.Size = bi.HeaderSize + uint64(b.buf.Len())
+		if bi.Size > maxSmallSize && bi.HeaderSize == SmallHeaderSize && !bi.ExtendToEOF {
+			bi.HeaderSize = LargeHeaderSize
+			bi.Size += LargeHeaderSize - SmallHeaderSize
+		}
+		if _, err := WriteBoxInfo(w, bi); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(b.buf.Bytes()); err != nil {
+			return nil, err
+		}
+		return bi, nil
+	}
+
 	end, err := w.writer.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return nil, err
 	}
 	bi.Size = uint64(end) - bi.Offset
+	if bi.Size > maxSmallSize && bi.HeaderSize == SmallHeaderSize && !bi.ExtendToEOF {
+		switch {
+		case b.reserved:
+			bi.Offset -= SmallHeaderSize
+		case w.opts.LargeSize == LargeSizeShift:
+			if err := w.shiftPayload(bi, end); err != nil {
+				return nil, err
+			}
+			end += LargeHeaderSize - SmallHeaderSize
+		default:
+			return nil, errors.New("header size changed")
+		}
+		bi.HeaderSize = LargeHeaderSize
+		bi.Size += LargeHeaderSize - SmallHeaderSize
+	}
 	if _, err = bi.SeekToStart(w.writer); err != nil {
 		return nil, err
 	}
@@ -55,7 +249,45 @@ func (w *Writer) EndBox() (*BoxInfo, error) {
 	return bi, nil
 }
 
+// shiftPayload moves the payload of the box which ends at end by 8 bytes toward the end.
+func (w *Writer) shiftPayload(bi *BoxInfo, end int64) error {
+	if w.offsets {
+		return fmt.Errorf("offsets in the written boxes would refer to the shifted payload: type=%s", bi.Type)
+	}
+	rw, ok := w.writer.(io.ReadWriteSeeker)
+	if !ok {
+		return errors.New("writer does not support reading to shift payload")
+	}
+	return shiftData(rw, int64(bi.Offset+bi.HeaderSize), end, LargeHeaderSize-SmallHeaderSize)
+}
+
+// shiftData moves the data in the range [start, end) by shift bytes toward the end.
+func shiftData(rw io.ReadWriteSeeker, start, end, shift int64) error {
+	buf := make([]byte, 1024*1024)
+	for pos := end; pos > start; {
+		n := int64(len(buf))
+		if pos-start < n {
+			n = pos - start
+		}
+		pos -= n
+		if _, err := rw.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rw, buf[:n]); err != nil {
+			return err
+		}
+		if _, err := rw.Seek(pos+shift, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := rw.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (w *Writer) CopyBox(r io.ReadSeeker, bi *BoxInfo) error {
+	w.offsets = w.offsets || hasOffsets(bi.Type, true)
 	if _, err := bi.SeekToStart(r); err != nil {
 		return err
 	}
@@ -3,6 +3,7 @@ package mp4
 import (
 	"bytes"
 	"io"
+	"os"
 	"testing"
 
 	"gopkg.in/src-d/go-billy.v4/memfs"
@@ -152,3 +153,217 @@ func TestWriter(t *testing.T) {
 		0x00, 0x00, 0x00, 0x09, // height
 	}, bin)
 }
+
+func TestStreamWriter(t *testing.T) {
+	output := bytes.NewBuffer(nil)
+	w := NewStreamWriter(output)
+
+	// start moov
+	bi, err := w.StartBox(&BoxInfo{Type: BoxTypeMoov()})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), bi.Offset)
+	assert.Equal(t, uint64(8), bi.Size)
+
+	// start mvex
+	bi, err = w.StartBox(&BoxInfo{Type: BoxTypeMvex()})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8), bi.Offset)
+
+	// trex
+	bi, err = w.StartBox(&BoxInfo{Type: BoxTypeTrex()})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(16), bi.Offset)
+	_, err = Marshal(w, &Trex{TrackID: 1, DefaultSampleDescriptionIndex: 1}, Context{})
+	require.NoError(t, err)
+	offset, err := w.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	assert.Equal(t, int64(48), offset)
+	_, err = w.Seek(8, io.SeekStart)
+	assert.Error(t, err)
+	bi, err = w.EndBox()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(16), bi.Offset)
+	assert.Equal(t, uint64(32), bi.Size)
+
+	// end mvex and moov
+	bi, err = w.EndBox()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8), bi.Offset)
+	assert.Equal(t, uint64(40), bi.Size)
+	assert.Zero(t, output.Len(), "boxes are buffered until the outermost box ends")
+	bi, err = w.EndBox()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), bi.Offset)
+	assert.Equal(t, uint64(48), bi.Size)
+	assert.Equal(t, 48, output.Len())
+
+	// mdat whose size is declared
+	bi, err = w.StartFixedSizeBox(&BoxInfo{Type: BoxTypeMdat(), Size: 12})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(48), bi.Offset)
+	assert.Equal(t, uint64(8), bi.HeaderSize)
+	assert.Equal(t, 56, output.Len(), "header is written immediately")
+	_, err = w.Write([]byte{0x01, 0x02})
+	require.NoError(t, err)
+	assert.Equal(t, 58, output.Len(), "payload is not buffered")
+	_, err = w.Write([]byte{0x03, 0x04})
+	require.NoError(t, err)
+	bi, err = w.EndBox()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(12), bi.Size)
+
+	assert.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x30, 'm', 'o', 'o', 'v',
+		0x00, 0x00, 0x00, 0x28, 'm', 'v', 'e', 'x',
+		0x00, 0x00, 0x00, 0x20, 't', 'r', 'e', 'x',
+		0, 0x00, 0x00, 0x00, // version and flags
+		0x00, 0x00, 0x00, 0x01, // track ID
+		0x00, 0x00, 0x00, 0x01, // default sample description index
+		0x00, 0x00, 0x00, 0x00, // default sample duration
+		0x00, 0x00, 0x00, 0x00, // default sample size
+		0x00, 0x00, 0x00, 0x00, // default sample flags
+		0x00, 0x00, 0x00, 0x0c, 'm', 'd', 'a', 't',
+		0x01, 0x02, 0x03, 0x04,
+	}, output.Bytes())
+
+	// size mismatch
+	_, err = w.StartFixedSizeBox(&BoxInfo{Type: BoxTypeMdat(), Size: 12})
+	require.NoError(t, err)
+	_, err = w.Write([]byte{0x01, 0x02})
+	require.NoError(t, err)
+	_, err = w.EndBox()
+	assert.Error(t, err)
+}
+
+func TestStreamWriterBoxTree(t *testing.T) {
+	for _, name := range []string{"./testdata/sample.mp4", "./testdata/sample_fragmented.mp4"} {
+		t.Run(name, func(t *testing.T) {
+			input, err := os.ReadFile(name)
+			require.NoError(t, err)
+			tree, err := ReadBoxTree(bytes.NewReader(input))
+			require.NoError(t, err)
+			output := bytes.NewBuffer(nil)
+			require.NoError(t, tree.Write(NewStreamWriter(output)))
+			assert.Equal(t, input, output.Bytes())
+		})
+	}
+}
+
+func TestWriterFixedSizeBox(t *testing.T) {
+	output, err := memfs.New().Create("output.mp4")
+	require.NoError(t, err)
+	defer output.Close()
+	w := NewWriter(output)
+
+	_, err = w.StartFixedSizeBox(&BoxInfo{Type: BoxTypeFree(), Size: 10})
+	require.NoError(t, err)
+	_, err = w.Write([]byte{0x01, 0x02})
+	require.NoError(t, err)
+	bi, err := w.EndBox()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), bi.Size)
+
+	_, err = w.StartFixedSizeBox(&BoxInfo{Type: BoxTypeFree(), Size: 10})
+	require.NoError(t, err)
+	_, err = w.EndBox()
+	assert.Error(t, err)
+}
+
+func TestWriterLargeSizePolicy(t *testing.T) {
+	defer func(size uint64) { maxSmallSize = size }(maxSmallSize)
+	maxSmallSize = 16
+
+	// writeBoxesWithChild writes a moov box which has the child box and an mdat box which has payloadSize bytes
+	writeBoxesWithChild := func(t *testing.T, w *Writer, child BoxType, payloadSize int) (*BoxInfo, error) {
+		_, err := w.StartBox(&BoxInfo{Type: BoxTypeMoov()})
+		require.NoError(t, err)
+		_, err = w.StartBox(&BoxInfo{Type: child})
+		require.NoError(t, err)
+		_, err = w.EndBox()
+		require.NoError(t, err)
+		_, err = w.EndBox()
+		require.NoError(t, err)
+		_, err = w.StartBox(&BoxInfo{Type: BoxTypeMdat()})
+		require.NoError(t, err)
+		_, err = w.Write(bytes.Repeat([]byte{0xab}, payloadSize))
+		require.NoError(t, err)
+		return w.EndBox()
+	}
+	writeBoxes := func(t *testing.T, w *Writer, payloadSize int) (*BoxInfo, error) {
+		return writeBoxesWithChild(t, w, BoxTypeFree(), payloadSize)
+	}
+	header := []byte{
+		0x00, 0x00, 0x00, 0x10, 'm', 'o', 'o', 'v',
+		0x00, 0x00, 0x00, 0x08, 'f', 'r', 'e', 'e',
+	}
+
+	t.Run("error", func(t *testing.T) {
+		output, err := memfs.New().Create("output.mp4")
+		require.NoError(t, err)
+		defer output.Close()
+		_, err = writeBoxes(t, NewWriter(output), 10)
+		assert.Error(t, err)
+	})
+
+	t.Run("reserve", func(t *testing.T) {
+		for _, payloadSize := range []int{4, 10} {
+			output, err := memfs.New().Create("output.mp4")
+			require.NoError(t, err)
+			defer output.Close()
+			bi, err := writeBoxes(t, NewWriterWithOptions(output, WriterOptions{LargeSize: LargeSizeReserve}), payloadSize)
+			require.NoError(t, err)
+			var expected []byte
+			if payloadSize == 4 {
+				assert.Equal(t, &BoxInfo{Offset: 24, Size: 12, HeaderSize: SmallHeaderSize, Type: BoxTypeMdat()}, bi)
+				expected = append(header,
+					0x00, 0x00, 0x00, 0x08, 'f', 'r', 'e', 'e',
+					0x00, 0x00, 0x00, 0x0c, 'm', 'd', 'a', 't',
+				)
+			} else {
+				assert.Equal(t, &BoxInfo{Offset: 16, Size: 26, HeaderSize: LargeHeaderSize, Type: BoxTypeMdat()}, bi)
+				expected = append(header,
+					0x00, 0x00, 0x00, 0x01, 'm', 'd', 'a', 't',
+					0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1a,
+				)
+			}
+			expected = append(expected, bytes.Repeat([]byte{0xab}, payloadSize)...)
+			_, err = output.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			actual, err := io.ReadAll(output)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual)
+		}
+	})
+
+	t.Run("shift", func(t *testing.T) {
+		output, err := memfs.New().Create("output.mp4")
+		require.NoError(t, err)
+		defer output.Close()
+		w := NewWriterWithOptions(output, WriterOptions{LargeSize: LargeSizeShift})
+		bi, err := writeBoxes(t, w, 10)
+		require.NoError(t, err)
+		assert.Equal(t, &BoxInfo{Offset: 16, Size: 26, HeaderSize: LargeHeaderSize, Type: BoxTypeMdat()}, bi)
+		offset, err := w.Seek(0, io.SeekCurrent)
+		require.NoError(t, err)
+		assert.Equal(t, int64(42), offset)
+		expected := append(header,
+			0x00, 0x00, 0x00, 0x01, 'm', 'd', 'a', 't',
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1a,
+		)
+		expected = append(expected, bytes.Repeat([]byte{0xab}, 10)...)
+		_, err = output.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		actual, err := io.ReadAll(output)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	})
+
+	t.Run("shift after offsets", func(t *testing.T) {
+		// the chunk offsets of the stco box would refer to the shifted payload
+		output, err := memfs.New().Create("output.mp4")
+		require.NoError(t, err)
+		defer output.Close()
+		_, err = writeBoxesWithChild(t, NewWriterWithOptions(output, WriterOptions{LargeSize: LargeSizeShift}), BoxTypeStco(), 10)
+		assert.Error(t, err)
+	})
+}